@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/EuskadiTech/Figaro/internal/auth"
 	"github.com/EuskadiTech/Figaro/internal/database"
@@ -42,6 +43,21 @@ func main() {
 	// Create handlers
 	h := handlers.New(cfg)
 
+	// Consume or release material reservations of finished activities
+	go h.RunReservationSettler(5 * time.Minute)
+
+	// Move activities from pending to in progress and completed as their dates pass
+	go h.RunActivityStatusUpdater(time.Minute)
+
+	// Schedule and send the reminders of upcoming activities
+	go h.RunActivityReminders(time.Minute)
+
+	// Email the reminders of due and overdue material loans
+	go h.RunLoanReminders(time.Hour)
+
+	// Write off the expired batches of perishable materials
+	go h.RunBatchExpiry(time.Hour)
+
 	// Setup Gin router
 	if os.Getenv("GIN_MODE") == "" {
 		gin.SetMode(gin.ReleaseMode) // Production mode by default
@@ -58,6 +74,13 @@ func main() {
 	router.GET("/auth/google/callback", h.GoogleOAuthCallback)
 	router.GET("/static/*filepath", h.Static)
 
+	// Calendar feeds authenticate with the token in the URL
+	router.GET("/actividades/ics/:token/global.ics", h.ActividadesFeedGlobal)
+	router.GET("/actividades/ics/:token/centro/:id", h.ActividadesFeedCentro)
+	router.GET("/actividades/ics/:token/aula/:id", h.ActividadesFeedAula)
+	router.GET("/.well-known/caldav", h.CalDAVWellKnown)
+	router.Handle("PROPFIND", "/.well-known/caldav", h.CalDAVWellKnown)
+
 	// Routes that require authentication
 	authGroup := router.Group("/")
 	authGroup.Use(auth.RequireAuth())
@@ -69,6 +92,10 @@ func main() {
 		authGroup.GET("/perfil/webdav", h.WebDAVTokens)
 		authGroup.POST("/perfil/webdav/crear", h.WebDAVCreateToken)
 		authGroup.POST("/perfil/webdav/revocar/:id", h.WebDAVRevokeToken)
+		authGroup.GET("/perfil/calendario", h.CalendarioSuscripciones)
+		authGroup.POST("/perfil/calendario/regenerar", h.CalendarioRegenerarToken)
+		authGroup.GET("/notificaciones", h.Notificaciones)
+		authGroup.GET("/notificaciones/abrir/:id", h.NotificacionAbrir)
 		authGroup.GET("/elegir_centro", h.ElegirCentro)
 		authGroup.POST("/elegir_centro", h.ElegirCentro)
 
@@ -106,6 +133,16 @@ func main() {
 		davGroup.HEAD("/CarpetasCompartidas/:folder/*path", h.WebDAVSharedFolders)
 		davGroup.OPTIONS("/CarpetasCompartidas/:folder/*path", h.WebDAVSharedFolders)
 
+		// Activities CalDAV, one calendar per center
+		davGroup.Handle("PROPFIND", "/", h.CalDAVRoot)
+		davGroup.Handle("PROPFIND", "/Calendarios/*path", h.CalDAV)
+		davGroup.Handle("REPORT", "/Calendarios/*path", h.CalDAV)
+		davGroup.GET("/Calendarios/*path", h.CalDAV)
+		davGroup.HEAD("/Calendarios/*path", h.CalDAV)
+		davGroup.PUT("/Calendarios/*path", h.CalDAV)
+		davGroup.DELETE("/Calendarios/*path", h.CalDAV)
+		davGroup.OPTIONS("/Calendarios/*path", h.CalDAV)
+
 		// Materials module
 		authGroup.GET("/materiales", h.MaterialesIndex)
 		authGroup.GET("/materiales/crear", h.MaterialesCrear)
@@ -113,14 +150,74 @@ func main() {
 		authGroup.GET("/materiales/editar/:id", h.MaterialesEditar)
 		authGroup.POST("/materiales/editar/:id", h.MaterialesEditar)
 		authGroup.POST("/materiales/eliminar/:id", h.MaterialesEliminar)
+		authGroup.GET("/materiales/ubicaciones", h.MaterialesUbicaciones)
+		authGroup.POST("/materiales/ubicaciones/crear", h.MaterialesUbicacionCrear)
+		authGroup.POST("/materiales/ubicaciones/editar/:id", h.MaterialesUbicacionEditar)
+		authGroup.POST("/materiales/ubicaciones/eliminar/:id", h.MaterialesUbicacionEliminar)
+		authGroup.GET("/materiales/stock/:id", h.MaterialesStock)
+		authGroup.POST("/materiales/stock/:id", h.MaterialesStock)
+		authGroup.GET("/materiales/traspasos", h.MaterialesTraspasos)
+		authGroup.GET("/materiales/traspasos/crear", h.MaterialesTraspasoCrear)
+		authGroup.POST("/materiales/traspasos/crear", h.MaterialesTraspasoCrear)
+		authGroup.POST("/materiales/traspasos/aceptar/:id", h.MaterialesTraspasoAceptar)
+		authGroup.POST("/materiales/traspasos/rechazar/:id", h.MaterialesTraspasoRechazar)
+		authGroup.POST("/materiales/traspasos/cancelar/:id", h.MaterialesTraspasoCancelar)
+		authGroup.GET("/materiales/compras", h.MaterialesCompras)
+		authGroup.POST("/materiales/compras", h.MaterialesCompras)
+		authGroup.GET("/materiales/pedidos", h.MaterialesPedidos)
+		authGroup.GET("/materiales/pedidos/ver/:id", h.MaterialesPedidoVer)
+		authGroup.POST("/materiales/pedidos/ver/:id", h.MaterialesPedidoVer)
+		authGroup.POST("/materiales/pedidos/estado/:id", h.MaterialesPedidoEstado)
+		authGroup.POST("/materiales/pedidos/eliminar/:id", h.MaterialesPedidoEliminar)
+		authGroup.GET("/materiales/pedidos/exportar/:id", h.MaterialesPedidoExportar)
+		authGroup.GET("/materiales/inventarios", h.MaterialesInventarios)
+		authGroup.POST("/materiales/inventarios/crear", h.MaterialesInventarioCrear)
+		authGroup.GET("/materiales/inventarios/ver/:id", h.MaterialesInventarioVer)
+		authGroup.POST("/materiales/inventarios/ver/:id", h.MaterialesInventarioVer)
+		authGroup.GET("/materiales/inventarios/cerrar/:id", h.MaterialesInventarioCerrar)
+		authGroup.POST("/materiales/inventarios/cerrar/:id", h.MaterialesInventarioCerrar)
+		authGroup.POST("/materiales/inventarios/cancelar/:id", h.MaterialesInventarioCancelar)
+		authGroup.GET("/materiales/inventarios/exportar/:id", h.MaterialesInventarioExportar)
+		authGroup.GET("/materiales/prestamos", h.MaterialesPrestamos)
+		authGroup.POST("/materiales/prestamos/crear", h.MaterialesPrestamoCrear)
+		authGroup.POST("/materiales/prestamos/devolver/:id", h.MaterialesPrestamoDevolver)
+		authGroup.GET("/materiales/caducidades", h.MaterialesCaducidades)
+		authGroup.GET("/materiales/lotes/:id", h.MaterialesLotes)
+		authGroup.POST("/materiales/lotes/:id/crear", h.MaterialesLoteCrear)
+		authGroup.POST("/materiales/lotes/:id/eliminar/:batchId", h.MaterialesLoteEliminar)
+		authGroup.GET("/materiales/unidades/:id", h.MaterialesUnidades)
+		authGroup.POST("/materiales/unidades/:id/crear", h.MaterialesUnidadCrear)
+		authGroup.POST("/materiales/unidades/:id/eliminar/:unitId", h.MaterialesUnidadEliminar)
+		authGroup.GET("/materiales/solicitudes", h.MaterialesSolicitudes)
+		authGroup.GET("/materiales/solicitudes/crear", h.MaterialesSolicitudCrear)
+		authGroup.POST("/materiales/solicitudes/crear", h.MaterialesSolicitudCrear)
+		authGroup.GET("/materiales/solicitudes/ver/:id", h.MaterialesSolicitudVer)
+		authGroup.POST("/materiales/solicitudes/resolver/:id", h.MaterialesSolicitudResolver)
+		authGroup.POST("/materiales/solicitudes/cancelar/:id", h.MaterialesSolicitudCancelar)
+		authGroup.GET("/materiales/kits", h.MaterialesKits)
+		authGroup.GET("/materiales/kits/crear", h.MaterialesKitCrear)
+		authGroup.POST("/materiales/kits/crear", h.MaterialesKitCrear)
+		authGroup.GET("/materiales/kits/editar/:id", h.MaterialesKitEditar)
+		authGroup.POST("/materiales/kits/editar/:id", h.MaterialesKitEditar)
+		authGroup.POST("/materiales/kits/eliminar/:id", h.MaterialesKitEliminar)
+		authGroup.POST("/materiales/kits/montar/:id", h.MaterialesKitMontar)
+		authGroup.POST("/materiales/kits/usar/:id", h.MaterialesKitUsar)
+		authGroup.POST("/materiales/kits/desmontar/:id", h.MaterialesKitDesmontar)
 
 		// Activities module
 		authGroup.GET("/actividades", h.ActividadesIndex)
+		authGroup.GET("/actividades/calendario", h.ActividadesCalendario)
 		authGroup.GET("/actividades/crear", h.ActividadesCrear)
 		authGroup.POST("/actividades/crear", h.ActividadesCrear)
 		authGroup.GET("/actividades/editar/:id", h.ActividadesEditar)
 		authGroup.POST("/actividades/editar/:id", h.ActividadesEditar)
 		authGroup.POST("/actividades/eliminar/:id", h.ActividadesEliminar)
+		authGroup.POST("/actividades/dejar-de-compartir/:id", h.ActividadesDejarDeCompartir)
+		authGroup.GET("/actividades/adjuntos/:id", h.ActividadesAdjunto)
+		authGroup.GET("/actividades/asistencia/:id", h.ActividadesAsistencia)
+		authGroup.POST("/actividades/asistencia/:id", h.ActividadesAsistencia)
+		authGroup.GET("/actividades/aulas", h.ActividadesAulas)
+		authGroup.GET("/actividades/aulas/:id", h.ActividadesAula)
 
 		// Shared folders module
 		authGroup.GET("/carpetas-compartidas", h.CarpetasCompartidasIndex)
@@ -148,6 +245,20 @@ func main() {
 		authGroup.POST("/admin/centros/aulas/:center_id/editar/:aula_id", h.AdminAulaEditar)
 		authGroup.POST("/admin/centros/aulas/:center_id/eliminar/:aula_id", h.AdminAulaEliminar)
 		authGroup.GET("/admin/materiales-report", h.AdminMaterialesReport)
+		authGroup.POST("/admin/materiales-report/minimos", h.AdminMaterialesMinimos)
+		authGroup.GET("/admin/traspasos-report", h.AdminTraspasosReport)
+		authGroup.GET("/admin/categorias", h.AdminCategorias)
+		authGroup.GET("/admin/categorias/crear", h.AdminCategoriaCrear)
+		authGroup.POST("/admin/categorias/crear", h.AdminCategoriaCrear)
+		authGroup.GET("/admin/categorias/editar/:id", h.AdminCategoriaEditar)
+		authGroup.POST("/admin/categorias/editar/:id", h.AdminCategoriaEditar)
+		authGroup.POST("/admin/categorias/eliminar/:id", h.AdminCategoriaEliminar)
+		authGroup.GET("/admin/proveedores", h.AdminProveedores)
+		authGroup.GET("/admin/proveedores/crear", h.AdminProveedorCrear)
+		authGroup.POST("/admin/proveedores/crear", h.AdminProveedorCrear)
+		authGroup.GET("/admin/proveedores/editar/:id", h.AdminProveedorEditar)
+		authGroup.POST("/admin/proveedores/editar/:id", h.AdminProveedorEditar)
+		authGroup.POST("/admin/proveedores/eliminar/:id", h.AdminProveedorEliminar)
 		authGroup.GET("/admin/actividades-report", h.AdminActividadesReport)
 		authGroup.GET("/admin/files", h.AdminFiles)
 		authGroup.GET("/admin/configuracion", h.AdminConfiguracion)
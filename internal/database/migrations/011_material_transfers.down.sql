@@ -0,0 +1,7 @@
+-- Rollback: Remove inter-center material transfers
+-- Version: 011
+
+DROP INDEX IF EXISTS idx_material_transfers_status;
+DROP INDEX IF EXISTS idx_material_transfers_destination_center_id;
+DROP INDEX IF EXISTS idx_material_transfers_source_center_id;
+DROP TABLE IF EXISTS material_transfers;
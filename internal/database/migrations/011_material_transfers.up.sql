@@ -0,0 +1,33 @@
+-- Migration: Add inter-center material transfers
+-- Version: 011
+
+-- A transfer is proposed by the source center and accepted (or rejected) by the
+-- destination center. Stock only moves when the transfer is accepted.
+CREATE TABLE IF NOT EXISTS material_transfers (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    source_center_id INTEGER NOT NULL,
+    destination_center_id INTEGER NOT NULL,
+    source_material_id INTEGER NULL,
+    destination_material_id INTEGER NULL,
+    material_name VARCHAR(255) NOT NULL,
+    unit VARCHAR(100) NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'rejected', 'cancelled')),
+    notes TEXT DEFAULT '',
+    requested_by INTEGER NULL,
+    responded_by INTEGER NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    responded_at DATETIME NULL,
+    FOREIGN KEY (source_center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (destination_center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (source_material_id) REFERENCES materials(id) ON DELETE SET NULL,
+    FOREIGN KEY (destination_material_id) REFERENCES materials(id) ON DELETE SET NULL,
+    FOREIGN KEY (requested_by) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (responded_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_material_transfers_source_center_id ON material_transfers(source_center_id);
+CREATE INDEX IF NOT EXISTS idx_material_transfers_destination_center_id ON material_transfers(destination_center_id);
+CREATE INDEX IF NOT EXISTS idx_material_transfers_status ON material_transfers(status);
@@ -0,0 +1,7 @@
+-- Rollback: Remove material reservations for activities
+-- Version: 012
+
+DROP INDEX IF EXISTS idx_activity_material_reservations_status;
+DROP INDEX IF EXISTS idx_activity_material_reservations_material_id;
+DROP INDEX IF EXISTS idx_activity_material_reservations_activity_id;
+DROP TABLE IF EXISTS activity_material_reservations;
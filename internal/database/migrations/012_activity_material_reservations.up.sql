@@ -0,0 +1,22 @@
+-- Migration: Add material reservations for activities
+-- Version: 012
+
+-- Reserved quantities reduce the free stock of a material until the activity
+-- finishes (consumed) or is cancelled (released).
+CREATE TABLE IF NOT EXISTS activity_material_reservations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    material_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    status VARCHAR(20) NOT NULL DEFAULT 'reserved' CHECK (status IN ('reserved', 'consumed', 'released')),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    settled_at DATETIME NULL,
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE,
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE CASCADE
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_activity_material_reservations_activity_id ON activity_material_reservations(activity_id);
+CREATE INDEX IF NOT EXISTS idx_activity_material_reservations_material_id ON activity_material_reservations(material_id);
+CREATE INDEX IF NOT EXISTS idx_activity_material_reservations_status ON activity_material_reservations(status);
@@ -0,0 +1,9 @@
+-- Rollback: Remove purchase orders
+-- Version: 013
+
+DROP INDEX IF EXISTS idx_purchase_order_items_material_id;
+DROP INDEX IF EXISTS idx_purchase_order_items_order_id;
+DROP INDEX IF EXISTS idx_purchase_orders_status;
+DROP INDEX IF EXISTS idx_purchase_orders_center_id;
+DROP TABLE IF EXISTS purchase_order_items;
+DROP TABLE IF EXISTS purchase_orders;
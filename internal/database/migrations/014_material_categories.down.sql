@@ -0,0 +1,11 @@
+-- Rollback: Remove managed material categories
+-- Version: 014
+
+-- The normalised free-text values stay in materials.category
+DROP INDEX IF EXISTS idx_materials_category_id;
+ALTER TABLE materials DROP COLUMN category_id;
+
+DROP INDEX IF EXISTS idx_material_categories_slug;
+DROP INDEX IF EXISTS idx_material_categories_parent_id;
+DROP INDEX IF EXISTS idx_material_categories_center_id;
+DROP TABLE IF EXISTS material_categories;
@@ -0,0 +1,82 @@
+-- Migration: Add managed material categories with hierarchy
+-- Version: 014
+
+-- Categories are global (center_id NULL) or specific to a center, and can be
+-- nested through parent_id. Icons are file names from static/pictos.
+CREATE TABLE IF NOT EXISTS material_categories (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    center_id INTEGER NULL,
+    parent_id INTEGER NULL,
+    name VARCHAR(100) NOT NULL,
+    slug VARCHAR(100) NOT NULL,
+    icon VARCHAR(255) NOT NULL DEFAULT '',
+    default_minimum_quantity INTEGER NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (parent_id) REFERENCES material_categories(id) ON DELETE SET NULL
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_material_categories_center_id ON material_categories(center_id);
+CREATE INDEX IF NOT EXISTS idx_material_categories_parent_id ON material_categories(parent_id);
+CREATE INDEX IF NOT EXISTS idx_material_categories_slug ON material_categories(slug);
+
+-- Default global categories (the ones offered by the old material form)
+INSERT INTO material_categories (center_id, name, slug, icon) VALUES
+    (NULL, 'General', 'general', 'material_escolar.png'),
+    (NULL, 'Electrónico', 'electronico', 'datacenter.png'),
+    (NULL, 'Mobiliario', 'mobiliario', 'aula.png'),
+    (NULL, 'Papelería', 'papeleria', 'papel_lapiz.png'),
+    (NULL, 'Otros', 'otros', 'mas.png');
+
+-- Normalise the free-text values: lowercase, without accents and with dashes
+-- instead of spaces, so "Papeleria", "papelería" and "Papelería" become one
+UPDATE materials SET category = 'general' WHERE category IS NULL OR TRIM(category) = '';
+
+-- The replacements are applied in order after lowercasing. SQLite only lowercases
+-- ASCII, so the accented capitals are listed too.
+CREATE TEMP TABLE category_slug_replacements (
+    step INTEGER PRIMARY KEY,
+    from_text TEXT NOT NULL,
+    to_text TEXT NOT NULL
+);
+INSERT INTO category_slug_replacements (step, from_text, to_text) VALUES
+    (1, 'á', 'a'), (2, 'à', 'a'), (3, 'ä', 'a'), (4, 'â', 'a'), (5, 'Á', 'a'), (6, 'À', 'a'), (7, 'Ä', 'a'), (8, 'Â', 'a'),
+    (9, 'é', 'e'), (10, 'è', 'e'), (11, 'ë', 'e'), (12, 'ê', 'e'), (13, 'É', 'e'), (14, 'È', 'e'), (15, 'Ë', 'e'), (16, 'Ê', 'e'),
+    (17, 'í', 'i'), (18, 'ì', 'i'), (19, 'ï', 'i'), (20, 'î', 'i'), (21, 'Í', 'i'), (22, 'Ì', 'i'), (23, 'Ï', 'i'), (24, 'Î', 'i'),
+    (25, 'ó', 'o'), (26, 'ò', 'o'), (27, 'ö', 'o'), (28, 'ô', 'o'), (29, 'Ó', 'o'), (30, 'Ò', 'o'), (31, 'Ö', 'o'), (32, 'Ô', 'o'),
+    (33, 'ú', 'u'), (34, 'ù', 'u'), (35, 'ü', 'u'), (36, 'û', 'u'), (37, 'Ú', 'u'), (38, 'Ù', 'u'), (39, 'Ü', 'u'), (40, 'Û', 'u'),
+    (41, 'ñ', 'n'), (42, 'Ñ', 'n'), (43, 'ç', 'c'), (44, 'Ç', 'c'), (45, ' ', '-'), (46, '_', '-');
+
+-- The normalised slug of every material, computed once
+CREATE TEMP TABLE material_category_slugs AS
+WITH RECURSIVE slugs (material_id, name, step, slug) AS (
+    SELECT id, TRIM(category), 0, LOWER(TRIM(category)) FROM materials
+    UNION ALL
+    SELECT s.material_id, s.name, r.step, REPLACE(s.slug, r.from_text, r.to_text)
+    FROM slugs s
+    JOIN category_slug_replacements r ON r.step = s.step + 1
+)
+SELECT material_id, name, slug FROM slugs
+WHERE step = (SELECT MAX(step) FROM category_slug_replacements);
+
+INSERT INTO material_categories (center_id, name, slug)
+SELECT NULL, MIN(name), slug
+FROM material_category_slugs
+WHERE slug NOT IN (SELECT slug FROM material_categories WHERE center_id IS NULL)
+GROUP BY slug;
+
+UPDATE materials SET category = (
+    SELECT slug FROM material_category_slugs s WHERE s.material_id = materials.id
+);
+
+DROP TABLE material_category_slugs;
+DROP TABLE category_slug_replacements;
+
+-- Link every material to its category
+ALTER TABLE materials ADD COLUMN category_id INTEGER REFERENCES material_categories(id) ON DELETE SET NULL;
+UPDATE materials SET category_id = (
+    SELECT id FROM material_categories mc WHERE mc.center_id IS NULL AND mc.slug = materials.category
+);
+CREATE INDEX IF NOT EXISTS idx_materials_category_id ON materials(category_id);
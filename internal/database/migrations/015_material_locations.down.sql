@@ -0,0 +1,7 @@
+-- Rollback: Remove stock per storage location
+-- Version: 015
+
+DROP INDEX IF EXISTS idx_material_stock_location_id;
+DROP INDEX IF EXISTS idx_storage_locations_center_id;
+DROP TABLE IF EXISTS material_stock;
+DROP TABLE IF EXISTS storage_locations;
@@ -0,0 +1,46 @@
+-- Migration: Add stock per storage location
+-- Version: 015
+
+-- Each center stores its materials in locations: named storage rooms and its
+-- classrooms. Every center has one default location (the store room) that
+-- receives new stock. materials.available_quantity is kept as the sum of the
+-- quantities in material_stock.
+CREATE TABLE IF NOT EXISTS storage_locations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    center_id INTEGER NOT NULL,
+    classroom_id INTEGER NULL UNIQUE,
+    name VARCHAR(255) NOT NULL,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (classroom_id) REFERENCES classrooms(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS material_stock (
+    material_id INTEGER NOT NULL,
+    location_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (material_id, location_id),
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE CASCADE,
+    FOREIGN KEY (location_id) REFERENCES storage_locations(id) ON DELETE CASCADE
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_storage_locations_center_id ON storage_locations(center_id);
+CREATE INDEX IF NOT EXISTS idx_material_stock_location_id ON material_stock(location_id);
+
+-- A store room for every center and a location for every classroom
+INSERT INTO storage_locations (center_id, name, is_default)
+SELECT id, 'Almacén', TRUE FROM centers;
+
+INSERT INTO storage_locations (center_id, classroom_id, name)
+SELECT center_id, id, name FROM classrooms;
+
+-- Existing stock starts in the store room
+INSERT INTO material_stock (material_id, location_id, quantity)
+SELECT m.id, l.id, m.available_quantity
+FROM materials m
+JOIN storage_locations l ON l.center_id = m.center_id AND l.is_default = TRUE
+WHERE m.available_quantity > 0;
@@ -0,0 +1,10 @@
+-- Rollback: Remove stocktake sessions
+-- Version: 016
+
+DROP INDEX IF EXISTS idx_stocktake_items_stocktake_id;
+DROP INDEX IF EXISTS idx_stocktakes_status;
+DROP INDEX IF EXISTS idx_stocktakes_center_id;
+DROP INDEX IF EXISTS idx_materials_barcode;
+DROP TABLE IF EXISTS stocktake_items;
+DROP TABLE IF EXISTS stocktakes;
+ALTER TABLE materials DROP COLUMN barcode;
@@ -0,0 +1,49 @@
+-- Migration: Add stocktake sessions
+-- Version: 016
+
+-- Barcode printed on the material, used to find it when counting with a scanner
+ALTER TABLE materials ADD COLUMN barcode VARCHAR(100) NOT NULL DEFAULT '';
+
+-- A stocktake counts the materials of a center, optionally limited to a
+-- category (with its subcategories) or a storage location. Closing it stores
+-- the expected quantity of each item and applies the accepted adjustments.
+CREATE TABLE IF NOT EXISTS stocktakes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    center_id INTEGER NOT NULL,
+    category_id INTEGER NULL,
+    location_id INTEGER NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'closed', 'cancelled')),
+    notes TEXT DEFAULT '',
+    created_by INTEGER NULL,
+    closed_by INTEGER NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    closed_at DATETIME NULL,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (category_id) REFERENCES material_categories(id) ON DELETE SET NULL,
+    FOREIGN KEY (location_id) REFERENCES storage_locations(id) ON DELETE SET NULL,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (closed_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Name and unit are copied so past stocktakes stay readable if the material is deleted
+CREATE TABLE IF NOT EXISTS stocktake_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    stocktake_id INTEGER NOT NULL,
+    material_id INTEGER NULL,
+    material_name VARCHAR(255) NOT NULL,
+    unit VARCHAR(100) NOT NULL,
+    expected_quantity INTEGER NOT NULL DEFAULT 0,
+    counted_quantity INTEGER NULL CHECK (counted_quantity >= 0),
+    adjusted BOOLEAN NOT NULL DEFAULT FALSE,
+    reason TEXT DEFAULT '',
+    counted_at DATETIME NULL,
+    FOREIGN KEY (stocktake_id) REFERENCES stocktakes(id) ON DELETE CASCADE,
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE SET NULL
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_materials_barcode ON materials(barcode);
+CREATE INDEX IF NOT EXISTS idx_stocktakes_center_id ON stocktakes(center_id);
+CREATE INDEX IF NOT EXISTS idx_stocktakes_status ON stocktakes(status);
+CREATE INDEX IF NOT EXISTS idx_stocktake_items_stocktake_id ON stocktake_items(stocktake_id);
@@ -0,0 +1,7 @@
+-- Rollback: Remove material movements ledger
+-- Version: 017
+
+DROP INDEX IF EXISTS idx_material_movements_created_at;
+DROP INDEX IF EXISTS idx_material_movements_center_id;
+DROP INDEX IF EXISTS idx_material_movements_material_id;
+DROP TABLE IF EXISTS material_movements;
@@ -0,0 +1,28 @@
+-- Migration: Add material movements ledger
+-- Version: 017
+
+-- Every change of the available quantity of a material, used to compute
+-- consumption rates. kind is one of: initial, consumption, restock,
+-- purchase, transfer_in, transfer_out, stocktake.
+CREATE TABLE IF NOT EXISTS material_movements (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    material_id INTEGER NOT NULL,
+    center_id INTEGER NOT NULL,
+    kind VARCHAR(20) NOT NULL,
+    quantity_change INTEGER NOT NULL,
+    quantity_after INTEGER NOT NULL,
+    user_id INTEGER NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE CASCADE,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_material_movements_material_id ON material_movements(material_id);
+CREATE INDEX IF NOT EXISTS idx_material_movements_center_id ON material_movements(center_id);
+CREATE INDEX IF NOT EXISTS idx_material_movements_created_at ON material_movements(created_at);
+
+-- Opening balance of the existing materials
+INSERT INTO material_movements (material_id, center_id, kind, quantity_change, quantity_after)
+SELECT id, center_id, 'initial', available_quantity, available_quantity FROM materials WHERE available_quantity > 0;
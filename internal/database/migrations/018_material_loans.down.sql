@@ -0,0 +1,9 @@
+-- Rollback: Remove loans of reusable materials
+-- Version: 018
+
+DROP INDEX IF EXISTS idx_material_loans_due_date;
+DROP INDEX IF EXISTS idx_material_loans_status;
+DROP INDEX IF EXISTS idx_material_loans_center_id;
+DROP INDEX IF EXISTS idx_material_loans_material_id;
+DROP TABLE IF EXISTS material_loans;
+ALTER TABLE materials DROP COLUMN is_lendable;
@@ -0,0 +1,40 @@
+-- Migration: Add loans of reusable materials
+-- Version: 018
+
+-- Reusable materials (tablets, sports kits, microscopes...) are lent instead of consumed
+ALTER TABLE materials ADD COLUMN is_lendable BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- A loan takes units of a material out to a user or a classroom until they are
+-- returned. Outstanding loans are not available for reservations or transfers.
+CREATE TABLE IF NOT EXISTS material_loans (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    material_id INTEGER NOT NULL,
+    center_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    borrower_user_id INTEGER NULL,
+    borrower_classroom_id INTEGER NULL,
+    due_date DATE NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'out' CHECK (status IN ('out', 'returned')),
+    notes TEXT DEFAULT '',
+    send_reminders BOOLEAN NOT NULL DEFAULT FALSE,
+    reminder_sent_at DATETIME NULL,
+    overdue_notice_sent_at DATETIME NULL,
+    lent_by INTEGER NULL,
+    returned_by INTEGER NULL,
+    lent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    returned_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE CASCADE,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (borrower_user_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (borrower_classroom_id) REFERENCES classrooms(id) ON DELETE SET NULL,
+    FOREIGN KEY (lent_by) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (returned_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_material_loans_material_id ON material_loans(material_id);
+CREATE INDEX IF NOT EXISTS idx_material_loans_center_id ON material_loans(center_id);
+CREATE INDEX IF NOT EXISTS idx_material_loans_status ON material_loans(status);
+CREATE INDEX IF NOT EXISTS idx_material_loans_due_date ON material_loans(due_date);
@@ -0,0 +1,8 @@
+-- Rollback: Remove suppliers and material costs
+-- Version: 019
+
+DROP INDEX IF EXISTS idx_materials_preferred_supplier_id;
+ALTER TABLE material_movements DROP COLUMN unit_cost;
+ALTER TABLE materials DROP COLUMN preferred_supplier_id;
+ALTER TABLE materials DROP COLUMN unit_cost;
+DROP TABLE IF EXISTS suppliers;
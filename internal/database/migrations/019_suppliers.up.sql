@@ -0,0 +1,36 @@
+-- Migration: Add suppliers and material costs
+-- Version: 019
+
+-- Suppliers are shared by every center and managed by the administrators
+CREATE TABLE IF NOT EXISTS suppliers (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    contact_name VARCHAR(255) DEFAULT '',
+    email VARCHAR(255) DEFAULT '',
+    phone VARCHAR(50) DEFAULT '',
+    website VARCHAR(500) DEFAULT '',
+    notes TEXT DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Last known cost of one unit and the supplier it is usually bought from
+ALTER TABLE materials ADD COLUMN unit_cost REAL NOT NULL DEFAULT 0;
+ALTER TABLE materials ADD COLUMN preferred_supplier_id INTEGER NULL REFERENCES suppliers(id) ON DELETE SET NULL;
+
+-- Unit cost of the stock that came in with a movement (purchases and restocks)
+ALTER TABLE material_movements ADD COLUMN unit_cost REAL NULL;
+
+-- Suppliers already typed in purchase orders become managed suppliers
+INSERT OR IGNORE INTO suppliers (name)
+SELECT DISTINCT TRIM(supplier) FROM purchase_orders WHERE TRIM(COALESCE(supplier, '')) <> '';
+
+-- The last price paid in a purchase order is the starting unit cost
+UPDATE materials SET unit_cost = COALESCE((
+    SELECT i.unit_price FROM purchase_order_items i
+    JOIN purchase_orders o ON i.order_id = o.id
+    WHERE i.material_id = materials.id AND i.unit_price > 0
+    ORDER BY o.id DESC LIMIT 1), 0);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_materials_preferred_supplier_id ON materials(preferred_supplier_id);
@@ -0,0 +1,8 @@
+-- Rollback: Remove batch and expiry tracking of materials
+-- Version: 020
+
+DROP INDEX IF EXISTS idx_material_batches_expiry_date;
+DROP INDEX IF EXISTS idx_material_batches_center_id;
+DROP INDEX IF EXISTS idx_material_batches_material_id;
+DROP TABLE IF EXISTS material_batches;
+ALTER TABLE materials DROP COLUMN tracks_batches;
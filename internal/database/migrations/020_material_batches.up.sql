@@ -0,0 +1,33 @@
+-- Migration: Add batch and expiry tracking of materials
+-- Version: 020
+
+-- Perishable consumables (first-aid supplies, cleaning products...) are tracked by batch
+ALTER TABLE materials ADD COLUMN tracks_batches BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- A batch is a lot of a material received together with the same expiry date.
+-- Consumption takes units from the batches that expire first; the units of a
+-- material not covered by its batches have no known expiry. Batches past their
+-- expiry date are written off and their units leave the available quantity.
+CREATE TABLE IF NOT EXISTS material_batches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    material_id INTEGER NOT NULL,
+    center_id INTEGER NOT NULL,
+    batch_code VARCHAR(100) NOT NULL DEFAULT '',
+    quantity INTEGER NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+    initial_quantity INTEGER NOT NULL DEFAULT 0,
+    expiry_date DATE NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'expired')),
+    created_by INTEGER NULL,
+    received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expired_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE CASCADE,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_material_batches_material_id ON material_batches(material_id);
+CREATE INDEX IF NOT EXISTS idx_material_batches_center_id ON material_batches(center_id);
+CREATE INDEX IF NOT EXISTS idx_material_batches_expiry_date ON material_batches(expiry_date);
@@ -0,0 +1,8 @@
+-- Rollback: Remove material kits
+-- Version: 021
+
+DROP INDEX IF EXISTS idx_material_kit_items_material_id;
+DROP INDEX IF EXISTS idx_material_kit_items_kit_id;
+DROP INDEX IF EXISTS idx_material_kits_center_id;
+DROP TABLE IF EXISTS material_kit_items;
+DROP TABLE IF EXISTS material_kits;
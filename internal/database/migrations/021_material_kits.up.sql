@@ -0,0 +1,33 @@
+-- Migration: Add material kits
+-- Version: 021
+
+-- A kit is a standard set of materials of a center, such as a science experiment
+-- kit or a first day pack. Assembling kits takes their components out of stock
+-- and keeps them as ready-made kits until they are used or taken apart.
+CREATE TABLE IF NOT EXISTS material_kits (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    center_id INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    description TEXT DEFAULT '',
+    assembled_quantity INTEGER NOT NULL DEFAULT 0 CHECK (assembled_quantity >= 0),
+    created_by INTEGER NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS material_kit_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kit_id INTEGER NOT NULL,
+    material_id INTEGER NOT NULL,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    FOREIGN KEY (kit_id) REFERENCES material_kits(id) ON DELETE CASCADE,
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE CASCADE,
+    UNIQUE(kit_id, material_id)
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_material_kits_center_id ON material_kits(center_id);
+CREATE INDEX IF NOT EXISTS idx_material_kit_items_kit_id ON material_kit_items(kit_id);
+CREATE INDEX IF NOT EXISTS idx_material_kit_items_material_id ON material_kit_items(material_id);
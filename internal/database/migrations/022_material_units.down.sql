@@ -0,0 +1,6 @@
+-- Rollback: Remove unit definitions and conversions for materials
+-- Version: 022
+
+DROP INDEX IF EXISTS idx_material_units_material_id;
+DROP TABLE IF EXISTS material_units;
+ALTER TABLE purchase_order_items DROP COLUMN unit_factor;
@@ -0,0 +1,22 @@
+-- Migration: Add unit definitions and conversions for materials
+-- Version: 022
+
+-- Stock is always stored in the base unit of the material (materials.unit).
+-- Each material can define larger units with the number of base units they
+-- hold, so 1 box = 12 packs = 144 pieces becomes pack = 12 and box = 144.
+CREATE TABLE IF NOT EXISTS material_units (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    material_id INTEGER NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    factor INTEGER NOT NULL CHECK (factor > 1),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE CASCADE,
+    UNIQUE(material_id, name)
+);
+
+-- Purchase order lines can be ordered in any unit of the material; the factor
+-- converts the ordered quantity to base units when the order is received
+ALTER TABLE purchase_order_items ADD COLUMN unit_factor INTEGER NOT NULL DEFAULT 1;
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_material_units_material_id ON material_units(material_id);
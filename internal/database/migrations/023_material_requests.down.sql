@@ -0,0 +1,12 @@
+-- Rollback: Remove material requests and in-app notifications
+-- Version: 023
+
+DROP INDEX IF EXISTS idx_notifications_user_id;
+DROP INDEX IF EXISTS idx_material_request_items_material_id;
+DROP INDEX IF EXISTS idx_material_request_items_request_id;
+DROP INDEX IF EXISTS idx_material_requests_status;
+DROP INDEX IF EXISTS idx_material_requests_requested_by;
+DROP INDEX IF EXISTS idx_material_requests_center_id;
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS material_request_items;
+DROP TABLE IF EXISTS material_requests;
@@ -0,0 +1,56 @@
+-- Migration: Add material requests and in-app notifications
+-- Version: 023
+
+-- Teachers request materials for their classroom instead of editing the stock.
+-- A coordinator fulfils the request in full or in part, which takes the stock
+-- out of the inventory, or rejects it. Requesters can cancel pending requests.
+CREATE TABLE IF NOT EXISTS material_requests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    center_id INTEGER NOT NULL,
+    classroom_id INTEGER NULL,
+    requested_by INTEGER NULL,
+    needed_by DATE NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'fulfilled', 'partial', 'rejected', 'cancelled')),
+    notes TEXT DEFAULT '',
+    response_notes TEXT DEFAULT '',
+    reviewed_by INTEGER NULL,
+    reviewed_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    FOREIGN KEY (classroom_id) REFERENCES classrooms(id) ON DELETE SET NULL,
+    FOREIGN KEY (requested_by) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (reviewed_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- The material name and unit are kept so requests stay readable if the material is deleted
+CREATE TABLE IF NOT EXISTS material_request_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    request_id INTEGER NOT NULL,
+    material_id INTEGER NULL,
+    material_name VARCHAR(255) NOT NULL,
+    unit VARCHAR(50) NOT NULL DEFAULT '',
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    fulfilled_quantity INTEGER NOT NULL DEFAULT 0 CHECK (fulfilled_quantity >= 0),
+    FOREIGN KEY (request_id) REFERENCES material_requests(id) ON DELETE CASCADE,
+    FOREIGN KEY (material_id) REFERENCES materials(id) ON DELETE SET NULL
+);
+
+-- Notifications shown to a user inside the application until they are read
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    message TEXT NOT NULL,
+    link VARCHAR(500) DEFAULT '',
+    read_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_material_requests_center_id ON material_requests(center_id);
+CREATE INDEX IF NOT EXISTS idx_material_requests_requested_by ON material_requests(requested_by);
+CREATE INDEX IF NOT EXISTS idx_material_requests_status ON material_requests(status);
+CREATE INDEX IF NOT EXISTS idx_material_request_items_request_id ON material_request_items(request_id);
+CREATE INDEX IF NOT EXISTS idx_material_request_items_material_id ON material_request_items(material_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id);
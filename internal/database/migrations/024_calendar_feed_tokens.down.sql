@@ -0,0 +1,5 @@
+-- Rollback: Remove calendar feed tokens
+-- Version: 024
+
+DROP INDEX IF EXISTS idx_calendar_feed_tokens_token;
+DROP TABLE IF EXISTS calendar_feed_tokens;
@@ -0,0 +1,17 @@
+-- Migration: Add calendar feed tokens for the activity ICS subscriptions
+-- Version: 024
+
+-- Calendar apps cannot log in, so each user gets a secret token that is part
+-- of the feed URLs. There is one token per user; regenerating it replaces the
+-- row and invalidates every URL the user subscribed with before.
+CREATE TABLE IF NOT EXISTS calendar_feed_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL UNIQUE,
+    token TEXT NOT NULL UNIQUE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used DATETIME NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_calendar_feed_tokens_token ON calendar_feed_tokens(token);
@@ -0,0 +1,7 @@
+-- Rollback: Remove CalDAV identifiers from activities
+-- Version: 025
+
+DROP INDEX IF EXISTS idx_activities_caldav_name;
+DROP INDEX IF EXISTS idx_activities_ical_uid;
+ALTER TABLE activities DROP COLUMN caldav_name;
+ALTER TABLE activities DROP COLUMN ical_uid;
@@ -0,0 +1,12 @@
+-- Migration: Add CalDAV identifiers to activities
+-- Version: 025
+
+-- Activities created from a calendar app keep the UID and the resource name
+-- the app chose, so it finds them again on the next sync. Activities created
+-- in Figaro leave both NULL and use actividad-<id>@figaro and actividad-<id>.ics.
+ALTER TABLE activities ADD COLUMN ical_uid TEXT NULL;
+ALTER TABLE activities ADD COLUMN caldav_name TEXT NULL;
+
+-- Create indexes for better performance
+CREATE UNIQUE INDEX IF NOT EXISTS idx_activities_ical_uid ON activities(ical_uid);
+CREATE INDEX IF NOT EXISTS idx_activities_caldav_name ON activities(caldav_name);
@@ -0,0 +1,10 @@
+-- Rollback: Remove recurring activities
+-- Version: 026
+
+DROP INDEX IF EXISTS idx_activity_exceptions_activity_id;
+DROP INDEX IF EXISTS idx_activities_recurrence_parent_id;
+DROP TABLE IF EXISTS activity_exceptions;
+DELETE FROM activities WHERE recurrence_parent_id IS NOT NULL;
+ALTER TABLE activities DROP COLUMN recurrence_date;
+ALTER TABLE activities DROP COLUMN recurrence_parent_id;
+ALTER TABLE activities DROP COLUMN recurrence_rule;
@@ -0,0 +1,28 @@
+-- Migration: Add recurring activities
+-- Version: 026
+
+-- A recurring activity is a series: its start and end are those of the first
+-- occurrence and recurrence_rule is an RFC 5545 RRULE (daily, weekly on some
+-- weekdays or monthly, until a date or a number of times). UNTIL is written
+-- in the wall clock time of the center, like start_datetime.
+ALTER TABLE activities ADD COLUMN recurrence_rule TEXT NULL;
+
+-- An occurrence edited on its own is stored as an activity of its own that
+-- replaces the occurrence of its series starting at recurrence_date. Overrides
+-- are deleted with their series by the application.
+ALTER TABLE activities ADD COLUMN recurrence_parent_id INTEGER NULL;
+ALTER TABLE activities ADD COLUMN recurrence_date DATETIME NULL;
+
+-- Occurrences removed from a series (EXDATE), by their original start
+CREATE TABLE IF NOT EXISTS activity_exceptions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    occurrence_date DATETIME NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(activity_id, occurrence_date),
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_activities_recurrence_parent_id ON activities(recurrence_parent_id);
+CREATE INDEX IF NOT EXISTS idx_activity_exceptions_activity_id ON activity_exceptions(activity_id);
@@ -0,0 +1,4 @@
+-- Rollback: Remove the working hours override of activities
+-- Version: 027
+
+ALTER TABLE activities DROP COLUMN outside_working_hours;
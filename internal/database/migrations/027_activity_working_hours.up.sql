@@ -0,0 +1,8 @@
+-- Migration: Validate activities against the working hours of the centers
+-- Version: 027
+
+-- Activities must take place within the working hours of their center
+-- (center_working_hours, in the timezone of the center). An administrator
+-- can allow an activity outside of them, which is recorded here so that
+-- later edits keep the permission.
+ALTER TABLE activities ADD COLUMN outside_working_hours BOOLEAN DEFAULT FALSE;
@@ -0,0 +1,5 @@
+-- Rollback: Remove the status history of activities
+-- Version: 028
+
+DROP INDEX IF EXISTS idx_activity_status_history_activity_id;
+DROP TABLE IF EXISTS activity_status_history;
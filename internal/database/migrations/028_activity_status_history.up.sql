@@ -0,0 +1,21 @@
+-- Migration: Add the status lifecycle of activities
+-- Version: 028
+
+-- The status of an activity follows its dates: a scheduler moves it from
+-- pending to in_progress when it starts and to completed when it ends (for a
+-- series, when its last occurrence ends). Cancelled and postponed are set by
+-- users and are kept until they change them. Every change is recorded here;
+-- changed_by is NULL for the changes made by the scheduler.
+CREATE TABLE IF NOT EXISTS activity_status_history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    old_status VARCHAR(20),
+    new_status VARCHAR(20) NOT NULL,
+    changed_by INTEGER NULL,
+    changed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE,
+    FOREIGN KEY (changed_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_activity_status_history_activity_id ON activity_status_history(activity_id);
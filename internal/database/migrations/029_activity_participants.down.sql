@@ -0,0 +1,10 @@
+-- Rollback: Remove the participants and attendance of activities
+-- Version: 029
+
+DROP INDEX IF EXISTS idx_activity_attendance_classroom_id;
+DROP INDEX IF EXISTS idx_activity_attendance_activity_id;
+DROP INDEX IF EXISTS idx_activity_staff_user_id;
+DROP INDEX IF EXISTS idx_activity_classrooms_classroom_id;
+DROP TABLE IF EXISTS activity_attendance;
+DROP TABLE IF EXISTS activity_staff;
+DROP TABLE IF EXISTS activity_classrooms;
@@ -0,0 +1,50 @@
+-- Migration: Add the participants and attendance of activities
+-- Version: 029
+
+-- The classrooms taking part in an activity and the staff members responsible
+-- for it. Like the custom links, the participants of a series apply to all its
+-- occurrences, including the edited ones.
+CREATE TABLE IF NOT EXISTS activity_classrooms (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    classroom_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE,
+    FOREIGN KEY (classroom_id) REFERENCES classrooms(id) ON DELETE CASCADE,
+    UNIQUE(activity_id, classroom_id)
+);
+
+CREATE TABLE IF NOT EXISTS activity_staff (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE(activity_id, user_id)
+);
+
+-- Attendance taken after an activity, one row per classroom or staff member.
+-- occurrence_date is the original start of an occurrence of a series and NULL
+-- for single activities and edited occurrences.
+CREATE TABLE IF NOT EXISTS activity_attendance (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    occurrence_date DATETIME NULL,
+    classroom_id INTEGER NULL,
+    user_id INTEGER NULL,
+    attended BOOLEAN NOT NULL,
+    recorded_by INTEGER NULL,
+    recorded_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE,
+    FOREIGN KEY (classroom_id) REFERENCES classrooms(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (recorded_by) REFERENCES users(id) ON DELETE SET NULL,
+    CHECK ((classroom_id IS NULL) <> (user_id IS NULL))
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_activity_classrooms_classroom_id ON activity_classrooms(classroom_id);
+CREATE INDEX IF NOT EXISTS idx_activity_staff_user_id ON activity_staff(user_id);
+CREATE INDEX IF NOT EXISTS idx_activity_attendance_activity_id ON activity_attendance(activity_id);
+CREATE INDEX IF NOT EXISTS idx_activity_attendance_classroom_id ON activity_attendance(classroom_id);
@@ -0,0 +1,5 @@
+-- Rollback: Remove file attachments from activities
+-- Version: 030
+
+DROP INDEX IF EXISTS idx_activity_attachments_activity_id;
+DROP TABLE IF EXISTS activity_attachments;
@@ -0,0 +1,21 @@
+-- Migration: Add file attachments to activities
+-- Version: 030
+
+-- Files attached to an activity, such as programmes or permission slips. The
+-- files are kept under the upload directory with a generated name, and like the
+-- custom links, the attachments of a series apply to all its occurrences.
+CREATE TABLE IF NOT EXISTS activity_attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    file_name TEXT NOT NULL,
+    stored_name TEXT NOT NULL UNIQUE,
+    content_type TEXT NOT NULL DEFAULT '',
+    size INTEGER NOT NULL DEFAULT 0,
+    uploaded_by INTEGER NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE,
+    FOREIGN KEY (uploaded_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_activity_attachments_activity_id ON activity_attachments(activity_id);
@@ -0,0 +1,8 @@
+-- Rollback: Remove the reminders of activities
+-- Version: 031
+
+DROP INDEX IF EXISTS idx_activity_reminder_outbox_status_send_at;
+DROP INDEX IF EXISTS idx_activity_reminder_subscriptions_center_id;
+DROP TABLE IF EXISTS activity_reminder_outbox;
+DROP TABLE IF EXISTS activity_reminder_subscriptions;
+DROP TABLE IF EXISTS activity_reminders;
@@ -0,0 +1,54 @@
+-- Migration: Add email and in-app reminders before activities start
+-- Version: 031
+
+-- How long before an activity its reminders are sent. Like the custom links,
+-- the reminders of a series apply to all its occurrences.
+CREATE TABLE IF NOT EXISTS activity_reminders (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    minutes_before INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE,
+    UNIQUE(activity_id, minutes_before)
+);
+
+-- The users who want the reminders of the activities a center can see, besides
+-- the staff responsible for each activity
+CREATE TABLE IF NOT EXISTS activity_reminder_subscriptions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    center_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (center_id) REFERENCES centers(id) ON DELETE CASCADE,
+    UNIQUE(user_id, center_id)
+);
+
+-- Outbox of the reminders to send, one row per occurrence, reminder and user.
+-- occurrence is the key of an occurrence of a series and empty for single
+-- activities and edited occurrences. start_datetime is the wall clock time of
+-- the center, as activities are stored, while send_at is in UTC. Failed emails
+-- are retried at next_attempt_at until they give up.
+CREATE TABLE IF NOT EXISTS activity_reminder_outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    activity_id INTEGER NOT NULL,
+    occurrence TEXT NOT NULL DEFAULT '',
+    minutes_before INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    start_datetime DATETIME NOT NULL,
+    send_at DATETIME NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, sent or failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    notified_at DATETIME NULL,
+    sent_at DATETIME NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (activity_id) REFERENCES activities(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE(activity_id, occurrence, minutes_before, user_id)
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_activity_reminder_subscriptions_center_id ON activity_reminder_subscriptions(center_id);
+CREATE INDEX IF NOT EXISTS idx_activity_reminder_outbox_status_send_at ON activity_reminder_outbox(status, send_at);
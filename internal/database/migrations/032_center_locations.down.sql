@@ -0,0 +1,4 @@
+-- Rollback: Create the missing storage locations of centers and classrooms
+-- Version: 032
+
+-- The created locations may already hold stock, so they are kept
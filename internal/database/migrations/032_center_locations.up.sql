@@ -0,0 +1,18 @@
+-- Migration: Create the missing storage locations of centers and classrooms
+-- Version: 032
+
+-- The locations of centers and classrooms created after migration 015 used to
+-- be added when a page first read them. They are now created together with
+-- their center or classroom, so add the ones still missing.
+INSERT INTO storage_locations (center_id, name, is_default)
+SELECT c.id, 'Almacén', TRUE FROM centers c
+WHERE NOT EXISTS (SELECT 1 FROM storage_locations l WHERE l.center_id = c.id AND l.is_default = TRUE);
+
+INSERT INTO storage_locations (center_id, classroom_id, name)
+SELECT cl.center_id, cl.id, cl.name FROM classrooms cl
+WHERE NOT EXISTS (SELECT 1 FROM storage_locations l WHERE l.classroom_id = cl.id);
+
+-- Classroom locations follow the name of their classroom
+UPDATE storage_locations SET name = (SELECT name FROM classrooms WHERE id = classroom_id), updated_at = datetime('now')
+WHERE classroom_id IS NOT NULL
+AND name != (SELECT name FROM classrooms WHERE id = classroom_id);
@@ -3,12 +3,14 @@ package handlers
 import (
 	"database/sql"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/EuskadiTech/Figaro/internal/auth"
 	"github.com/EuskadiTech/Figaro/internal/database"
 	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
 	"github.com/gin-gonic/gin"
 )
 
@@ -31,6 +33,10 @@ func (h *Handlers) ActividadesIndex(c *gin.Context) {
 	searchQuery := c.Query("q")
 	showPast := c.Query("past") == "y"
 	activeTab := c.DefaultQuery("tab", "all") // default to "all" activities
+	statusFilter := c.Query("estado")
+	if !isValidActivityStatus(statusFilter) {
+		statusFilter = ""
+	}
 
 	// Get pagination parameters
 	pageStr := c.DefaultQuery("page", "1")
@@ -44,11 +50,11 @@ func (h *Handlers) ActividadesIndex(c *gin.Context) {
 	var totalCount int
 	switch activeTab {
 	case "compartidas":
-		activities, totalCount, err = h.getSharedActivitiesPaginated(centro, searchQuery, showPast, page, 25)
+		activities, totalCount, err = h.getSharedActivitiesPaginated(centro, searchQuery, statusFilter, showPast, page, 25)
 	case "enlaces":
-		activities, totalCount, err = h.getActivitiesWithCustomLinksPaginated(centro, searchQuery, showPast, page, 25)
+		activities, totalCount, err = h.getActivitiesWithCustomLinksPaginated(centro, searchQuery, statusFilter, showPast, page, 25)
 	default: // "all" or any other value
-		activities, totalCount, err = h.getActivitiesPaginated(centro, searchQuery, showPast, page, 25)
+		activities, totalCount, err = h.getActivitiesPaginated(centro, searchQuery, statusFilter, showPast, page, 25)
 	}
 	
 	if err != nil {
@@ -56,6 +62,20 @@ func (h *Handlers) ActividadesIndex(c *gin.Context) {
 		totalCount = 0
 	}
 
+	// Show where shared activities come from and who the center shares its own with
+	h.setActivitiesSharing(activities, centro)
+	h.setActivitiesCustomLinks(activities)
+	h.setActivitiesParticipants(activities)
+	h.setActivitiesAttachments(activities)
+
+	// Load the materials each activity has reserved in this center
+	for i := range activities {
+		reservations, err := h.getActivityReservations(activities[i].ID, centro)
+		if err == nil {
+			activities[i].Reservations = reservations
+		}
+	}
+
 	// Create pagination info
 	pagination := models.NewPaginationInfo(page, 25, totalCount)
 
@@ -66,6 +86,7 @@ func (h *Handlers) ActividadesIndex(c *gin.Context) {
 	data["SearchQuery"] = searchQuery
 	data["ShowPast"] = showPast
 	data["ActiveTab"] = activeTab
+	data["StatusFilter"] = statusFilter
 	data["Pagination"] = pagination
 
 	h.renderTemplate(c, "actividades.html", data)
@@ -134,18 +155,29 @@ func (h *Handlers) getActivities(centro string, searchQuery string, showPast boo
 	return activities, nil
 }
 
-// getActivitiesPaginated retrieves activities for a center with pagination
-func (h *Handlers) getActivitiesPaginated(centro string, searchQuery string, showPast bool, page, perPage int) ([]models.Activity, int, error) {
+// getActivitiesPaginated retrieves the activities a center can see with pagination
+func (h *Handlers) getActivitiesPaginated(centro string, searchQuery, status string, showPast bool, page, perPage int) ([]models.Activity, int, error) {
+	return h.getFilteredActivitiesPaginated(activityVisibleSQL, []interface{}{centro, centro}, searchQuery, status, showPast, page, perPage)
+}
+
+// getFilteredActivitiesPaginated retrieves the activities matching a condition, and a status
+// if one is given, with pagination. Single activities are paged by the database; recurring
+// activities are expanded into their occurrences and merged with them.
+func (h *Handlers) getFilteredActivitiesPaginated(condition string, conditionArgs []interface{}, searchQuery, status string, showPast bool, page, perPage int) ([]models.Activity, int, error) {
 	var baseQuery string
-	var args []interface{}
+	args := append([]interface{}{}, conditionArgs...)
 
 	if showPast {
-		baseQuery = `FROM activities WHERE (center_id = (SELECT id FROM centers WHERE name = ?) OR is_global = 1)`
-		args = []interface{}{centro}
+		baseQuery = `FROM activities WHERE ` + condition
 	} else {
-		baseQuery = `FROM activities WHERE (center_id = (SELECT id FROM centers WHERE name = ?) OR is_global = 1) 
+		baseQuery = `FROM activities WHERE ` + condition + ` 
 				AND start_datetime > datetime('now', 'start of day')`
-		args = []interface{}{centro}
+	}
+	baseQuery += " AND recurrence_rule IS NULL"
+	// The occurrences of a series are filtered by the status of their own dates
+	if status != "" {
+		baseQuery += " AND status = ?"
+		args = append(args, status)
 	}
 
 	if searchQuery != "" {
@@ -162,14 +194,21 @@ func (h *Handlers) getActivitiesPaginated(centro string, searchQuery string, sho
 		return nil, 0, err
 	}
 
+	// Neither the single activities nor the occurrences of one series can fill more than the
+	// pages up to the requested one, so the series are only expanded that far
+	occurrences, occurrenceCount, err := h.getActivityOccurrences(condition, conditionArgs, searchQuery, status, showPast, max(page, 1)*perPage)
+	if err != nil {
+		return nil, 0, err
+	}
+	totalCount += occurrenceCount
+
 	// Calculate pagination
 	pagination := models.NewPaginationInfo(page, perPage, totalCount)
 	
-	// Get paginated results
-	query := `SELECT id, center_id, title, description, start_datetime, end_datetime, is_global, status, meeting_url, web_url, created_at, updated_at ` + 
-		baseQuery + ` ORDER BY start_datetime ASC LIMIT ? OFFSET ?`
+	// Get the single activities up to the end of the page, the occurrences may come before them
+	query := `SELECT ` + activityColumns + ` ` + baseQuery + ` ORDER BY start_datetime ASC LIMIT ?`
 	
-	args = append(args, perPage, pagination.Offset)
+	args = append(args, pagination.Offset+perPage)
 	rows, err := database.DB.Query(query, args...)
 	if err != nil {
 		return nil, totalCount, err
@@ -178,47 +217,37 @@ func (h *Handlers) getActivitiesPaginated(centro string, searchQuery string, sho
 
 	var activities []models.Activity
 	for rows.Next() {
-		var activity models.Activity
-		var centerID sql.NullInt64
-		var meetingURL sql.NullString
-		var webURL sql.NullString
-
-		err := rows.Scan(&activity.ID, &centerID, &activity.Title, &activity.Description,
-			&activity.StartDatetime, &activity.EndDatetime, &activity.IsGlobal, &activity.Status,
-			&meetingURL, &webURL, &activity.CreatedAt, &activity.UpdatedAt)
+		activity, err := scanActivity(rows)
 		if err != nil {
 			continue
 		}
-
-		if centerID.Valid {
-			centerIDInt := int(centerID.Int64)
-			activity.CenterID = &centerIDInt
-		}
-
-		if meetingURL.Valid {
-			activity.MeetingURL = &meetingURL.String
-		}
-
-		if webURL.Valid {
-			activity.WebURL = &webURL.String
-		}
-
 		activities = append(activities, activity)
 	}
 
+	activities = append(activities, occurrences...)
+	sort.SliceStable(activities, func(i, j int) bool {
+		return activities[i].StartDatetime.Before(activities[j].StartDatetime)
+	})
+	if pagination.Offset >= len(activities) {
+		return []models.Activity{}, totalCount, nil
+	}
+	activities = activities[pagination.Offset:min(pagination.Offset+perPage, len(activities))]
+
 	return activities, totalCount, nil
 }
 
-// getSharedActivitiesPaginated retrieves shared activities with pagination
-func (h *Handlers) getSharedActivitiesPaginated(centro string, searchQuery string, showPast bool, page, perPage int) ([]models.Activity, int, error) {
-	// For simplicity, delegate to main function - in real implementation you'd add specific logic for shared activities
-	return h.getActivitiesPaginated(centro, searchQuery, showPast, page, perPage)
+// getSharedActivitiesPaginated retrieves with pagination the activities shared with the center
+// and those the center shared with others
+func (h *Handlers) getSharedActivitiesPaginated(centro string, searchQuery, status string, showPast bool, page, perPage int) ([]models.Activity, int, error) {
+	condition := "(" + activitySharedWithSQL + " OR " + activitySharedBySQL + ")"
+	return h.getFilteredActivitiesPaginated(condition, []interface{}{centro, centro}, searchQuery, status, showPast, page, perPage)
 }
 
-// getActivitiesWithCustomLinksPaginated retrieves activities with custom links with pagination
-func (h *Handlers) getActivitiesWithCustomLinksPaginated(centro string, searchQuery string, showPast bool, page, perPage int) ([]models.Activity, int, error) {
-	// For simplicity, delegate to main function - in real implementation you'd add specific logic for custom links
-	return h.getActivitiesPaginated(centro, searchQuery, showPast, page, perPage)
+// getActivitiesWithCustomLinksPaginated retrieves with pagination the activities the center
+// can see that have custom links
+func (h *Handlers) getActivitiesWithCustomLinksPaginated(centro string, searchQuery, status string, showPast bool, page, perPage int) ([]models.Activity, int, error) {
+	condition := activityVisibleSQL + " AND " + activityHasCustomLinksSQL
+	return h.getFilteredActivitiesPaginated(condition, []interface{}{centro, centro}, searchQuery, status, showPast, page, perPage)
 }
 
 // ActividadesCrear handles activity creation
@@ -247,11 +276,43 @@ func (h *Handlers) ActividadesCrear(c *gin.Context) {
 	data["Centro"] = centro
 	data["Action"] = "crear"
 
+	// The calendar opens the form on the day and hour that was clicked
+	if start, err := parseDateTime(c.Query("fecha"), c.Query("hora")); err == nil {
+		end, err := parseDateTime(c.Query("fecha"), c.Query("fin"))
+		if err != nil || !end.After(start) {
+			end = start.Add(time.Hour)
+		}
+		data["FormData"] = gin.H{
+			"titulo":       "",
+			"descripcion":  "",
+			"fecha_inicio": start.Format("2006-01-02"),
+			"hora_inicio":  start.Format("15:04"),
+			"fecha_fin":    end.Format("2006-01-02"),
+			"hora_fin":     end.Format("15:04"),
+			"global":       false,
+			"meeting_url":  "",
+			"web_url":      "",
+			"status":       "pending",
+		}
+	}
+
+	h.setActivityFormData(c, data, centro)
 	h.renderTemplate(c, "actividad_form.html", data)
 }
 
 // handleActivityCreate processes activity creation
 func (h *Handlers) handleActivityCreate(c *gin.Context, centro string) {
+	if err := h.readActivityForm(c); err != nil {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Actividad"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = attachmentErrorMessage(err, h.maxUploadSizeText())
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
 	title := c.PostForm("titulo")
 	description := c.PostForm("descripcion")
 	startDate := c.PostForm("fecha_inicio")
@@ -261,6 +322,11 @@ func (h *Handlers) handleActivityCreate(c *gin.Context, centro string) {
 	isGlobal := c.PostForm("global") == "1"
 	meetingURL := c.PostForm("meeting_url")
 	webURL := c.PostForm("web_url")
+	// Only cancelled and postponed are chosen by hand, the rest follow the dates of the activity
+	status := c.PostForm("status")
+	if !isManualActivityStatus(status) {
+		status = "pending"
+	}
 
 	if title == "" || startDate == "" || startTime == "" || endDate == "" || endTime == "" {
 		data := h.getCommonData(c)
@@ -278,7 +344,9 @@ func (h *Handlers) handleActivityCreate(c *gin.Context, centro string) {
 			"global":       isGlobal,
 			"meeting_url":  meetingURL,
 			"web_url":      webURL,
+			"status":       status,
 		}
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
@@ -291,6 +359,7 @@ func (h *Handlers) handleActivityCreate(c *gin.Context, centro string) {
 		data["Centro"] = centro
 		data["Action"] = "crear"
 		data["ErrorMessage"] = "Fecha/hora de inicio inválida"
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
@@ -302,6 +371,7 @@ func (h *Handlers) handleActivityCreate(c *gin.Context, centro string) {
 		data["Centro"] = centro
 		data["Action"] = "crear"
 		data["ErrorMessage"] = "Fecha/hora de fin inválida"
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
@@ -312,10 +382,123 @@ func (h *Handlers) handleActivityCreate(c *gin.Context, centro string) {
 		data["Centro"] = centro
 		data["Action"] = "crear"
 		data["ErrorMessage"] = "La fecha de fin debe ser posterior a la fecha de inicio"
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	reservations, err := parseActivityReservations(c)
+	if err != nil {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Actividad"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = "Las cantidades de materiales reservados deben ser números mayores que cero"
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	customLinks, err := parseActivityCustomLinks(c)
+	if err != nil {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Actividad"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = "Cada enlace personalizado necesita una etiqueta y una dirección que empiece por http:// o https://"
+		data["FormData"] = gin.H{
+			"titulo":       title,
+			"descripcion":  description,
+			"fecha_inicio": startDate,
+			"hora_inicio":  startTime,
+			"fecha_fin":    endDate,
+			"hora_fin":     endTime,
+			"global":       isGlobal,
+			"meeting_url":  meetingURL,
+			"web_url":      webURL,
+			"status":       status,
+		}
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	attachments, err := h.parseActivityAttachments(c)
+	if err != nil {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Actividad"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = attachmentErrorMessage(err, h.maxUploadSizeText())
+		data["FormData"] = gin.H{
+			"titulo":       title,
+			"descripcion":  description,
+			"fecha_inicio": startDate,
+			"hora_inicio":  startTime,
+			"fecha_fin":    endDate,
+			"hora_fin":     endTime,
+			"global":       isGlobal,
+			"meeting_url":  meetingURL,
+			"web_url":      webURL,
+			"status":       status,
+		}
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	recurrenceRule, err := parseActivityRecurrence(c, startDatetime)
+	if err != nil {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Actividad"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = "La repetición no es válida: revisa el intervalo, los días y el final de la repetición"
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	// The stock of a series would be consumed when its first occurrence ends, so only
+	// single activities reserve materials
+	if recurrenceRule != nil && len(reservations) > 0 {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Actividad"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = "Las actividades periódicas no pueden reservar materiales"
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
 
+	// Only administrators can schedule activities outside of the working hours of the center
+	outsideWorkingHours := c.PostForm("fuera_horario") == "1" && auth.UserHasAccess(c, "ADMIN")
+	if !outsideWorkingHours {
+		if problem := h.checkWorkingHours(centro, startDatetime, endDatetime, recurrenceRule); problem != "" {
+			data := h.getCommonData(c)
+			data["PageTitle"] = "Figaró - Crear Actividad"
+			data["Centro"] = centro
+			data["Action"] = "crear"
+			data["ErrorMessage"] = problem
+			data["FormData"] = gin.H{
+				"titulo":       title,
+				"descripcion":  description,
+				"fecha_inicio": startDate,
+				"hora_inicio":  startTime,
+				"fecha_fin":    endDate,
+				"hora_fin":     endTime,
+				"global":       isGlobal,
+				"meeting_url":  meetingURL,
+				"web_url":      webURL,
+				"status":       status,
+			}
+			h.setActivityFormData(c, data, centro)
+			h.renderTemplate(c, "actividad_form.html", data)
+			return
+		}
+	}
+
 	var centerID *int
 	if !isGlobal {
 		id, err := h.getCenterID(centro)
@@ -326,9 +509,14 @@ func (h *Handlers) handleActivityCreate(c *gin.Context, centro string) {
 		centerID = &id
 	}
 
-	// Insert into database
-	query := `INSERT INTO activities (center_id, title, description, start_datetime, end_datetime, is_global, meeting_url, web_url, updated_at) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`
+	// The selections are checked before the activity and everything attached to it are saved together
+	userID := auth.GetCurrentUser(c).ID
+	classroomIDs, userIDs := h.parseActivityParticipants(c, centro)
+	var shares []int
+	if centerID != nil {
+		// Global activities are already seen by every center
+		shares = h.parseActivityShares(c, centro)
+	}
 
 	var meetingURLPtr, webURLPtr *string
 	if meetingURL != "" {
@@ -338,17 +526,93 @@ func (h *Handlers) handleActivityCreate(c *gin.Context, centro string) {
 		webURLPtr = &webURL
 	}
 
-	_, err = database.DB.Exec(query, centerID, title, description, startDatetime, endDatetime, isGlobal, meetingURLPtr, webURLPtr)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=Error al crear la actividad")
+		return
+	}
+	defer tx.Rollback()
+
+	// Insert into database
+	query := `INSERT INTO activities (center_id, title, description, start_datetime, end_datetime, is_global, meeting_url, web_url, status, recurrence_rule, outside_working_hours, updated_at) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`
+
+	result, err := tx.Exec(query, centerID, title, description, startDatetime, endDatetime, isGlobal, meetingURLPtr, webURLPtr, status, recurrenceRule, outsideWorkingHours)
 	if err != nil {
+		tx.Rollback()
 		data := h.getCommonData(c)
 		data["PageTitle"] = "Figaró - Crear Actividad"
 		data["Centro"] = centro
 		data["Action"] = "crear"
 		data["ErrorMessage"] = "Error al crear la actividad: " + err.Error()
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
 
+	id, _ := result.LastInsertId()
+	newID := int(id)
+	if err := recordActivityStatus(tx, newID, "", status, &userID); err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=Error al crear la actividad")
+		return
+	}
+
+	if len(customLinks) > 0 {
+		if err := setActivityCustomLinks(tx, newID, customLinks); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=No se pudo crear la actividad: error al guardar los enlaces personalizados")
+			return
+		}
+	}
+
+	if err := setActivityParticipants(tx, newID, centro, classroomIDs, userIDs); err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=No se pudo crear la actividad: error al guardar los participantes")
+		return
+	}
+
+	if err := setActivityReminders(tx, newID, parseActivityReminders(c)); err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=No se pudo crear la actividad: error al guardar los recordatorios")
+		return
+	}
+
+	// Share the activity with the selected centers
+	if len(shares) > 0 {
+		if err := setActivityShares(tx, newID, *centerID, shares); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=No se pudo crear la actividad: error al compartirla con los centros seleccionados")
+			return
+		}
+	}
+
+	// Reserve the requested materials for the new activity
+	if len(reservations) > 0 {
+		if err := setActivityReservations(tx, newID, centro, reservations); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=No se pudo crear la actividad: error al reservar los materiales")
+			return
+		}
+	}
+
+	// The files go last, and are removed again if the activity is not saved
+	if _, err := h.writeActivityAttachments(tx, newID, attachments, userID); err != nil {
+		logger.Error("Failed to save the attachments of activity %d: %v", newID, err)
+		h.removeActivityAttachmentFiles(newID)
+		c.Redirect(http.StatusFound, "/actividades?error=No se pudo crear la actividad: error al guardar los archivos adjuntos")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.removeActivityAttachmentFiles(newID)
+		c.Redirect(http.StatusFound, "/actividades?error=Error al crear la actividad")
+		return
+	}
+
+	if err := h.updateActivityStatuses(); err != nil {
+		logger.Error("Failed to update activity statuses: %v", err)
+	}
+	if len(reservations) > 0 {
+		if err := h.settleActivityReservations(); err != nil {
+			logger.Error("Failed to settle material reservations: %v", err)
+		}
+	}
+
 	c.Redirect(http.StatusFound, "/actividades?success=Actividad creada correctamente")
 }
 
@@ -378,8 +642,8 @@ func (h *Handlers) ActividadesEditar(c *gin.Context) {
 		return
 	}
 
-	// Get activity data
-	activity, err := h.getActivity(activityID, centro)
+	// Get activity data, or the occurrence of a recurring activity being edited
+	activity, err := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
 	if err != nil {
 		c.Redirect(http.StatusFound, "/actividades?error=Actividad no encontrada")
 		return
@@ -392,11 +656,25 @@ func (h *Handlers) ActividadesEditar(c *gin.Context) {
 	data["Action"] = "editar"
 	data["Activity"] = activity
 
+	h.setActivityFormData(c, data, centro)
 	h.renderTemplate(c, "actividad_form.html", data)
 }
 
 // handleActivityUpdate processes activity updates
 func (h *Handlers) handleActivityUpdate(c *gin.Context, centro, activityID string) {
+	if err := h.readActivityForm(c); err != nil {
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Actividad"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Activity"] = activity
+		data["ErrorMessage"] = attachmentErrorMessage(err, h.maxUploadSizeText())
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
 	title := c.PostForm("titulo")
 	description := c.PostForm("descripcion")
 	startDate := c.PostForm("fecha_inicio")
@@ -406,15 +684,18 @@ func (h *Handlers) handleActivityUpdate(c *gin.Context, centro, activityID strin
 	isGlobal := c.PostForm("global") == "1"
 	meetingURL := c.PostForm("meeting_url")
 	webURL := c.PostForm("web_url")
+	// Only cancelled and postponed are chosen by hand, the rest follow the dates of the activity
+	status := c.PostForm("status")
 
 	if title == "" || startDate == "" || startTime == "" || endDate == "" || endTime == "" {
-		activity, _ := h.getActivity(activityID, centro)
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
 		data := h.getCommonData(c)
 		data["PageTitle"] = "Figaró - Editar Actividad"
 		data["Centro"] = centro
 		data["Action"] = "editar"
 		data["Activity"] = activity
 		data["ErrorMessage"] = "Título, fecha y hora de inicio y fin son requeridos"
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
@@ -422,38 +703,112 @@ func (h *Handlers) handleActivityUpdate(c *gin.Context, centro, activityID strin
 	// Parse dates
 	startDatetime, err := parseDateTime(startDate, startTime)
 	if err != nil {
-		activity, _ := h.getActivity(activityID, centro)
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
 		data := h.getCommonData(c)
 		data["PageTitle"] = "Figaró - Editar Actividad"
 		data["Centro"] = centro
 		data["Action"] = "editar"
 		data["Activity"] = activity
 		data["ErrorMessage"] = "Fecha/hora de inicio inválida"
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
 
 	endDatetime, err := parseDateTime(endDate, endTime)
 	if err != nil {
-		activity, _ := h.getActivity(activityID, centro)
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
 		data := h.getCommonData(c)
 		data["PageTitle"] = "Figaró - Editar Actividad"
 		data["Centro"] = centro
 		data["Action"] = "editar"
 		data["Activity"] = activity
 		data["ErrorMessage"] = "Fecha/hora de fin inválida"
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
 
 	if endDatetime.Before(startDatetime) {
-		activity, _ := h.getActivity(activityID, centro)
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
 		data := h.getCommonData(c)
 		data["PageTitle"] = "Figaró - Editar Actividad"
 		data["Centro"] = centro
 		data["Action"] = "editar"
 		data["Activity"] = activity
 		data["ErrorMessage"] = "La fecha de fin debe ser posterior a la fecha de inicio"
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	reservations, err := parseActivityReservations(c)
+	if err != nil {
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Actividad"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Activity"] = activity
+		data["ErrorMessage"] = "Las cantidades de materiales reservados deben ser números mayores que cero"
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	customLinks, err := parseActivityCustomLinks(c)
+	if err != nil {
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Actividad"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Activity"] = activity
+		data["ErrorMessage"] = "Cada enlace personalizado necesita una etiqueta y una dirección que empiece por http:// o https://"
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	attachments, err := h.parseActivityAttachments(c)
+	if err != nil {
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Actividad"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Activity"] = activity
+		data["ErrorMessage"] = attachmentErrorMessage(err, h.maxUploadSizeText())
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	recurrenceRule, err := parseActivityRecurrence(c, startDatetime)
+	if err != nil {
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Actividad"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Activity"] = activity
+		data["ErrorMessage"] = "La repetición no es válida: revisa el intervalo, los días y el final de la repetición"
+		h.setActivityFormData(c, data, centro)
+		h.renderTemplate(c, "actividad_form.html", data)
+		return
+	}
+
+	// The stock of a series would be consumed when its first occurrence ends, so only
+	// single activities reserve materials
+	if recurrenceRule != nil && len(reservations) > 0 {
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Actividad"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Activity"] = activity
+		data["ErrorMessage"] = "Las actividades periódicas no pueden reservar materiales"
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
@@ -476,21 +831,143 @@ func (h *Handlers) handleActivityUpdate(c *gin.Context, centro, activityID strin
 		webURLPtr = &webURL
 	}
 
+	series, err := h.getActivity(activityID, centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=Actividad no encontrada o sin permisos")
+		return
+	}
+	if series.RecurrenceParentID != nil {
+		recurrenceRule = nil // An edited occurrence of a series does not repeat on its own
+	}
+	if !isManualActivityStatus(status) {
+		status = series.Status
+		if isManualActivityStatus(status) {
+			status = "pending"
+		}
+	}
+
+	// A recurring activity is edited from one of its occurrences: the changes apply to
+	// that occurrence, to it and the following ones, or to the whole series
+	occurrence := series.StartDatetime
+	scope := "all"
+	if fecha := c.Query("fecha"); fecha != "" && series.RecurrenceRule != nil {
+		occurrence, err = parseOccurrenceDate(series, fecha)
+		if err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=La repetición de la actividad no existe")
+			return
+		}
+		scope = c.DefaultPostForm("alcance", "this")
+		if scope == "following" && occurrence.Equal(series.StartDatetime) {
+			scope = "all"
+		}
+	}
+
+	// Only administrators can allow activities outside of the working hours of the center;
+	// other users keep what an administrator decided
+	outsideWorkingHours := series.OutsideWorkingHours
+	if auth.UserHasAccess(c, "ADMIN") {
+		outsideWorkingHours = c.PostForm("fuera_horario") == "1"
+	}
+	if !outsideWorkingHours {
+		checkedRule := recurrenceRule
+		if scope == "this" {
+			checkedRule = nil
+		}
+		if problem := h.checkWorkingHours(centro, startDatetime, endDatetime, checkedRule); problem != "" {
+			activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
+			data := h.getCommonData(c)
+			data["PageTitle"] = "Figaró - Editar Actividad"
+			data["Centro"] = centro
+			data["Action"] = "editar"
+			data["Activity"] = activity
+			data["ErrorMessage"] = problem
+			h.setActivityFormData(c, data, centro)
+			h.renderTemplate(c, "actividad_form.html", data)
+			return
+		}
+	}
+
+	changes := models.Activity{
+		CenterID:            centerID,
+		Title:               title,
+		Description:         description,
+		StartDatetime:       startDatetime,
+		EndDatetime:         endDatetime,
+		IsGlobal:            isGlobal,
+		Status:              status,
+		MeetingURL:          meetingURLPtr,
+		WebURL:              webURLPtr,
+		RecurrenceRule:      recurrenceRule,
+		OutsideWorkingHours: outsideWorkingHours,
+	}
+	switch scope {
+	case "this":
+		if err := h.saveActivityOccurrence(series, occurrence, changes); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=Error al actualizar la actividad")
+			return
+		}
+		if err := h.updateActivityStatuses(); err != nil {
+			logger.Error("Failed to update activity statuses: %v", err)
+		}
+		c.Redirect(http.StatusFound, "/actividades?success=Actividad actualizada correctamente")
+		return
+	case "following":
+		newID, err := h.splitActivitySeries(series, occurrence, changes)
+		if err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=Error al actualizar la actividad")
+			return
+		}
+		if err := h.updateActivityShares(c, newID, centro, centerID); err != nil {
+			logger.Error("Failed to share activity %d: %v", newID, err)
+		}
+		if err := saveActivityCustomLinks(newID, customLinks); err != nil {
+			logger.Error("Failed to save the custom links of activity %d: %v", newID, err)
+		}
+		classroomIDs, userIDs := h.parseActivityParticipants(c, centro)
+		if err := saveActivityParticipants(newID, centro, classroomIDs, userIDs); err != nil {
+			logger.Error("Failed to save the participants of activity %d: %v", newID, err)
+		}
+		if err := h.copyActivityAttachments(series.ID, newID, removedAttachmentIDs(c)); err != nil {
+			logger.Error("Failed to copy the attachments of activity %d: %v", series.ID, err)
+		}
+		if err := h.saveActivityAttachments(newID, attachments, auth.GetCurrentUser(c).ID); err != nil {
+			logger.Error("Failed to save the attachments of activity %d: %v", newID, err)
+		}
+		if err := saveActivityReminders(newID, parseActivityReminders(c)); err != nil {
+			logger.Error("Failed to save the reminders of activity %d: %v", newID, err)
+		}
+		if err := h.updateActivityStatuses(); err != nil {
+			logger.Error("Failed to update activity statuses: %v", err)
+		}
+		c.Redirect(http.StatusFound, "/actividades?success=Actividades actualizadas correctamente")
+		return
+	}
+
+	// The whole series moves as much as the edited occurrence did
+	var shift time.Duration
+	if series.RecurrenceRule != nil && recurrenceRule != nil {
+		shift = startDatetime.Sub(occurrence)
+		duration := endDatetime.Sub(startDatetime)
+		startDatetime = series.StartDatetime.Add(shift)
+		endDatetime = startDatetime.Add(duration)
+	}
+
 	// Update in database - allow editing global activities or activities from the current center
 	query := `UPDATE activities SET center_id = ?, title = ?, description = ?, start_datetime = ?, end_datetime = ?, 
-			  is_global = ?, meeting_url = ?, web_url = ?, updated_at = datetime('now')
+			  is_global = ?, meeting_url = ?, web_url = ?, status = ?, recurrence_rule = ?, outside_working_hours = ?, updated_at = datetime('now')
 			  WHERE id = ? AND (is_global = 1 OR center_id = (SELECT id FROM centers WHERE name = ?))`
 
 	result, err := database.DB.Exec(query, centerID, title, description, startDatetime, endDatetime,
-		isGlobal, meetingURLPtr, webURLPtr, activityID, centro)
+		isGlobal, meetingURLPtr, webURLPtr, status, recurrenceRule, outsideWorkingHours, activityID, centro)
 	if err != nil {
-		activity, _ := h.getActivity(activityID, centro)
+		activity, _ := h.getActivityOccurrence(activityID, centro, c.Query("fecha"))
 		data := h.getCommonData(c)
 		data["PageTitle"] = "Figaró - Editar Actividad"
 		data["Centro"] = centro
 		data["Action"] = "editar"
 		data["Activity"] = activity
 		data["ErrorMessage"] = "Error al actualizar la actividad: " + err.Error()
+		h.setActivityFormData(c, data, centro)
 		h.renderTemplate(c, "actividad_form.html", data)
 		return
 	}
@@ -501,6 +978,54 @@ func (h *Handlers) handleActivityUpdate(c *gin.Context, centro, activityID strin
 		return
 	}
 
+	h.saveActivityStatusChange(series.ID, series.Status, status, auth.GetCurrentUser(c).ID)
+
+	if series.RecurrenceRule != nil {
+		if err := updateActivityExclusions(series.ID, recurrenceRule != nil, shift); err != nil {
+			logger.Error("Failed to update the exceptions of recurring activity %d: %v", series.ID, err)
+		}
+	}
+
+	// Edited occurrences are shared along with their series and show its custom links, participants,
+	// attachments and reminders
+	if series.RecurrenceParentID == nil {
+		if err := h.updateActivityShares(c, series.ID, centro, centerID); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=Actividad actualizada, pero no se pudo compartir con los centros seleccionados")
+			return
+		}
+		if err := saveActivityCustomLinks(series.ID, customLinks); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=Actividad actualizada, pero no se pudieron guardar los enlaces personalizados")
+			return
+		}
+		classroomIDs, userIDs := h.parseActivityParticipants(c, centro)
+		if err := saveActivityParticipants(series.ID, centro, classroomIDs, userIDs); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=Actividad actualizada, pero no se pudieron guardar los participantes")
+			return
+		}
+		if err := h.deleteActivityAttachments(series.ID, removedAttachmentIDs(c)); err != nil {
+			logger.Error("Failed to remove the attachments of activity %d: %v", series.ID, err)
+		}
+		if err := h.saveActivityAttachments(series.ID, attachments, auth.GetCurrentUser(c).ID); err != nil {
+			logger.Error("Failed to save the attachments of activity %d: %v", series.ID, err)
+			c.Redirect(http.StatusFound, "/actividades?error=Actividad actualizada, pero no se pudieron guardar los archivos adjuntos")
+			return
+		}
+		if err := saveActivityReminders(series.ID, parseActivityReminders(c)); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=Actividad actualizada, pero no se pudieron guardar los recordatorios")
+			return
+		}
+	}
+
+	// Replace the material reservations and settle them if the activity is already over
+	id, _ := strconv.Atoi(activityID)
+	if err := h.saveActivityReservations(id, centro, reservations); err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=Actividad actualizada, pero no se pudieron reservar los materiales")
+		return
+	}
+	if err := h.settleActivityReservations(); err != nil {
+		logger.Error("Failed to settle material reservations: %v", err)
+	}
+
 	c.Redirect(http.StatusFound, "/actividades?success=Actividad actualizada correctamente")
 }
 
@@ -525,6 +1050,47 @@ func (h *Handlers) ActividadesEliminar(c *gin.Context) {
 		return
 	}
 
+	activity, err := h.getActivity(activityID, centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=Actividad no encontrada o sin permisos")
+		return
+	}
+
+	// Deleting an edited occurrence of a series removes that occurrence from it
+	if activity.RecurrenceParentID != nil && activity.RecurrenceDate != nil {
+		if err := removeActivityOccurrence(*activity.RecurrenceParentID, *activity.RecurrenceDate, activity.ID); err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=Error al eliminar la actividad")
+			return
+		}
+		c.Redirect(http.StatusFound, "/actividades?success=Actividad eliminada correctamente")
+		return
+	}
+
+	// An occurrence of a series is removed alone or with the following ones;
+	// removing it from the first occurrence on deletes the whole series
+	if fecha := c.Query("fecha"); fecha != "" && activity.RecurrenceRule != nil {
+		occurrence, err := parseOccurrenceDate(activity, fecha)
+		if err != nil {
+			c.Redirect(http.StatusFound, "/actividades?error=La repetición de la actividad no existe")
+			return
+		}
+
+		scope := c.DefaultPostForm("alcance", "this")
+		if scope == "this" || (scope == "following" && occurrence.After(activity.StartDatetime)) {
+			if scope == "this" {
+				err = removeActivityOccurrence(activity.ID, occurrence, 0)
+			} else {
+				err = h.truncateActivitySeries(activity, occurrence)
+			}
+			if err != nil {
+				c.Redirect(http.StatusFound, "/actividades?error=Error al eliminar la actividad")
+				return
+			}
+			c.Redirect(http.StatusFound, "/actividades?success=Actividad eliminada correctamente")
+			return
+		}
+	}
+
 	// Delete activity - allow deleting global activities or activities from the current center
 	query := `DELETE FROM activities WHERE id = ? AND (is_global = 1 OR center_id = (SELECT id FROM centers WHERE name = ?))`
 	result, err := database.DB.Exec(query, activityID, centro)
@@ -539,38 +1105,35 @@ func (h *Handlers) ActividadesEliminar(c *gin.Context) {
 		return
 	}
 
+	// The edited occurrences go with their series
+	if _, err := database.DB.Exec(`DELETE FROM activities WHERE recurrence_parent_id = ?`, activity.ID); err != nil {
+		logger.Error("Failed to delete the occurrences of activity %d: %v", activity.ID, err)
+	}
+	h.removeActivityAttachmentFiles(activity.ID)
+
 	c.Redirect(http.StatusFound, "/actividades?success=Actividad eliminada correctamente")
 }
 
 // getActivity retrieves a single activity by ID
 func (h *Handlers) getActivity(activityID, centro string) (models.Activity, error) {
-	var activity models.Activity
-	query := `SELECT id, center_id, title, description, start_datetime, end_datetime, is_global, meeting_url, web_url, created_at, updated_at 
+	query := `SELECT ` + activityColumns + ` 
 			  FROM activities WHERE id = ? AND (is_global = 1 OR center_id = (SELECT id FROM centers WHERE name = ?))`
 
-	var centerID sql.NullInt64
-	var meetingURL sql.NullString
-	var webURL sql.NullString
-
-	err := database.DB.QueryRow(query, activityID, centro).Scan(
-		&activity.ID, &centerID, &activity.Title, &activity.Description,
-		&activity.StartDatetime, &activity.EndDatetime, &activity.IsGlobal,
-		&meetingURL, &webURL, &activity.CreatedAt, &activity.UpdatedAt)
-
-	if centerID.Valid {
-		centerIDInt := int(centerID.Int64)
-		activity.CenterID = &centerIDInt
-	}
-
-	if meetingURL.Valid {
-		activity.MeetingURL = &meetingURL.String
-	}
-
-	if webURL.Valid {
-		activity.WebURL = &webURL.String
-	}
+	return scanActivity(database.DB.QueryRow(query, activityID, centro))
+}
 
-	return activity, err
+// setActivityFormData adds the options of the activity form: the materials to reserve,
+// the working hours of the center, the centers to share the activity with, its custom links,
+// its participants, its attachments, its reminders and the history of its status
+func (h *Handlers) setActivityFormData(c *gin.Context, data gin.H, centro string) {
+	h.setActivityFormMaterials(c, data, centro)
+	h.setActivityFormWorkingHours(data, centro)
+	h.setActivityFormShares(c, data, centro)
+	h.setActivityFormCustomLinks(c, data)
+	h.setActivityFormParticipants(c, data, centro)
+	h.setActivityFormAttachments(data)
+	h.setActivityFormReminders(c, data)
+	h.setActivityFormStatusHistory(data)
 }
 
 // parseDateTime parses date and time strings into a time.Time
@@ -735,7 +1298,7 @@ func (h *Handlers) getActivitiesWithCustomLinks(centro string, searchQuery strin
 
 // getCustomLinksForActivity retrieves custom links for a specific activity
 func (h *Handlers) getCustomLinksForActivity(activityID int) ([]models.ActivityCustomLink, error) {
-	query := `SELECT id, activity_id, label, url, created_at FROM activity_custom_links WHERE activity_id = ? ORDER BY created_at ASC`
+	query := `SELECT id, activity_id, label, url, created_at FROM activity_custom_links WHERE activity_id = ? ORDER BY created_at ASC, id ASC`
 	
 	rows, err := database.DB.Query(query, activityID)
 	if err != nil {
@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+// maxActivityFormFiles is how many attachments of the maximum upload size one activity
+// form can carry; the whole body is cut off beyond that
+const maxActivityFormFiles = 10
+
+// activityFormLimit is the largest activity form body read, leaving room for the other fields
+func (h *Handlers) activityFormLimit() int64 {
+	return h.Config.MaxUploadSize*maxActivityFormFiles + 1<<20
+}
+
+// readActivityForm limits the body of the activity form and parses it before any field is
+// read, so an oversized upload is rejected without receiving all of it
+func (h *Handlers) readActivityForm(c *gin.Context) error {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.activityFormLimit())
+	if _, err := c.MultipartForm(); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return err
+	}
+	return nil
+}
+
+// parseActivityAttachments reads the files uploaded with the activity form. Each file can
+// take up to the maximum upload size of the configuration.
+func (h *Handlers) parseActivityAttachments(c *gin.Context) ([]*multipart.FileHeader, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		if errors.Is(err, http.ErrNotMultipart) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var files []*multipart.FileHeader
+	for _, file := range form.File["adjuntos[]"] {
+		if file.Size == 0 && file.Filename == "" {
+			continue
+		}
+		if file.Size > h.Config.MaxUploadSize {
+			return nil, errAttachmentTooLarge
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// removedAttachmentIDs reads the attachments marked for removal in the activity form
+func removedAttachmentIDs(c *gin.Context) []int {
+	var ids []int
+	for _, value := range c.PostFormArray("eliminar_adjuntos[]") {
+		if id, err := strconv.Atoi(value); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// maxUploadSizeText returns the maximum size of an attachment for display
+func (h *Handlers) maxUploadSizeText() string {
+	return models.ActivityAttachment{Size: h.Config.MaxUploadSize}.SizeText()
+}
+
+// activityAttachmentDir returns the directory that holds the attachments of an activity
+func (h *Handlers) activityAttachmentDir(activityID int) string {
+	return filepath.Join(h.Config.UploadDir, "actividades", strconv.Itoa(activityID))
+}
+
+// attachmentStoredName generates the name an attachment is stored with, keeping the
+// extension of the uploaded file
+func attachmentStoredName(fileName string) (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes) + strings.ToLower(filepath.Ext(fileName)), nil
+}
+
+// writeAttachmentFile copies an attachment to the upload directory
+func writeAttachmentFile(dst string, src io.Reader) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// saveActivityAttachments stores the uploaded files and attaches them to an activity
+func (h *Handlers) saveActivityAttachments(activityID int, files []*multipart.FileHeader, userID int) error {
+	if len(files) == 0 {
+		return nil
+	}
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	paths, err := h.writeActivityAttachments(tx, activityID, files, userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		removeAttachmentFiles(paths)
+		return err
+	}
+	return nil
+}
+
+// writeActivityAttachments is saveActivityAttachments inside an existing transaction. It
+// returns the files it wrote, which are left behind if the transaction is rolled back.
+func (h *Handlers) writeActivityAttachments(tx *sql.Tx, activityID int, files []*multipart.FileHeader, userID int) ([]string, error) {
+	var paths []string
+	if len(files) == 0 {
+		return paths, nil
+	}
+	dir := h.activityAttachmentDir(activityID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return paths, err
+	}
+
+	for _, file := range files {
+		storedName, err := attachmentStoredName(file.Filename)
+		if err != nil {
+			return paths, err
+		}
+		src, err := file.Open()
+		if err != nil {
+			return paths, err
+		}
+		path := filepath.Join(dir, storedName)
+		err = writeAttachmentFile(path, src)
+		src.Close()
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
+
+		_, err = tx.Exec(`INSERT INTO activity_attachments (activity_id, file_name, stored_name, content_type, size, uploaded_by) VALUES (?, ?, ?, ?, ?, ?)`,
+			activityID, filepath.Base(file.Filename), storedName, file.Header.Get("Content-Type"), file.Size, userID)
+		if err != nil {
+			return paths, err
+		}
+	}
+	return paths, nil
+}
+
+// removeAttachmentFiles removes the files of attachments that were not saved
+func removeAttachmentFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Error("Failed to remove the unsaved attachment %s: %v", path, err)
+		}
+	}
+}
+
+// deleteActivityAttachments removes attachments of an activity along with their files
+func (h *Handlers) deleteActivityAttachments(activityID int, ids []int) error {
+	for _, id := range ids {
+		var storedName string
+		err := database.DB.QueryRow(`SELECT stored_name FROM activity_attachments WHERE id = ? AND activity_id = ?`,
+			id, activityID).Scan(&storedName)
+		if err != nil {
+			continue
+		}
+		if _, err := database.DB.Exec(`DELETE FROM activity_attachments WHERE id = ?`, id); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(h.activityAttachmentDir(activityID), storedName)); err != nil && !os.IsNotExist(err) {
+			logger.Error("Failed to remove the file of attachment %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// copyActivityAttachments attaches to an activity copies of the attachments of another one,
+// leaving out those in skip. A series split in two keeps its attachments on both parts.
+func (h *Handlers) copyActivityAttachments(fromID, toID int, skip []int) error {
+	attachments, err := getActivityAttachments(fromID)
+	if err != nil {
+		return err
+	}
+	skipped := make(map[int]bool)
+	for _, id := range skip {
+		skipped[id] = true
+	}
+
+	dir := h.activityAttachmentDir(toID)
+	for _, attachment := range attachments {
+		if skipped[attachment.ID] {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		storedName, err := attachmentStoredName(attachment.FileName)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(filepath.Join(h.activityAttachmentDir(fromID), attachment.StoredName))
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, storedName)
+		err = writeAttachmentFile(path, src)
+		src.Close()
+		if err != nil {
+			return err
+		}
+
+		_, err = database.DB.Exec(`INSERT INTO activity_attachments (activity_id, file_name, stored_name, content_type, size, uploaded_by) VALUES (?, ?, ?, ?, ?, ?)`,
+			toID, attachment.FileName, storedName, attachment.ContentType, attachment.Size, attachment.UploadedBy)
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	return nil
+}
+
+// removeActivityAttachmentFiles removes the files of a deleted activity. Its rows go
+// with the activity.
+func (h *Handlers) removeActivityAttachmentFiles(activityID int) {
+	if err := os.RemoveAll(h.activityAttachmentDir(activityID)); err != nil {
+		logger.Error("Failed to remove the attachments of activity %d: %v", activityID, err)
+	}
+}
+
+// getActivityAttachments returns the attachments of an activity, the oldest first
+func getActivityAttachments(activityID int) ([]models.ActivityAttachment, error) {
+	rows, err := database.DB.Query(`SELECT t.id, t.activity_id, t.file_name, t.stored_name, t.content_type, t.size, t.uploaded_by,
+			  COALESCE(NULLIF(u.display_name, ''), u.username, ''), t.created_at
+			  FROM activity_attachments t
+			  LEFT JOIN users u ON t.uploaded_by = u.id
+			  WHERE t.activity_id = ?
+			  ORDER BY t.created_at, t.id`, activityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []models.ActivityAttachment
+	for rows.Next() {
+		var attachment models.ActivityAttachment
+		err := rows.Scan(&attachment.ID, &attachment.ActivityID, &attachment.FileName, &attachment.StoredName,
+			&attachment.ContentType, &attachment.Size, &attachment.UploadedBy, &attachment.UploadedByName, &attachment.CreatedAt)
+		if err != nil {
+			continue
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// setActivityFormAttachments adds to the activity form the attachments of the edited activity
+func (h *Handlers) setActivityFormAttachments(data gin.H) {
+	data["MaxUploadSize"] = h.maxUploadSizeText()
+	activity, ok := data["Activity"].(models.Activity)
+	if !ok {
+		return
+	}
+	attachments, err := getActivityAttachments(activitySeriesID(activity))
+	if err != nil {
+		logger.Error("Failed to get the attachments of activity %d: %v", activity.ID, err)
+		return
+	}
+	data["Attachments"] = attachments
+}
+
+// setActivitiesAttachments loads the attachments of the listed activities
+func (h *Handlers) setActivitiesAttachments(activities []models.Activity) {
+	for i := range activities {
+		seriesID := activitySeriesID(activities[i])
+		attachments, err := getActivityAttachments(seriesID)
+		if err != nil {
+			logger.Error("Failed to get the attachments of activity %d: %v", seriesID, err)
+			continue
+		}
+		activities[i].Attachments = attachments
+	}
+}
+
+// ActividadesAdjunto downloads an attachment of an activity the current center can see
+func (h *Handlers) ActividadesAdjunto(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	var activityID int
+	var fileName, storedName string
+	err = database.DB.QueryRow(`SELECT activity_id, file_name, stored_name FROM activity_attachments
+			  WHERE id = ? AND activity_id IN (SELECT id FROM activities WHERE `+activityVisibleSQL+`)`,
+		c.Param("id"), centro, centro).Scan(&activityID, &fileName, &storedName)
+	if err != nil {
+		c.String(http.StatusNotFound, "Archivo no encontrado")
+		return
+	}
+
+	path := filepath.Join(h.activityAttachmentDir(activityID), storedName)
+	if _, err := os.Stat(path); err != nil {
+		logger.Error("Failed to find the file of an attachment of activity %d: %v", activityID, err)
+		c.String(http.StatusNotFound, "Archivo no encontrado")
+		return
+	}
+	c.FileAttachment(path, fileName)
+}
+
+// attachmentErrorMessage describes for the activity form why the uploaded files were rejected
+func attachmentErrorMessage(err error, maxSize string) string {
+	if errors.Is(err, errAttachmentTooLarge) {
+		return "Cada archivo adjunto puede ocupar como máximo " + maxSize
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return "Los archivos adjuntos ocupan demasiado: sube como máximo " + strconv.Itoa(maxActivityFormFiles) +
+			" archivos de hasta " + maxSize + " cada uno"
+	}
+	return "No se pudieron leer los archivos adjuntos"
+}
@@ -0,0 +1,574 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	// Embedded zone database so center timezones resolve on hosts without tzdata
+	_ "time/tzdata"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/ical"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultCenterTimezone matches the default of the centers.timezone column
+const defaultCenterTimezone = "Europe/Madrid"
+
+// calendarActivity is an activity of a calendar feed or CalDAV collection with the timezone
+// of the center that owns it and the identifiers given by calendar apps, if any
+type calendarActivity struct {
+	models.Activity
+	Timezone   string
+	ICalUID    sql.NullString
+	CalDAVName sql.NullString
+	ExDates    []time.Time        // Occurrences removed from a series
+	Overrides  []calendarActivity // Edited occurrences of a series
+}
+
+// uid returns the iCalendar UID of the activity
+func (a calendarActivity) uid() string {
+	if a.ICalUID.Valid && a.ICalUID.String != "" {
+		return a.ICalUID.String
+	}
+	return fmt.Sprintf("actividad-%d@figaro", a.ID)
+}
+
+// resourceName returns the file name of the activity inside a CalDAV collection
+func (a calendarActivity) resourceName() string {
+	if a.CalDAVName.Valid && a.CalDAVName.String != "" {
+		return a.CalDAVName.String
+	}
+	return fmt.Sprintf("actividad-%d.ics", a.ID)
+}
+
+// CalendarioSuscripciones shows the calendar feed URLs of the current user
+func (h *Handlers) CalendarioSuscripciones(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	token, err := h.getCalendarFeedToken(user.ID)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/perfil?error=Error al obtener el token de calendario")
+		return
+	}
+
+	centers, err := h.getAllCenters()
+	if err != nil {
+		centers = []models.Center{}
+	}
+	classrooms := map[int][]models.Classroom{}
+	for _, center := range centers {
+		if list, err := h.getClassroomsByCenter(fmt.Sprintf("%d", center.ID)); err == nil {
+			classrooms[center.ID] = list
+		}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Calendarios"
+	data["Token"] = token
+	data["Centers"] = centers
+	data["Classrooms"] = classrooms
+	data["FeedBaseURL"] = fmt.Sprintf("%s/actividades/ics/%s", requestBaseURL(c), token.Token)
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "calendario_suscripciones.html", data)
+}
+
+// CalendarioRegenerarToken replaces the calendar feed token, invalidating the URLs in use
+func (h *Handlers) CalendarioRegenerarToken(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	if _, err := h.regenerateCalendarFeedToken(user.ID); err != nil {
+		c.Redirect(http.StatusFound, "/perfil/calendario?error=Error al regenerar el token")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/perfil/calendario?success=Token regenerado. Vuelve a suscribirte con las nuevas direcciones")
+}
+
+// ActividadesFeedCentro serves the activities of a center as an ICS feed: its own activities,
+// the global ones and those shared with it
+func (h *Handlers) ActividadesFeedCentro(c *gin.Context) {
+	if !h.authorizeCalendarFeed(c) {
+		return
+	}
+
+	center, err := h.getCenterByID(strings.TrimSuffix(c.Param("id"), ".ics"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	activities, err := h.getCalendarActivities(center.ID, center.Timezone, feedHistoryStart())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	h.writeActivityFeed(c, "Figaró - "+center.Name, "Actividades de "+center.Name, center.Timezone, activities)
+}
+
+// ActividadesFeedAula serves as an ICS feed the activities a classroom takes part in
+func (h *Handlers) ActividadesFeedAula(c *gin.Context) {
+	if !h.authorizeCalendarFeed(c) {
+		return
+	}
+
+	var classroomName string
+	var center models.Center
+	err := database.DB.QueryRow(`SELECT cl.name, c.id, c.name, c.timezone
+			  FROM classrooms cl JOIN centers c ON cl.center_id = c.id WHERE cl.id = ?`,
+		strings.TrimSuffix(c.Param("id"), ".ics")).Scan(&classroomName, &center.ID, &center.Name, &center.Timezone)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	activities, err := h.getFilteredCalendarActivities(`COALESCE(a.recurrence_parent_id, a.id) IN
+			  (SELECT activity_id FROM activity_classrooms WHERE classroom_id = ?)`,
+		[]interface{}{strings.TrimSuffix(c.Param("id"), ".ics")}, center.Timezone, feedHistoryStart())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	h.writeActivityFeed(c, fmt.Sprintf("Figaró - %s (%s)", classroomName, center.Name),
+		fmt.Sprintf("Actividades del aula %s de %s", classroomName, center.Name), center.Timezone, activities)
+}
+
+// ActividadesFeedGlobal serves only the global activities as an ICS feed
+func (h *Handlers) ActividadesFeedGlobal(c *gin.Context) {
+	if !h.authorizeCalendarFeed(c) {
+		return
+	}
+
+	timezone := h.getDefaultTimezone()
+	activities, err := h.getCalendarActivities(0, timezone, feedHistoryStart())
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	h.writeActivityFeed(c, "Figaró - Actividades globales", "Actividades globales de todos los centros", timezone, activities)
+}
+
+// authorizeCalendarFeed authenticates a feed request by the token in its URL. It writes the
+// error response itself and reports whether the request may continue.
+func (h *Handlers) authorizeCalendarFeed(c *gin.Context) bool {
+	var userID int
+	err := database.DB.QueryRow(`SELECT user_id FROM calendar_feed_tokens WHERE token = ?`, c.Param("token")).Scan(&userID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return false
+	}
+
+	if !userHasPermission(userID, "actividades.read") {
+		c.AbortWithStatus(http.StatusForbidden)
+		return false
+	}
+
+	database.DB.Exec(`UPDATE calendar_feed_tokens SET last_used = CURRENT_TIMESTAMP WHERE user_id = ?`, userID)
+	return true
+}
+
+// userHasPermission checks a permission of a user outside a browser session, administrators included
+func userHasPermission(userID int, permission string) bool {
+	permissions, err := auth.GetUserPermissions(userID)
+	if err != nil {
+		return false
+	}
+	for _, p := range permissions {
+		if p == "ADMIN" || p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// feedHistoryStart is the oldest end date of the activities included in the ICS feeds
+func feedHistoryStart() time.Time {
+	return time.Now().AddDate(-1, 0, 0)
+}
+
+// calendarActivitySelect selects the columns scanned by scanCalendarActivity; its only
+// parameter is the timezone for global activities
+const calendarActivitySelect = `SELECT a.id, a.center_id, a.title, COALESCE(a.description, ''), a.start_datetime, a.end_datetime,
+			  a.is_global, a.status, a.meeting_url, a.web_url, a.created_at, a.updated_at,
+			  CASE WHEN a.is_global = 1 THEN ? ELSE COALESCE(c.timezone, ?) END, a.ical_uid, a.caldav_name,
+			  a.recurrence_rule, a.recurrence_parent_id, a.recurrence_date, a.outside_working_hours
+			  FROM activities a
+			  LEFT JOIN centers c ON a.center_id = c.id`
+
+// getCalendarActivities retrieves the activities of a center calendar, or only the global ones for
+// center 0, that end after since (all of them for a zero time). Global activities take the timezone
+// of the calendar. Recurring activities are always included, with their edited occurrences.
+func (h *Handlers) getCalendarActivities(centerID int, timezone string, since time.Time) ([]calendarActivity, error) {
+	if centerID == 0 {
+		return h.getFilteredCalendarActivities("a.is_global = 1", nil, timezone, since)
+	}
+	return h.getFilteredCalendarActivities(`(a.is_global = 1 OR a.center_id = ?
+			  OR COALESCE(a.recurrence_parent_id, a.id) IN (SELECT activity_id FROM activity_shares WHERE center_id = ?))`,
+		[]interface{}{centerID, centerID}, timezone, since)
+}
+
+// getFilteredCalendarActivities returns the activities matching a condition on the activities
+// table (joined as a) for a calendar, as getCalendarActivities does
+func (h *Handlers) getFilteredCalendarActivities(condition string, conditionArgs []interface{}, timezone string, since time.Time) ([]calendarActivity, error) {
+	query := calendarActivitySelect + " WHERE " + condition
+	args := append([]interface{}{timezone, timezone}, conditionArgs...)
+	if !since.IsZero() {
+		query += " AND (a.end_datetime >= ? OR a.recurrence_rule IS NOT NULL OR a.recurrence_parent_id IS NOT NULL)"
+		args = append(args, since.UTC().Format("2006-01-02 15:04:05"))
+	}
+	query += " ORDER BY a.start_datetime ASC"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activities []calendarActivity
+	for rows.Next() {
+		activity, err := scanCalendarActivity(rows)
+		if err != nil {
+			continue
+		}
+		activities = append(activities, activity)
+	}
+
+	activities, err = groupCalendarRecurrences(activities)
+	if err != nil {
+		return nil, err
+	}
+	h.setCalendarCustomLinks(activities)
+	return activities, nil
+}
+
+// groupCalendarRecurrences moves the edited occurrences of the series in the list under
+// their series and loads the occurrences removed from each series
+func groupCalendarRecurrences(activities []calendarActivity) ([]calendarActivity, error) {
+	index := make(map[int]int)
+	for i, activity := range activities {
+		if activity.RecurrenceRule != nil {
+			index[activity.ID] = i
+		}
+	}
+
+	grouped := make([]calendarActivity, 0, len(activities))
+	var overrides []calendarActivity
+	for _, activity := range activities {
+		if activity.RecurrenceParentID != nil {
+			if _, ok := index[*activity.RecurrenceParentID]; ok {
+				overrides = append(overrides, activity)
+				continue
+			}
+		}
+		grouped = append(grouped, activity)
+	}
+
+	for i, activity := range grouped {
+		if activity.RecurrenceRule == nil {
+			continue
+		}
+		index[activity.ID] = i
+		exdates, err := getActivityExceptions(activity.ID)
+		if err != nil {
+			return nil, err
+		}
+		grouped[i].ExDates = exdates
+	}
+	for _, override := range overrides {
+		i := index[*override.RecurrenceParentID]
+		grouped[i].Overrides = append(grouped[i].Overrides, override)
+	}
+
+	return grouped, nil
+}
+
+// setCalendarCustomLinks loads the custom links of calendar activities and of their edited
+// occurrences, which show the links of their series
+func (h *Handlers) setCalendarCustomLinks(activities []calendarActivity) {
+	for i := range activities {
+		links, err := h.getCustomLinksForActivity(activitySeriesID(activities[i].Activity))
+		if err != nil {
+			logger.Error("Failed to get the custom links of activity %d: %v", activities[i].ID, err)
+			continue
+		}
+		activities[i].CustomLinks = links
+		for j := range activities[i].Overrides {
+			activities[i].Overrides[j].CustomLinks = links
+		}
+	}
+}
+
+// scanCalendarActivity scans a row selected with calendarActivitySelect
+func scanCalendarActivity(rows interface{ Scan(...interface{}) error }) (calendarActivity, error) {
+	var activity calendarActivity
+	var centerID sql.NullInt64
+	var meetingURL sql.NullString
+	var webURL sql.NullString
+
+	err := rows.Scan(&activity.ID, &centerID, &activity.Title, &activity.Description,
+		&activity.StartDatetime, &activity.EndDatetime, &activity.IsGlobal, &activity.Status,
+		&meetingURL, &webURL, &activity.CreatedAt, &activity.UpdatedAt, &activity.Timezone,
+		&activity.ICalUID, &activity.CalDAVName,
+		&activity.RecurrenceRule, &activity.RecurrenceParentID, &activity.RecurrenceDate, &activity.OutsideWorkingHours)
+	if err != nil {
+		return activity, err
+	}
+
+	if centerID.Valid {
+		centerIDInt := int(centerID.Int64)
+		activity.CenterID = &centerIDInt
+	}
+
+	if meetingURL.Valid && meetingURL.String != "" {
+		activity.MeetingURL = &meetingURL.String
+	}
+
+	if webURL.Valid && webURL.String != "" {
+		activity.WebURL = &webURL.String
+	}
+
+	return activity, nil
+}
+
+// writeActivityFeed renders activities as an iCalendar response
+func (h *Handlers) writeActivityFeed(c *gin.Context, name, description, timezone string, activities []calendarActivity) {
+	calendar := ical.Calendar{
+		Name:            name,
+		Description:     description,
+		Timezone:        timezone,
+		Method:          "PUBLISH",
+		RefreshInterval: "PT1H",
+	}
+	for _, activity := range activities {
+		calendar.Events = append(calendar.Events, activityEvents(activity)...)
+	}
+
+	c.Header("Content-Disposition", "inline; filename=\"actividades.ics\"")
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", calendar.Bytes())
+}
+
+// activityEvents converts an activity to its VEVENTs: the activity itself and, for a series,
+// its edited occurrences, which share the UID of the series
+func activityEvents(activity calendarActivity) []ical.Event {
+	events := []ical.Event{activityEvent(activity)}
+	location := loadTimezone(activity.Timezone)
+	for _, override := range activity.Overrides {
+		event := activityEvent(override)
+		event.UID = events[0].UID
+		event.TimeZone = location
+		if override.RecurrenceDate != nil {
+			event.RecurrenceID = inLocation(*override.RecurrenceDate, location)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// activityEvent converts an activity to a VEVENT. Activity times are stored as the wall clock
+// time of their center, so they are placed in the center timezone before writing them in UTC.
+// A series is written in the center timezone instead, so its occurrences keep their time
+// across daylight saving changes.
+func activityEvent(activity calendarActivity) ical.Event {
+	location := loadTimezone(activity.Timezone)
+
+	event := ical.Event{
+		UID:          activity.uid(),
+		Summary:      activity.Title,
+		Description:  activity.Description,
+		Start:        inLocation(activity.StartDatetime, location),
+		End:          inLocation(activity.EndDatetime, location),
+		Created:      activity.CreatedAt,
+		LastModified: activity.UpdatedAt,
+		Status:       ical.StatusConfirmed,
+	}
+	switch activity.Status {
+	case "cancelled":
+		event.Status = ical.StatusCancelled
+	case "postponed":
+		event.Status = ical.StatusTentative // Its date is not final
+	}
+	if activity.IsGlobal {
+		event.Categories = []string{"Global"}
+	}
+
+	if activity.RecurrenceRule != nil {
+		if rule, err := ical.ParseRule(*activity.RecurrenceRule); err == nil {
+			// UNTIL must be in UTC when the start has a timezone
+			if !rule.Until.IsZero() && !rule.UntilUTC {
+				rule.Until = inLocation(rule.Until, location).UTC()
+				rule.UntilUTC = true
+			}
+			event.RRule = rule.String()
+			event.TimeZone = location
+			for _, exdate := range activity.ExDates {
+				event.ExDates = append(event.ExDates, inLocation(exdate, location))
+			}
+		}
+	}
+
+	if activity.MeetingURL != nil {
+		event.Location = *activity.MeetingURL
+		event.Conference = *activity.MeetingURL
+	}
+	if activity.WebURL != nil {
+		event.URL = *activity.WebURL
+	}
+
+	// Calendar apps show the description everywhere, so the links are repeated there
+	if links := activityLinks(event.Conference, event.URL, activity.CustomLinks); links != "" {
+		if event.Description != "" {
+			event.Description += "\n\n"
+		}
+		event.Description += links
+	}
+
+	return event
+}
+
+// activityOverlaps reports whether an activity, or any occurrence of a series, takes place
+// between start and end; zero times leave the range open
+func activityOverlaps(activity calendarActivity, start, end time.Time) bool {
+	overlaps := func(from, to time.Time) bool {
+		return (start.IsZero() || to.After(start)) && (end.IsZero() || from.Before(end))
+	}
+
+	event := activityEvent(activity)
+	if overlaps(event.Start, event.End) {
+		return true
+	}
+	for _, override := range activity.Overrides {
+		if e := activityEvent(override); overlaps(e.Start, e.End) {
+			return true
+		}
+	}
+	if event.RRule == "" {
+		return false
+	}
+
+	// The first occurrence that ends after the start of the range
+	rule, err := ical.ParseRule(event.RRule)
+	if err != nil {
+		return false
+	}
+	after := event.Start
+	if !start.IsZero() {
+		after = start.Add(-event.End.Sub(event.Start)).Add(time.Second)
+	}
+	next, ok := rule.Next(event.Start, after.In(event.TimeZone))
+	return ok && overlaps(next, next.Add(event.End.Sub(event.Start)))
+}
+
+// activityLinks describes the meeting, web and custom links of an activity for the event description
+func activityLinks(meetingURL, webURL string, customLinks []models.ActivityCustomLink) string {
+	var links []string
+	if meetingURL != "" {
+		links = append(links, "Reunión: "+meetingURL)
+	}
+	if webURL != "" {
+		links = append(links, "Web: "+webURL)
+	}
+	for _, link := range customLinks {
+		links = append(links, link.Label+": "+link.URL)
+	}
+	return strings.Join(links, "\n")
+}
+
+// stripActivityLinks removes the links added by activityEvent from a description sent
+// back by a calendar app, so they are not appended again on every sync
+func stripActivityLinks(description, meetingURL, webURL string, customLinks []models.ActivityCustomLink) string {
+	description = strings.TrimRight(strings.ReplaceAll(description, "\r\n", "\n"), "\n ")
+	links := activityLinks(meetingURL, webURL, customLinks)
+	if links == "" || !strings.HasSuffix(description, links) {
+		return description
+	}
+	return strings.TrimRight(strings.TrimSuffix(description, links), "\n ")
+}
+
+// loadTimezone returns the location of an IANA timezone name, falling back to the default center timezone
+func loadTimezone(name string) *time.Location {
+	if name == "" {
+		name = defaultCenterTimezone
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		logger.Error("Unknown timezone %q, using %s: %v", name, defaultCenterTimezone, err)
+		location, _ = time.LoadLocation(defaultCenterTimezone)
+	}
+	return location
+}
+
+// inLocation reads the wall clock time of t as a time in the given location
+func inLocation(t time.Time, location *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, location)
+}
+
+// wallClock reverts inLocation: it returns the wall clock time of t in the given location
+// in the form activities are stored
+func wallClock(t time.Time, location *time.Location) time.Time {
+	t = t.In(location)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// getDefaultTimezone returns the default timezone of the general settings
+func (h *Handlers) getDefaultTimezone() string {
+	settings, err := h.getAllSystemSettings()
+	if err != nil || settings["general"]["default_timezone"] == "" {
+		return defaultCenterTimezone
+	}
+	return settings["general"]["default_timezone"]
+}
+
+// getCalendarFeedToken returns the calendar feed token of a user, creating it on first use
+func (h *Handlers) getCalendarFeedToken(userID int) (models.CalendarFeedToken, error) {
+	var token models.CalendarFeedToken
+	err := database.DB.QueryRow(`SELECT id, user_id, token, created_at, last_used FROM calendar_feed_tokens WHERE user_id = ?`,
+		userID).Scan(&token.ID, &token.UserID, &token.Token, &token.CreatedAt, &token.LastUsed)
+	if err == sql.ErrNoRows {
+		return h.regenerateCalendarFeedToken(userID)
+	}
+	return token, err
+}
+
+// regenerateCalendarFeedToken stores a new random calendar feed token for a user
+func (h *Handlers) regenerateCalendarFeedToken(userID int) (models.CalendarFeedToken, error) {
+	value, err := h.generateWebDAVToken()
+	if err != nil {
+		return models.CalendarFeedToken{}, err
+	}
+
+	_, err = database.DB.Exec(`INSERT INTO calendar_feed_tokens (user_id, token) VALUES (?, ?)
+			  ON CONFLICT(user_id) DO UPDATE SET token = excluded.token, created_at = CURRENT_TIMESTAMP, last_used = NULL`,
+		userID, value)
+	if err != nil {
+		return models.CalendarFeedToken{}, err
+	}
+
+	return models.CalendarFeedToken{UserID: userID, Token: value, CreatedAt: time.Now()}, nil
+}
+
+// requestBaseURL returns the scheme and host the request was made to
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, c.Request.Host)
+}
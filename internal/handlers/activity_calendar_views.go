@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// Views of the activities calendar
+const (
+	calendarViewMonth = "mes"
+	calendarViewWeek  = "semana"
+	calendarViewDay   = "dia"
+)
+
+// Hours shown by the week and day views of a center without working hours
+const (
+	calendarDefaultFirstHour = 8
+	calendarDefaultLastHour  = 20
+)
+
+// monthNames are the Spanish names of the months used in the calendar titles
+var monthNames = map[time.Month]string{
+	time.January: "enero", time.February: "febrero", time.March: "marzo", time.April: "abril",
+	time.May: "mayo", time.June: "junio", time.July: "julio", time.August: "agosto",
+	time.September: "septiembre", time.October: "octubre", time.November: "noviembre", time.December: "diciembre",
+}
+
+// calendarEntry is an activity shown on a day of the calendar. Kind is global, local or
+// compartida (shared by another center), which sets its colour.
+type calendarEntry struct {
+	models.Activity
+	Kind      string
+	Continued bool // It started on an earlier day
+	Editable  bool // The user can open it in the activity form
+}
+
+// calendarSlot is an hour of a day in the week and day views
+type calendarSlot struct {
+	Open      bool   // The center is open, so activities can be created from the slot
+	CreateURL string // Activity form for the slot, starting at the opening time if it opens later in the hour
+	Now       bool
+	Entries   []calendarEntry
+}
+
+// calendarDay is a day of the calendar
+type calendarDay struct {
+	Date      time.Time
+	Key       string // Date in the form used in URLs
+	Name      string // Weekday
+	Today     bool
+	InMonth   bool   // It belongs to the month shown by the month view
+	Open      bool   // The center is open on this day
+	CreateURL string // Activity form for the first hour of the day
+	Entries   []calendarEntry
+	Slots     []calendarSlot
+}
+
+// ActividadesCalendario shows the activities of the current center in a month, week or day view
+func (h *Handlers) ActividadesCalendario(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	var centerID int
+	var timezone string
+	err = database.DB.QueryRow(`SELECT id, COALESCE(timezone, '') FROM centers WHERE name = ?`, centro).Scan(&centerID, &timezone)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+	location := loadTimezone(timezone)
+	hours, err := getWorkingHours(centerID)
+	if err != nil {
+		logger.Error("Failed to get working hours of center %d: %v", centerID, err)
+		hours = workingHours{}
+	}
+
+	// Dates are wall clock times of the center, as activities are stored
+	now := wallClock(time.Now(), location)
+	today := now.Truncate(24 * time.Hour)
+	date := today
+	if fecha := c.Query("fecha"); fecha != "" {
+		if parsed, err := time.Parse("2006-01-02", fecha); err == nil {
+			date = parsed
+		}
+	}
+
+	view := c.DefaultQuery("vista", calendarViewWeek)
+	var from, to, previous, next time.Time
+	var title string
+	switch view {
+	case calendarViewMonth:
+		first := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+		from = startOfWeek(first)
+		to = startOfWeek(first.AddDate(0, 1, 0).AddDate(0, 0, -1)).AddDate(0, 0, 7)
+		previous, next = first.AddDate(0, -1, 0), first.AddDate(0, 1, 0)
+		title = fmt.Sprintf("%s de %d", monthNames[first.Month()], first.Year())
+	case calendarViewDay:
+		from, to = date, date.AddDate(0, 0, 1)
+		previous, next = date.AddDate(0, 0, -1), date.AddDate(0, 0, 1)
+		title = formatWorkingDate(date)
+	default:
+		view = calendarViewWeek
+		from, to = startOfWeek(date), startOfWeek(date).AddDate(0, 0, 7)
+		previous, next = date.AddDate(0, 0, -7), date.AddDate(0, 0, 7)
+		title = fmt.Sprintf("Semana del %s al %s", from.Format("02/01/2006"), to.AddDate(0, 0, -1).Format("02/01/2006"))
+	}
+
+	activities, err := h.getActivitiesBetween(centro, from, to)
+	if err != nil {
+		logger.Error("Failed to get the activities of center %s for the calendar: %v", centro, err)
+	}
+	h.setActivitiesSharing(activities, centro)
+
+	// Activities shared by other centers can only be changed there
+	canEdit := auth.UserHasAccess(c, "actividades.update")
+
+	var days []calendarDay
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		entry := calendarDay{
+			Date:      day,
+			Key:       day.Format("2006-01-02"),
+			Name:      weekdayNames[day.Weekday()],
+			Today:     day.Equal(today),
+			InMonth:   day.Month() == date.Month(),
+			Open:      true,
+			CreateURL: calendarCreateURL(day, calendarDefaultFirstHour*60, calendarDefaultFirstHour*60+60),
+		}
+		if open, ok := hours[day.Weekday()]; ok {
+			entry.CreateURL = calendarCreateURL(day, open.Start, min(open.Start+60, open.End))
+		} else if len(hours) > 0 {
+			entry.Open = false
+		}
+		for _, activity := range activities {
+			if activity.StartDatetime.Before(day.AddDate(0, 0, 1)) && activity.EndDatetime.After(day) {
+				kind := calendarEntryKind(activity, centerID)
+				entry.Entries = append(entry.Entries, calendarEntry{
+					Activity:  activity,
+					Kind:      kind,
+					Continued: activity.StartDatetime.Before(day),
+					Editable:  canEdit && kind != "compartida",
+				})
+			}
+		}
+		days = append(days, entry)
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Calendario de Actividades"
+	data["Centro"] = centro
+	data["Timezone"] = location.String()
+	data["WorkingHours"] = describeWorkingHours(hours)
+	data["View"] = view
+	data["Date"] = date.Format("2006-01-02")
+	data["Title"] = title
+	data["Previous"] = previous.Format("2006-01-02")
+	data["Next"] = next.Format("2006-01-02")
+	data["Today"] = today.Format("2006-01-02")
+
+	if view == calendarViewMonth {
+		var weeks [][]calendarDay
+		for i := 0; i < len(days); i += 7 {
+			weeks = append(weeks, days[i:i+7])
+		}
+		data["Weekdays"] = days[:7]
+		data["Weeks"] = weeks
+	} else {
+		data["Hours"] = setCalendarSlots(days, hours, now)
+		data["Days"] = days
+	}
+
+	h.renderTemplate(c, "actividades_calendario.html", data)
+}
+
+// getActivitiesBetween returns the activities a center can see that take place between
+// from and to, with the occurrences of the recurring ones, sorted by start
+func (h *Handlers) getActivitiesBetween(centro string, from, to time.Time) ([]models.Activity, error) {
+	return h.getFilteredActivitiesBetween(activityVisibleSQL, []interface{}{centro, centro}, from, to)
+}
+
+// getFilteredActivitiesBetween returns the activities matching a condition that take place
+// between from and to, with the occurrences of the recurring ones, sorted by start
+func (h *Handlers) getFilteredActivitiesBetween(condition string, conditionArgs []interface{}, from, to time.Time) ([]models.Activity, error) {
+	args := append(append([]interface{}{}, conditionArgs...), to.Format("2006-01-02 15:04:05"), from.Format("2006-01-02 15:04:05"))
+	rows, err := database.DB.Query(`SELECT `+activityColumns+` FROM activities
+			  WHERE `+condition+` AND recurrence_rule IS NULL AND start_datetime < ? AND end_datetime > ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var activities []models.Activity
+	for rows.Next() {
+		activity, err := scanActivity(rows)
+		if err != nil {
+			continue
+		}
+		activities = append(activities, activity)
+	}
+	rows.Close()
+
+	args = append(append([]interface{}{}, conditionArgs...), to.Format("2006-01-02 15:04:05"))
+	rows, err = database.DB.Query(`SELECT `+activityColumns+` FROM activities
+			  WHERE `+condition+` AND recurrence_rule IS NOT NULL AND start_datetime < ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var series []models.Activity
+	expandFrom := from
+	for rows.Next() {
+		activity, err := scanActivity(rows)
+		if err != nil {
+			continue
+		}
+		series = append(series, activity)
+		// Occurrences that started earlier may still be taking place
+		if start := from.Add(-activity.EndDatetime.Sub(activity.StartDatetime)); start.Before(expandFrom) {
+			expandFrom = start
+		}
+	}
+	rows.Close()
+
+	occurrences, err := expandActivitySeries(series, expandFrom, to)
+	if err != nil {
+		return nil, err
+	}
+	h.setOccurrenceStatuses(occurrences)
+	for _, occurrence := range occurrences {
+		if occurrence.EndDatetime.After(from) {
+			activities = append(activities, occurrence)
+		}
+	}
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		return activities[i].StartDatetime.Before(activities[j].StartDatetime)
+	})
+	return activities, nil
+}
+
+// setCalendarSlots splits the days of the week and day views into hours, from the earliest
+// opening to the latest closing of those days, widened to show every activity. It returns
+// the hours shown.
+func setCalendarSlots(days []calendarDay, hours workingHours, now time.Time) []string {
+	first, last := 24, 0
+	for _, day := range days {
+		if open, ok := hours[day.Date.Weekday()]; ok {
+			first = min(first, open.Start/60)
+			last = max(last, (open.End+59)/60)
+		}
+	}
+	if first >= last {
+		first, last = calendarDefaultFirstHour, calendarDefaultLastHour
+	}
+	for _, day := range days {
+		for _, entry := range day.Entries {
+			if entry.Continued {
+				continue
+			}
+			first = min(first, entry.StartDatetime.Hour())
+			last = max(last, entry.StartDatetime.Hour()+1)
+		}
+	}
+
+	var labels []string
+	for hour := first; hour < last; hour++ {
+		labels = append(labels, formatClock(hour*60))
+	}
+
+	for i := range days {
+		day := &days[i]
+		open, isOpen := hours[day.Date.Weekday()]
+		for hour := first; hour < last; hour++ {
+			start, closing := hour*60, 24*60-1
+			slot := calendarSlot{
+				Now:  day.Today && now.Hour() == hour,
+				Open: len(hours) == 0,
+			}
+			if isOpen && start < open.End && start+60 > open.Start {
+				slot.Open = true
+				start, closing = max(start, open.Start), open.End
+			}
+			if slot.Open {
+				slot.CreateURL = calendarCreateURL(day.Date, start, min(start+60, closing))
+			}
+
+			for _, entry := range day.Entries {
+				// Activities that started on an earlier day go in the first slot
+				startHour := entry.StartDatetime.Hour()
+				if entry.Continued {
+					startHour = first
+				}
+				if startHour == hour {
+					slot.Entries = append(slot.Entries, entry)
+				}
+			}
+			day.Slots = append(day.Slots, slot)
+		}
+	}
+	return labels
+}
+
+// calendarEntryKind tells whether an activity is global, of the center or shared by another center
+func calendarEntryKind(activity models.Activity, centerID int) string {
+	switch {
+	case activity.IsGlobal || activity.CenterID == nil:
+		return "global"
+	case *activity.CenterID == centerID:
+		return "local"
+	default:
+		return "compartida"
+	}
+}
+
+// startOfWeek returns the Monday of the week of a date
+func startOfWeek(date time.Time) time.Time {
+	return date.AddDate(0, 0, -((int(date.Weekday()) + 6) % 7))
+}
+
+// calendarCreateURL returns the address of the activity form prefilled with a day and the
+// start and end times, in minutes from midnight
+func calendarCreateURL(day time.Time, start, end int) string {
+	values := url.Values{}
+	values.Set("fecha", day.Format("2006-01-02"))
+	values.Set("hora", formatClock(start))
+	values.Set("fin", formatClock(end))
+	return "/actividades/crear?" + values.Encode()
+}
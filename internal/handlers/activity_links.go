@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// maxCustomLinkLabel is the length of the label column of activity_custom_links
+const maxCustomLinkLabel = 255
+
+// activityHasCustomLinksSQL matches the activities with custom links. The links of a series
+// are shown on all its occurrences, including the edited ones.
+const activityHasCustomLinksSQL = `COALESCE(recurrence_parent_id, id) IN (SELECT activity_id FROM activity_custom_links)`
+
+var errInvalidCustomLink = errors.New("invalid custom link")
+
+// customLinkRows reads the label and URL rows of the activity form as they were typed,
+// leaving out the empty ones
+func customLinkRows(c *gin.Context) []models.ActivityCustomLink {
+	labels := c.PostFormArray("custom_link_label[]")
+	urls := c.PostFormArray("custom_link_url[]")
+
+	var links []models.ActivityCustomLink
+	for i := 0; i < len(labels) || i < len(urls); i++ {
+		var link models.ActivityCustomLink
+		if i < len(labels) {
+			link.Label = strings.TrimSpace(labels[i])
+		}
+		if i < len(urls) {
+			link.URL = strings.TrimSpace(urls[i])
+		}
+		if link.Label == "" && link.URL == "" {
+			continue
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// parseActivityCustomLinks reads the custom links of the activity form. Every link needs a
+// label and an http or https URL.
+func parseActivityCustomLinks(c *gin.Context) ([]models.ActivityCustomLink, error) {
+	links := customLinkRows(c)
+	for _, link := range links {
+		if link.Label == "" || len(link.Label) > maxCustomLinkLabel || !isValidLinkURL(link.URL) {
+			return nil, errInvalidCustomLink
+		}
+	}
+	return links, nil
+}
+
+// isValidLinkURL reports whether a URL is an absolute http or https address
+func isValidLinkURL(value string) bool {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// saveActivityCustomLinks replaces the custom links of an activity
+func saveActivityCustomLinks(activityID int, links []models.ActivityCustomLink) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setActivityCustomLinks(tx, activityID, links); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setActivityCustomLinks is saveActivityCustomLinks inside an existing transaction
+func setActivityCustomLinks(tx *sql.Tx, activityID int, links []models.ActivityCustomLink) error {
+	if _, err := tx.Exec(`DELETE FROM activity_custom_links WHERE activity_id = ?`, activityID); err != nil {
+		return err
+	}
+	for _, link := range links {
+		if _, err := tx.Exec(`INSERT INTO activity_custom_links (activity_id, label, url) VALUES (?, ?, ?)`,
+			activityID, link.Label, link.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activitySeriesID returns the activity that holds the custom links and shares of an
+// activity: its series for an edited occurrence, or the activity itself
+func activitySeriesID(activity models.Activity) int {
+	if activity.RecurrenceParentID != nil {
+		return *activity.RecurrenceParentID
+	}
+	return activity.ID
+}
+
+// setActivityFormCustomLinks adds to the activity form the custom links being edited
+func (h *Handlers) setActivityFormCustomLinks(c *gin.Context, data gin.H) {
+	// Keep the submitted links when the form is shown again after an error
+	if c.Request.Method == http.MethodPost {
+		data["CustomLinks"] = customLinkRows(c)
+		return
+	}
+	if activity, ok := data["Activity"].(models.Activity); ok {
+		links, err := h.getCustomLinksForActivity(activitySeriesID(activity))
+		if err == nil {
+			data["CustomLinks"] = links
+		}
+	}
+}
+
+// setActivitiesCustomLinks loads the custom links of the listed activities
+func (h *Handlers) setActivitiesCustomLinks(activities []models.Activity) {
+	for i := range activities {
+		seriesID := activitySeriesID(activities[i])
+		links, err := h.getCustomLinksForActivity(seriesID)
+		if err != nil {
+			logger.Error("Failed to get the custom links of activity %d: %v", seriesID, err)
+			continue
+		}
+		activities[i].CustomLinks = links
+	}
+}
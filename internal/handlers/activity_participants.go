@@ -0,0 +1,619 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// activityClassroomSQL matches the activities a classroom takes part in. The participants of
+// a series take part in all its occurrences, including the edited ones.
+const activityClassroomSQL = `COALESCE(recurrence_parent_id, id) IN (SELECT activity_id FROM activity_classrooms WHERE classroom_id = ?)`
+
+// classroomHistoryUpcomingDays is how far ahead the classroom history lists activities,
+// after those of the last year
+const classroomHistoryUpcomingDays = 30
+
+// activityParticipantOption is a classroom or a user the activity form can add as participant
+type activityParticipantOption struct {
+	ID       int
+	Name     string
+	Selected bool
+}
+
+// classroomHistoryEntry is an occurrence of an activity in the history of a classroom
+type classroomHistoryEntry struct {
+	models.Activity
+	Attendance string // "si", "no" or empty until it is taken
+	Started    bool
+}
+
+// attendanceRow is a participant in the attendance form
+type attendanceRow struct {
+	models.ActivityParticipant
+	Key        string // Name of its field in the form
+	Attendance string // "si", "no" or empty until it is taken
+	Started    bool   // The activity started, so the attendance can be taken
+}
+
+// parseActivityParticipants reads the classrooms of the center and the staff members
+// selected in the activity form, leaving out those that do not exist
+func (h *Handlers) parseActivityParticipants(c *gin.Context, centro string) (classroomIDs, userIDs []int) {
+	for _, value := range c.PostFormArray("aulas[]") {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		var count int
+		database.DB.QueryRow(`SELECT COUNT(*) FROM classrooms WHERE id = ? AND center_id = (SELECT id FROM centers WHERE name = ?)`,
+			id, centro).Scan(&count)
+		if count > 0 {
+			classroomIDs = append(classroomIDs, id)
+		}
+	}
+	for _, value := range c.PostFormArray("responsables[]") {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		var count int
+		database.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, id).Scan(&count)
+		if count > 0 {
+			userIDs = append(userIDs, id)
+		}
+	}
+	return classroomIDs, userIDs
+}
+
+// saveActivityParticipants replaces the classrooms of the center and the staff members taking
+// part in an activity. Classrooms of other centers, added to a global activity there, are kept.
+func saveActivityParticipants(activityID int, centro string, classroomIDs, userIDs []int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setActivityParticipants(tx, activityID, centro, classroomIDs, userIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setActivityParticipants is saveActivityParticipants inside an existing transaction
+func setActivityParticipants(tx *sql.Tx, activityID int, centro string, classroomIDs, userIDs []int) error {
+	_, err := tx.Exec(`DELETE FROM activity_classrooms WHERE activity_id = ?
+			  AND classroom_id IN (SELECT id FROM classrooms WHERE center_id = (SELECT id FROM centers WHERE name = ?))`,
+		activityID, centro)
+	if err != nil {
+		return err
+	}
+	for _, id := range classroomIDs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO activity_classrooms (activity_id, classroom_id) VALUES (?, ?)`, activityID, id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM activity_staff WHERE activity_id = ?`, activityID); err != nil {
+		return err
+	}
+	for _, id := range userIDs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO activity_staff (activity_id, user_id) VALUES (?, ?)`, activityID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getActivityParticipants returns the classrooms and the staff members taking part in an activity
+func getActivityParticipants(activityID int) (classrooms, staff []models.ActivityParticipant, err error) {
+	rows, err := database.DB.Query(`SELECT cl.id, cl.name, c.name
+			  FROM activity_classrooms ac
+			  JOIN classrooms cl ON ac.classroom_id = cl.id
+			  JOIN centers c ON cl.center_id = c.id
+			  WHERE ac.activity_id = ?
+			  ORDER BY c.name, cl.name`, activityID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var participant models.ActivityParticipant
+		var id int
+		if err := rows.Scan(&id, &participant.Name, &participant.CenterName); err != nil {
+			continue
+		}
+		participant.ClassroomID = &id
+		classrooms = append(classrooms, participant)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`SELECT u.id, COALESCE(NULLIF(u.display_name, ''), u.username)
+			  FROM activity_staff s
+			  JOIN users u ON s.user_id = u.id
+			  WHERE s.activity_id = ?
+			  ORDER BY 2`, activityID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var participant models.ActivityParticipant
+		var id int
+		if err := rows.Scan(&id, &participant.Name); err != nil {
+			continue
+		}
+		participant.UserID = &id
+		staff = append(staff, participant)
+	}
+
+	return classrooms, staff, nil
+}
+
+// setActivityFormParticipants adds to the activity form the classrooms of the center and the
+// users that can take part in the activity, with those selected
+func (h *Handlers) setActivityFormParticipants(c *gin.Context, data gin.H, centro string) {
+	selectedClassrooms := make(map[int]bool)
+	selectedUsers := make(map[int]bool)
+	if c.Request.Method == http.MethodPost {
+		// Keep the submitted selection when the form is shown again after an error
+		classroomIDs, userIDs := h.parseActivityParticipants(c, centro)
+		for _, id := range classroomIDs {
+			selectedClassrooms[id] = true
+		}
+		for _, id := range userIDs {
+			selectedUsers[id] = true
+		}
+	} else if activity, ok := data["Activity"].(models.Activity); ok {
+		classrooms, staff, err := getActivityParticipants(activitySeriesID(activity))
+		if err == nil {
+			for _, classroom := range classrooms {
+				selectedClassrooms[*classroom.ClassroomID] = true
+			}
+			for _, member := range staff {
+				selectedUsers[*member.UserID] = true
+			}
+		}
+	}
+
+	var classroomOptions []activityParticipantOption
+	if centerID, err := h.getCenterID(centro); err == nil {
+		classrooms, _ := h.getClassroomsByCenter(strconv.Itoa(centerID))
+		for _, classroom := range classrooms {
+			classroomOptions = append(classroomOptions, activityParticipantOption{
+				ID: classroom.ID, Name: classroom.Name, Selected: selectedClassrooms[classroom.ID],
+			})
+		}
+	}
+
+	var staffOptions []activityParticipantOption
+	users, err := h.getAllUsers()
+	if err != nil {
+		logger.Error("Failed to get the users for the activity form: %v", err)
+	}
+	for _, user := range users {
+		staffOptions = append(staffOptions, activityParticipantOption{
+			ID: user.ID, Name: user.DisplayName, Selected: selectedUsers[user.ID],
+		})
+	}
+
+	data["ClassroomOptions"] = classroomOptions
+	data["StaffOptions"] = staffOptions
+}
+
+// setActivitiesParticipants loads the classrooms and staff members of the listed activities
+func (h *Handlers) setActivitiesParticipants(activities []models.Activity) {
+	for i := range activities {
+		seriesID := activitySeriesID(activities[i])
+		classrooms, staff, err := getActivityParticipants(seriesID)
+		if err != nil {
+			logger.Error("Failed to get the participants of activity %d: %v", seriesID, err)
+			continue
+		}
+		activities[i].Classrooms = classrooms
+		activities[i].Staff = staff
+	}
+}
+
+// attendanceKey identifies a participant in the attendance of an occurrence
+func attendanceKey(participant models.ActivityParticipant) string {
+	if participant.ClassroomID != nil {
+		return fmt.Sprintf("aula_%d", *participant.ClassroomID)
+	}
+	return fmt.Sprintf("usuario_%d", *participant.UserID)
+}
+
+// attendanceRows prepares the participants for the attendance form with their recorded attendance
+func attendanceRows(participants []models.ActivityParticipant, attendance map[string]bool, started bool) []attendanceRow {
+	var rows []attendanceRow
+	for _, participant := range participants {
+		row := attendanceRow{ActivityParticipant: participant, Key: attendanceKey(participant), Started: started}
+		if attended, ok := attendance[row.Key]; ok {
+			row.Attendance = "no"
+			if attended {
+				row.Attendance = "si"
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// getActivityAttendance returns by participant the attendance recorded for an activity, or for
+// the occurrence of a series starting at occurrence
+func getActivityAttendance(activityID int, occurrence *time.Time) (map[string]bool, error) {
+	rows, err := database.DB.Query(`SELECT classroom_id, user_id, attended FROM activity_attendance
+			  WHERE activity_id = ? AND occurrence_date IS ?`, activityID, occurrence)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attendance := make(map[string]bool)
+	for rows.Next() {
+		var participant models.ActivityParticipant
+		var attended bool
+		if err := rows.Scan(&participant.ClassroomID, &participant.UserID, &attended); err != nil {
+			continue
+		}
+		attendance[attendanceKey(participant)] = attended
+	}
+	return attendance, nil
+}
+
+// saveActivityAttendance replaces the attendance of an activity, or of the occurrence of a
+// series starting at occurrence, with that of the participants that have it set
+func saveActivityAttendance(activityID int, occurrence *time.Time, participants []models.ActivityParticipant, userID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM activity_attendance WHERE activity_id = ? AND occurrence_date IS ?`, activityID, occurrence); err != nil {
+		return err
+	}
+	for _, participant := range participants {
+		if participant.Attended == nil {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO activity_attendance (activity_id, occurrence_date, classroom_id, user_id, attended, recorded_by)
+				  VALUES (?, ?, ?, ?, ?, ?)`,
+			activityID, occurrence, participant.ClassroomID, participant.UserID, *participant.Attended, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// centerNow returns the current wall clock time of a center, as activities are stored
+func centerNow(centro string) time.Time {
+	var timezone string
+	database.DB.QueryRow(`SELECT COALESCE(timezone, '') FROM centers WHERE name = ?`, centro).Scan(&timezone)
+	return wallClock(time.Now(), loadTimezone(timezone))
+}
+
+// ActividadesAsistencia shows and records the attendance of the participants of an activity,
+// or of one occurrence of a series. It is taken once the activity has started.
+func (h *Handlers) ActividadesAsistencia(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "actividades.update") {
+		c.Redirect(http.StatusFound, "/actividades?error=No tienes permiso para pasar lista")
+		return
+	}
+
+	activity, err := h.getActivityOccurrence(c.Param("id"), centro, c.Query("fecha"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=Actividad no encontrada")
+		return
+	}
+
+	classrooms, staff, err := getActivityParticipants(activitySeriesID(activity))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=Error al obtener los participantes de la actividad")
+		return
+	}
+	started := !centerNow(centro).Before(activity.StartDatetime)
+
+	page := fmt.Sprintf("/actividades/asistencia/%d", activity.ID)
+	if key := activity.OccurrenceKey(); key != "" {
+		page += "?fecha=" + url.QueryEscape(key)
+	}
+
+	if c.Request.Method == http.MethodPost {
+		if !started {
+			c.Redirect(http.StatusFound, "/actividades?error=La asistencia se toma cuando la actividad ha empezado")
+			return
+		}
+
+		// Each participant is marked "si", "no" or left without attendance
+		participants := append(append([]models.ActivityParticipant{}, classrooms...), staff...)
+		for i := range participants {
+			var attended bool
+			switch c.PostForm(attendanceKey(participants[i])) {
+			case "si":
+				attended = true
+			case "no":
+				attended = false
+			default:
+				continue
+			}
+			participants[i].Attended = &attended
+		}
+
+		if err := saveActivityAttendance(activity.ID, activity.OccurrenceDate, participants, user.ID); err != nil {
+			logger.Error("Failed to save the attendance of activity %d: %v", activity.ID, err)
+			c.Redirect(http.StatusFound, "/actividades?error=Error al guardar la asistencia")
+			return
+		}
+		c.Redirect(http.StatusFound, "/actividades?success=Asistencia guardada correctamente")
+		return
+	}
+
+	attendance, err := getActivityAttendance(activity.ID, activity.OccurrenceDate)
+	if err != nil {
+		logger.Error("Failed to get the attendance of activity %d: %v", activity.ID, err)
+	}
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Asistencia"
+	data["Centro"] = centro
+	data["Activity"] = activity
+	data["Classrooms"] = attendanceRows(classrooms, attendance, started)
+	data["Staff"] = attendanceRows(staff, attendance, started)
+	data["Started"] = started
+	data["FormAction"] = page
+
+	h.renderTemplate(c, "actividad_asistencia.html", data)
+}
+
+// ActividadesAulas opens the activity history of the classroom selected by the user, or of
+// the first classroom of the center
+func (h *Handlers) ActividadesAulas(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	aula, _ := c.Cookie("aula")
+	var classroomID int
+	err = database.DB.QueryRow(`SELECT cl.id FROM classrooms cl JOIN centers c ON cl.center_id = c.id
+			  WHERE c.name = ? ORDER BY cl.name = ? DESC, cl.name LIMIT 1`, centro, aula).Scan(&classroomID)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/actividades?error=El centro no tiene aulas")
+		return
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/actividades/aulas/%d", classroomID))
+}
+
+// ActividadesAula shows the activities a classroom of the center took part in during the last
+// year and those coming up, with its attendance
+func (h *Handlers) ActividadesAula(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+	classrooms, err := h.getClassroomsByCenter(strconv.Itoa(centerID))
+	if err != nil {
+		classrooms = []models.Classroom{}
+	}
+
+	var classroom models.Classroom
+	for _, candidate := range classrooms {
+		if strconv.Itoa(candidate.ID) == c.Param("id") {
+			classroom = candidate
+		}
+	}
+	if classroom.ID == 0 {
+		c.Redirect(http.StatusFound, "/actividades?error=Aula no encontrada")
+		return
+	}
+
+	now := centerNow(centro)
+	entries, err := h.getClassroomHistory(classroom.ID, feedHistoryStart(), now.AddDate(0, 0, classroomHistoryUpcomingDays), now)
+	if err != nil {
+		logger.Error("Failed to get the activity history of classroom %d: %v", classroom.ID, err)
+		entries = []classroomHistoryEntry{}
+	}
+
+	var attended, absent, unrecorded int
+	for _, entry := range entries {
+		switch {
+		case entry.Attendance == "si":
+			attended++
+		case entry.Attendance == "no":
+			absent++
+		case entry.Started && !isManualActivityStatus(entry.Status):
+			unrecorded++
+		}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Actividades del aula " + classroom.Name
+	data["Centro"] = centro
+	data["Classroom"] = classroom
+	data["Classrooms"] = classrooms
+	data["Entries"] = entries
+	data["Attended"] = attended
+	data["Absent"] = absent
+	data["Unrecorded"] = unrecorded
+	data["UpcomingDays"] = classroomHistoryUpcomingDays
+
+	h.renderTemplate(c, "actividades_aula.html", data)
+}
+
+// getClassroomHistory returns the occurrences of the activities a classroom takes part in
+// between from and to, the latest first, with the attendance of the classroom
+func (h *Handlers) getClassroomHistory(classroomID int, from, to, now time.Time) ([]classroomHistoryEntry, error) {
+	activities, err := h.getFilteredActivitiesBetween(activityClassroomSQL, []interface{}{classroomID}, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := database.DB.Query(`SELECT activity_id, occurrence_date, attended FROM activity_attendance WHERE classroom_id = ?`, classroomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Attendance by activity and original start of the occurrence, 0 for single activities
+	attendance := make(map[int]map[int64]bool)
+	for rows.Next() {
+		var activityID int
+		var occurrence sql.NullTime
+		var attended bool
+		if err := rows.Scan(&activityID, &occurrence, &attended); err != nil {
+			continue
+		}
+		if attendance[activityID] == nil {
+			attendance[activityID] = make(map[int64]bool)
+		}
+		var key int64
+		if occurrence.Valid {
+			key = occurrence.Time.Unix()
+		}
+		attendance[activityID][key] = attended
+	}
+
+	entries := make([]classroomHistoryEntry, 0, len(activities))
+	for _, activity := range activities {
+		entry := classroomHistoryEntry{Activity: activity, Started: !now.Before(activity.StartDatetime)}
+		var key int64
+		if activity.OccurrenceDate != nil {
+			key = activity.OccurrenceDate.Unix()
+		}
+		if attended, ok := attendance[activity.ID][key]; ok {
+			entry.Attendance = "no"
+			if attended {
+				entry.Attendance = "si"
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartDatetime.After(entries[j].StartDatetime)
+	})
+	return entries, nil
+}
+
+// getClassroomParticipation summarises by classroom the activities of a center, or of all of
+// them for center 0, and their attendance between the days from and to, each optional
+func getClassroomParticipation(centerID int, from, to string) ([]models.ClassroomParticipation, error) {
+	// The activities are those taking place in the period, every series that started before its end
+	activityCondition := "1 = 1"
+	var activityArgs []interface{}
+	if from != "" {
+		activityCondition += " AND (a.end_datetime >= ? OR a.recurrence_rule IS NOT NULL)"
+		activityArgs = append(activityArgs, from)
+	}
+	if to != "" {
+		activityCondition += " AND a.start_datetime < date(?, '+1 day')"
+		activityArgs = append(activityArgs, to)
+	}
+
+	// The attendance is that of the occurrences that started in the period
+	attendanceCondition := "1 = 1"
+	var attendanceArgs []interface{}
+	if from != "" {
+		attendanceCondition += " AND COALESCE(att.occurrence_date, a.start_datetime) >= ?"
+		attendanceArgs = append(attendanceArgs, from)
+	}
+	if to != "" {
+		attendanceCondition += " AND COALESCE(att.occurrence_date, a.start_datetime) < date(?, '+1 day')"
+		attendanceArgs = append(attendanceArgs, to)
+	}
+
+	query := `SELECT cl.id, cl.name, c.name,
+			  (SELECT COUNT(*) FROM activity_classrooms ac JOIN activities a ON ac.activity_id = a.id
+			   WHERE ac.classroom_id = cl.id AND ` + activityCondition + `),
+			  (SELECT COUNT(*) FROM activity_attendance att JOIN activities a ON att.activity_id = a.id
+			   WHERE att.classroom_id = cl.id AND att.attended = 1 AND ` + attendanceCondition + `),
+			  (SELECT COUNT(*) FROM activity_attendance att JOIN activities a ON att.activity_id = a.id
+			   WHERE att.classroom_id = cl.id AND att.attended = 0 AND ` + attendanceCondition + `)
+			  FROM classrooms cl
+			  JOIN centers c ON cl.center_id = c.id`
+	args := append(append(append([]interface{}{}, activityArgs...), attendanceArgs...), attendanceArgs...)
+	if centerID != 0 {
+		query += " WHERE cl.center_id = ?"
+		args = append(args, centerID)
+	}
+	query += " ORDER BY c.name, cl.name"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participation []models.ClassroomParticipation
+	for rows.Next() {
+		var row models.ClassroomParticipation
+		if err := rows.Scan(&row.ClassroomID, &row.ClassroomName, &row.CenterName, &row.Activities, &row.Attended, &row.Absent); err != nil {
+			continue
+		}
+		participation = append(participation, row)
+	}
+	return participation, nil
+}
+
+// participationByCenter adds up the participation of the classrooms of each center
+func participationByCenter(classrooms []models.ClassroomParticipation) []models.ClassroomParticipation {
+	var centers []models.ClassroomParticipation
+	for _, classroom := range classrooms {
+		if len(centers) == 0 || centers[len(centers)-1].CenterName != classroom.CenterName {
+			centers = append(centers, models.ClassroomParticipation{CenterName: classroom.CenterName})
+		}
+		center := &centers[len(centers)-1]
+		center.Activities += classroom.Activities
+		center.Attended += classroom.Attended
+		center.Absent += classroom.Absent
+	}
+	return centers
+}
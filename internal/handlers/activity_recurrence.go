@@ -0,0 +1,619 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/ical"
+	"github.com/gin-gonic/gin"
+)
+
+// recurrenceHorizonYears is how far ahead the occurrences of a series are listed
+const recurrenceHorizonYears = 1
+
+// activityColumns are the columns read by scanActivity
+const activityColumns = `id, center_id, title, description, start_datetime, end_datetime, is_global, status,
+	meeting_url, web_url, created_at, updated_at, recurrence_rule, recurrence_parent_id, recurrence_date, outside_working_hours`
+
+var (
+	errInvalidRecurrence  = errors.New("invalid recurrence")
+	errOccurrenceNotFound = errors.New("occurrence not found")
+)
+
+// Spanish names used to describe recurrence rules
+var (
+	weekdayNames = map[time.Weekday]string{
+		time.Monday: "lunes", time.Tuesday: "martes", time.Wednesday: "miércoles", time.Thursday: "jueves",
+		time.Friday: "viernes", time.Saturday: "sábado", time.Sunday: "domingo",
+	}
+	ordinalNames = map[int]string{1: "primer", 2: "segundo", 3: "tercer", 4: "cuarto", -1: "último"}
+)
+
+// scanActivity reads an activity selected with activityColumns
+func scanActivity(rows interface{ Scan(...interface{}) error }) (models.Activity, error) {
+	var activity models.Activity
+	var centerID, parentID sql.NullInt64
+	var meetingURL, webURL, rule sql.NullString
+
+	err := rows.Scan(&activity.ID, &centerID, &activity.Title, &activity.Description,
+		&activity.StartDatetime, &activity.EndDatetime, &activity.IsGlobal, &activity.Status,
+		&meetingURL, &webURL, &activity.CreatedAt, &activity.UpdatedAt,
+		&rule, &parentID, &activity.RecurrenceDate, &activity.OutsideWorkingHours)
+	if err != nil {
+		return activity, err
+	}
+
+	if centerID.Valid {
+		centerIDInt := int(centerID.Int64)
+		activity.CenterID = &centerIDInt
+	}
+	if meetingURL.Valid {
+		activity.MeetingURL = &meetingURL.String
+	}
+	if webURL.Valid {
+		activity.WebURL = &webURL.String
+	}
+	if rule.Valid {
+		activity.RecurrenceRule = &rule.String
+		activity.RecurrenceText = describeRecurrence(activity)
+	}
+	if parentID.Valid {
+		parentIDInt := int(parentID.Int64)
+		activity.RecurrenceParentID = &parentIDInt
+	}
+
+	return activity, nil
+}
+
+// getActivityOccurrences returns the first limit occurrences of the recurring activities
+// matching a condition, and how many there are in total. They start from today, or from the
+// start of each series when past activities are shown, and are only those in a status if one
+// is given. Series are only expanded as far as the page needs.
+func (h *Handlers) getActivityOccurrences(condition string, conditionArgs []interface{}, searchQuery, status string, showPast bool, limit int) ([]models.Activity, int, error) {
+	query := `SELECT ` + activityColumns + ` FROM activities
+			  WHERE ` + condition + ` AND recurrence_rule IS NOT NULL`
+	args := append([]interface{}{}, conditionArgs...)
+
+	if searchQuery != "" {
+		query += " AND (title LIKE ? OR description LIKE ?)"
+		searchPattern := "%" + searchQuery + "%"
+		args = append(args, searchPattern, searchPattern)
+	}
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	var series []models.Activity
+	var ids []int
+	for rows.Next() {
+		activity, err := scanActivity(rows)
+		if err != nil {
+			continue
+		}
+		series = append(series, activity)
+		ids = append(ids, activity.ID)
+	}
+	rows.Close()
+
+	exclusions, err := getRecurrenceExclusions(ids)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Same limit as the single activities: those starting after the start of today
+	now := time.Now().UTC()
+	from := time.Time{}
+	if !showPast {
+		from = now.Truncate(24 * time.Hour).Add(time.Second)
+	}
+	to := now.AddDate(recurrenceHorizonYears, 0, 0)
+	clock := h.activityClock()
+
+	var occurrences []models.Activity
+	total := 0
+	for _, activity := range series {
+		rule, err := ical.ParseRule(*activity.RecurrenceRule)
+		if err != nil {
+			continue
+		}
+		windowFrom, windowTo, ok := occurrenceStatusWindow(activity, status, clock(activity), from, to)
+		if !ok {
+			continue
+		}
+
+		excluded := 0
+		for start := range exclusions[activity.ID] {
+			t := time.Unix(start, 0).In(activity.StartDatetime.Location())
+			if !t.Before(windowFrom) && t.Before(windowTo) && rule.Includes(activity.StartDatetime, t) {
+				excluded++
+			}
+		}
+		total += rule.CountBetween(activity.StartDatetime, windowFrom, windowTo) - excluded
+
+		// Enough starts to fill the page once the excluded ones are left out
+		taken := 0
+		for _, start := range rule.FirstBetween(activity.StartDatetime, windowFrom, windowTo, limit+excluded) {
+			if taken == limit {
+				break
+			}
+			if exclusions[activity.ID][start.Unix()] {
+				continue
+			}
+			occurrences = append(occurrences, activityOccurrence(activity, start))
+			taken++
+		}
+	}
+
+	h.setOccurrenceStatuses(occurrences)
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].StartDatetime.Before(occurrences[j].StartDatetime)
+	})
+	return occurrences, total, nil
+}
+
+// occurrenceStatusWindow narrows [from, to) to the starts of the occurrences of a series that
+// are in a status at now, the wall clock time of its center. It reports false when none can be.
+func occurrenceStatusWindow(series models.Activity, status string, now, from, to time.Time) (time.Time, time.Time, bool) {
+	// A status set by hand covers every occurrence
+	if isManualActivityStatus(series.Status) || isManualActivityStatus(status) {
+		return from, to, status == "" || status == series.Status
+	}
+
+	duration := series.EndDatetime.Sub(series.StartDatetime)
+	lo, hi := from, to
+	switch status {
+	case "pending":
+		lo = maxTime(lo, now.Add(time.Nanosecond))
+	case "in_progress":
+		lo = maxTime(lo, now.Add(-duration).Add(time.Nanosecond))
+		hi = minTime(hi, now.Add(time.Nanosecond))
+	case "completed":
+		hi = minTime(hi, now.Add(-duration).Add(time.Nanosecond))
+	}
+	return lo, hi, lo.Before(hi)
+}
+
+// minTime returns the earlier of two times
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// maxTime returns the later of two times
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// expandActivitySeries returns the occurrences of the series starting in [from, to), sorted,
+// without those removed from their series or replaced by an edited occurrence
+func expandActivitySeries(series []models.Activity, from, to time.Time) ([]models.Activity, error) {
+	ids := make([]int, len(series))
+	for i, activity := range series {
+		ids[i] = activity.ID
+	}
+	exclusions, err := getRecurrenceExclusions(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var occurrences []models.Activity
+	for _, activity := range series {
+		rule, err := ical.ParseRule(*activity.RecurrenceRule)
+		if err != nil {
+			continue
+		}
+		for _, start := range rule.Between(activity.StartDatetime, from, to) {
+			if exclusions[activity.ID][start.Unix()] {
+				continue
+			}
+			occurrences = append(occurrences, activityOccurrence(activity, start))
+		}
+	}
+
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].StartDatetime.Before(occurrences[j].StartDatetime)
+	})
+	return occurrences, nil
+}
+
+// getRecurrenceExclusions returns, by series, the starts of the occurrences that were
+// removed or replaced by an edited occurrence
+func getRecurrenceExclusions(ids []int) (map[int]map[int64]bool, error) {
+	exclusions := make(map[int]map[int64]bool)
+	if len(ids) == 0 {
+		return exclusions, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, 0, 2*len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	args = append(args, args...)
+
+	rows, err := database.DB.Query(`SELECT activity_id, occurrence_date FROM activity_exceptions WHERE activity_id IN (`+placeholders+`)
+			  UNION ALL
+			  SELECT recurrence_parent_id, recurrence_date FROM activities WHERE recurrence_parent_id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var date time.Time
+		if err := rows.Scan(&id, &date); err != nil {
+			continue
+		}
+		if exclusions[id] == nil {
+			exclusions[id] = make(map[int64]bool)
+		}
+		exclusions[id][date.Unix()] = true
+	}
+	return exclusions, nil
+}
+
+// getActivityExceptions returns the starts of the occurrences removed from a series
+func getActivityExceptions(activityID int) ([]time.Time, error) {
+	rows, err := database.DB.Query(`SELECT occurrence_date FROM activity_exceptions WHERE activity_id = ? ORDER BY occurrence_date`, activityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dates []time.Time
+	for rows.Next() {
+		var date time.Time
+		if err := rows.Scan(&date); err != nil {
+			continue
+		}
+		dates = append(dates, date)
+	}
+	return dates, nil
+}
+
+// activityOccurrence returns the occurrence of a series starting at start
+func activityOccurrence(series models.Activity, start time.Time) models.Activity {
+	occurrence := series
+	occurrence.EndDatetime = start.Add(series.EndDatetime.Sub(series.StartDatetime))
+	occurrence.StartDatetime = start
+	occurrence.OccurrenceDate = &start
+	return occurrence
+}
+
+// parseOccurrenceDate reads the start of an occurrence of a series as given in URLs
+// and checks that the series has that occurrence
+func parseOccurrenceDate(series models.Activity, fecha string) (time.Time, error) {
+	if series.RecurrenceRule == nil {
+		return time.Time{}, errOccurrenceNotFound
+	}
+	start, err := time.Parse("2006-01-02T15:04", fecha)
+	if err != nil {
+		return time.Time{}, errOccurrenceNotFound
+	}
+	rule, err := ical.ParseRule(*series.RecurrenceRule)
+	if err != nil || !rule.Includes(series.StartDatetime, start) {
+		return time.Time{}, errOccurrenceNotFound
+	}
+
+	exclusions, err := getRecurrenceExclusions([]int{series.ID})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if exclusions[series.ID][start.Unix()] {
+		return time.Time{}, errOccurrenceNotFound
+	}
+	return start, nil
+}
+
+// getActivityOccurrence retrieves an activity, or one occurrence of a series when fecha is set
+func (h *Handlers) getActivityOccurrence(activityID, centro, fecha string) (models.Activity, error) {
+	activity, err := h.getActivity(activityID, centro)
+	if err != nil || fecha == "" {
+		return activity, err
+	}
+
+	start, err := parseOccurrenceDate(activity, fecha)
+	if err != nil {
+		return activity, err
+	}
+	occurrence := []models.Activity{activityOccurrence(activity, start)}
+	h.setOccurrenceStatuses(occurrence)
+	return occurrence[0], nil
+}
+
+// parseActivityRecurrence reads the repetition fields of the activity form into an RRULE,
+// nil when the activity does not repeat. UNTIL is the end of the chosen day.
+func parseActivityRecurrence(c *gin.Context, start time.Time) (*string, error) {
+	freq := c.PostForm("repeticion")
+	if freq == "" {
+		return nil, nil
+	}
+
+	rule := ical.Rule{Freq: freq, Interval: 1}
+	if interval := c.PostForm("intervalo"); interval != "" {
+		n, err := strconv.Atoi(interval)
+		if err != nil || n < 1 {
+			return nil, errInvalidRecurrence
+		}
+		rule.Interval = n
+	}
+
+	switch freq {
+	case ical.FreqDaily:
+	case ical.FreqWeekly:
+		for _, code := range c.PostFormArray("dias[]") {
+			weekday, ok := ical.ParseWeekday(code)
+			if !ok {
+				return nil, errInvalidRecurrence
+			}
+			rule.ByDay = append(rule.ByDay, weekday)
+		}
+	case ical.FreqMonthly:
+		if c.PostForm("mensual") == "semana" {
+			rule.ByDay = []time.Weekday{start.Weekday()}
+			rule.Ordinal = weekOfMonth(start)
+		}
+	default:
+		return nil, errInvalidRecurrence
+	}
+
+	switch c.PostForm("fin") {
+	case "hasta":
+		until, err := time.Parse("2006-01-02", c.PostForm("hasta"))
+		if err != nil || until.Before(start.Truncate(24*time.Hour)) {
+			return nil, errInvalidRecurrence
+		}
+		rule.Until = until.Add(24*time.Hour - time.Second)
+	case "veces":
+		n, err := strconv.Atoi(c.PostForm("veces"))
+		if err != nil || n < 1 {
+			return nil, errInvalidRecurrence
+		}
+		rule.Count = n
+	}
+
+	// Normalise the rule as the CalDAV clients will read it
+	parsed, err := ical.ParseRule(rule.String())
+	if err != nil {
+		return nil, errInvalidRecurrence
+	}
+	value := parsed.String()
+	return &value, nil
+}
+
+// weekOfMonth returns the week of the month of a day for monthly rules on a weekday,
+// -1 for the fifth one so the rule means the last one
+func weekOfMonth(t time.Time) int {
+	week := (t.Day()-1)/7 + 1
+	if week > 4 {
+		return -1
+	}
+	return week
+}
+
+// describeRecurrence describes the rule of a series in Spanish, such as
+// "Cada semana los lunes y miércoles, hasta el 30/06/2027"
+func describeRecurrence(activity models.Activity) string {
+	if activity.RecurrenceRule == nil {
+		return ""
+	}
+	rule, err := ical.ParseRule(*activity.RecurrenceRule)
+	if err != nil {
+		return "Se repite"
+	}
+
+	units := map[string][2]string{
+		ical.FreqDaily:   {"día", "días"},
+		ical.FreqWeekly:  {"semana", "semanas"},
+		ical.FreqMonthly: {"mes", "meses"},
+	}[rule.Freq]
+	text := "Cada " + units[0]
+	if rule.Interval > 1 {
+		text = fmt.Sprintf("Cada %d %s", rule.Interval, units[1])
+	}
+
+	switch {
+	case rule.Freq == ical.FreqWeekly && len(rule.ByDay) > 0:
+		names := make([]string, len(rule.ByDay))
+		for i, weekday := range rule.ByDay {
+			names[i] = weekdayNames[weekday]
+		}
+		if len(names) == 1 {
+			text += " los " + names[0]
+		} else {
+			text += " los " + strings.Join(names[:len(names)-1], ", ") + " y " + names[len(names)-1]
+		}
+	case rule.Freq == ical.FreqMonthly && len(rule.ByDay) == 1:
+		text += " el " + ordinalNames[rule.Ordinal] + " " + weekdayNames[rule.ByDay[0]]
+	case rule.Freq == ical.FreqMonthly:
+		text += fmt.Sprintf(" el día %d", activity.StartDatetime.Day())
+	}
+
+	switch {
+	case rule.Count == 1:
+		text += ", una vez"
+	case rule.Count > 1:
+		text += fmt.Sprintf(", %d veces", rule.Count)
+	case !rule.Until.IsZero():
+		text += ", hasta el " + rule.Until.Format("02/01/2006")
+	}
+	return text
+}
+
+// saveActivityOccurrence stores the changes to a single occurrence of a series as an
+// activity of its own that replaces it
+func (h *Handlers) saveActivityOccurrence(series models.Activity, occurrence time.Time, changes models.Activity) error {
+	_, err := database.DB.Exec(`INSERT INTO activities (center_id, title, description, start_datetime, end_datetime, is_global,
+			  meeting_url, web_url, status, recurrence_parent_id, recurrence_date, outside_working_hours, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`,
+		changes.CenterID, changes.Title, changes.Description, changes.StartDatetime, changes.EndDatetime, changes.IsGlobal,
+		changes.MeetingURL, changes.WebURL, changes.Status, series.ID, occurrence, changes.OutsideWorkingHours)
+	return err
+}
+
+// splitActivitySeries ends a series before one of its occurrences and starts a new series
+// with the changes from that occurrence on, returning the ID of the new series
+func (h *Handlers) splitActivitySeries(series models.Activity, occurrence time.Time, changes models.Activity) (int, error) {
+	// The number of repetitions left, when it was not changed in the form
+	if changes.RecurrenceRule != nil && *changes.RecurrenceRule == *series.RecurrenceRule {
+		rule, err := ical.ParseRule(*series.RecurrenceRule)
+		if err == nil && rule.Count > 0 {
+			rule.Count -= rule.CountBefore(series.StartDatetime, occurrence)
+			value := rule.String()
+			changes.RecurrenceRule = &value
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := endActivitySeries(tx, series, occurrence); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`INSERT INTO activities (center_id, title, description, start_datetime, end_datetime, is_global,
+			  meeting_url, web_url, status, recurrence_rule, outside_working_hours, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`,
+		changes.CenterID, changes.Title, changes.Description, changes.StartDatetime, changes.EndDatetime, changes.IsGlobal,
+		changes.MeetingURL, changes.WebURL, changes.Status, changes.RecurrenceRule, changes.OutsideWorkingHours)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), tx.Commit()
+}
+
+// truncateActivitySeries removes the occurrences of a series from the one starting at end on
+func (h *Handlers) truncateActivitySeries(series models.Activity, end time.Time) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := endActivitySeries(tx, series, end); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// endActivitySeries makes a series finish before the occurrence starting at end and
+// forgets the later removed and edited occurrences
+func endActivitySeries(tx *sql.Tx, series models.Activity, end time.Time) error {
+	rule, err := ical.ParseRule(*series.RecurrenceRule)
+	if err != nil {
+		return err
+	}
+	// Rules repeat at most once a day, so the series can end the day before
+	rule.Count = 0
+	rule.Until = end.Truncate(24 * time.Hour).Add(-time.Second)
+	rule.UntilUTC = false
+
+	if _, err := tx.Exec(`UPDATE activities SET recurrence_rule = ?, updated_at = datetime('now') WHERE id = ?`,
+		rule.String(), series.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM activity_exceptions WHERE activity_id = ? AND occurrence_date >= ?`, series.ID, end); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM activities WHERE recurrence_parent_id = ? AND recurrence_date >= ?`, series.ID, end)
+	return err
+}
+
+// updateActivityExclusions keeps the removed and edited occurrences of a series in line
+// after the whole series changed: they move with it, or are dropped if it no longer repeats
+func updateActivityExclusions(seriesID int, repeats bool, shift time.Duration) error {
+	if !repeats {
+		if _, err := database.DB.Exec(`DELETE FROM activity_exceptions WHERE activity_id = ?`, seriesID); err != nil {
+			return err
+		}
+		_, err := database.DB.Exec(`DELETE FROM activities WHERE recurrence_parent_id = ?`, seriesID)
+		return err
+	}
+	if shift == 0 {
+		return nil
+	}
+
+	dates, err := getActivityExceptions(seriesID)
+	if err != nil {
+		return err
+	}
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM activity_exceptions WHERE activity_id = ?`, seriesID); err != nil {
+		return err
+	}
+	for _, date := range dates {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO activity_exceptions (activity_id, occurrence_date) VALUES (?, ?)`,
+			seriesID, date.Add(shift)); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT id, recurrence_date FROM activities WHERE recurrence_parent_id = ?`, seriesID)
+	if err != nil {
+		return err
+	}
+	overrides := make(map[int]time.Time)
+	for rows.Next() {
+		var id int
+		var date time.Time
+		if err := rows.Scan(&id, &date); err == nil {
+			overrides[id] = date
+		}
+	}
+	rows.Close()
+	for id, date := range overrides {
+		if _, err := tx.Exec(`UPDATE activities SET recurrence_date = ? WHERE id = ?`, date.Add(shift), id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// removeActivityOccurrence removes one occurrence from a series. An edited occurrence is
+// deleted and its original occurrence is not shown again.
+func removeActivityOccurrence(seriesID int, occurrence time.Time, overrideID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if overrideID != 0 {
+		if _, err := tx.Exec(`DELETE FROM activities WHERE id = ?`, overrideID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO activity_exceptions (activity_id, occurrence_date) VALUES (?, ?)`,
+		seriesID, occurrence); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
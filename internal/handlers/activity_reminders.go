@@ -0,0 +1,462 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/EuskadiTech/Figaro/pkg/mail"
+	"github.com/gin-gonic/gin"
+)
+
+// activityHasRemindersSQL matches the activities with reminders. The reminders of a series
+// are sent for all its occurrences, including the edited ones.
+const activityHasRemindersSQL = `COALESCE(recurrence_parent_id, id) IN (SELECT activity_id FROM activity_reminders)`
+
+const (
+	// maxReminderAttempts is how many times an email reminder is tried before giving up
+	maxReminderAttempts = 5
+	// reminderRetryDelay is the wait before trying a failed email reminder again, multiplied
+	// by the attempts made
+	reminderRetryDelay = 5 * time.Minute
+)
+
+// activityReminderOption is how long before an activity the activity form can send a reminder
+type activityReminderOption struct {
+	Minutes  int
+	Label    string
+	Selected bool
+}
+
+// activityReminderOptions are the reminders an activity can have, the shortest first
+var activityReminderOptions = []activityReminderOption{
+	{Minutes: 15, Label: "15 minutos antes"},
+	{Minutes: 60, Label: "1 hora antes"},
+	{Minutes: 24 * 60, Label: "1 día antes"},
+	{Minutes: 7 * 24 * 60, Label: "1 semana antes"},
+}
+
+// reminderCenterOption is a center whose activity reminders a user can subscribe to
+type reminderCenterOption struct {
+	ID       int
+	Name     string
+	Selected bool
+}
+
+// reminderKey identifies a reminder of the outbox
+type reminderKey struct {
+	activityID int
+	occurrence string
+	minutes    int
+	userID     int
+}
+
+// parseActivityReminders reads the reminders selected in the activity form, leaving out
+// those that are not offered
+func parseActivityReminders(c *gin.Context) []int {
+	selected := make(map[string]bool)
+	for _, value := range c.PostFormArray("recordatorios[]") {
+		selected[value] = true
+	}
+
+	var minutes []int
+	for _, option := range activityReminderOptions {
+		if selected[strconv.Itoa(option.Minutes)] {
+			minutes = append(minutes, option.Minutes)
+		}
+	}
+	return minutes
+}
+
+// saveActivityReminders replaces the reminders of an activity. The outbox follows them the
+// next time the reminders are scheduled.
+func saveActivityReminders(activityID int, minutes []int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setActivityReminders(tx, activityID, minutes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setActivityReminders is saveActivityReminders inside an existing transaction
+func setActivityReminders(tx *sql.Tx, activityID int, minutes []int) error {
+	if _, err := tx.Exec(`DELETE FROM activity_reminders WHERE activity_id = ?`, activityID); err != nil {
+		return err
+	}
+	for _, m := range minutes {
+		if _, err := tx.Exec(`INSERT INTO activity_reminders (activity_id, minutes_before) VALUES (?, ?)`, activityID, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getActivityReminders returns how many minutes before an activity its reminders are sent,
+// the shortest first
+func getActivityReminders(activityID int) ([]int, error) {
+	rows, err := database.DB.Query(`SELECT minutes_before FROM activity_reminders WHERE activity_id = ? ORDER BY minutes_before`, activityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var minutes []int
+	for rows.Next() {
+		var m int
+		if err := rows.Scan(&m); err != nil {
+			continue
+		}
+		minutes = append(minutes, m)
+	}
+	return minutes, nil
+}
+
+// setActivityFormReminders adds to the activity form the reminders it can send
+func (h *Handlers) setActivityFormReminders(c *gin.Context, data gin.H) {
+	// Keep the submitted reminders when the form is shown again after an error
+	var minutes []int
+	if c.Request.Method == http.MethodPost {
+		minutes = parseActivityReminders(c)
+	} else if activity, ok := data["Activity"].(models.Activity); ok {
+		var err error
+		minutes, err = getActivityReminders(activitySeriesID(activity))
+		if err != nil {
+			logger.Error("Failed to get the reminders of activity %d: %v", activity.ID, err)
+		}
+	}
+	selected := make(map[int]bool)
+	for _, m := range minutes {
+		selected[m] = true
+	}
+
+	options := make([]activityReminderOption, len(activityReminderOptions))
+	for i, option := range activityReminderOptions {
+		option.Selected = selected[option.Minutes]
+		options[i] = option
+	}
+	data["ReminderOptions"] = options
+}
+
+// getReminderCenterOptions returns the centers a user can get the activity reminders of,
+// with those the user subscribed to selected
+func (h *Handlers) getReminderCenterOptions(userID int) ([]reminderCenterOption, error) {
+	centers, err := h.getAllCenters()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := database.DB.Query(`SELECT center_id FROM activity_reminder_subscriptions WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	selected := make(map[int]bool)
+	for rows.Next() {
+		var centerID int
+		if err := rows.Scan(&centerID); err != nil {
+			continue
+		}
+		selected[centerID] = true
+	}
+
+	var options []reminderCenterOption
+	for _, center := range centers {
+		options = append(options, reminderCenterOption{ID: center.ID, Name: center.Name, Selected: selected[center.ID]})
+	}
+	return options, nil
+}
+
+// saveReminderSubscriptions replaces the centers a user gets the activity reminders of
+func (h *Handlers) saveReminderSubscriptions(c *gin.Context, userID int) error {
+	centers, err := h.getAllCenters()
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]bool)
+	for _, id := range c.PostFormArray("recordatorios_centros[]") {
+		selected[id] = true
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM activity_reminder_subscriptions WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, center := range centers {
+		if !selected[strconv.Itoa(center.ID)] {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO activity_reminder_subscriptions (user_id, center_id) VALUES (?, ?)`, userID, center.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// getReminderRecipients returns the users reminded of an activity: its responsible staff
+// and the users subscribed to a center that sees it, shared and global activities included
+func getReminderRecipients(activity models.Activity) ([]int, error) {
+	seriesID := activitySeriesID(activity)
+	rows, err := database.DB.Query(`SELECT user_id FROM activity_staff WHERE activity_id = ?
+			  UNION
+			  SELECT user_id FROM activity_reminder_subscriptions
+			  WHERE ? OR center_id = ? OR center_id IN (SELECT center_id FROM activity_shares WHERE activity_id = ?)`,
+		seriesID, activity.IsGlobal, activity.CenterID, seriesID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// scheduleActivityReminders brings the outbox in line with the activities: it adds the
+// reminders of the upcoming occurrences, moves those whose activity starts at another time,
+// even if they were sent, and drops the pending ones of activities that were cancelled,
+// removed or no longer remind those users. A reminder that is already due when it is first
+// scheduled is only kept if it is the shortest one due, so late activities get one reminder.
+func (h *Handlers) scheduleActivityReminders(now time.Time) error {
+	centers, err := h.getAllCenters()
+	if err != nil {
+		return err
+	}
+	locations := make(map[int]*time.Location)
+	for _, center := range centers {
+		locations[center.ID] = loadTimezone(center.Timezone)
+	}
+	defaultLocation := loadTimezone(h.getDefaultTimezone())
+
+	// Activities are stored in the wall clock of their center, so the range covers every
+	// timezone around the reminders that can be due until the longest one
+	longest := time.Duration(activityReminderOptions[len(activityReminderOptions)-1].Minutes) * time.Minute
+	from := now.UTC().Add(-14 * time.Hour)
+	to := now.UTC().Add(longest + 14*time.Hour)
+	activities, err := h.getFilteredActivitiesBetween(activityHasRemindersSQL+` AND (status IS NULL OR status NOT IN ('cancelled', 'postponed'))`,
+		nil, from, to)
+	if err != nil {
+		return err
+	}
+
+	type outboxEntry struct {
+		key    reminderKey
+		start  time.Time
+		sendAt time.Time
+	}
+	var entries []outboxEntry
+	reminders := make(map[int][]int)
+	scheduled := make(map[reminderKey]bool)
+	for _, activity := range activities {
+		location := defaultLocation
+		if activity.CenterID != nil && locations[*activity.CenterID] != nil {
+			location = locations[*activity.CenterID]
+		}
+		start := inLocation(activity.StartDatetime, location)
+		if !start.After(now) {
+			continue
+		}
+
+		seriesID := activitySeriesID(activity)
+		minutes, ok := reminders[seriesID]
+		if !ok {
+			if minutes, err = getActivityReminders(seriesID); err != nil {
+				return err
+			}
+			reminders[seriesID] = minutes
+		}
+		recipients, err := getReminderRecipients(activity)
+		if err != nil {
+			return err
+		}
+
+		due := false
+		for _, m := range minutes {
+			sendAt := start.Add(-time.Duration(m) * time.Minute)
+			if !sendAt.After(now) {
+				if due {
+					continue
+				}
+				due = true
+			}
+			for _, userID := range recipients {
+				key := reminderKey{activityID: activity.ID, occurrence: activity.OccurrenceKey(), minutes: m, userID: userID}
+				scheduled[key] = true
+				entries = append(entries, outboxEntry{key: key, start: activity.StartDatetime, sendAt: sendAt})
+			}
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, entry := range entries {
+		_, err := tx.Exec(`INSERT INTO activity_reminder_outbox (activity_id, occurrence, minutes_before, user_id, start_datetime, send_at)
+				  VALUES (?, ?, ?, ?, ?, ?)
+				  ON CONFLICT(activity_id, occurrence, minutes_before, user_id) DO UPDATE SET
+				  start_datetime = excluded.start_datetime, send_at = excluded.send_at, status = 'pending', attempts = 0,
+				  next_attempt_at = NULL, last_error = '', notified_at = NULL, sent_at = NULL
+				  WHERE activity_reminder_outbox.send_at <> excluded.send_at`,
+			entry.key.activityID, entry.key.occurrence, entry.key.minutes, entry.key.userID, entry.start,
+			entry.sendAt.UTC().Format("2006-01-02 15:04:05"))
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT id, activity_id, occurrence, minutes_before, user_id FROM activity_reminder_outbox WHERE status = 'pending'`)
+	if err != nil {
+		return err
+	}
+	var cancelled []int
+	for rows.Next() {
+		var id int
+		var key reminderKey
+		if err := rows.Scan(&id, &key.activityID, &key.occurrence, &key.minutes, &key.userID); err != nil {
+			continue
+		}
+		if !scheduled[key] {
+			cancelled = append(cancelled, id)
+		}
+	}
+	rows.Close()
+	for _, id := range cancelled {
+		if _, err := tx.Exec(`DELETE FROM activity_reminder_outbox WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// sendActivityReminders delivers the due reminders of the outbox: an in-app notification
+// and, when email is configured and the user has an address, an email. Failed emails are
+// tried again later until maxReminderAttempts.
+func (h *Handlers) sendActivityReminders(now time.Time) error {
+	current := now.UTC().Format("2006-01-02 15:04:05")
+	rows, err := database.DB.Query(`SELECT o.id, o.user_id, o.start_datetime, o.attempts, o.notified_at IS NOT NULL,
+			  a.title, COALESCE(c.name, ''), COALESCE(u.email, '')
+			  FROM activity_reminder_outbox o
+			  JOIN activities a ON o.activity_id = a.id
+			  JOIN users u ON o.user_id = u.id
+			  LEFT JOIN centers c ON a.center_id = c.id
+			  WHERE o.status = 'pending' AND o.send_at <= ? AND (o.next_attempt_at IS NULL OR o.next_attempt_at <= ?)
+			  ORDER BY o.send_at, o.id`, current, current)
+	if err != nil {
+		return err
+	}
+
+	type dueReminder struct {
+		id, userID, attempts int
+		start                time.Time
+		notified             bool
+		title, center, email string
+	}
+	var due []dueReminder
+	for rows.Next() {
+		var reminder dueReminder
+		err := rows.Scan(&reminder.id, &reminder.userID, &reminder.start, &reminder.attempts, &reminder.notified,
+			&reminder.title, &reminder.center, &reminder.email)
+		if err != nil {
+			continue
+		}
+		due = append(due, reminder)
+	}
+	rows.Close()
+	if len(due) == 0 {
+		return nil
+	}
+
+	cfg := h.getEmailConfig()
+	sent := 0
+	for _, reminder := range due {
+		message := fmt.Sprintf("La actividad %s empieza el %s a las %s", reminder.title,
+			reminder.start.Format("02/01/2006"), reminder.start.Format("15:04"))
+		if reminder.center != "" {
+			message += " en " + reminder.center
+		}
+		message += "."
+
+		// The in-app notification is stored once, even if the email is tried again
+		if !reminder.notified {
+			link := "/actividades/calendario?vista=dia&fecha=" + reminder.start.Format("2006-01-02")
+			if _, err := database.DB.Exec(`INSERT INTO notifications (user_id, message, link) VALUES (?, ?, ?)`,
+				reminder.userID, "Recordatorio: "+message, link); err != nil {
+				return err
+			}
+			if _, err := database.DB.Exec(`UPDATE activity_reminder_outbox SET notified_at = datetime('now') WHERE id = ?`, reminder.id); err != nil {
+				return err
+			}
+		}
+
+		if cfg.Enabled() && reminder.email != "" {
+			if err := mail.Send(cfg, []string{reminder.email}, "Recordatorio de actividad: "+reminder.title, message); err != nil {
+				logger.Error("Failed to email reminder %d: %v", reminder.id, err)
+				attempts := reminder.attempts + 1
+				status := "pending"
+				if attempts >= maxReminderAttempts {
+					status = "failed"
+				}
+				nextAttempt := now.UTC().Add(time.Duration(attempts) * reminderRetryDelay).Format("2006-01-02 15:04:05")
+				_, err := database.DB.Exec(`UPDATE activity_reminder_outbox SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?`,
+					status, attempts, nextAttempt, err.Error(), reminder.id)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if _, err := database.DB.Exec(`UPDATE activity_reminder_outbox SET status = 'sent', sent_at = datetime('now') WHERE id = ?`, reminder.id); err != nil {
+			return err
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		logger.Info("Sent %d activity reminders", sent)
+	}
+	return nil
+}
+
+// RunActivityReminders periodically schedules the reminders of upcoming activities and
+// sends those that are due
+func (h *Handlers) RunActivityReminders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if err := h.scheduleActivityReminders(now); err != nil {
+			logger.Error("Failed to schedule activity reminders: %v", err)
+		} else if err := h.sendActivityReminders(now); err != nil {
+			logger.Error("Failed to send activity reminders: %v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// Conditions on the activities table for the centers that can see an activity. Each takes
+// the name of the center as its only parameter. An edited occurrence of a series is shared
+// with the centers its series is shared with.
+const (
+	// activitySharedWithSQL matches the activities other centers shared with the center
+	activitySharedWithSQL = `COALESCE(recurrence_parent_id, id) IN (SELECT activity_id FROM activity_shares
+			  WHERE center_id = (SELECT id FROM centers WHERE name = ?))`
+	// activitySharedBySQL matches the activities of the center that it shared with others
+	activitySharedBySQL = `(center_id = (SELECT id FROM centers WHERE name = ?)
+			  AND COALESCE(recurrence_parent_id, id) IN (SELECT activity_id FROM activity_shares))`
+)
+
+// activityVisibleSQL matches the activities a center can see: its own, the global ones and
+// those shared with it. It takes the name of the center twice.
+const activityVisibleSQL = `(center_id = (SELECT id FROM centers WHERE name = ?) OR is_global = 1 OR ` + activitySharedWithSQL + `)`
+
+// activityShareOption is a center the activity form can share an activity with
+type activityShareOption struct {
+	ID       int
+	Name     string
+	Selected bool
+}
+
+// ActividadesDejarDeCompartir stops sharing an activity of the current center with another center
+func (h *Handlers) ActividadesDejarDeCompartir(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	// Only the center that owns the activity can revoke its shares
+	result, err := database.DB.Exec(`DELETE FROM activity_shares WHERE activity_id = ? AND center_id = ?
+			  AND activity_id IN (SELECT id FROM activities WHERE center_id = (SELECT id FROM centers WHERE name = ?))`,
+		c.Param("id"), c.PostForm("centro_id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/actividades?tab=compartidas&error=Error al dejar de compartir la actividad")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		c.Redirect(http.StatusFound, "/actividades?tab=compartidas&error=Actividad no encontrada o sin permisos")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/actividades?tab=compartidas&success=La actividad ya no se comparte con ese centro")
+}
+
+// getActivityShares returns the centers an activity is shared with
+func getActivityShares(activityID int) ([]models.ActivityShare, error) {
+	rows, err := database.DB.Query(`SELECT s.id, s.activity_id, s.center_id, s.shared_by_center_id, s.created_at, c.name
+			  FROM activity_shares s
+			  JOIN centers c ON s.center_id = c.id
+			  WHERE s.activity_id = ?
+			  ORDER BY c.name`, activityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []models.ActivityShare
+	for rows.Next() {
+		var share models.ActivityShare
+		err := rows.Scan(&share.ID, &share.ActivityID, &share.CenterID, &share.SharedByCenterID, &share.CreatedAt, &share.CenterName)
+		if err != nil {
+			continue
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// parseActivityShares reads the centers selected in the activity form, leaving out the
+// current center and any center that does not exist
+func (h *Handlers) parseActivityShares(c *gin.Context, centro string) []int {
+	centers, err := h.getAllCenters()
+	if err != nil {
+		return nil
+	}
+	selected := make(map[string]bool)
+	for _, id := range c.PostFormArray("compartir[]") {
+		selected[strings.TrimSpace(id)] = true
+	}
+
+	var ids []int
+	for _, center := range centers {
+		if center.Name != centro && selected[strconv.Itoa(center.ID)] {
+			ids = append(ids, center.ID)
+		}
+	}
+	return ids
+}
+
+// saveActivityShares replaces the centers an activity is shared with. The centers left out
+// stop seeing the activity.
+func saveActivityShares(activityID, originCenterID int, centerIDs []int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setActivityShares(tx, activityID, originCenterID, centerIDs); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setActivityShares is saveActivityShares inside an existing transaction
+func setActivityShares(tx *sql.Tx, activityID, originCenterID int, centerIDs []int) error {
+	query := `DELETE FROM activity_shares WHERE activity_id = ?`
+	args := []interface{}{activityID}
+	if len(centerIDs) > 0 {
+		query += ` AND center_id NOT IN (` + strings.TrimSuffix(strings.Repeat("?,", len(centerIDs)), ",") + `)`
+		for _, id := range centerIDs {
+			args = append(args, id)
+		}
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+
+	for _, id := range centerIDs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO activity_shares (activity_id, center_id, shared_by_center_id) VALUES (?, ?, ?)`,
+			activityID, id, originCenterID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateActivityShares saves the centers selected in the form of an edited activity. A
+// global activity is seen by every center, so it is no longer shared with some of them.
+func (h *Handlers) updateActivityShares(c *gin.Context, activityID int, centro string, centerID *int) error {
+	if centerID == nil {
+		return saveActivityShares(activityID, 0, nil)
+	}
+	return saveActivityShares(activityID, *centerID, h.parseActivityShares(c, centro))
+}
+
+// setActivityFormShares adds to the activity form the centers the activity can be shared with
+func (h *Handlers) setActivityFormShares(c *gin.Context, data gin.H, centro string) {
+	centers, err := h.getAllCenters()
+	if err != nil {
+		return
+	}
+
+	// Keep the submitted selection when the form is shown again after an error
+	selected := make(map[int]bool)
+	if c.Request.Method == http.MethodPost {
+		for _, id := range h.parseActivityShares(c, centro) {
+			selected[id] = true
+		}
+	} else if activity, ok := data["Activity"].(models.Activity); ok {
+		shares, err := getActivityShares(activity.ID)
+		if err == nil {
+			for _, share := range shares {
+				selected[share.CenterID] = true
+			}
+		}
+	}
+
+	var options []activityShareOption
+	for _, center := range centers {
+		if center.Name == centro {
+			continue
+		}
+		options = append(options, activityShareOption{ID: center.ID, Name: center.Name, Selected: selected[center.ID]})
+	}
+	data["ShareCenters"] = options
+}
+
+// setActivitiesSharing fills in how the listed activities are shared: the origin center of
+// those shared with the center, which is shown on their read-only copy, and the recipients
+// of those the center shares with others
+func (h *Handlers) setActivitiesSharing(activities []models.Activity, centro string) {
+	centers, err := h.getAllCenters()
+	if err != nil {
+		return
+	}
+	names := make(map[int]string)
+	currentID := 0
+	for _, center := range centers {
+		names[center.ID] = center.Name
+		if center.Name == centro {
+			currentID = center.ID
+		}
+	}
+
+	for i := range activities {
+		activity := &activities[i]
+		if activity.IsGlobal || activity.CenterID == nil {
+			continue
+		}
+		if *activity.CenterID != currentID {
+			name := names[*activity.CenterID]
+			activity.SharedFromCenter = &name
+			continue
+		}
+
+		seriesID := activity.ID
+		if activity.RecurrenceParentID != nil {
+			seriesID = *activity.RecurrenceParentID
+		}
+		shares, err := getActivityShares(seriesID)
+		if err != nil {
+			logger.Error("Failed to get the shares of activity %d: %v", seriesID, err)
+			continue
+		}
+		activity.Shares = shares
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/ical"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// isManualActivityStatus reports whether a status is set by users, so the scheduler keeps it,
+// instead of following the dates of the activity
+func isManualActivityStatus(status string) bool {
+	switch status {
+	case "cancelled", "postponed":
+		return true
+	}
+	return false
+}
+
+// isValidActivityStatus reports whether an activity can be filtered by a status
+func isValidActivityStatus(status string) bool {
+	switch status {
+	case "pending", "in_progress", "completed", "cancelled", "postponed":
+		return true
+	}
+	return false
+}
+
+// activityLifecycleStatus returns the status of an activity from its dates, given as wall
+// clock times of its center like now. A series is in progress from its first occurrence until
+// the last one ends, so one that repeats forever never completes.
+func activityLifecycleStatus(start, end time.Time, rule *string, now time.Time) string {
+	if now.Before(start) {
+		return "pending"
+	}
+	if rule != nil {
+		if r, err := ical.ParseRule(*rule); err == nil {
+			// An occurrence that started after now minus its duration has not ended yet
+			if _, ok := r.Next(start, now.Add(-end.Sub(start)).Add(time.Second)); ok {
+				return "in_progress"
+			}
+			return "completed"
+		}
+	}
+	if now.Before(end) {
+		return "in_progress"
+	}
+	return "completed"
+}
+
+// activityClock returns a function that gives the current time in the center of an
+// activity, as a wall clock time like activities are stored. Global activities take the
+// default timezone.
+func (h *Handlers) activityClock() func(models.Activity) time.Time {
+	now := time.Now()
+	defaultLocation := loadTimezone(h.getDefaultTimezone())
+	locations := make(map[int]*time.Location)
+	if centers, err := h.getAllCenters(); err == nil {
+		for _, center := range centers {
+			locations[center.ID] = loadTimezone(center.Timezone)
+		}
+	}
+
+	return func(activity models.Activity) time.Time {
+		location := defaultLocation
+		if activity.CenterID != nil && locations[*activity.CenterID] != nil {
+			location = locations[*activity.CenterID]
+		}
+		return wallClock(now, location)
+	}
+}
+
+// setOccurrenceStatuses gives each occurrence of a series the status of its own dates. The
+// stored status of a series covers all its occurrences, so it is only kept when it was set
+// by hand.
+func (h *Handlers) setOccurrenceStatuses(occurrences []models.Activity) {
+	clock := h.activityClock()
+	for i := range occurrences {
+		occurrence := &occurrences[i]
+		if occurrence.OccurrenceDate == nil || isManualActivityStatus(occurrence.Status) {
+			continue
+		}
+		occurrence.Status = activityLifecycleStatus(occurrence.StartDatetime, occurrence.EndDatetime, nil, clock(*occurrence))
+	}
+}
+
+// updateActivityStatuses moves the activities that follow their dates to the status they are
+// in now, in the timezone of their center, and records the changes. Global activities take
+// the default timezone.
+func (h *Handlers) updateActivityStatuses() error {
+	rows, err := database.DB.Query(`SELECT a.id, a.status, a.start_datetime, a.end_datetime, a.recurrence_rule, COALESCE(c.timezone, '')
+			  FROM activities a
+			  LEFT JOIN centers c ON a.center_id = c.id
+			  WHERE a.status IS NULL OR a.status NOT IN ('cancelled', 'postponed')`)
+	if err != nil {
+		return err
+	}
+
+	type statusChange struct {
+		id       int
+		from, to string
+	}
+	defaultTimezone := h.getDefaultTimezone()
+	locations := make(map[string]*time.Location)
+	now := time.Now()
+
+	var changes []statusChange
+	for rows.Next() {
+		var id int
+		var status sql.NullString
+		var start, end time.Time
+		var rule *string
+		var timezone string
+		if err := rows.Scan(&id, &status, &start, &end, &rule, &timezone); err != nil {
+			rows.Close()
+			return err
+		}
+		if timezone == "" {
+			timezone = defaultTimezone
+		}
+		location, ok := locations[timezone]
+		if !ok {
+			location = loadTimezone(timezone)
+			locations[timezone] = location
+		}
+
+		if next := activityLifecycleStatus(start, end, rule, wallClock(now, location)); next != status.String {
+			changes = append(changes, statusChange{id: id, from: status.String, to: next})
+		}
+	}
+	rows.Close()
+	if len(changes) == 0 {
+		return nil
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, change := range changes {
+		if _, err := tx.Exec(`UPDATE activities SET status = ? WHERE id = ?`, change.to, change.id); err != nil {
+			return err
+		}
+		if err := recordActivityStatus(tx, change.id, change.from, change.to, nil); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logger.Info("Updated the status of %d activities", len(changes))
+	return nil
+}
+
+// recordActivityStatus adds a status change to the history of an activity. userID is nil
+// for the changes made by the scheduler.
+func recordActivityStatus(tx *sql.Tx, activityID int, from, to string, userID *int) error {
+	if from == to {
+		return nil
+	}
+	var oldStatus *string
+	if from != "" {
+		oldStatus = &from
+	}
+	_, err := tx.Exec(`INSERT INTO activity_status_history (activity_id, old_status, new_status, changed_by) VALUES (?, ?, ?, ?)`,
+		activityID, oldStatus, to, userID)
+	return err
+}
+
+// saveActivityStatusChange records the status a user gave to an activity and moves it along
+// its dates right away when it follows them
+func (h *Handlers) saveActivityStatusChange(activityID int, from, to string, userID int) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		logger.Error("Failed to record the status of activity %d: %v", activityID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := recordActivityStatus(tx, activityID, from, to, &userID); err != nil {
+		logger.Error("Failed to record the status of activity %d: %v", activityID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Error("Failed to record the status of activity %d: %v", activityID, err)
+		return
+	}
+
+	if err := h.updateActivityStatuses(); err != nil {
+		logger.Error("Failed to update activity statuses: %v", err)
+	}
+}
+
+// getActivityStatusHistory returns the status changes of an activity, the latest first
+func getActivityStatusHistory(activityID int) ([]models.ActivityStatusChange, error) {
+	rows, err := database.DB.Query(`SELECT h.id, h.activity_id, COALESCE(h.old_status, ''), h.new_status, h.changed_by,
+			  COALESCE(NULLIF(u.display_name, ''), u.username, ''), h.changed_at
+			  FROM activity_status_history h
+			  LEFT JOIN users u ON h.changed_by = u.id
+			  WHERE h.activity_id = ?
+			  ORDER BY h.changed_at DESC, h.id DESC`, activityID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []models.ActivityStatusChange
+	for rows.Next() {
+		var change models.ActivityStatusChange
+		err := rows.Scan(&change.ID, &change.ActivityID, &change.OldStatus, &change.NewStatus, &change.ChangedBy,
+			&change.ChangedByName, &change.ChangedAt)
+		if err != nil {
+			continue
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
+
+// setActivityFormStatusHistory adds the status history of the edited activity to the activity form
+func (h *Handlers) setActivityFormStatusHistory(data gin.H) {
+	activity, ok := data["Activity"].(models.Activity)
+	if !ok {
+		return
+	}
+	history, err := getActivityStatusHistory(activity.ID)
+	if err != nil {
+		logger.Error("Failed to get the status history of activity %d: %v", activity.ID, err)
+		return
+	}
+	data["StatusHistory"] = history
+}
+
+// RunActivityStatusUpdater periodically moves activities through their status lifecycle
+func (h *Handlers) RunActivityStatusUpdater(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := h.updateActivityStatuses(); err != nil {
+			logger.Error("Failed to update activity statuses: %v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -570,11 +571,17 @@ func (h *Handlers) AdminCentroEditar(c *gin.Context) {
 		return
 	}
 
+	workingHours, err := getWorkingHoursDays(center.ID)
+	if err != nil {
+		logger.Error("Failed to get working hours of center %d: %v", center.ID, err)
+	}
+
 	// Show edit form
 	data := h.getCommonData(c)
 	data["PageTitle"] = "Figaró - Editar Centro"
 	data["Action"] = "editar"
 	data["Center"] = center
+	data["WorkingHours"] = workingHours
 
 	h.renderTemplate(c, "admin_centro_form.html", data)
 }
@@ -583,6 +590,7 @@ func (h *Handlers) AdminCentroEditar(c *gin.Context) {
 func (h *Handlers) handleCenterUpdate(c *gin.Context, centerID string) {
 	name := c.PostForm("nombre")
 	timezone := c.PostForm("timezone")
+	workingHours, workingHoursErr := parseWorkingHoursDays(c)
 
 	if name == "" {
 		center, _ := h.getCenterByID(centerID)
@@ -590,12 +598,26 @@ func (h *Handlers) handleCenterUpdate(c *gin.Context, centerID string) {
 		data["PageTitle"] = "Figaró - Editar Centro"
 		data["Action"] = "editar"
 		data["Center"] = center
+		data["WorkingHours"] = workingHours
 		data["ErrorMessage"] = "El nombre del centro es obligatorio"
 		data["FormData"] = map[string]string{"nombre": name, "timezone": timezone}
 		h.renderTemplate(c, "admin_centro_form.html", data)
 		return
 	}
 
+	if workingHoursErr != nil {
+		center, _ := h.getCenterByID(centerID)
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Centro"
+		data["Action"] = "editar"
+		data["Center"] = center
+		data["WorkingHours"] = workingHours
+		data["ErrorMessage"] = "El horario no es válido: cada día abierto necesita una hora de apertura anterior a la de cierre"
+		data["FormData"] = map[string]string{"nombre": name, "timezone": timezone}
+		h.renderTemplate(c, "admin_centro_form.html", data)
+		return
+	}
+
 	// Set default timezone if none provided
 	if timezone == "" {
 		timezone = "Europe/Madrid"
@@ -609,12 +631,19 @@ func (h *Handlers) handleCenterUpdate(c *gin.Context, centerID string) {
 		data["PageTitle"] = "Figaró - Editar Centro"
 		data["Action"] = "editar"
 		data["Center"] = center
+		data["WorkingHours"] = workingHours
 		data["ErrorMessage"] = "Error al actualizar el centro: " + err.Error()
 		data["FormData"] = map[string]string{"nombre": name, "timezone": timezone}
 		h.renderTemplate(c, "admin_centro_form.html", data)
 		return
 	}
 
+	id, _ := strconv.Atoi(centerID)
+	if err := saveWorkingHours(id, workingHours); err != nil {
+		c.Redirect(http.StatusFound, "/admin/centros?error=Centro actualizado, pero no se pudo guardar el horario")
+		return
+	}
+
 	c.Redirect(http.StatusFound, "/admin/centros?success=Centro actualizado correctamente")
 }
 
@@ -638,8 +667,17 @@ func (h *Handlers) AdminMaterialesReport(c *gin.Context) {
 		centers = []models.Center{}
 	}
 
+	// Get filters; a category also includes its subcategories
+	centerFilter, _ := parseIntSafe(c.Query("centro"))
+	categoryFilter, _ := parseIntSafe(c.Query("categoria"))
+
+	categories, err := h.getAllMaterialCategories()
+	if err != nil {
+		categories = []models.MaterialCategory{}
+	}
+
 	// Get all materials with center information
-	materials, err := h.getAllMaterialsWithCenter()
+	materials, err := h.getAllMaterialsWithCenter(centerFilter, categoryFilter)
 	if err != nil {
 		materials = []models.MaterialWithCenter{}
 	}
@@ -647,11 +685,69 @@ func (h *Handlers) AdminMaterialesReport(c *gin.Context) {
 	// Calculate statistics
 	stats := h.calculateMaterialStats(materials)
 
+	// Consumption forecast over the chosen window, suggesting a minimum that covers coverageDays
+	windowDays, _ := parseIntSafe(c.Query("dias"))
+	if windowDays != 30 && windowDays != 180 && windowDays != 365 {
+		windowDays = defaultConsumptionWindow
+	}
+	coverageDays, err := parseIntSafe(c.Query("cobertura"))
+	if err != nil || coverageDays < 1 || coverageDays > 365 {
+		coverageDays = defaultCoverageDays
+	}
+	h.applyConsumptionForecast(materials, windowDays, coverageDays)
+
+	// The trend charts can focus on a single material of the report
+	materialFilter, _ := parseIntSafe(c.Query("material"))
+	materialFilterName := ""
+	for _, material := range materials {
+		if material.ID == materialFilter {
+			materialFilterName = material.Name + " (" + material.CenterName + ")"
+		}
+	}
+	if materialFilterName == "" {
+		materialFilter = 0
+	}
+	monthlyTrend, termTrend, err := h.getConsumptionTrend(centerFilter, categoryFilter, materialFilter)
+	if err != nil {
+		monthlyTrend, termTrend = []models.ConsumptionPeriod{}, []models.ConsumptionPeriod{}
+	}
+
+	// Value of the stock and spend per school term, for the quarterly figures
+	valuation, err := h.getInventoryValuation(centerFilter, categoryFilter)
+	if err != nil {
+		valuation = []models.InventoryValuation{}
+	}
+	valuationTotal := 0.0
+	uncostedMaterials := 0
+	for _, row := range valuation {
+		valuationTotal += row.Value
+		uncostedMaterials += row.Uncosted
+	}
+	spendByTerm, err := h.getSpendByTerm(centerFilter, categoryFilter)
+	if err != nil {
+		spendByTerm = []models.SpendPeriod{}
+	}
+
 	data := h.getCommonData(c)
 	data["PageTitle"] = "Figaró - Informe de Materiales por Centro"
 	data["Centers"] = centers
+	data["Categories"] = categories
+	data["CenterFilter"] = centerFilter
+	data["CategoryFilter"] = categoryFilter
+	data["MaterialFilter"] = materialFilter
+	data["MaterialFilterName"] = materialFilterName
+	data["WindowDays"] = windowDays
+	data["CoverageDays"] = coverageDays
 	data["Materials"] = materials
 	data["Stats"] = stats
+	data["MonthlyTrend"] = monthlyTrend
+	data["TermTrend"] = termTrend
+	data["Valuation"] = valuation
+	data["ValuationTotal"] = valuationTotal
+	data["UncostedMaterials"] = uncostedMaterials
+	data["SpendByTerm"] = spendByTerm
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
 
 	h.renderTemplate(c, "admin_materiales_report.html", data)
 }
@@ -676,20 +772,52 @@ func (h *Handlers) AdminActividadesReport(c *gin.Context) {
 		centers = []models.Center{}
 	}
 
+	// Get filters; the dates select the activities taking place between them
+	centerFilter, _ := parseIntSafe(c.Query("centro"))
+	statusFilter := c.Query("estado")
+	if !isValidActivityStatus(statusFilter) {
+		statusFilter = ""
+	}
+	fromFilter, toFilter := c.Query("fecha_inicio"), c.Query("fecha_fin")
+	if _, err := time.Parse("2006-01-02", fromFilter); err != nil {
+		fromFilter = ""
+	}
+	if _, err := time.Parse("2006-01-02", toFilter); err != nil {
+		toFilter = ""
+	}
+	condition, args := activityReportCondition(centerFilter, fromFilter, toFilter)
+	occurrences, err := h.getReportOccurrences(centerFilter, fromFilter, toFilter)
+	if err != nil {
+		logger.Error("Failed to get the occurrences of the activities report: %v", err)
+		occurrences = []models.Activity{}
+	}
+
 	// Get recent activities with center information
-	activities, err := h.getAllActivitiesWithCenter()
+	activities, err := h.getAllActivitiesWithCenter(condition, args, occurrences, statusFilter)
 	if err != nil {
 		activities = []models.ActivityWithCenter{}
 	}
 
-	// Calculate statistics
-	stats := h.calculateActivityStats()
+	// Calculate statistics of every status
+	stats := h.calculateActivityStats(condition, args, occurrences)
+
+	// Participation of the classrooms and their centers in the activities of the period
+	participation, err := getClassroomParticipation(centerFilter, fromFilter, toFilter)
+	if err != nil {
+		participation = []models.ClassroomParticipation{}
+	}
 
 	data := h.getCommonData(c)
 	data["PageTitle"] = "Figaró - Informe de Actividades"
 	data["Centers"] = centers
+	data["CenterFilter"] = centerFilter
+	data["StatusFilter"] = statusFilter
+	data["FromFilter"] = fromFilter
+	data["ToFilter"] = toFilter
 	data["Activities"] = activities
 	data["Stats"] = stats
+	data["ClassroomParticipation"] = participation
+	data["CenterParticipation"] = participationByCenter(participation)
 
 	h.renderTemplate(c, "admin_actividades_report.html", data)
 }
@@ -1530,17 +1658,32 @@ func (h *Handlers) getAllCenters() ([]models.Center, error) {
 	return centers, nil
 }
 
-// getAllMaterialsWithCenter gets all materials with their center names
-func (h *Handlers) getAllMaterialsWithCenter() ([]models.MaterialWithCenter, error) {
+// getAllMaterialsWithCenter gets all materials with their center names, optionally
+// filtered by center and by category (including its subcategories); 0 means no filter
+func (h *Handlers) getAllMaterialsWithCenter(centerID, categoryID int) ([]models.MaterialWithCenter, error) {
+	where := "1 = 1"
+	var args []interface{}
+	if centerID != 0 {
+		where += " AND m.center_id = ?"
+		args = append(args, centerID)
+	}
+	if categoryID != 0 {
+		where += " AND m.category_id IN (" + categoryTreeSQL + ")"
+		args = append(args, categoryID)
+	}
+
 	query := `
 		SELECT m.id, m.center_id, c.name as center_name, m.name, m.photo_path, m.unit, 
-			   m.available_quantity, m.minimum_quantity, m.notes, m.category, m.created_at, m.updated_at
+			   m.available_quantity, m.minimum_quantity, m.notes, m.category,
+			   COALESCE(mc.name, ''), COALESCE(mc.icon, ''), m.created_at, m.updated_at
 		FROM materials m
 		JOIN centers c ON m.center_id = c.id
+		LEFT JOIN material_categories mc ON m.category_id = mc.id
+		WHERE ` + where + `
 		ORDER BY c.name, m.name
 	`
 
-	rows, err := database.DB.Query(query)
+	rows, err := database.DB.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -1551,13 +1694,23 @@ func (h *Handlers) getAllMaterialsWithCenter() ([]models.MaterialWithCenter, err
 		var material models.MaterialWithCenter
 		err := rows.Scan(&material.ID, &material.CenterID, &material.CenterName, &material.Name,
 			&material.PhotoPath, &material.Unit, &material.AvailableQuantity, &material.MinimumQuantity,
-			&material.Notes, &material.Category, &material.CreatedAt, &material.UpdatedAt)
+			&material.Notes, &material.Category, &material.CategoryName, &material.CategoryIcon,
+			&material.CreatedAt, &material.UpdatedAt)
 		if err != nil {
 			continue
 		}
 		materials = append(materials, material)
 	}
 
+	// Quantities are shown broken down into the units of each material
+	units, err := h.getUnitsByMaterial(centerID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range materials {
+		materials[i].Units = units[materials[i].ID]
+	}
+
 	return materials, nil
 }
 
@@ -1581,19 +1734,102 @@ func (h *Handlers) calculateMaterialStats(materials []models.MaterialWithCenter)
 	return stats
 }
 
-// getAllActivitiesWithCenter gets all activities with their center names
-func (h *Handlers) getAllActivitiesWithCenter() ([]models.ActivityWithCenter, error) {
+// activityReportCondition returns the condition on the single activities (joined as a) of the
+// activities report for a center and the days from and to, each optional. The occurrences
+// of the series come from getReportOccurrences.
+func activityReportCondition(centerID int, from, to string) (string, []interface{}) {
+	condition := "a.recurrence_rule IS NULL"
+	var args []interface{}
+	if centerID != 0 {
+		condition += " AND a.center_id = ?"
+		args = append(args, centerID)
+	}
+	if from != "" {
+		condition += " AND a.end_datetime >= ?"
+		args = append(args, from)
+	}
+	if to != "" {
+		condition += " AND a.start_datetime < date(?, '+1 day')"
+		args = append(args, to)
+	}
+	return condition, args
+}
+
+// getReportOccurrences returns the occurrences of the series of the activities report for a
+// center and the days from and to, each optional, with the status of their own dates.
+// Without an end day they reach recurrenceHorizonYears ahead.
+func (h *Handlers) getReportOccurrences(centerID int, from, to string) ([]models.Activity, error) {
+	fromTime := time.Time{}
+	if parsed, err := time.Parse("2006-01-02", from); err == nil {
+		fromTime = parsed
+	}
+	toTime := time.Now().UTC().AddDate(recurrenceHorizonYears, 0, 0)
+	if parsed, err := time.Parse("2006-01-02", to); err == nil {
+		toTime = parsed.AddDate(0, 0, 1)
+	}
+
+	query := `SELECT ` + activityColumns + ` FROM activities
+			  WHERE recurrence_rule IS NOT NULL AND start_datetime < ?`
+	args := []interface{}{toTime.Format("2006-01-02 15:04:05")}
+	if centerID != 0 {
+		query += " AND center_id = ?"
+		args = append(args, centerID)
+	}
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var series []models.Activity
+	expandFrom := fromTime
+	for rows.Next() {
+		activity, err := scanActivity(rows)
+		if err != nil {
+			continue
+		}
+		series = append(series, activity)
+		// Occurrences that started earlier may still be taking place
+		if start := fromTime.Add(-activity.EndDatetime.Sub(activity.StartDatetime)); start.Before(expandFrom) {
+			expandFrom = start
+		}
+	}
+	rows.Close()
+
+	expanded, err := expandActivitySeries(series, expandFrom, toTime)
+	if err != nil {
+		return nil, err
+	}
+	var occurrences []models.Activity
+	for _, occurrence := range expanded {
+		if !occurrence.EndDatetime.Before(fromTime) {
+			occurrences = append(occurrences, occurrence)
+		}
+	}
+	h.setOccurrenceStatuses(occurrences)
+	return occurrences, nil
+}
+
+// getAllActivitiesWithCenter gets the latest activities matching a report condition and
+// occurrences of series, and a status if one is given, with their center names
+func (h *Handlers) getAllActivitiesWithCenter(condition string, conditionArgs []interface{}, occurrences []models.Activity, status string) ([]models.ActivityWithCenter, error) {
+	args := append([]interface{}{}, conditionArgs...)
+	if status != "" {
+		condition += " AND COALESCE(a.status, 'pending') = ?"
+		args = append(args, status)
+	}
+
 	query := `
 		SELECT a.id, a.center_id, COALESCE(c.name, 'Global') as center_name, a.title, a.description,
-			   a.start_datetime, a.end_datetime, a.is_global, a.status, a.meeting_url, a.web_url,
+			   a.start_datetime, a.end_datetime, a.is_global, COALESCE(a.status, 'pending'), a.meeting_url, a.web_url,
 			   a.created_at, a.updated_at
 		FROM activities a
 		LEFT JOIN centers c ON a.center_id = c.id
+		WHERE ` + condition + `
 		ORDER BY a.start_datetime DESC
 		LIMIT 10
 	`
 
-	rows, err := database.DB.Query(query)
+	rows, err := database.DB.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -1611,27 +1847,86 @@ func (h *Handlers) getAllActivitiesWithCenter() ([]models.ActivityWithCenter, er
 		activities = append(activities, activity)
 	}
 
+	centerNames := make(map[int]string)
+	if centers, err := h.getAllCenters(); err == nil {
+		for _, center := range centers {
+			centerNames[center.ID] = center.Name
+		}
+	}
+	for _, occurrence := range occurrences {
+		if status != "" && occurrence.Status != status {
+			continue
+		}
+		centerName := "Global"
+		if occurrence.CenterID != nil {
+			centerName = centerNames[*occurrence.CenterID]
+		}
+		activities = append(activities, models.ActivityWithCenter{
+			ID:            occurrence.ID,
+			CenterID:      occurrence.CenterID,
+			CenterName:    centerName,
+			Title:         occurrence.Title,
+			Description:   occurrence.Description,
+			StartDatetime: occurrence.StartDatetime,
+			EndDatetime:   occurrence.EndDatetime,
+			IsGlobal:      occurrence.IsGlobal,
+			Status:        occurrence.Status,
+			MeetingURL:    occurrence.MeetingURL,
+			WebURL:        occurrence.WebURL,
+			CreatedAt:     occurrence.CreatedAt,
+			UpdatedAt:     occurrence.UpdatedAt,
+		})
+	}
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		return activities[i].StartDatetime.After(activities[j].StartDatetime)
+	})
+	if len(activities) > 10 {
+		activities = activities[:10]
+	}
 	return activities, nil
 }
 
-// calculateActivityStats calculates statistics from activities data
-func (h *Handlers) calculateActivityStats() models.ActivityStats {
+// calculateActivityStats counts the activities matching a report condition by their stored
+// status, and the occurrences of series by the status of their own dates
+func (h *Handlers) calculateActivityStats(condition string, args []interface{}, occurrences []models.Activity) models.ActivityStats {
 	stats := models.ActivityStats{}
+	counts := make(map[string]int)
 
-	// Count total activities
-	database.DB.QueryRow("SELECT COUNT(*) FROM activities").Scan(&stats.TotalActivities)
-
-	// Count activities by status based on current time
-	now := time.Now()
-
-	// Pending (future start date)
-	database.DB.QueryRow("SELECT COUNT(*) FROM activities WHERE start_datetime > ?", now).Scan(&stats.PendingActivities)
-
-	// In Progress (current time between start and end)
-	database.DB.QueryRow("SELECT COUNT(*) FROM activities WHERE start_datetime <= ? AND end_datetime >= ?", now, now).Scan(&stats.InProgressActivities)
+	// Activities created before statuses existed have none and are pending
+	rows, err := database.DB.Query(`SELECT COALESCE(a.status, 'pending'), COUNT(*) FROM activities a WHERE `+condition+` GROUP BY COALESCE(a.status, 'pending')`, args...)
+	if err != nil {
+		return stats
+	}
+	defer rows.Close()
 
-	// Completed (past end date)
-	database.DB.QueryRow("SELECT COUNT(*) FROM activities WHERE end_datetime < ?", now).Scan(&stats.CompletedActivities)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			continue
+		}
+		counts[status] += count
+	}
+	for _, occurrence := range occurrences {
+		counts[occurrence.Status]++
+	}
+
+	for status, count := range counts {
+		stats.TotalActivities += count
+		switch status {
+		case "pending":
+			stats.PendingActivities = count
+		case "in_progress":
+			stats.InProgressActivities = count
+		case "completed":
+			stats.CompletedActivities = count
+		case "cancelled":
+			stats.CancelledActivities = count
+		case "postponed":
+			stats.PostponedActivities = count
+		}
+	}
 
 	return stats
 }
@@ -1679,18 +1974,51 @@ func (h *Handlers) getClassroomByID(classroomID string) (models.Classroom, error
 	return classroom, err
 }
 
-// createClassroom creates a new classroom
+// createClassroom creates a new classroom with its storage location
 func (h *Handlers) createClassroom(centerID, name string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `INSERT INTO classrooms (center_id, name, created_at, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`
-	_, err := database.DB.Exec(query, centerID, name)
-	return err
+	result, err := tx.Exec(query, centerID, name)
+	if err != nil {
+		return err
+	}
+
+	classroomID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if err := createClassroomLocation(tx, classroomID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// updateClassroom updates a classroom
+// updateClassroom updates a classroom and renames its storage location
 func (h *Handlers) updateClassroom(classroomID, name string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `UPDATE classrooms SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
-	_, err := database.DB.Exec(query, name, classroomID)
-	return err
+	if _, err := tx.Exec(query, name, classroomID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE storage_locations SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE classroom_id = ?`, name, classroomID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // deleteClassroom deletes a classroom
@@ -1700,11 +2028,30 @@ func (h *Handlers) deleteClassroom(classroomID string) error {
 	return err
 }
 
-// createCenter creates a new center
+// createCenter creates a new center with its store room
 func (h *Handlers) createCenter(name, timezone string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `INSERT INTO centers (name, timezone, created_at, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`
-	_, err := database.DB.Exec(query, name, timezone)
-	return err
+	result, err := tx.Exec(query, name, timezone)
+	if err != nil {
+		return err
+	}
+
+	centerID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if err := createStoreRoom(tx, centerID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 // updateCenter updates a center
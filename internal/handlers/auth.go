@@ -175,6 +175,12 @@ func (h *Handlers) Profile(c *gin.Context) {
 	data["Sessions"] = sessions
 	data["CurrentSessionID"] = currentSessionID
 
+	reminderCenters, err := h.getReminderCenterOptions(user.ID)
+	if err != nil {
+		logger.Error("Failed to get the activity reminder subscriptions of user %d: %v", user.ID, err)
+	}
+	data["ReminderCenters"] = reminderCenters
+
 	h.renderTemplate(c, "profile.html", data)
 }
 
@@ -208,6 +214,14 @@ func (h *Handlers) ProfilePost(c *gin.Context) {
 		auth.DeactivateAllUserSessions(user.ID, currentSessionID)
 		c.Redirect(http.StatusFound, "/perfil?success=Todas las demás sesiones han sido cerradas")
 
+	case "activity_reminders":
+		if err := h.saveReminderSubscriptions(c, user.ID); err != nil {
+			logger.Error("Failed to save the activity reminder subscriptions of user %d: %v", user.ID, err)
+			c.Redirect(http.StatusFound, "/perfil?error=Error al guardar los recordatorios de actividades")
+			return
+		}
+		c.Redirect(http.StatusFound, "/perfil?success=Recordatorios de actividades guardados")
+
 	default:
 		c.Redirect(http.StatusFound, "/perfil")
 	}
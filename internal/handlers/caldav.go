@@ -0,0 +1,870 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/ical"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// XML namespaces used by CalDAV clients
+const (
+	davNamespace       = "DAV:"
+	calDAVNamespace    = "urn:ietf:params:xml:ns:caldav"
+	calServerNamespace = "http://calendarserver.org/ns/"
+)
+
+// calDAVHome is the calendar home of every user; it also acts as their principal
+const calDAVHome = "/dav/Calendarios/"
+
+// maxCalDAVEventSize limits the size of the events uploaded with PUT
+const maxCalDAVEventSize = 1 << 20
+
+// defaultUIDPattern matches the UIDs given to activities created in Figaro
+var defaultUIDPattern = regexp.MustCompile(`^actividad-(\d+)@figaro$`)
+
+// errCalDAVNotFound is returned when a CalDAV path does not name a home, calendar or event
+var errCalDAVNotFound = errors.New("caldav resource not found")
+
+// davRequest is the parsed body of a PROPFIND or REPORT request
+type davRequest struct {
+	Report string     // Local name of the root element, such as propfind or calendar-multiget
+	Props  []xml.Name // Requested properties, empty for allprop or an empty body
+	Hrefs  []string   // Resources of a calendar-multiget
+	Start  time.Time  // Time range of a calendar-query, zero when open
+	End    time.Time
+}
+
+// davResponse is a resource of a multistatus response with its rendered properties
+type davResponse struct {
+	Href   string
+	Props  map[xml.Name]string
+	Status int // Set for the hrefs of a multiget that were not found
+}
+
+// calDAVPath is a parsed path below the calendar home
+type calDAVPath struct {
+	Center *models.Center // nil for the calendar home
+	Name   string         // Event resource name, empty for a collection
+}
+
+// CalDAVWellKnown redirects calendar clients discovering the service to the calendar home
+func (h *Handlers) CalDAVWellKnown(c *gin.Context) {
+	c.Redirect(http.StatusMovedPermanently, calDAVHome)
+}
+
+// CalDAVRoot answers PROPFIND requests on /dav/ so clients configured with the
+// server address find the calendar home
+func (h *Handlers) CalDAVRoot(c *gin.Context) {
+	user := c.MustGet("webdav_user").(*models.User)
+
+	req, err := parseDAVRequest(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	root := calDAVHomeResponse(user)
+	root.Href = "/dav/"
+	writeMultistatus(c, []davResponse{root}, req.Props)
+}
+
+// CalDAV exposes the activities of every center as a calendar collection under /dav/Calendarios.
+// Events can be read by users with actividades.read and created, edited or deleted with the
+// matching activities permissions.
+func (h *Handlers) CalDAV(c *gin.Context) {
+	user := c.MustGet("webdav_user").(*models.User)
+	if !userHasPermission(user.ID, "actividades.read") {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	if c.Request.Method == http.MethodOptions {
+		c.Header("DAV", "1, 3, calendar-access")
+		c.Header("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		c.Status(http.StatusOK)
+		return
+	}
+
+	path, err := h.parseCalDAVPath(c.Param("path"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	switch c.Request.Method {
+	case "PROPFIND":
+		h.calDAVPropfind(c, user, path)
+	case "REPORT":
+		h.calDAVReport(c, path)
+	case http.MethodGet, http.MethodHead:
+		h.calDAVGet(c, path)
+	case http.MethodPut:
+		h.calDAVPut(c, user, path)
+	case http.MethodDelete:
+		h.calDAVDelete(c, user, path)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// calDAVPropfind lists the properties of the home, a calendar or an event, and of
+// their children when Depth is not 0
+func (h *Handlers) calDAVPropfind(c *gin.Context, user *models.User, path calDAVPath) {
+	req, err := parseDAVRequest(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	withChildren := c.GetHeader("Depth") != "0"
+
+	var responses []davResponse
+	switch {
+	case path.Center == nil:
+		responses = append(responses, calDAVHomeResponse(user))
+		if withChildren {
+			centers, err := h.getAllCenters()
+			if err != nil {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			for _, center := range centers {
+				activities, err := h.getCalendarActivities(center.ID, center.Timezone, time.Time{})
+				if err != nil {
+					continue
+				}
+				responses = append(responses, calDAVCalendarResponse(user, center, activities))
+			}
+		}
+
+	case path.Name == "":
+		activities, err := h.getCalendarActivities(path.Center.ID, path.Center.Timezone, time.Time{})
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		responses = append(responses, calDAVCalendarResponse(user, *path.Center, activities))
+		if withChildren {
+			for _, activity := range activities {
+				responses = append(responses, calDAVEventResponse(*path.Center, activity))
+			}
+		}
+
+	default:
+		activity, err := h.findCalDAVActivity(*path.Center, path.Name)
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		responses = append(responses, calDAVEventResponse(*path.Center, activity))
+	}
+
+	writeMultistatus(c, responses, req.Props)
+}
+
+// calDAVReport answers calendar-query and calendar-multiget reports on a calendar
+func (h *Handlers) calDAVReport(c *gin.Context, path calDAVPath) {
+	if path.Center == nil || path.Name != "" {
+		writeDAVError(c, http.StatusForbidden, davNamespace, "supported-report")
+		return
+	}
+
+	req, err := parseDAVRequest(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	center := *path.Center
+	activities, err := h.getCalendarActivities(center.ID, center.Timezone, time.Time{})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var responses []davResponse
+	switch req.Report {
+	case "calendar-query":
+		for _, activity := range activities {
+			if !activityOverlaps(activity, req.Start, req.End) {
+				continue
+			}
+			responses = append(responses, calDAVEventResponse(center, activity))
+		}
+
+	case "calendar-multiget":
+		byName := map[string]calendarActivity{}
+		for _, activity := range activities {
+			byName[activity.resourceName()] = activity
+		}
+		for _, href := range req.Hrefs {
+			name := calDAVHrefName(href, center)
+			if activity, ok := byName[name]; ok {
+				responses = append(responses, calDAVEventResponse(center, activity))
+				continue
+			}
+			responses = append(responses, davResponse{Href: href, Status: http.StatusNotFound})
+		}
+
+	default:
+		writeDAVError(c, http.StatusForbidden, davNamespace, "supported-report")
+		return
+	}
+
+	writeMultistatus(c, responses, req.Props)
+}
+
+// calDAVGet downloads an event, or a whole calendar as a single iCalendar file
+func (h *Handlers) calDAVGet(c *gin.Context, path calDAVPath) {
+	if path.Center == nil {
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if path.Name == "" {
+		activities, err := h.getCalendarActivities(path.Center.ID, path.Center.Timezone, time.Time{})
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		calendar := ical.Calendar{Name: "Figaró - " + path.Center.Name, Timezone: path.Center.Timezone}
+		for _, activity := range activities {
+			calendar.Events = append(calendar.Events, activityEvents(activity)...)
+		}
+		c.Data(http.StatusOK, "text/calendar; charset=utf-8", calendar.Bytes())
+		return
+	}
+
+	activity, err := h.findCalDAVActivity(*path.Center, path.Name)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	data := calDAVEventData(activity)
+	c.Header("ETag", calDAVETag(data))
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", data)
+}
+
+// calDAVPut creates or updates the activity behind an event resource
+func (h *Handlers) calDAVPut(c *gin.Context, user *models.User, path calDAVPath) {
+	if path.Center == nil || path.Name == "" {
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+		return
+	}
+	center := *path.Center
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxCalDAVEventSize+1))
+	if err != nil || len(body) > maxCalDAVEventSize {
+		c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	location := loadTimezone(center.Timezone)
+	events, err := ical.ParseEvents(body, location)
+	if err != nil {
+		writeDAVError(c, http.StatusForbidden, calDAVNamespace, "valid-calendar-data")
+		return
+	}
+	for _, e := range events {
+		if e.End.Before(e.Start) {
+			writeDAVError(c, http.StatusForbidden, calDAVNamespace, "valid-calendar-data")
+			return
+		}
+	}
+
+	// The resource holds the event, or a series followed by its edited occurrences
+	event := events[0]
+	var overrides []ical.Event
+	for _, e := range events {
+		if e.RecurrenceID.IsZero() {
+			event = e
+		} else {
+			overrides = append(overrides, e)
+		}
+	}
+	recurrenceRule, err := importRecurrenceRule(event, location)
+	if err != nil {
+		writeDAVError(c, http.StatusForbidden, calDAVNamespace, "valid-calendar-object-resource")
+		return
+	}
+
+	existing, err := h.findCalDAVActivity(center, path.Name)
+	exists := err == nil
+	if !calDAVPreconditions(c, existing, exists) {
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+
+	fields := calDAVEventFields(event, location, existing.CustomLinks)
+
+	if exists {
+		if !calDAVWritable(existing, center) || !userHasPermission(user.ID, "actividades.update") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+	} else {
+		if !userHasPermission(user.ID, "actividades.create") {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		if event.UID == "" {
+			writeDAVError(c, http.StatusForbidden, calDAVNamespace, "valid-calendar-object-resource")
+			return
+		}
+		if h.calDAVUIDExists(event.UID) {
+			writeDAVError(c, http.StatusForbidden, calDAVNamespace, "no-uid-conflict")
+			return
+		}
+	}
+
+	// As in the activity form, only administrators can schedule activities outside of the
+	// working hours of the center, and what they allowed is kept on later changes
+	outsideWorkingHours := exists && existing.OutsideWorkingHours
+	if !outsideWorkingHours {
+		problem := h.checkWorkingHours(center.Name, fields.StartDatetime, fields.EndDatetime, recurrenceRule)
+		for _, override := range overrides {
+			if problem != "" {
+				break
+			}
+			o := calDAVEventFields(override, location, existing.CustomLinks)
+			problem = h.checkWorkingHours(center.Name, o.StartDatetime, o.EndDatetime, nil)
+		}
+		if problem != "" {
+			if !userHasPermission(user.ID, "ADMIN") {
+				c.String(http.StatusForbidden, problem)
+				return
+			}
+			outsideWorkingHours = true
+		}
+	}
+
+	// The event can only cancel or postpone the activity, otherwise it follows its dates
+	status := calDAVActivityStatus(event.Status)
+	var activityID int64
+	var previousStatus string
+
+	// The activity, its occurrences and its status change are saved together
+	tx, err := database.DB.Begin()
+	if err != nil {
+		logger.Error("CalDAV: failed to save activity %s for user %d: %v", path.Name, user.ID, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if exists {
+		previousStatus = existing.Status
+		if status == "pending" && !isManualActivityStatus(existing.Status) {
+			status = existing.Status
+		}
+
+		_, err = tx.Exec(`UPDATE activities SET title = ?, description = ?, start_datetime = ?, end_datetime = ?,
+				  meeting_url = ?, web_url = ?, status = ?, recurrence_rule = ?, outside_working_hours = ?, updated_at = datetime('now') WHERE id = ?`,
+			fields.Title, fields.Description, fields.StartDatetime, fields.EndDatetime, fields.MeetingURL, fields.WebURL,
+			status, recurrenceRule, outsideWorkingHours, existing.ID)
+		activityID = int64(existing.ID)
+	} else {
+		var result sql.Result
+		result, err = tx.Exec(`INSERT INTO activities (center_id, title, description, start_datetime, end_datetime,
+				  is_global, meeting_url, web_url, status, recurrence_rule, outside_working_hours, ical_uid, caldav_name, updated_at)
+				  VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`,
+			center.ID, fields.Title, fields.Description, fields.StartDatetime, fields.EndDatetime, fields.MeetingURL, fields.WebURL,
+			status, recurrenceRule, outsideWorkingHours, event.UID, path.Name)
+		if err == nil {
+			activityID, err = result.LastInsertId()
+		}
+	}
+	if err == nil {
+		err = saveCalDAVRecurrence(tx, int(activityID), recurrenceRule != nil, event, overrides, location, existing.CustomLinks)
+	}
+	if err == nil {
+		err = recordActivityStatus(tx, int(activityID), previousStatus, status, &user.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		logger.Error("CalDAV: failed to save activity %s for user %d: %v", path.Name, user.ID, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// A status that follows the dates is moved along them right away
+	if err := h.updateActivityStatuses(); err != nil {
+		logger.Error("Failed to update activity statuses: %v", err)
+	}
+
+	// Moving an activity may finish it, which consumes its material reservations
+	if err := h.settleActivityReservations(); err != nil {
+		logger.Error("Failed to settle material reservations: %v", err)
+	}
+
+	if saved, err := h.getCalendarActivity(center, activityID); err == nil {
+		c.Header("ETag", calDAVETag(calDAVEventData(saved)))
+	}
+	if exists {
+		c.Status(http.StatusNoContent)
+	} else {
+		c.Status(http.StatusCreated)
+	}
+}
+
+// calDAVDelete deletes the activity behind an event resource
+func (h *Handlers) calDAVDelete(c *gin.Context, user *models.User, path calDAVPath) {
+	if path.Center == nil || path.Name == "" {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	activity, err := h.findCalDAVActivity(*path.Center, path.Name)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if !calDAVPreconditions(c, activity, true) {
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	if !calDAVWritable(activity, *path.Center) || !userHasPermission(user.ID, "actividades.delete") {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	if _, err := database.DB.Exec(`DELETE FROM activities WHERE id = ? OR recurrence_parent_id = ?`, activity.ID, activity.ID); err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	h.removeActivityAttachmentFiles(activity.ID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// parseCalDAVPath resolves the part of a path below the calendar home: "/", "/<center id>/"
+// or "/<center id>/<event name>"
+func (h *Handlers) parseCalDAVPath(raw string) (calDAVPath, error) {
+	parts := strings.Split(strings.Trim(raw, "/"), "/")
+	if parts[0] == "" {
+		return calDAVPath{}, nil
+	}
+	if len(parts) > 2 {
+		return calDAVPath{}, errCalDAVNotFound
+	}
+
+	if _, err := strconv.Atoi(parts[0]); err != nil {
+		return calDAVPath{}, errCalDAVNotFound
+	}
+	center, err := h.getCenterByID(parts[0])
+	if err != nil {
+		return calDAVPath{}, errCalDAVNotFound
+	}
+
+	path := calDAVPath{Center: &center}
+	if len(parts) == 2 {
+		path.Name = parts[1]
+	}
+	return path, nil
+}
+
+// findCalDAVActivity finds an activity of a center calendar by its resource name
+func (h *Handlers) findCalDAVActivity(center models.Center, name string) (calendarActivity, error) {
+	activities, err := h.getCalendarActivities(center.ID, center.Timezone, time.Time{})
+	if err != nil {
+		return calendarActivity{}, err
+	}
+	for _, activity := range activities {
+		if activity.resourceName() == name {
+			return activity, nil
+		}
+	}
+	return calendarActivity{}, errCalDAVNotFound
+}
+
+// getCalendarActivity retrieves an activity by ID as seen from a center calendar, with its
+// edited occurrences if it is a series
+func (h *Handlers) getCalendarActivity(center models.Center, activityID int64) (calendarActivity, error) {
+	rows, err := database.DB.Query(calendarActivitySelect+" WHERE a.id = ? OR a.recurrence_parent_id = ?",
+		center.Timezone, center.Timezone, activityID, activityID)
+	if err != nil {
+		return calendarActivity{}, err
+	}
+	defer rows.Close()
+
+	var activities []calendarActivity
+	for rows.Next() {
+		activity, err := scanCalendarActivity(rows)
+		if err != nil {
+			return calendarActivity{}, err
+		}
+		activities = append(activities, activity)
+	}
+	activities, err = groupCalendarRecurrences(activities)
+	if err != nil {
+		return calendarActivity{}, err
+	}
+	h.setCalendarCustomLinks(activities)
+	for _, activity := range activities {
+		if int64(activity.ID) == activityID {
+			return activity, nil
+		}
+	}
+	return calendarActivity{}, sql.ErrNoRows
+}
+
+// calDAVEventFields reads the activity fields of an event sent by a calendar app. The custom
+// links of the activity, which are not changed from calendar apps, are removed from the description.
+func calDAVEventFields(event ical.Event, location *time.Location, customLinks []models.ActivityCustomLink) models.Activity {
+	activity := models.Activity{
+		Title:         strings.TrimSpace(event.Summary),
+		StartDatetime: wallClock(event.Start, location),
+		EndDatetime:   wallClock(event.End, location),
+	}
+	if activity.Title == "" {
+		activity.Title = "Sin título"
+	}
+
+	meetingURL := event.Conference
+	if meetingURL == "" && (strings.HasPrefix(event.Location, "http://") || strings.HasPrefix(event.Location, "https://")) {
+		meetingURL = event.Location
+	}
+	if meetingURL != "" {
+		activity.MeetingURL = &meetingURL
+	}
+	if event.URL != "" {
+		webURL := event.URL
+		activity.WebURL = &webURL
+	}
+	activity.Description = stripActivityLinks(event.Description, meetingURL, event.URL, customLinks)
+	return activity
+}
+
+// importRecurrenceRule converts the RRULE of an event to the form stored in activities,
+// with UNTIL in the wall clock time of the center; nil when the event does not repeat
+func importRecurrenceRule(event ical.Event, location *time.Location) (*string, error) {
+	if event.RRule == "" {
+		return nil, nil
+	}
+	rule, err := ical.ParseRule(event.RRule)
+	if err != nil {
+		return nil, err
+	}
+	if !rule.Until.IsZero() {
+		if !rule.UntilUTC {
+			// A floating UNTIL is in the timezone of the start
+			eventLocation := location
+			if event.TimeZone != nil {
+				eventLocation = event.TimeZone
+			}
+			rule.Until = inLocation(rule.Until, eventLocation)
+		}
+		rule.Until = wallClock(rule.Until, location)
+		rule.UntilUTC = false
+	}
+	value := rule.String()
+	return &value, nil
+}
+
+// saveCalDAVRecurrence replaces the removed and edited occurrences of an activity with those
+// of the series sent by a calendar app, inside an existing transaction
+func saveCalDAVRecurrence(tx *sql.Tx, activityID int, repeats bool, series ical.Event, overrides []ical.Event, location *time.Location,
+	customLinks []models.ActivityCustomLink) error {
+	if _, err := tx.Exec(`DELETE FROM activity_exceptions WHERE activity_id = ?`, activityID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM activities WHERE recurrence_parent_id = ?`, activityID); err != nil {
+		return err
+	}
+
+	if repeats {
+		for _, exdate := range series.ExDates {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO activity_exceptions (activity_id, occurrence_date) VALUES (?, ?)`,
+				activityID, wallClock(exdate, location)); err != nil {
+				return err
+			}
+		}
+
+		for _, override := range overrides {
+			fields := calDAVEventFields(override, location, customLinks)
+			status := calDAVActivityStatus(override.Status)
+			_, err := tx.Exec(`INSERT INTO activities (center_id, title, description, start_datetime, end_datetime, is_global,
+					  meeting_url, web_url, status, recurrence_parent_id, recurrence_date, outside_working_hours, updated_at)
+					  SELECT center_id, ?, ?, ?, ?, is_global, ?, ?, ?, id, ?, outside_working_hours, datetime('now') FROM activities WHERE id = ?`,
+				fields.Title, fields.Description, fields.StartDatetime, fields.EndDatetime, fields.MeetingURL, fields.WebURL,
+				status, wallClock(override.RecurrenceID, location), activityID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// calDAVActivityStatus returns the status of an activity for the status of its event. Confirmed
+// events leave the activity pending, to be moved along its dates.
+func calDAVActivityStatus(status string) string {
+	switch status {
+	case ical.StatusCancelled:
+		return "cancelled"
+	case ical.StatusTentative:
+		return "postponed"
+	}
+	return "pending"
+}
+
+// calDAVUIDExists reports whether an activity already uses an iCalendar UID
+func (h *Handlers) calDAVUIDExists(uid string) bool {
+	var count int
+	if match := defaultUIDPattern.FindStringSubmatch(uid); match != nil {
+		database.DB.QueryRow(`SELECT COUNT(*) FROM activities WHERE id = ?`, match[1]).Scan(&count)
+		if count > 0 {
+			return true
+		}
+	}
+	database.DB.QueryRow(`SELECT COUNT(*) FROM activities WHERE ical_uid = ?`, uid).Scan(&count)
+	return count > 0
+}
+
+// calDAVWritable reports whether an activity can be changed from a center calendar: like in the
+// web interface, its own activities and the global ones, but not those shared by other centers
+func calDAVWritable(activity calendarActivity, center models.Center) bool {
+	return activity.IsGlobal || (activity.CenterID != nil && *activity.CenterID == center.ID)
+}
+
+// calDAVPreconditions checks the If-Match and If-None-Match headers against an event
+func calDAVPreconditions(c *gin.Context, activity calendarActivity, exists bool) bool {
+	ifMatch := c.GetHeader("If-Match")
+	ifNoneMatch := c.GetHeader("If-None-Match")
+	if ifNoneMatch == "*" && exists {
+		return false
+	}
+	if ifMatch == "" {
+		return true
+	}
+	if !exists {
+		return false
+	}
+	return ifMatch == "*" || ifMatch == calDAVETag(calDAVEventData(activity))
+}
+
+// calDAVEventData renders an activity as a calendar object resource
+func calDAVEventData(activity calendarActivity) []byte {
+	calendar := ical.Calendar{Events: activityEvents(activity)}
+	return calendar.Bytes()
+}
+
+// calDAVETag returns the entity tag of calendar data
+func calDAVETag(data []byte) string {
+	sum := sha1.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// calDAVHrefName returns the event name of a multiget href inside a center calendar
+func calDAVHrefName(href string, center models.Center) string {
+	if parsed, err := url.Parse(strings.TrimSpace(href)); err == nil {
+		href = parsed.Path
+	}
+	prefix := fmt.Sprintf("%s%d/", calDAVHome, center.ID)
+	if !strings.HasPrefix(href, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(href, prefix)
+}
+
+// calDAVHomeResponse describes the calendar home, which is also the principal of the user
+func calDAVHomeResponse(user *models.User) davResponse {
+	props := calDAVCommonProps()
+	props[xml.Name{Space: davNamespace, Local: "resourcetype"}] = "<D:resourcetype><D:collection/><D:principal/></D:resourcetype>"
+	props[xml.Name{Space: davNamespace, Local: "displayname"}] = "<D:displayname>" + xmlEscape(user.DisplayName) + "</D:displayname>"
+	props[xml.Name{Space: davNamespace, Local: "principal-URL"}] = "<D:principal-URL><D:href>" + calDAVHome + "</D:href></D:principal-URL>"
+	props[xml.Name{Space: calDAVNamespace, Local: "calendar-home-set"}] = "<C:calendar-home-set><D:href>" + calDAVHome + "</D:href></C:calendar-home-set>"
+	props[xml.Name{Space: calDAVNamespace, Local: "calendar-user-address-set"}] = "<C:calendar-user-address-set><D:href>mailto:" +
+		xmlEscape(user.Email) + "</D:href></C:calendar-user-address-set>"
+	props[xml.Name{Space: davNamespace, Local: "current-user-privilege-set"}] = "<D:current-user-privilege-set><D:privilege><D:read/></D:privilege></D:current-user-privilege-set>"
+
+	return davResponse{Href: calDAVHome, Props: props}
+}
+
+// calDAVCalendarResponse describes the calendar collection of a center
+func calDAVCalendarResponse(user *models.User, center models.Center, activities []calendarActivity) davResponse {
+	// The collection tag changes whenever any of its events changes, is added or is removed
+	hash := sha1.New()
+	for _, activity := range activities {
+		fmt.Fprintf(hash, "%s %s\n", activity.resourceName(), calDAVETag(calDAVEventData(activity)))
+	}
+	ctag := hex.EncodeToString(hash.Sum(nil))
+
+	privileges := "<D:privilege><D:read/></D:privilege>"
+	if userHasPermission(user.ID, "actividades.create") {
+		privileges += "<D:privilege><D:bind/></D:privilege>"
+	}
+	if userHasPermission(user.ID, "actividades.update") {
+		privileges += "<D:privilege><D:write-content/></D:privilege>"
+	}
+	if userHasPermission(user.ID, "actividades.delete") {
+		privileges += "<D:privilege><D:unbind/></D:privilege>"
+	}
+
+	props := calDAVCommonProps()
+	props[xml.Name{Space: davNamespace, Local: "resourcetype"}] = "<D:resourcetype><D:collection/><C:calendar/></D:resourcetype>"
+	props[xml.Name{Space: davNamespace, Local: "displayname"}] = "<D:displayname>" + xmlEscape(center.Name) + "</D:displayname>"
+	props[xml.Name{Space: davNamespace, Local: "getetag"}] = `<D:getetag>"` + ctag + `"</D:getetag>`
+	props[xml.Name{Space: davNamespace, Local: "current-user-privilege-set"}] = "<D:current-user-privilege-set>" + privileges + "</D:current-user-privilege-set>"
+	props[xml.Name{Space: davNamespace, Local: "supported-report-set"}] = "<D:supported-report-set>" +
+		"<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>" +
+		"<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report></D:supported-report-set>"
+	props[xml.Name{Space: calServerNamespace, Local: "getctag"}] = "<CS:getctag>" + ctag + "</CS:getctag>"
+	props[xml.Name{Space: calDAVNamespace, Local: "calendar-description"}] = "<C:calendar-description>" +
+		xmlEscape("Actividades de "+center.Name) + "</C:calendar-description>"
+	props[xml.Name{Space: calDAVNamespace, Local: "supported-calendar-component-set"}] = `<C:supported-calendar-component-set><C:comp name="VEVENT"/></C:supported-calendar-component-set>`
+	props[xml.Name{Space: calDAVNamespace, Local: "supported-calendar-data"}] = `<C:supported-calendar-data><C:calendar-data content-type="text/calendar" version="2.0"/></C:supported-calendar-data>`
+
+	return davResponse{Href: fmt.Sprintf("%s%d/", calDAVHome, center.ID), Props: props}
+}
+
+// calDAVEventResponse describes an event resource, including its calendar data
+func calDAVEventResponse(center models.Center, activity calendarActivity) davResponse {
+	data := calDAVEventData(activity)
+
+	props := calDAVCommonProps()
+	props[xml.Name{Space: davNamespace, Local: "resourcetype"}] = "<D:resourcetype/>"
+	props[xml.Name{Space: davNamespace, Local: "getetag"}] = "<D:getetag>" + calDAVETag(data) + "</D:getetag>"
+	props[xml.Name{Space: davNamespace, Local: "getcontenttype"}] = "<D:getcontenttype>text/calendar; charset=utf-8; component=VEVENT</D:getcontenttype>"
+	props[xml.Name{Space: davNamespace, Local: "getcontentlength"}] = fmt.Sprintf("<D:getcontentlength>%d</D:getcontentlength>", len(data))
+	props[xml.Name{Space: calDAVNamespace, Local: "calendar-data"}] = "<C:calendar-data>" + xmlEscape(string(data)) + "</C:calendar-data>"
+
+	href := fmt.Sprintf("%s%d/%s", calDAVHome, center.ID, url.PathEscape(activity.resourceName()))
+	return davResponse{Href: href, Props: props}
+}
+
+// calDAVCommonProps returns the properties every resource has
+func calDAVCommonProps() map[xml.Name]string {
+	principal := "<D:href>" + calDAVHome + "</D:href>"
+	return map[xml.Name]string{
+		{Space: davNamespace, Local: "current-user-principal"}: "<D:current-user-principal>" + principal + "</D:current-user-principal>",
+		{Space: davNamespace, Local: "owner"}:                  "<D:owner>" + principal + "</D:owner>",
+	}
+}
+
+// parseDAVRequest reads the requested properties, hrefs and time range of a PROPFIND or REPORT body
+func parseDAVRequest(body io.Reader) (davRequest, error) {
+	var req davRequest
+	var stack []xml.Name
+
+	decoder := xml.NewDecoder(body)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return req, nil
+		}
+		if err != nil {
+			return req, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 {
+				req.Report = t.Name.Local
+			} else if stack[len(stack)-1] == (xml.Name{Space: davNamespace, Local: "prop"}) {
+				req.Props = append(req.Props, t.Name)
+			}
+			if t.Name == (xml.Name{Space: calDAVNamespace, Local: "time-range"}) {
+				for _, attr := range t.Attr {
+					value, err := time.Parse("20060102T150405Z", attr.Value)
+					if err != nil {
+						continue
+					}
+					switch attr.Name.Local {
+					case "start":
+						req.Start = value
+					case "end":
+						req.End = value
+					}
+				}
+			}
+			stack = append(stack, t.Name)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 && stack[len(stack)-1] == (xml.Name{Space: davNamespace, Local: "href"}) {
+				if href := strings.TrimSpace(string(t)); href != "" {
+					req.Hrefs = append(req.Hrefs, href)
+				}
+			}
+		}
+	}
+}
+
+// writeMultistatus writes a 207 response with the requested properties of each resource, or all
+// of them but the calendar data when none were requested
+func writeMultistatus(c *gin.Context, responses []davResponse, requested []xml.Name) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	b.WriteString(`<D:multistatus xmlns:D="DAV:" xmlns:C="` + calDAVNamespace + `" xmlns:CS="` + calServerNamespace + `">`)
+
+	for _, response := range responses {
+		b.WriteString("<D:response><D:href>" + xmlEscape(response.Href) + "</D:href>")
+		if response.Status != 0 {
+			fmt.Fprintf(&b, "<D:status>HTTP/1.1 %d %s</D:status></D:response>", response.Status, http.StatusText(response.Status))
+			continue
+		}
+
+		var found, missing []string
+		if len(requested) == 0 {
+			for name, value := range response.Props {
+				if name.Local != "calendar-data" {
+					found = append(found, value)
+				}
+			}
+		}
+		for _, name := range requested {
+			if value, ok := response.Props[name]; ok {
+				found = append(found, value)
+			} else {
+				missing = append(missing, "<"+name.Local+` xmlns="`+xmlEscape(name.Space)+`"/>`)
+			}
+		}
+
+		if len(found) > 0 {
+			b.WriteString("<D:propstat><D:prop>" + strings.Join(found, "") + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+		}
+		if len(missing) > 0 {
+			b.WriteString("<D:propstat><D:prop>" + strings.Join(missing, "") + "</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+		}
+		b.WriteString("</D:response>")
+	}
+
+	b.WriteString("</D:multistatus>")
+	c.Data(http.StatusMultiStatus, "application/xml; charset=utf-8", []byte(b.String()))
+}
+
+// writeDAVError writes a WebDAV error response naming the failed precondition
+func writeDAVError(c *gin.Context, status int, space, condition string) {
+	body := `<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<D:error xmlns:D="DAV:"><` + condition + ` xmlns="` + space + `"/></D:error>`
+	c.Data(status, "application/xml; charset=utf-8", []byte(body))
+}
+
+// xmlEscape escapes text for XML content and attribute values
+func xmlEscape(value string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(value))
+	return b.String()
+}
@@ -185,6 +185,7 @@ func (h *Handlers) getCommonData(c *gin.Context) gin.H {
 			session["Aula"] = aula
 		}
 		data["Session"] = session
+		data["UnreadNotifications"] = h.countUnreadNotifications(user.ID)
 
 		// Add permissions check function
 		data["HasAccess"] = func(permission string) bool {
@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// materialUsageSQL selects the movements (alias mv) that count as usage: consumption, classroom requests,
+// the losses found in stocktakes and the components put into kits, net of kits taken apart
+const materialUsageSQL = `(mv.kind IN ('consumption', 'request', 'kit_assembly', 'kit_disassembly') OR (mv.kind = 'stocktake' AND mv.quantity_change < 0))`
+
+// materialSpendSQL selects the movements (alias mv) that brought new stock the center paid for
+const materialSpendSQL = `(mv.kind IN ('purchase', 'restock') AND mv.quantity_change > 0)`
+
+// Defaults of the consumption forecast, in days
+const (
+	defaultConsumptionWindow = 90
+	defaultCoverageDays      = 30
+	minimumObservedDays      = 7
+)
+
+var monthAbbreviations = []string{"Ene", "Feb", "Mar", "Abr", "May", "Jun", "Jul", "Ago", "Sep", "Oct", "Nov", "Dic"}
+
+// recordMaterialMovement stores a change of the available quantity of a material in the movements ledger.
+// It runs after the stock helpers so the stored total is the synced one, and after the unit cost is
+// updated so the spend of purchases and restocks is valued at the price paid. Units that leave the
+// stock are taken from the batches of the material that expire first.
+func recordMaterialMovement(db sqlExecutor, materialID, change int, kind string, userID int) error {
+	if change == 0 {
+		return nil
+	}
+
+	// Expired batches are written off by expireMaterialBatches itself
+	if change < 0 && kind != "expired" {
+		if err := consumeMaterialBatches(db, materialID, -change); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`INSERT INTO material_movements (material_id, center_id, kind, quantity_change, quantity_after, user_id, unit_cost)
+			  SELECT id, center_id, ?, ?, available_quantity, ?, unit_cost FROM materials WHERE id = ?`,
+		kind, change, nullableID(userID), materialID)
+	return err
+}
+
+// getMaterialMovements retrieves the latest movements of a material
+func (h *Handlers) getMaterialMovements(materialID, limit int) ([]models.MaterialMovement, error) {
+	rows, err := database.DB.Query(`SELECT mv.id, mv.material_id, mv.center_id, mv.kind, mv.quantity_change, mv.quantity_after,
+			  mv.user_id, COALESCE(u.display_name, ''), mv.created_at
+			  FROM material_movements mv
+			  LEFT JOIN users u ON mv.user_id = u.id
+			  WHERE mv.material_id = ?
+			  ORDER BY mv.created_at DESC, mv.id DESC
+			  LIMIT ?`, materialID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movements []models.MaterialMovement
+	for rows.Next() {
+		var movement models.MaterialMovement
+		err := rows.Scan(&movement.ID, &movement.MaterialID, &movement.CenterID, &movement.Kind,
+			&movement.QuantityChange, &movement.QuantityAfter, &movement.UserID, &movement.UserName, &movement.CreatedAt)
+		if err != nil {
+			continue
+		}
+		movements = append(movements, movement)
+	}
+
+	return movements, nil
+}
+
+// applyConsumptionForecast fills the consumption rate, the days left until the minimum is
+// reached and the minimum that covers coverageDays of usage for each material.
+// Young materials are measured over their own lifetime, never less than a week.
+func (h *Handlers) applyConsumptionForecast(materials []models.MaterialWithCenter, windowDays, coverageDays int) error {
+	rows, err := database.DB.Query(`SELECT mv.material_id, -SUM(mv.quantity_change)
+			  FROM material_movements mv
+			  WHERE `+materialUsageSQL+` AND mv.created_at >= datetime('now', ?)
+			  GROUP BY mv.material_id`, fmt.Sprintf("-%d days", windowDays))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	used := make(map[int]int)
+	for rows.Next() {
+		var materialID, quantity int
+		if err := rows.Scan(&materialID, &quantity); err != nil {
+			continue
+		}
+		used[materialID] = quantity
+	}
+
+	now := time.Now().UTC()
+	for i := range materials {
+		material := &materials[i]
+		material.Used = used[material.ID]
+		if material.Used <= 0 {
+			continue
+		}
+
+		observedDays := int(now.Sub(material.CreatedAt).Hours() / 24)
+		observedDays = min(max(observedDays, minimumObservedDays), windowDays)
+
+		material.DailyRate = float64(material.Used) / float64(observedDays)
+		material.SuggestedMinimum = int(math.Ceil(material.DailyRate * float64(coverageDays)))
+
+		if material.AvailableQuantity > material.MinimumQuantity {
+			material.DaysUntilMinimum = int(float64(material.AvailableQuantity-material.MinimumQuantity) / material.DailyRate)
+		}
+	}
+
+	return nil
+}
+
+// materialForecast returns the consumption forecast of a single material with the default window and coverage
+func (h *Handlers) materialForecast(material models.Material) models.MaterialWithCenter {
+	forecast := []models.MaterialWithCenter{{
+		ID:                material.ID,
+		AvailableQuantity: material.AvailableQuantity,
+		MinimumQuantity:   material.MinimumQuantity,
+		CreatedAt:         material.CreatedAt,
+	}}
+	h.applyConsumptionForecast(forecast, defaultConsumptionWindow, defaultCoverageDays)
+	return forecast[0]
+}
+
+// getConsumptionTrend returns the usage of the last twelve months and of the school terms of the
+// current and previous school years, optionally filtered by center, category and material (0 means no filter)
+func (h *Handlers) getConsumptionTrend(centerID, categoryID, materialID int) ([]models.ConsumptionPeriod, []models.ConsumptionPeriod, error) {
+	now := time.Now().UTC()
+	currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	// School years start in September
+	schoolYear := now.Year()
+	if now.Month() < time.September {
+		schoolYear--
+	}
+	start := time.Date(schoolYear-1, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	query := `SELECT strftime('%Y-%m', mv.created_at), -SUM(mv.quantity_change)
+			  FROM material_movements mv
+			  JOIN materials m ON mv.material_id = m.id
+			  WHERE ` + materialUsageSQL + ` AND mv.created_at >= ?`
+	args := []interface{}{start.Format("2006-01-02")}
+	if centerID != 0 {
+		query += " AND mv.center_id = ?"
+		args = append(args, centerID)
+	}
+	if categoryID != 0 {
+		query += " AND m.category_id IN (" + categoryTreeSQL + ")"
+		args = append(args, categoryID)
+	}
+	if materialID != 0 {
+		query += " AND mv.material_id = ?"
+		args = append(args, materialID)
+	}
+	query += " GROUP BY 1"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	usedByMonth := make(map[string]int)
+	for rows.Next() {
+		var month string
+		var quantity int
+		if err := rows.Scan(&month, &quantity); err != nil {
+			continue
+		}
+		usedByMonth[month] = quantity
+	}
+
+	var months, terms []models.ConsumptionPeriod
+	for month := start; !month.After(currentMonth); month = month.AddDate(0, 1, 0) {
+		used := usedByMonth[month.Format("2006-01")]
+
+		if !month.Before(currentMonth.AddDate(0, -11, 0)) {
+			months = append(months, models.ConsumptionPeriod{
+				Label: fmt.Sprintf("%s %02d", monthAbbreviations[month.Month()-1], month.Year()%100),
+				Used:  used,
+			})
+		}
+
+		label := schoolTermLabel(month)
+		if len(terms) == 0 || terms[len(terms)-1].Label != label {
+			terms = append(terms, models.ConsumptionPeriod{Label: label})
+		}
+		terms[len(terms)-1].Used += used
+	}
+
+	return scaleConsumptionPeriods(months), scaleConsumptionPeriods(terms), nil
+}
+
+// getSpendByTerm returns the amount spent on purchases and restocks in each school term of the
+// current and previous school years, optionally filtered by center and category (0 means no filter)
+func (h *Handlers) getSpendByTerm(centerID, categoryID int) ([]models.SpendPeriod, error) {
+	now := time.Now().UTC()
+	currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	schoolYear := now.Year()
+	if now.Month() < time.September {
+		schoolYear--
+	}
+	start := time.Date(schoolYear-1, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	query := `SELECT strftime('%Y-%m', mv.created_at), SUM(mv.quantity_change * COALESCE(mv.unit_cost, 0))
+			  FROM material_movements mv
+			  JOIN materials m ON mv.material_id = m.id
+			  WHERE ` + materialSpendSQL + ` AND mv.created_at >= ?`
+	args := []interface{}{start.Format("2006-01-02")}
+	if centerID != 0 {
+		query += " AND mv.center_id = ?"
+		args = append(args, centerID)
+	}
+	if categoryID != 0 {
+		query += " AND m.category_id IN (" + categoryTreeSQL + ")"
+		args = append(args, categoryID)
+	}
+	query += " GROUP BY 1"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	spentByMonth := make(map[string]float64)
+	for rows.Next() {
+		var month string
+		var amount float64
+		if err := rows.Scan(&month, &amount); err != nil {
+			continue
+		}
+		spentByMonth[month] = amount
+	}
+
+	var terms []models.SpendPeriod
+	mostExpensive := 0.0
+	for month := start; !month.After(currentMonth); month = month.AddDate(0, 1, 0) {
+		label := schoolTermLabel(month)
+		if len(terms) == 0 || terms[len(terms)-1].Label != label {
+			terms = append(terms, models.SpendPeriod{Label: label})
+		}
+		terms[len(terms)-1].Amount += spentByMonth[month.Format("2006-01")]
+		mostExpensive = max(mostExpensive, terms[len(terms)-1].Amount)
+	}
+
+	if mostExpensive > 0 {
+		for i := range terms {
+			terms[i].Percent = int(terms[i].Amount * 100 / mostExpensive)
+		}
+	}
+
+	return terms, nil
+}
+
+// getInventoryValuation returns the value of the available stock at its unit cost grouped by
+// center and category, optionally filtered by center and category (0 means no filter)
+func (h *Handlers) getInventoryValuation(centerID, categoryID int) ([]models.InventoryValuation, error) {
+	query := `SELECT c.id, c.name, COALESCE(mc.name, 'Sin categoría'), COUNT(*),
+			  SUM(MAX(m.available_quantity, 0)), SUM(MAX(m.available_quantity, 0) * m.unit_cost),
+			  SUM(CASE WHEN m.available_quantity > 0 AND m.unit_cost = 0 THEN 1 ELSE 0 END)
+			  FROM materials m
+			  JOIN centers c ON m.center_id = c.id
+			  LEFT JOIN material_categories mc ON m.category_id = mc.id
+			  WHERE 1 = 1`
+	var args []interface{}
+	if centerID != 0 {
+		query += " AND m.center_id = ?"
+		args = append(args, centerID)
+	}
+	if categoryID != 0 {
+		query += " AND m.category_id IN (" + categoryTreeSQL + ")"
+		args = append(args, categoryID)
+	}
+	query += " GROUP BY c.id, mc.id ORDER BY c.name, 3"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var valuation []models.InventoryValuation
+	for rows.Next() {
+		var row models.InventoryValuation
+		err := rows.Scan(&row.CenterID, &row.CenterName, &row.CategoryName, &row.MaterialCount,
+			&row.Units, &row.Value, &row.Uncosted)
+		if err != nil {
+			continue
+		}
+		valuation = append(valuation, row)
+	}
+
+	return valuation, nil
+}
+
+// schoolTermLabel names the school term a month belongs to
+func schoolTermLabel(month time.Time) string {
+	year := month.Year()
+	if month.Month() < time.September {
+		year--
+	}
+	course := fmt.Sprintf("%d/%02d", year, (year+1)%100)
+
+	switch {
+	case month.Month() >= time.September:
+		return "1er trimestre " + course
+	case month.Month() <= time.March:
+		return "2º trimestre " + course
+	case month.Month() <= time.June:
+		return "3er trimestre " + course
+	default:
+		return "Verano " + course
+	}
+}
+
+// scaleConsumptionPeriods sets the bar height of each period relative to the busiest one
+func scaleConsumptionPeriods(periods []models.ConsumptionPeriod) []models.ConsumptionPeriod {
+	busiest := 0
+	for _, period := range periods {
+		busiest = max(busiest, period.Used)
+	}
+	if busiest == 0 {
+		return periods
+	}
+
+	for i := range periods {
+		periods[i].Percent = periods[i].Used * 100 / busiest
+	}
+	return periods
+}
+
+// AdminMaterialesMinimos sets the minimum quantity of the selected materials from the report suggestions
+func (h *Handlers) AdminMaterialesMinimos(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	// Go back to the report with the same filters
+	filters := url.Values{}
+	for _, key := range []string{"centro", "categoria", "dias", "cobertura"} {
+		if value := c.PostForm(key); value != "" {
+			filters.Set(key, value)
+		}
+	}
+
+	updated := 0
+	for _, materialID := range c.PostFormArray("aplicar[]") {
+		minimum, err := parseIntSafe(c.PostForm("minimo_" + materialID))
+		if err != nil || minimum < 0 {
+			continue
+		}
+
+		result, err := database.DB.Exec(`UPDATE materials SET minimum_quantity = ?, updated_at = datetime('now') WHERE id = ?`,
+			minimum, materialID)
+		if err != nil {
+			filters.Set("error", "Error al actualizar los mínimos")
+			c.Redirect(http.StatusFound, "/admin/materiales-report?"+filters.Encode())
+			return
+		}
+		rowsAffected, _ := result.RowsAffected()
+		updated += int(rowsAffected)
+	}
+
+	filters.Set("success", fmt.Sprintf("Cantidad mínima actualizada en %d material(es)", updated))
+	c.Redirect(http.StatusFound, "/admin/materiales-report?"+filters.Encode())
+}
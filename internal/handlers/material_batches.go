@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultExpiryWarningDays is how far ahead batches are shown as expiring soon
+const defaultExpiryWarningDays = 30
+
+// MaterialesLotes shows the batches of a material and the form to register new ones
+func (h *Handlers) MaterialesLotes(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	// Expired batches must not count as available when the page is shown
+	if err := h.expireMaterialBatches(); err != nil {
+		logger.Error("Failed to write off expired material batches: %v", err)
+	}
+
+	material, err := h.getMaterial(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado")
+		return
+	}
+
+	batches, err := h.getMaterialBatches(material.ID)
+	if err != nil {
+		batches = []models.MaterialBatch{}
+	}
+
+	inBatches := 0
+	for _, batch := range batches {
+		if batch.Status == "active" {
+			inBatches += batch.Quantity
+		}
+	}
+
+	locations, _ := h.getStorageLocations(material.CenterID)
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Lotes de " + material.Name
+	data["Centro"] = centro
+	data["Material"] = material
+	data["Batches"] = batches
+	data["UntrackedQuantity"] = max(material.AvailableQuantity-inBatches, 0)
+	data["Locations"] = locations
+	data["WarningDays"] = defaultExpiryWarningDays
+	data["Today"] = time.Now().Format("2006-01-02")
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_lotes.html", data)
+}
+
+// MaterialesLoteCrear registers a batch of a material, either as new stock or for units already in stock
+func (h *Handlers) MaterialesLoteCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	material, err := h.getMaterial(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado")
+		return
+	}
+	redirectURL := fmt.Sprintf("/materiales/lotes/%d", material.ID)
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para registrar lotes")
+		return
+	}
+
+	quantity, err := parseUnitQuantity(c.PostForm("cantidad"), c.PostForm("unidad_id"), material)
+	if err != nil || quantity <= 0 {
+		c.Redirect(http.StatusFound, redirectURL+"?error=La cantidad debe ser mayor que cero")
+		return
+	}
+
+	var expiryDate interface{}
+	if expiry := c.PostForm("caducidad"); expiry != "" {
+		parsed, err := time.Parse("2006-01-02", expiry)
+		if err != nil {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Fecha de caducidad no válida")
+			return
+		}
+		if expiry < time.Now().Format("2006-01-02") {
+			c.Redirect(http.StatusFound, redirectURL+"?error=El lote ya está caducado")
+			return
+		}
+		expiryDate = parsed.Format("2006-01-02")
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al registrar el lote")
+		return
+	}
+	defer tx.Rollback()
+
+	if c.PostForm("origen") == "existente" {
+		// Units already in stock get an expiry date; they must not be covered by another batch
+		var inBatches int
+		tx.QueryRow(`SELECT COALESCE(SUM(quantity), 0) FROM material_batches WHERE material_id = ? AND status = 'active'`,
+			material.ID).Scan(&inBatches)
+		if quantity > material.AvailableQuantity-inBatches {
+			c.Redirect(http.StatusFound, redirectURL+"?error="+fmt.Sprintf("Solo hay %d unidad(es) sin lote", max(material.AvailableQuantity-inBatches, 0)))
+			return
+		}
+	} else {
+		locationID, _ := parseIntSafe(c.PostForm("ubicacion_id"))
+		err = addMaterialStock(tx, material.ID, locationID, quantity)
+		if err == errLocationNotFound {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Ubicación no encontrada")
+			return
+		}
+		if err == nil {
+			err = recordMaterialMovement(tx, material.ID, quantity, "restock", user.ID)
+		}
+		if err != nil {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Error al registrar el lote")
+			return
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO material_batches (material_id, center_id, batch_code, quantity, initial_quantity, expiry_date, created_by, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, datetime('now'))`,
+		material.ID, material.CenterID, strings.TrimSpace(c.PostForm("lote")), quantity, quantity, expiryDate, user.ID)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE materials SET tracks_batches = TRUE WHERE id = ?`, material.ID)
+	}
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al registrar el lote")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al registrar el lote")
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirectURL+"?success=Lote registrado correctamente")
+}
+
+// MaterialesLoteEliminar removes a batch registered by mistake; its units stay in stock without a batch
+func (h *Handlers) MaterialesLoteEliminar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	material, err := h.getMaterial(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado")
+		return
+	}
+	redirectURL := fmt.Sprintf("/materiales/lotes/%d", material.ID)
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para eliminar lotes")
+		return
+	}
+
+	result, err := database.DB.Exec(`DELETE FROM material_batches WHERE id = ? AND material_id = ? AND status = 'active'`,
+		c.Param("batchId"), material.ID)
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al eliminar el lote")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Lote no encontrado")
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirectURL+"?success=Lote eliminado; sus unidades quedan sin lote")
+}
+
+// MaterialesCaducidades shows the batches of the selected center that expire in the coming days
+// and those recently written off
+func (h *Handlers) MaterialesCaducidades(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if err := h.expireMaterialBatches(); err != nil {
+		logger.Error("Failed to write off expired material batches: %v", err)
+	}
+
+	days, err := parseIntSafe(c.Query("dias"))
+	if err != nil || days < 1 || days > 365 {
+		days = defaultExpiryWarningDays
+	}
+
+	expiring, err := h.getCenterBatches(centro, `b.status = 'active' AND b.quantity > 0 AND b.expiry_date IS NOT NULL
+			  AND b.expiry_date <= date('now', 'localtime', ?) ORDER BY b.expiry_date, m.name`, fmt.Sprintf("+%d days", days))
+	if err != nil {
+		expiring = []models.MaterialBatch{}
+	}
+
+	expired, err := h.getCenterBatches(centro, `b.status = 'expired' AND b.expired_at >= datetime('now', '-90 days')
+			  ORDER BY b.expired_at DESC, m.name`)
+	if err != nil {
+		expired = []models.MaterialBatch{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Caducidades"
+	data["Centro"] = centro
+	data["Days"] = days
+	data["DayOptions"] = []int{7, 15, 30, 60, 90}
+	data["Expiring"] = expiring
+	data["Expired"] = expired
+
+	h.renderTemplate(c, "materiales_caducidades.html", data)
+}
+
+// consumeMaterialBatches takes units out of the active batches of a material, first expiry first out.
+// Batches without an expiry date go last; units beyond the batches are the ones without a batch.
+func consumeMaterialBatches(db sqlExecutor, materialID, quantity int) error {
+	for quantity > 0 {
+		var batchID, available int
+		err := db.QueryRow(`SELECT id, quantity FROM material_batches
+				  WHERE material_id = ? AND status = 'active' AND quantity > 0
+				  ORDER BY expiry_date IS NULL, expiry_date, received_at, id LIMIT 1`, materialID).Scan(&batchID, &available)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		take := min(available, quantity)
+		if _, err := db.Exec(`UPDATE material_batches SET quantity = quantity - ?, updated_at = datetime('now') WHERE id = ?`,
+			take, batchID); err != nil {
+			return err
+		}
+		quantity -= take
+	}
+	return nil
+}
+
+// expireMaterialBatches writes off the batches past their expiry date, taking their units
+// out of the available quantity of the material
+func (h *Handlers) expireMaterialBatches() error {
+	rows, err := database.DB.Query(`SELECT id, material_id, quantity FROM material_batches
+			  WHERE status = 'active' AND expiry_date < date('now', 'localtime')`)
+	if err != nil {
+		return err
+	}
+
+	var batches []models.MaterialBatch
+	for rows.Next() {
+		var batch models.MaterialBatch
+		if err := rows.Scan(&batch.ID, &batch.MaterialID, &batch.Quantity); err != nil {
+			continue
+		}
+		batches = append(batches, batch)
+	}
+	rows.Close()
+
+	for _, batch := range batches {
+		if err := expireMaterialBatch(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireMaterialBatch writes off a single expired batch in its own transaction
+func expireMaterialBatch(batch models.MaterialBatch) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	removed, err := removeMaterialStock(tx, batch.MaterialID, batch.Quantity)
+	if err != nil {
+		return err
+	}
+
+	// The batch keeps the quantity that was written off
+	_, err = tx.Exec(`UPDATE material_batches SET status = 'expired', quantity = ?, expired_at = datetime('now'),
+			  updated_at = datetime('now') WHERE id = ? AND status = 'active'`, removed, batch.ID)
+	if err != nil {
+		return err
+	}
+	if err := recordMaterialMovement(tx, batch.MaterialID, -removed, "expired", 0); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RunBatchExpiry periodically writes off the expired batches of every center
+func (h *Handlers) RunBatchExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := h.expireMaterialBatches(); err != nil {
+			logger.Error("Failed to write off expired material batches: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// countExpiringBatches counts the batches of a center with stock that expire within the given days
+func (h *Handlers) countExpiringBatches(centro string, days int) int {
+	var count int
+	database.DB.QueryRow(`SELECT COUNT(*) FROM material_batches
+			  WHERE center_id = (SELECT id FROM centers WHERE name = ?) AND status = 'active' AND quantity > 0
+			  AND expiry_date IS NOT NULL AND expiry_date <= date('now', 'localtime', ?)`,
+		centro, fmt.Sprintf("+%d days", days)).Scan(&count)
+	return count
+}
+
+// materialBatchSelectSQL selects the batch columns scanned by scanMaterialBatch
+const materialBatchSelectSQL = `SELECT b.id, b.material_id, m.name, m.unit, b.center_id, b.batch_code, b.quantity, b.initial_quantity,
+			  b.expiry_date, b.status, COALESCE(u.display_name, ''), b.received_at, b.expired_at
+			  FROM material_batches b
+			  JOIN materials m ON b.material_id = m.id
+			  LEFT JOIN users u ON b.created_by = u.id`
+
+// scanMaterialBatch scans a row selected with materialBatchSelectSQL
+func scanMaterialBatch(rows interface{ Scan(...interface{}) error }) (models.MaterialBatch, error) {
+	var batch models.MaterialBatch
+	err := rows.Scan(&batch.ID, &batch.MaterialID, &batch.MaterialName, &batch.Unit, &batch.CenterID, &batch.BatchCode,
+		&batch.Quantity, &batch.InitialQuantity, &batch.ExpiryDate, &batch.Status, &batch.CreatedByName,
+		&batch.ReceivedAt, &batch.ExpiredAt)
+	return batch, err
+}
+
+// getMaterialBatches retrieves the batches of a material: the active ones by expiry date, then the expired ones
+func (h *Handlers) getMaterialBatches(materialID int) ([]models.MaterialBatch, error) {
+	return h.queryMaterialBatches(materialBatchSelectSQL+` WHERE b.material_id = ?
+			  ORDER BY b.status, b.expiry_date IS NULL, b.expiry_date, b.received_at, b.id`, materialID)
+}
+
+// getCenterBatches retrieves the batches of a center matching a condition (alias b) that includes the ORDER BY
+func (h *Handlers) getCenterBatches(centro, condition string, args ...interface{}) ([]models.MaterialBatch, error) {
+	query := materialBatchSelectSQL + ` WHERE b.center_id = (SELECT id FROM centers WHERE name = ?) AND ` + condition
+	return h.queryMaterialBatches(query, append([]interface{}{centro}, args...)...)
+}
+
+// queryMaterialBatches runs a query built on materialBatchSelectSQL
+func (h *Handlers) queryMaterialBatches(query string, args ...interface{}) ([]models.MaterialBatch, error) {
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []models.MaterialBatch
+	for rows.Next() {
+		batch, err := scanMaterialBatch(rows)
+		if err != nil {
+			continue
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, nil
+}
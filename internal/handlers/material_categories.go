@@ -0,0 +1,449 @@
+package handlers
+
+import (
+	"database/sql"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// categoryTreeSQL selects a category and all its descendants; the only argument is the root category ID
+const categoryTreeSQL = `WITH RECURSIVE category_tree(id) AS (
+			  SELECT ? UNION ALL
+			  SELECT mc.id FROM material_categories mc JOIN category_tree ON mc.parent_id = category_tree.id)
+			  SELECT id FROM category_tree`
+
+// AdminCategorias handles the material categories list
+func (h *Handlers) AdminCategorias(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	categories, err := h.getAllMaterialCategories()
+	if err != nil {
+		categories = []models.MaterialCategory{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Categorías de Materiales"
+	data["Categories"] = categories
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "admin_categorias.html", data)
+}
+
+// AdminCategoriaCrear handles material category creation
+func (h *Handlers) AdminCategoriaCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleCategorySave(c, models.MaterialCategory{})
+		return
+	}
+
+	h.renderCategoryForm(c, models.MaterialCategory{}, "")
+}
+
+// AdminCategoriaEditar handles material category editing
+func (h *Handlers) AdminCategoriaEditar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	category, err := h.getMaterialCategory(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/categorias?error=Categoría no encontrada")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleCategorySave(c, category)
+		return
+	}
+
+	h.renderCategoryForm(c, category, "")
+}
+
+// renderCategoryForm renders the category form with the data needed by its selects
+func (h *Handlers) renderCategoryForm(c *gin.Context, category models.MaterialCategory, errorMessage string) {
+	centers, err := h.getAllCenters()
+	if err != nil {
+		centers = []models.Center{}
+	}
+
+	// A category cannot be nested below itself
+	var parents []models.MaterialCategory
+	categories, _ := h.getAllMaterialCategories()
+	for _, candidate := range categories {
+		if category.ID == 0 || !h.isCategoryInTree(candidate.ID, category.ID) {
+			parents = append(parents, candidate)
+		}
+	}
+
+	data := h.getCommonData(c)
+	data["Action"] = "crear"
+	data["PageTitle"] = "Figaró - Crear Categoría"
+	if category.ID != 0 {
+		data["Action"] = "editar"
+		data["PageTitle"] = "Figaró - Editar Categoría"
+	}
+	data["Category"] = category
+	data["Centers"] = centers
+	data["Parents"] = parents
+	data["Pictos"] = getPictos()
+	data["ErrorMessage"] = errorMessage
+
+	h.renderTemplate(c, "admin_categoria_form.html", data)
+}
+
+// handleCategorySave validates and stores a new or edited category
+func (h *Handlers) handleCategorySave(c *gin.Context, category models.MaterialCategory) {
+	previousCenterID := category.CenterID
+
+	category.Name = strings.TrimSpace(c.PostForm("nombre"))
+	category.Icon = c.PostForm("icono")
+	category.CenterID, _ = parseIntSafe(c.PostForm("centro_id"))
+	category.ParentID, _ = parseIntSafe(c.PostForm("parent_id"))
+	category.DefaultMinimumQuantity = nil
+	if minimumQty := c.PostForm("cantidad_minima"); minimumQty != "" {
+		value, err := strconv.Atoi(minimumQty)
+		if err != nil || value < 0 {
+			h.renderCategoryForm(c, category, "La cantidad mínima por defecto debe ser un número positivo")
+			return
+		}
+		category.DefaultMinimumQuantity = &value
+	}
+
+	if category.Name == "" {
+		h.renderCategoryForm(c, category, "El nombre de la categoría es obligatorio")
+		return
+	}
+	category.Slug = slugify(category.Name)
+
+	if category.Icon != "" && !isPicto(category.Icon) {
+		h.renderCategoryForm(c, category, "Icono no válido")
+		return
+	}
+
+	if category.ParentID != 0 {
+		parent, err := h.getMaterialCategory(strconv.Itoa(category.ParentID))
+		if err != nil {
+			h.renderCategoryForm(c, category, "Categoría padre no encontrada")
+			return
+		}
+		// Global categories can only hang from global ones; center categories from global or same-center ones
+		if parent.CenterID != 0 && parent.CenterID != category.CenterID {
+			h.renderCategoryForm(c, category, "La categoría padre debe ser global o del mismo centro")
+			return
+		}
+		if category.ID != 0 && h.isCategoryInTree(category.ParentID, category.ID) {
+			h.renderCategoryForm(c, category, "Una categoría no puede estar dentro de sí misma o de sus subcategorías")
+			return
+		}
+	}
+
+	if category.ID != 0 && category.CenterID != previousCenterID {
+		var children int
+		database.DB.QueryRow(`SELECT COUNT(*) FROM material_categories WHERE parent_id = ?`, category.ID).Scan(&children)
+		if children > 0 {
+			h.renderCategoryForm(c, category, "No se puede cambiar el centro de una categoría con subcategorías")
+			return
+		}
+	}
+
+	var err error
+	if category.ID == 0 {
+		_, err = database.DB.Exec(`INSERT INTO material_categories (center_id, parent_id, name, slug, icon, default_minimum_quantity, updated_at)
+				  VALUES (?, ?, ?, ?, ?, ?, datetime('now'))`,
+			nullableID(category.CenterID), nullableID(category.ParentID), category.Name, category.Slug,
+			category.Icon, category.DefaultMinimumQuantity)
+	} else {
+		_, err = database.DB.Exec(`UPDATE material_categories SET center_id = ?, parent_id = ?, name = ?, slug = ?, icon = ?,
+				  default_minimum_quantity = ?, updated_at = datetime('now') WHERE id = ?`,
+			nullableID(category.CenterID), nullableID(category.ParentID), category.Name, category.Slug,
+			category.Icon, category.DefaultMinimumQuantity, category.ID)
+		if err == nil {
+			// Keep the legacy text column in sync with the managed category
+			_, err = database.DB.Exec(`UPDATE materials SET category = ? WHERE category_id = ?`, category.Slug, category.ID)
+		}
+	}
+	if err != nil {
+		h.renderCategoryForm(c, category, "Error al guardar la categoría: "+err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/admin/categorias?success=Categoría guardada correctamente")
+}
+
+// AdminCategoriaEliminar deletes a category, moving its materials and subcategories to its parent
+func (h *Handlers) AdminCategoriaEliminar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	category, err := h.getMaterialCategory(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/categorias?error=Categoría no encontrada")
+		return
+	}
+
+	parentSlug := "general"
+	if category.ParentID != 0 {
+		if parent, err := h.getMaterialCategory(strconv.Itoa(category.ParentID)); err == nil {
+			parentSlug = parent.Slug
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/categorias?error=Error al eliminar la categoría")
+		return
+	}
+	defer tx.Rollback()
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE materials SET category_id = ?, category = ? WHERE category_id = ?`,
+			[]interface{}{nullableID(category.ParentID), parentSlug, category.ID}},
+		{`UPDATE material_categories SET parent_id = ? WHERE parent_id = ?`,
+			[]interface{}{nullableID(category.ParentID), category.ID}},
+		{`DELETE FROM material_categories WHERE id = ?`, []interface{}{category.ID}},
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			c.Redirect(http.StatusFound, "/admin/categorias?error=Error al eliminar la categoría")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, "/admin/categorias?error=Error al eliminar la categoría")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/admin/categorias?success=Categoría eliminada correctamente")
+}
+
+// getAllMaterialCategories retrieves every category of every center as a tree
+func (h *Handlers) getAllMaterialCategories() ([]models.MaterialCategory, error) {
+	return h.queryMaterialCategories("1 = 1")
+}
+
+// getCategoriesForCenter retrieves the global categories plus those of a center as a tree
+func (h *Handlers) getCategoriesForCenter(centerID int) ([]models.MaterialCategory, error) {
+	return h.queryMaterialCategories("mc.center_id IS NULL OR mc.center_id = ?", centerID)
+}
+
+// queryMaterialCategories retrieves the categories matching a WHERE clause (alias mc) ordered as a tree
+func (h *Handlers) queryMaterialCategories(where string, args ...interface{}) ([]models.MaterialCategory, error) {
+	query := `SELECT mc.id, COALESCE(mc.center_id, 0), COALESCE(c.name, ''), COALESCE(mc.parent_id, 0), mc.name, mc.slug,
+			  mc.icon, mc.default_minimum_quantity, (SELECT COUNT(*) FROM materials m WHERE m.category_id = mc.id),
+			  mc.created_at, mc.updated_at
+			  FROM material_categories mc
+			  LEFT JOIN centers c ON mc.center_id = c.id
+			  WHERE ` + where + `
+			  ORDER BY mc.name`
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []models.MaterialCategory
+	for rows.Next() {
+		var category models.MaterialCategory
+		var defaultMinimum sql.NullInt64
+		err := rows.Scan(&category.ID, &category.CenterID, &category.CenterName, &category.ParentID,
+			&category.Name, &category.Slug, &category.Icon, &defaultMinimum, &category.MaterialCount,
+			&category.CreatedAt, &category.UpdatedAt)
+		if err != nil {
+			continue
+		}
+		if defaultMinimum.Valid {
+			value := int(defaultMinimum.Int64)
+			category.DefaultMinimumQuantity = &value
+		}
+		categories = append(categories, category)
+	}
+
+	return sortCategoryTree(categories), nil
+}
+
+// sortCategoryTree orders categories so that each one is followed by its children, setting their depth
+func sortCategoryTree(categories []models.MaterialCategory) []models.MaterialCategory {
+	known := map[int]bool{}
+	for _, category := range categories {
+		known[category.ID] = true
+	}
+
+	children := map[int][]models.MaterialCategory{}
+	for _, category := range categories {
+		parent := category.ParentID
+		if !known[parent] {
+			parent = 0 // Parents outside the list are shown as top-level
+		}
+		children[parent] = append(children[parent], category)
+	}
+
+	sorted := make([]models.MaterialCategory, 0, len(categories))
+	var walk func(parent, depth int)
+	walk = func(parent, depth int) {
+		for _, category := range children[parent] {
+			category.Depth = depth
+			sorted = append(sorted, category)
+			walk(category.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+
+	return sorted
+}
+
+// getMaterialCategory retrieves a single category by ID
+func (h *Handlers) getMaterialCategory(categoryID string) (models.MaterialCategory, error) {
+	var category models.MaterialCategory
+	var defaultMinimum sql.NullInt64
+	query := `SELECT mc.id, COALESCE(mc.center_id, 0), COALESCE(c.name, ''), COALESCE(mc.parent_id, 0), mc.name, mc.slug,
+			  mc.icon, mc.default_minimum_quantity, mc.created_at, mc.updated_at
+			  FROM material_categories mc
+			  LEFT JOIN centers c ON mc.center_id = c.id
+			  WHERE mc.id = ?`
+
+	err := database.DB.QueryRow(query, categoryID).Scan(&category.ID, &category.CenterID, &category.CenterName,
+		&category.ParentID, &category.Name, &category.Slug, &category.Icon, &defaultMinimum,
+		&category.CreatedAt, &category.UpdatedAt)
+	if defaultMinimum.Valid {
+		value := int(defaultMinimum.Int64)
+		category.DefaultMinimumQuantity = &value
+	}
+
+	return category, err
+}
+
+// getCategoryForCenter retrieves a category only if it can be used by the given center
+func (h *Handlers) getCategoryForCenter(categoryID string, centerID int) (models.MaterialCategory, error) {
+	category, err := h.getMaterialCategory(categoryID)
+	if err != nil {
+		return category, err
+	}
+	if category.CenterID != 0 && category.CenterID != centerID {
+		return category, sql.ErrNoRows
+	}
+	return category, nil
+}
+
+// isCategoryInTree reports whether categoryID is rootID or one of its descendants
+func (h *Handlers) isCategoryInTree(categoryID, rootID int) bool {
+	var count int
+	query := `SELECT COUNT(*) FROM (` + categoryTreeSQL + `) WHERE id = ?`
+	if err := database.DB.QueryRow(query, rootID, categoryID).Scan(&count); err != nil {
+		return false
+	}
+	return count > 0
+}
+
+// getPictos lists the icon files available in static/pictos
+func getPictos() []string {
+	entries, err := fs.ReadDir(staticFS, "static/pictos")
+	if err != nil {
+		return nil
+	}
+
+	var pictos []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(strings.ToLower(entry.Name()), ".png") {
+			pictos = append(pictos, entry.Name())
+		}
+	}
+	return pictos
+}
+
+// isPicto checks that an icon name is one of the available pictos
+func isPicto(name string) bool {
+	for _, picto := range getPictos() {
+		if picto == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nullableID converts an optional ID (0 meaning none) into a value for a nullable column
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// slugify builds the normalised identifier of a category name: lowercase,
+// without accents and with dashes instead of spaces or symbols
+func slugify(name string) string {
+	replacer := strings.NewReplacer(
+		"á", "a", "à", "a", "ä", "a", "â", "a",
+		"é", "e", "è", "e", "ë", "e", "ê", "e",
+		"í", "i", "ì", "i", "ï", "i", "î", "i",
+		"ó", "o", "ò", "o", "ö", "o", "ô", "o",
+		"ú", "u", "ù", "u", "ü", "u", "û", "u",
+		"ñ", "n", "ç", "c",
+	)
+	name = replacer.Replace(strings.ToLower(strings.TrimSpace(name)))
+
+	var b strings.Builder
+	dash := false
+	for _, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	return strings.TrimSuffix(b.String(), "-")
+}
@@ -0,0 +1,584 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Errors returned when assembling, using or taking apart kits
+var (
+	errKitNoStock      = errors.New("not enough free stock of the kit components")
+	errKitNotAssembled = errors.New("not enough assembled kits")
+)
+
+// kitItemSelectSQL selects the components of the kit given as the only argument with their free quantity
+const kitItemSelectSQL = `SELECT i.id, i.kit_id, i.material_id, m.name, m.unit, i.quantity,
+			  m.available_quantity - ` + reservedQuantitySQL + ` - ` + loanedQuantitySQL + `
+			  FROM material_kit_items i
+			  JOIN materials m ON i.material_id = m.id
+			  WHERE i.kit_id = ?
+			  ORDER BY m.name`
+
+// MaterialesKits handles the kits page of the selected center
+func (h *Handlers) MaterialesKits(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	kits, err := h.getMaterialKits(centro)
+	if err != nil {
+		kits = []models.MaterialKit{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Kits de Materiales"
+	data["Centro"] = centro
+	data["Kits"] = kits
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_kits.html", data)
+}
+
+// MaterialesKitCrear handles kit creation (GET shows form, POST processes it)
+func (h *Handlers) MaterialesKitCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=No tienes permiso para gestionar kits")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleKitSave(c, centro, models.MaterialKit{}, user)
+		return
+	}
+
+	h.renderKitForm(c, centro, models.MaterialKit{}, "")
+}
+
+// MaterialesKitEditar handles kit editing
+func (h *Handlers) MaterialesKitEditar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=No tienes permiso para gestionar kits")
+		return
+	}
+
+	kit, err := h.getMaterialKit(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=Kit no encontrado")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleKitSave(c, centro, kit, user)
+		return
+	}
+
+	h.renderKitForm(c, centro, kit, "")
+}
+
+// renderKitForm renders the kit form with the materials of the center
+func (h *Handlers) renderKitForm(c *gin.Context, centro string, kit models.MaterialKit, errorMessage string) {
+	materials, err := h.getMaterials(centro)
+	if err != nil {
+		materials = []models.Material{}
+	}
+
+	data := h.getCommonData(c)
+	data["Action"] = "crear"
+	data["PageTitle"] = "Figaró - Crear Kit"
+	if kit.ID != 0 {
+		data["Action"] = "editar"
+		data["PageTitle"] = "Figaró - Editar Kit"
+	}
+	data["Centro"] = centro
+	data["Kit"] = kit
+	data["Materials"] = materials
+	data["ErrorMessage"] = errorMessage
+
+	h.renderTemplate(c, "materiales_kit_form.html", data)
+}
+
+// handleKitSave validates and stores a new or edited kit with its components
+func (h *Handlers) handleKitSave(c *gin.Context, centro string, kit models.MaterialKit, user *models.User) {
+	kit.Name = strings.TrimSpace(c.PostForm("nombre"))
+	kit.Description = strings.TrimSpace(c.PostForm("descripcion"))
+
+	previousItems := kit.Items
+
+	// Components repeated in the form are added together
+	materialIDs := c.PostFormArray("item_material_id[]")
+	quantities := c.PostFormArray("item_cantidad[]")
+	unitIDs := c.PostFormArray("item_unidad_id[]")
+	quantityByMaterial := map[int]int{}
+	kit.Items = nil
+	for i, materialID := range materialIDs {
+		if materialID == "" || i >= len(quantities) {
+			continue
+		}
+		material, err := h.getMaterial(materialID, centro)
+		if err != nil {
+			h.renderKitForm(c, centro, kit, "Material no encontrado en este centro")
+			return
+		}
+		// Components can be given in any unit of the material and are stored in base units
+		var unitID string
+		if i < len(unitIDs) {
+			unitID = unitIDs[i]
+		}
+		quantity, err := parseUnitQuantity(quantities[i], unitID, material)
+		if err != nil || quantity <= 0 {
+			h.renderKitForm(c, centro, kit, "Las cantidades de los componentes deben ser mayores que cero")
+			return
+		}
+		if quantityByMaterial[material.ID] > maxBaseQuantity-quantity {
+			h.renderKitForm(c, centro, kit, "La cantidad de "+material.Name+" es demasiado grande")
+			return
+		}
+		if _, ok := quantityByMaterial[material.ID]; !ok {
+			kit.Items = append(kit.Items, models.MaterialKitItem{MaterialID: material.ID, MaterialName: material.Name, Unit: material.Unit})
+		}
+		quantityByMaterial[material.ID] += quantity
+	}
+	for i := range kit.Items {
+		kit.Items[i].Quantity = quantityByMaterial[kit.Items[i].MaterialID]
+	}
+
+	if kit.Name == "" {
+		h.renderKitForm(c, centro, kit, "El nombre del kit es obligatorio")
+		return
+	}
+	if len(kit.Items) == 0 {
+		h.renderKitForm(c, centro, kit, "Añade al menos un material al kit")
+		return
+	}
+	// Ready-made kits were assembled with the current components
+	if kit.AssembledQuantity > 0 && !sameKitItems(previousItems, kit.Items) {
+		h.renderKitForm(c, centro, kit, "Desmonta los kits montados antes de cambiar sus componentes")
+		return
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		h.renderKitForm(c, centro, kit, "Error al guardar el kit: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	if kit.ID == 0 {
+		result, err := tx.Exec(`INSERT INTO material_kits (center_id, name, description, created_by, updated_at)
+				  VALUES (?, ?, ?, ?, datetime('now'))`, centerID, kit.Name, kit.Description, user.ID)
+		if err != nil {
+			h.renderKitForm(c, centro, kit, "Error al guardar el kit: "+err.Error())
+			return
+		}
+		kitID, _ := result.LastInsertId()
+		kit.ID = int(kitID)
+	} else {
+		_, err := tx.Exec(`UPDATE material_kits SET name = ?, description = ?, updated_at = datetime('now') WHERE id = ?`,
+			kit.Name, kit.Description, kit.ID)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM material_kit_items WHERE kit_id = ?`, kit.ID)
+		}
+		if err != nil {
+			h.renderKitForm(c, centro, kit, "Error al guardar el kit: "+err.Error())
+			return
+		}
+	}
+
+	for _, item := range kit.Items {
+		_, err := tx.Exec(`INSERT INTO material_kit_items (kit_id, material_id, quantity) VALUES (?, ?, ?)`,
+			kit.ID, item.MaterialID, item.Quantity)
+		if err != nil {
+			h.renderKitForm(c, centro, kit, "Error al guardar el kit: "+err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.renderKitForm(c, centro, kit, "Error al guardar el kit: "+err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/kits?success=Kit guardado correctamente")
+}
+
+// MaterialesKitEliminar deletes a kit; ready-made kits are taken apart first
+func (h *Handlers) MaterialesKitEliminar(c *gin.Context) {
+	kit, user, ok := h.requireKitManager(c)
+	if !ok {
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=Error al eliminar el kit")
+		return
+	}
+	defer tx.Rollback()
+
+	if err := reloadKitStock(tx, &kit); err != nil {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=Error al eliminar el kit")
+		return
+	}
+
+	if kit.AssembledQuantity > 0 {
+		if err := returnKitComponents(tx, kit, kit.AssembledQuantity, user.ID); err != nil {
+			c.Redirect(http.StatusFound, "/materiales/kits?error=Error al desmontar los kits montados")
+			return
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM material_kits WHERE id = ?`, kit.ID); err != nil {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=Error al eliminar el kit")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=Error al eliminar el kit")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/kits?success=Kit eliminado correctamente")
+}
+
+// MaterialesKitMontar assembles kits, taking their components out of the stock
+func (h *Handlers) MaterialesKitMontar(c *gin.Context) {
+	h.handleKitAction(c, func(tx *sql.Tx, kit models.MaterialKit, quantity, userID int) error {
+		if err := takeKitComponents(tx, kit, quantity, "kit_assembly", userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE material_kits SET assembled_quantity = assembled_quantity + ?, updated_at = datetime('now')
+				  WHERE id = ?`, quantity, kit.ID)
+		return err
+	}, "%d kit(s) montado(s)")
+}
+
+// MaterialesKitUsar hands out kits: ready-made kits first, then kits made on the spot from the stock
+func (h *Handlers) MaterialesKitUsar(c *gin.Context) {
+	h.handleKitAction(c, func(tx *sql.Tx, kit models.MaterialKit, quantity, userID int) error {
+		fromAssembled := min(quantity, kit.AssembledQuantity)
+		if fromAssembled > 0 {
+			_, err := tx.Exec(`UPDATE material_kits SET assembled_quantity = assembled_quantity - ?, updated_at = datetime('now')
+					  WHERE id = ?`, fromAssembled, kit.ID)
+			if err != nil {
+				return err
+			}
+		}
+		if quantity > fromAssembled {
+			return takeKitComponents(tx, kit, quantity-fromAssembled, "consumption", userID)
+		}
+		return nil
+	}, "%d kit(s) usado(s)")
+}
+
+// MaterialesKitDesmontar takes ready-made kits apart, returning their components to the store room
+func (h *Handlers) MaterialesKitDesmontar(c *gin.Context) {
+	h.handleKitAction(c, func(tx *sql.Tx, kit models.MaterialKit, quantity, userID int) error {
+		if quantity > kit.AssembledQuantity {
+			return errKitNotAssembled
+		}
+		if err := returnKitComponents(tx, kit, quantity, userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE material_kits SET assembled_quantity = assembled_quantity - ?, updated_at = datetime('now')
+				  WHERE id = ?`, quantity, kit.ID)
+		return err
+	}, "%d kit(s) desmontado(s)")
+}
+
+// handleKitAction runs a kit stock action for the posted quantity in a single transaction,
+// so every component is updated or none is
+func (h *Handlers) handleKitAction(c *gin.Context, action func(tx *sql.Tx, kit models.MaterialKit, quantity, userID int) error, successFormat string) {
+	kit, user, ok := h.requireKitManager(c)
+	if !ok {
+		return
+	}
+
+	// Go back to the page the action was sent from
+	redirectURL := "/materiales/kits"
+	if c.PostForm("volver") == "materiales" {
+		redirectURL = "/materiales"
+	}
+
+	quantity, err := strconv.Atoi(c.DefaultPostForm("cantidad", "1"))
+	if err != nil || quantity <= 0 {
+		c.Redirect(http.StatusFound, redirectURL+"?error=La cantidad debe ser mayor que cero")
+		return
+	}
+	if quantity > maxBaseQuantity {
+		c.Redirect(http.StatusFound, redirectURL+"?error=La cantidad es demasiado grande")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al actualizar el kit")
+		return
+	}
+	defer tx.Rollback()
+
+	if err := reloadKitStock(tx, &kit); err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al actualizar el kit")
+		return
+	}
+
+	err = action(tx, kit, quantity, user.ID)
+	if err == errKitNoStock {
+		c.Redirect(http.StatusFound, redirectURL+"?error="+fmt.Sprintf("No hay stock libre suficiente de los componentes de %s", kit.Name))
+		return
+	}
+	if err == errKitNotAssembled {
+		c.Redirect(http.StatusFound, redirectURL+"?error="+fmt.Sprintf("Solo hay %d kit(s) montado(s) de %s", kit.AssembledQuantity, kit.Name))
+		return
+	}
+	if err == errInvalidQuantity {
+		c.Redirect(http.StatusFound, redirectURL+"?error=La cantidad es demasiado grande")
+		return
+	}
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al actualizar el kit")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al actualizar el kit")
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirectURL+"?success="+fmt.Sprintf(successFormat, quantity)+" de "+kit.Name)
+}
+
+// requireKitManager checks the user may manage kits and loads the kit of the selected center.
+// It writes the response and returns false when the request cannot continue.
+func (h *Handlers) requireKitManager(c *gin.Context) (models.MaterialKit, *models.User, bool) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return models.MaterialKit{}, nil, false
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return models.MaterialKit{}, nil, false
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=No tienes permiso para gestionar kits")
+		return models.MaterialKit{}, nil, false
+	}
+
+	kit, err := h.getMaterialKit(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/kits?error=Kit no encontrado")
+		return models.MaterialKit{}, nil, false
+	}
+
+	return kit, user, true
+}
+
+// takeKitComponents takes the components of the given number of kits out of the stock,
+// failing if any of them lacks free stock
+func takeKitComponents(tx *sql.Tx, kit models.MaterialKit, kits int, kind string, userID int) error {
+	needed := make([]int, len(kit.Items))
+	for i, item := range kit.Items {
+		quantity, err := unitQuantity(kits, item.Quantity)
+		if err != nil {
+			return err
+		}
+		if item.FreeQuantity < quantity {
+			return errKitNoStock
+		}
+		needed[i] = quantity
+	}
+
+	for i, item := range kit.Items {
+		removed, err := removeMaterialStock(tx, item.MaterialID, needed[i])
+		if err != nil {
+			return err
+		}
+		if err := recordMaterialMovement(tx, item.MaterialID, -removed, kind, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returnKitComponents puts the components of the given number of kits back in the store room
+func returnKitComponents(tx *sql.Tx, kit models.MaterialKit, kits, userID int) error {
+	for _, item := range kit.Items {
+		returned, err := unitQuantity(kits, item.Quantity)
+		if err != nil {
+			return err
+		}
+		if err := addMaterialStock(tx, item.MaterialID, 0, returned); err != nil {
+			return err
+		}
+		if err := recordMaterialMovement(tx, item.MaterialID, returned, "kit_disassembly", userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameKitItems reports whether two component lists have the same materials and quantities
+func sameKitItems(a, b []models.MaterialKitItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	quantities := map[int]int{}
+	for _, item := range a {
+		quantities[item.MaterialID] = item.Quantity
+	}
+	for _, item := range b {
+		if quantities[item.MaterialID] != item.Quantity {
+			return false
+		}
+	}
+	return true
+}
+
+// getMaterialKits retrieves the kits of a center with their components and how many can be made
+func (h *Handlers) getMaterialKits(centro string) ([]models.MaterialKit, error) {
+	rows, err := database.DB.Query(`SELECT id, center_id, name, description, assembled_quantity, created_at, updated_at
+			  FROM material_kits
+			  WHERE center_id = (SELECT id FROM centers WHERE name = ?)
+			  ORDER BY name`, centro)
+	if err != nil {
+		return nil, err
+	}
+
+	var kits []models.MaterialKit
+	for rows.Next() {
+		var kit models.MaterialKit
+		err := rows.Scan(&kit.ID, &kit.CenterID, &kit.Name, &kit.Description, &kit.AssembledQuantity,
+			&kit.CreatedAt, &kit.UpdatedAt)
+		if err != nil {
+			continue
+		}
+		kits = append(kits, kit)
+	}
+	rows.Close()
+
+	for i := range kits {
+		if err := h.loadKitItems(&kits[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return kits, nil
+}
+
+// getMaterialKit retrieves a kit of a center with its components
+func (h *Handlers) getMaterialKit(kitID, centro string) (models.MaterialKit, error) {
+	var kit models.MaterialKit
+	err := database.DB.QueryRow(`SELECT id, center_id, name, description, assembled_quantity, created_at, updated_at
+			  FROM material_kits
+			  WHERE id = ? AND center_id = (SELECT id FROM centers WHERE name = ?)`, kitID, centro).Scan(
+		&kit.ID, &kit.CenterID, &kit.Name, &kit.Description, &kit.AssembledQuantity, &kit.CreatedAt, &kit.UpdatedAt)
+	if err != nil {
+		return kit, err
+	}
+
+	return kit, h.loadKitItems(&kit)
+}
+
+// loadKitItems loads the components of a kit and computes how many kits the free stock allows
+func (h *Handlers) loadKitItems(kit *models.MaterialKit) error {
+	rows, err := database.DB.Query(kitItemSelectSQL, kit.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	scanKitItems(rows, kit)
+	return nil
+}
+
+// reloadKitStock reads the ready-made kits and the free stock of the components of a kit again
+// inside a transaction, so an action works on what concurrent actions have left
+func reloadKitStock(tx *sql.Tx, kit *models.MaterialKit) error {
+	err := tx.QueryRow(`SELECT assembled_quantity FROM material_kits WHERE id = ?`, kit.ID).Scan(&kit.AssembledQuantity)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(kitItemSelectSQL, kit.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	scanKitItems(rows, kit)
+	return nil
+}
+
+// scanKitItems reads the components of a kit and computes how many kits the free stock allows
+func scanKitItems(rows *sql.Rows, kit *models.MaterialKit) {
+	kit.Items = nil
+	kit.BuildableQuantity = 0
+	for rows.Next() {
+		var item models.MaterialKitItem
+		err := rows.Scan(&item.ID, &item.KitID, &item.MaterialID, &item.MaterialName, &item.Unit,
+			&item.Quantity, &item.FreeQuantity)
+		if err != nil {
+			continue
+		}
+
+		buildable := max(item.FreeQuantity, 0) / item.Quantity
+		if len(kit.Items) == 0 || buildable < kit.BuildableQuantity {
+			kit.BuildableQuantity = buildable
+		}
+		kit.Items = append(kit.Items, item)
+	}
+}
@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/EuskadiTech/Figaro/pkg/mail"
+	"github.com/gin-gonic/gin"
+)
+
+// loanedQuantitySQL is the quantity of a material (alias m) that is lent out
+const loanedQuantitySQL = `COALESCE((SELECT SUM(l.quantity) FROM material_loans l WHERE l.material_id = m.id AND l.status = 'out'), 0)`
+
+// reservedQuantitySQL is the quantity of a material (alias m) that is reserved for activities
+const reservedQuantitySQL = `COALESCE((SELECT SUM(r.quantity) FROM activity_material_reservations r WHERE r.material_id = m.id AND r.status = 'reserved'), 0)`
+
+// MaterialesPrestamos handles the loans page of the selected center
+func (h *Handlers) MaterialesPrestamos(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	// "activos" (default), "vencidos" or "devueltos"
+	statusFilter := c.DefaultQuery("estado", "activos")
+
+	loans, err := h.getMaterialLoans(centro, statusFilter)
+	if err != nil {
+		loans = []models.MaterialLoan{}
+	}
+
+	materials, err := h.getLendableMaterials(centro)
+	if err != nil {
+		materials = []models.Material{}
+	}
+
+	users, err := h.getAllUsers()
+	if err != nil {
+		users = []models.User{}
+	}
+
+	var classrooms []models.Classroom
+	if centerID, err := h.getCenterID(centro); err == nil {
+		classrooms, _ = h.getClassroomsByCenter(strconv.Itoa(centerID))
+	}
+
+	selectedMaterialID, _ := parseIntSafe(c.Query("material_id"))
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Préstamos"
+	data["Centro"] = centro
+	data["Loans"] = loans
+	data["StatusFilter"] = statusFilter
+	data["OverdueLoans"] = h.countOverdueLoans(centro)
+	data["LendableMaterials"] = materials
+	data["SelectedMaterialID"] = selectedMaterialID
+	data["Users"] = users
+	data["Classrooms"] = classrooms
+	data["DefaultDueDate"] = time.Now().AddDate(0, 0, 7).Format("2006-01-02")
+	data["Today"] = time.Now().Format("2006-01-02")
+	data["EmailEnabled"] = h.getEmailConfig().Enabled()
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_prestamos.html", data)
+}
+
+// MaterialesPrestamoCrear lends units of a reusable material to a user or a classroom
+func (h *Handlers) MaterialesPrestamoCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=No tienes permiso para prestar materiales")
+		return
+	}
+
+	material, err := h.getMaterial(c.PostForm("material_id"), centro)
+	if err != nil || !material.IsLendable {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=Material no encontrado o no se presta")
+		return
+	}
+
+	quantity, err := parseUnitQuantity(c.PostForm("cantidad"), c.PostForm("unidad_id"), material)
+	if err != nil || quantity <= 0 {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=La cantidad debe ser un número positivo")
+		return
+	}
+	if free := material.AvailableQuantity - material.ReservedQuantity - material.LoanedQuantity; quantity > free {
+		c.Redirect(http.StatusFound, fmt.Sprintf("/materiales/prestamos?error=Solo hay %d %s libres de %s", max(free, 0), material.Unit, material.Name))
+		return
+	}
+
+	dueDate, err := time.Parse("2006-01-02", c.PostForm("fecha_devolucion"))
+	if err != nil || dueDate.Format("2006-01-02") < time.Now().Format("2006-01-02") {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=La fecha de devolución no es válida")
+		return
+	}
+
+	// The borrower is "usuario:<id>" or "aula:<id>"
+	var borrowerUserID, borrowerClassroomID int
+	kind, id, _ := strings.Cut(c.PostForm("prestatario"), ":")
+	switch kind {
+	case "usuario":
+		borrowerUserID, _ = strconv.Atoi(id)
+		var count int
+		database.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, borrowerUserID).Scan(&count)
+		if count == 0 {
+			borrowerUserID = 0
+		}
+	case "aula":
+		borrowerClassroomID, _ = strconv.Atoi(id)
+		var count int
+		database.DB.QueryRow(`SELECT COUNT(*) FROM classrooms WHERE id = ? AND center_id = ?`, borrowerClassroomID, material.CenterID).Scan(&count)
+		if count == 0 {
+			borrowerClassroomID = 0
+		}
+	}
+	if borrowerUserID == 0 && borrowerClassroomID == 0 {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=Selecciona a quién se presta el material")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=Error al registrar el préstamo")
+		return
+	}
+	defer tx.Rollback()
+
+	// Check the free stock again inside the transaction so two loans made at the same time
+	// cannot lend the same units
+	var free int
+	err = tx.QueryRow(`SELECT m.available_quantity
+			  - `+reservedQuantitySQL+` - `+loanedQuantitySQL+` FROM materials m WHERE m.id = ? AND m.center_id = ?`, material.ID, material.CenterID).Scan(&free)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=Material no encontrado")
+		return
+	}
+	if quantity > free {
+		c.Redirect(http.StatusFound, fmt.Sprintf("/materiales/prestamos?error=Solo hay %d %s libres de %s", max(free, 0), material.Unit, material.Name))
+		return
+	}
+
+	_, err = tx.Exec(`INSERT INTO material_loans (material_id, center_id, quantity, borrower_user_id, borrower_classroom_id,
+			  due_date, notes, send_reminders, lent_by, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`,
+		material.ID, material.CenterID, quantity, nullableID(borrowerUserID), nullableID(borrowerClassroomID),
+		dueDate.Format("2006-01-02"), strings.TrimSpace(c.PostForm("notas")), c.PostForm("recordatorio") != "", user.ID)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=Error al registrar el préstamo")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=Error al registrar el préstamo")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/prestamos?success=Préstamo registrado correctamente")
+}
+
+// MaterialesPrestamoDevolver checks a loan back in
+func (h *Handlers) MaterialesPrestamoDevolver(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=No tienes permiso para registrar devoluciones")
+		return
+	}
+
+	result, err := database.DB.Exec(`UPDATE material_loans SET status = 'returned', returned_by = ?, returned_at = datetime('now'), updated_at = datetime('now')
+			  WHERE id = ? AND status = 'out' AND center_id = (SELECT id FROM centers WHERE name = ?)`,
+		user.ID, c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=Error al registrar la devolución")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.Redirect(http.StatusFound, "/materiales/prestamos?error=Préstamo no encontrado o ya devuelto")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/prestamos?success=Devolución registrada")
+}
+
+// getLendableMaterials retrieves the reusable materials of a center
+func (h *Handlers) getLendableMaterials(centro string) ([]models.Material, error) {
+	materials, err := h.getMaterials(centro)
+	if err != nil {
+		return nil, err
+	}
+
+	var lendable []models.Material
+	for _, material := range materials {
+		if material.IsLendable {
+			lendable = append(lendable, material)
+		}
+	}
+	return lendable, nil
+}
+
+// materialLoanSelectSQL selects the loan columns scanned by scanMaterialLoan
+const materialLoanSelectSQL = `SELECT l.id, l.material_id, m.name, m.unit, l.center_id, l.quantity, l.borrower_user_id, l.borrower_classroom_id,
+			  COALESCE(bu.display_name, cl.name, ''), COALESCE(bu.email, ''), l.due_date, l.status, l.notes, l.send_reminders,
+			  l.lent_by, COALESCE(lu.display_name, ''), COALESCE(lu.email, ''), COALESCE(ru.display_name, ''), l.lent_at, l.returned_at
+			  FROM material_loans l
+			  JOIN materials m ON l.material_id = m.id
+			  LEFT JOIN users bu ON l.borrower_user_id = bu.id
+			  LEFT JOIN classrooms cl ON l.borrower_classroom_id = cl.id
+			  LEFT JOIN users lu ON l.lent_by = lu.id
+			  LEFT JOIN users ru ON l.returned_by = ru.id`
+
+// scanMaterialLoan scans a row selected with materialLoanSelectSQL
+func scanMaterialLoan(rows interface{ Scan(...interface{}) error }) (models.MaterialLoan, error) {
+	var loan models.MaterialLoan
+	err := rows.Scan(&loan.ID, &loan.MaterialID, &loan.MaterialName, &loan.Unit, &loan.CenterID, &loan.Quantity,
+		&loan.BorrowerUserID, &loan.BorrowerClassroomID, &loan.BorrowerName, &loan.BorrowerEmail, &loan.DueDate,
+		&loan.Status, &loan.Notes, &loan.SendReminders, &loan.LentBy, &loan.LentByName, &loan.LentByEmail,
+		&loan.ReturnedByName, &loan.LentAt, &loan.ReturnedAt)
+	return loan, err
+}
+
+// getMaterialLoans retrieves the loans of a center: outstanding ("activos"), overdue ("vencidos") or returned ("devueltos")
+func (h *Handlers) getMaterialLoans(centro, statusFilter string) ([]models.MaterialLoan, error) {
+	query := materialLoanSelectSQL + ` WHERE l.center_id = (SELECT id FROM centers WHERE name = ?)`
+	switch statusFilter {
+	case "vencidos":
+		query += ` AND l.status = 'out' AND l.due_date < date('now', 'localtime') ORDER BY l.due_date, l.id`
+	case "devueltos":
+		query += ` AND l.status = 'returned' ORDER BY l.returned_at DESC, l.id DESC LIMIT 100`
+	default:
+		query += ` AND l.status = 'out' ORDER BY l.due_date, l.id`
+	}
+
+	rows, err := database.DB.Query(query, centro)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loans []models.MaterialLoan
+	for rows.Next() {
+		loan, err := scanMaterialLoan(rows)
+		if err != nil {
+			continue
+		}
+		loans = append(loans, loan)
+	}
+
+	return loans, nil
+}
+
+// countOverdueLoans returns how many outstanding loans of a center are past their due date
+func (h *Handlers) countOverdueLoans(centro string) int {
+	var count int
+	database.DB.QueryRow(`SELECT COUNT(*) FROM material_loans
+			  WHERE status = 'out' AND due_date < date('now', 'localtime') AND center_id = (SELECT id FROM centers WHERE name = ?)`,
+		centro).Scan(&count)
+	return count
+}
+
+// getEmailConfig loads the SMTP settings
+func (h *Handlers) getEmailConfig() mail.Config {
+	settings, err := h.getAllSystemSettings()
+	if err != nil {
+		return mail.Config{}
+	}
+	return mail.ConfigFromSettings(settings["email"])
+}
+
+// sendLoanReminders emails the borrowers of loans with reminders enabled: once the day before
+// the due date and once when the loan becomes overdue. Loans to classrooms notify the lender.
+func (h *Handlers) sendLoanReminders() error {
+	cfg := h.getEmailConfig()
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	reminders := []struct {
+		condition string
+		column    string
+		subject   string
+		message   string
+	}{
+		{
+			condition: `l.reminder_sent_at IS NULL AND l.due_date BETWEEN date('now', 'localtime') AND date('now', 'localtime', '+1 day')`,
+			column:    "reminder_sent_at",
+			subject:   "Recordatorio de devolución: %s",
+			message:   "El préstamo de %d %s de %s (%s) debe devolverse el %s.",
+		},
+		{
+			condition: `l.overdue_notice_sent_at IS NULL AND l.due_date < date('now', 'localtime')`,
+			column:    "overdue_notice_sent_at",
+			subject:   "Préstamo vencido: %s",
+			message:   "El préstamo de %d %s de %s (%s) debía devolverse el %s. Por favor, devuélvelo lo antes posible.",
+		},
+	}
+
+	sent := 0
+	for _, reminder := range reminders {
+		rows, err := database.DB.Query(materialLoanSelectSQL + ` WHERE l.status = 'out' AND l.send_reminders AND ` + reminder.condition)
+		if err != nil {
+			return err
+		}
+		var loans []models.MaterialLoan
+		for rows.Next() {
+			if loan, err := scanMaterialLoan(rows); err == nil {
+				loans = append(loans, loan)
+			}
+		}
+		rows.Close()
+
+		for _, loan := range loans {
+			recipient := loan.BorrowerEmail
+			if recipient == "" {
+				recipient = loan.LentByEmail
+			}
+
+			if recipient != "" {
+				body := fmt.Sprintf(reminder.message, loan.Quantity, loan.Unit, loan.MaterialName, loan.BorrowerName,
+					loan.DueDate.Format("02/01/2006"))
+				if err := mail.Send(cfg, []string{recipient}, fmt.Sprintf(reminder.subject, loan.MaterialName), body); err != nil {
+					logger.Error("Failed to send reminder of loan %d: %v", loan.ID, err)
+					continue
+				}
+				sent++
+			}
+
+			// Loans without anyone to notify are marked too, so they are not checked again
+			_, err := database.DB.Exec(`UPDATE material_loans SET `+reminder.column+` = datetime('now') WHERE id = ?`, loan.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if sent > 0 {
+		logger.Info("Sent %d material loan reminders", sent)
+	}
+	return nil
+}
+
+// RunLoanReminders periodically sends the reminders of due and overdue material loans
+func (h *Handlers) RunLoanReminders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := h.sendLoanReminders(); err != nil {
+			logger.Error("Failed to send material loan reminders: %v", err)
+		}
+		<-ticker.C
+	}
+}
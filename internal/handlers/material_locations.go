@@ -0,0 +1,559 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Errors returned when moving stock between locations
+var (
+	errLocationNotFound = errors.New("storage location not found")
+	errNotEnoughStock   = errors.New("not enough stock in location")
+)
+
+// sqlExecutor is implemented by both *sql.DB and *sql.Tx, so the stock helpers
+// can run on their own or as part of a larger transaction
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// MaterialesUbicaciones handles the storage locations page of the selected center
+func (h *Handlers) MaterialesUbicaciones(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Centro no encontrado")
+		return
+	}
+
+	locations, err := h.getStorageLocations(centerID)
+	if err != nil {
+		locations = []models.StorageLocation{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Ubicaciones"
+	data["Centro"] = centro
+	data["Locations"] = locations
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_ubicaciones.html", data)
+}
+
+// MaterialesUbicacionCrear creates a named storage room in the selected center
+func (h *Handlers) MaterialesUbicacionCrear(c *gin.Context) {
+	centerID, ok := h.requireLocationManager(c)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(c.PostForm("nombre"))
+	if name == "" {
+		c.Redirect(http.StatusFound, "/materiales/ubicaciones?error=El nombre de la ubicación es obligatorio")
+		return
+	}
+
+	_, err := database.DB.Exec(`INSERT INTO storage_locations (center_id, name, updated_at) VALUES (?, ?, datetime('now'))`,
+		centerID, name)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/ubicaciones?error=Error al crear la ubicación")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/ubicaciones?success=Ubicación creada correctamente")
+}
+
+// MaterialesUbicacionEditar renames a storage room; classroom locations take the classroom name
+func (h *Handlers) MaterialesUbicacionEditar(c *gin.Context) {
+	centerID, ok := h.requireLocationManager(c)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(c.PostForm("nombre"))
+	if name == "" {
+		c.Redirect(http.StatusFound, "/materiales/ubicaciones?error=El nombre de la ubicación es obligatorio")
+		return
+	}
+
+	result, err := database.DB.Exec(`UPDATE storage_locations SET name = ?, updated_at = datetime('now')
+			  WHERE id = ? AND center_id = ? AND classroom_id IS NULL`, name, c.Param("id"), centerID)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/ubicaciones?error=Error al renombrar la ubicación")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.Redirect(http.StatusFound, "/materiales/ubicaciones?error=Las aulas se renombran desde la administración del centro")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/ubicaciones?success=Ubicación actualizada correctamente")
+}
+
+// MaterialesUbicacionEliminar deletes a storage room, moving its stock to the default store room
+func (h *Handlers) MaterialesUbicacionEliminar(c *gin.Context) {
+	centerID, ok := h.requireLocationManager(c)
+	if !ok {
+		return
+	}
+
+	locationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/ubicaciones?error=Ubicación no encontrada")
+		return
+	}
+
+	err = h.deleteStorageLocation(centerID, locationID)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/ubicaciones?error=No se puede eliminar esta ubicación")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/ubicaciones?success=Ubicación eliminada; su material se ha movido al almacén")
+}
+
+// requireLocationManager checks the user may manage locations and returns the selected center ID.
+// It writes the response and returns false when the request cannot continue.
+func (h *Handlers) requireLocationManager(c *gin.Context) (int, bool) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return 0, false
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return 0, false
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return 0, false
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Centro no encontrado")
+		return 0, false
+	}
+
+	return centerID, true
+}
+
+// deleteStorageLocation removes a storage room after moving its stock to the default location.
+// The default location and classroom locations cannot be deleted.
+func (h *Handlers) deleteStorageLocation(centerID, locationID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var isDefault bool
+	var classroomID sql.NullInt64
+	err = tx.QueryRow(`SELECT is_default, classroom_id FROM storage_locations WHERE id = ? AND center_id = ?`,
+		locationID, centerID).Scan(&isDefault, &classroomID)
+	if err != nil {
+		return err
+	}
+	if isDefault || classroomID.Valid {
+		return errLocationNotFound
+	}
+
+	defaultID, err := defaultLocationID(tx, centerID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT material_id, quantity FROM material_stock WHERE location_id = ? AND quantity > 0`, locationID)
+	if err != nil {
+		return err
+	}
+	var stock []models.MaterialStock
+	for rows.Next() {
+		var item models.MaterialStock
+		if err := rows.Scan(&item.MaterialID, &item.Quantity); err != nil {
+			continue
+		}
+		stock = append(stock, item)
+	}
+	rows.Close()
+
+	for _, item := range stock {
+		if err := moveMaterialStock(tx, item.MaterialID, locationID, defaultID, item.Quantity); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM storage_locations WHERE id = ?`, locationID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MaterialesStock shows where a material is kept (GET) and moves it between locations (POST)
+func (h *Handlers) MaterialesStock(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	material, err := h.getMaterial(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado")
+		return
+	}
+
+	redirectURL := "/materiales/stock/" + strconv.Itoa(material.ID)
+	if c.Request.Method == http.MethodPost {
+		if !auth.UserHasAccess(c, "materiales.update") {
+			c.String(http.StatusForbidden, "Acceso denegado")
+			return
+		}
+
+		fromID, _ := strconv.Atoi(c.PostForm("origen"))
+		toID, _ := strconv.Atoi(c.PostForm("destino"))
+		quantity, err := parseUnitQuantity(c.PostForm("cantidad"), c.PostForm("unidad_id"), material)
+		if err != nil || quantity <= 0 {
+			c.Redirect(http.StatusFound, redirectURL+"?error=La cantidad debe ser un número positivo")
+			return
+		}
+		if fromID == toID {
+			c.Redirect(http.StatusFound, redirectURL+"?error=El origen y el destino deben ser distintos")
+			return
+		}
+
+		err = h.moveStockBetweenLocations(material, fromID, toID, quantity)
+		switch err {
+		case nil:
+			c.Redirect(http.StatusFound, redirectURL+"?success=Material movido correctamente")
+		case errNotEnoughStock:
+			c.Redirect(http.StatusFound, redirectURL+"?error=No hay suficiente cantidad en la ubicación de origen")
+		default:
+			c.Redirect(http.StatusFound, redirectURL+"?error=Error al mover el material")
+		}
+		return
+	}
+
+	stock, err := h.getMaterialStock(material.ID, material.CenterID)
+	if err != nil {
+		stock = []models.MaterialStock{}
+	}
+
+	movements, err := h.getMaterialMovements(material.ID, 20)
+	if err != nil {
+		movements = []models.MaterialMovement{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Ubicaciones de " + material.Name
+	data["Centro"] = centro
+	data["Material"] = material
+	data["Stock"] = stock
+	data["Movements"] = movements
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "material_stock.html", data)
+}
+
+// moveStockBetweenLocations moves a quantity of a material between two locations of its center
+func (h *Handlers) moveStockBetweenLocations(material models.Material, fromID, toID, quantity int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Both locations must belong to the material's center
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM storage_locations WHERE id IN (?, ?) AND center_id = ?`,
+		fromID, toID, material.CenterID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count != 2 {
+		return errLocationNotFound
+	}
+
+	if err := moveMaterialStock(tx, material.ID, fromID, toID, quantity); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getStorageLocations retrieves the locations of a center with their stock totals.
+// The store room comes first, followed by the other storage rooms and the classrooms.
+func (h *Handlers) getStorageLocations(centerID int) ([]models.StorageLocation, error) {
+	query := `SELECT l.id, l.center_id, COALESCE(l.classroom_id, 0), l.name, l.is_default,
+			  (SELECT COUNT(*) FROM material_stock s WHERE s.location_id = l.id AND s.quantity > 0),
+			  (SELECT COALESCE(SUM(s.quantity), 0) FROM material_stock s WHERE s.location_id = l.id),
+			  l.created_at, l.updated_at
+			  FROM storage_locations l
+			  WHERE l.center_id = ?
+			  ORDER BY l.is_default DESC, l.classroom_id IS NOT NULL, l.name`
+
+	rows, err := database.DB.Query(query, centerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []models.StorageLocation
+	for rows.Next() {
+		var location models.StorageLocation
+		err := rows.Scan(&location.ID, &location.CenterID, &location.ClassroomID, &location.Name, &location.IsDefault,
+			&location.MaterialCount, &location.TotalQuantity, &location.CreatedAt, &location.UpdatedAt)
+		if err != nil {
+			continue
+		}
+		locations = append(locations, location)
+	}
+
+	return locations, nil
+}
+
+// getMaterialStock retrieves the quantity of a material in every location of its center
+func (h *Handlers) getMaterialStock(materialID, centerID int) ([]models.MaterialStock, error) {
+	query := `SELECT l.id, l.name, l.classroom_id IS NOT NULL, COALESCE(s.quantity, 0), COALESCE(s.updated_at, l.updated_at)
+			  FROM storage_locations l
+			  LEFT JOIN material_stock s ON s.location_id = l.id AND s.material_id = ?
+			  WHERE l.center_id = ?
+			  ORDER BY l.is_default DESC, l.classroom_id IS NOT NULL, l.name`
+
+	rows, err := database.DB.Query(query, materialID, centerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stock []models.MaterialStock
+	for rows.Next() {
+		item := models.MaterialStock{MaterialID: materialID}
+		err := rows.Scan(&item.LocationID, &item.LocationName, &item.IsClassroom, &item.Quantity, &item.UpdatedAt)
+		if err != nil {
+			continue
+		}
+		stock = append(stock, item)
+	}
+
+	return stock, nil
+}
+
+// getClassroomLocationID finds the location of a classroom of the center by the classroom name
+func (h *Handlers) getClassroomLocationID(centerID int, aula string) (int, error) {
+	var locationID int
+	err := database.DB.QueryRow(`SELECT l.id FROM storage_locations l
+			  JOIN classrooms cl ON l.classroom_id = cl.id
+			  WHERE l.center_id = ? AND cl.name = ?`, centerID, aula).Scan(&locationID)
+	return locationID, err
+}
+
+// createStoreRoom creates the store room of a new center
+func createStoreRoom(db sqlExecutor, centerID int64) error {
+	_, err := db.Exec(`INSERT INTO storage_locations (center_id, name, is_default) VALUES (?, 'Almacén', TRUE)`, centerID)
+	return err
+}
+
+// createClassroomLocation creates the location of a new classroom, named after it
+func createClassroomLocation(db sqlExecutor, classroomID int64) error {
+	_, err := db.Exec(`INSERT INTO storage_locations (center_id, classroom_id, name)
+			  SELECT center_id, id, name FROM classrooms WHERE id = ?`, classroomID)
+	return err
+}
+
+// defaultLocationID returns the store room of a center
+func defaultLocationID(db sqlExecutor, centerID int) (int, error) {
+	var locationID int
+	err := db.QueryRow(`SELECT id FROM storage_locations WHERE center_id = ? AND is_default = TRUE ORDER BY id LIMIT 1`,
+		centerID).Scan(&locationID)
+	return locationID, err
+}
+
+// addMaterialStock adds a quantity of a material to a location of its center.
+// A zero locationID adds it to the center's store room.
+func addMaterialStock(db sqlExecutor, materialID, locationID, quantity int) error {
+	if locationID == 0 {
+		var centerID int
+		if err := db.QueryRow(`SELECT center_id FROM materials WHERE id = ?`, materialID).Scan(&centerID); err != nil {
+			return err
+		}
+		var err error
+		if locationID, err = defaultLocationID(db, centerID); err != nil {
+			return err
+		}
+	}
+
+	result, err := db.Exec(`INSERT INTO material_stock (material_id, location_id, quantity, updated_at)
+			  SELECT m.id, l.id, ?, datetime('now') FROM materials m
+			  JOIN storage_locations l ON l.center_id = m.center_id
+			  WHERE m.id = ? AND l.id = ?
+			  ON CONFLICT (material_id, location_id) DO UPDATE SET
+			  quantity = quantity + excluded.quantity, updated_at = datetime('now')`,
+		quantity, materialID, locationID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errLocationNotFound
+	}
+
+	return syncMaterialQuantity(db, materialID)
+}
+
+// removeMaterialStock takes up to quantity units of a material out of its locations,
+// starting with the store room and then the locations holding the most. It returns
+// the quantity actually removed, which is lower than requested if there is not enough.
+func removeMaterialStock(tx *sql.Tx, materialID, quantity int) (int, error) {
+	rows, err := tx.Query(`SELECT s.location_id, s.quantity FROM material_stock s
+			  JOIN storage_locations l ON s.location_id = l.id
+			  WHERE s.material_id = ? AND s.quantity > 0
+			  ORDER BY l.is_default DESC, s.quantity DESC`, materialID)
+	if err != nil {
+		return 0, err
+	}
+
+	var stock []models.MaterialStock
+	for rows.Next() {
+		var item models.MaterialStock
+		if err := rows.Scan(&item.LocationID, &item.Quantity); err != nil {
+			continue
+		}
+		stock = append(stock, item)
+	}
+	rows.Close()
+
+	removed := 0
+	for _, item := range stock {
+		if removed == quantity {
+			break
+		}
+		take := min(item.Quantity, quantity-removed)
+		_, err := tx.Exec(`UPDATE material_stock SET quantity = quantity - ?, updated_at = datetime('now')
+				  WHERE material_id = ? AND location_id = ?`, take, materialID, item.LocationID)
+		if err != nil {
+			return removed, err
+		}
+		removed += take
+	}
+
+	return removed, syncMaterialQuantity(tx, materialID)
+}
+
+// reconcileMaterialStock adjusts the locations of a material so they add up to the given total.
+// Increases go to locationID (the store room if zero) and decreases follow removeMaterialStock.
+func reconcileMaterialStock(materialID, locationID, total int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setMaterialTotal(tx, materialID, locationID, total); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setMaterialTotal is reconcileMaterialStock inside an existing transaction
+func setMaterialTotal(tx *sql.Tx, materialID, locationID, total int) error {
+	var current int
+	err := tx.QueryRow(`SELECT COALESCE(SUM(quantity), 0) FROM material_stock WHERE material_id = ?`, materialID).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	switch delta := max(total, 0) - current; {
+	case delta > 0:
+		return addMaterialStock(tx, materialID, locationID, delta)
+	case delta < 0:
+		_, err = removeMaterialStock(tx, materialID, -delta)
+		return err
+	default:
+		return syncMaterialQuantity(tx, materialID)
+	}
+}
+
+// setLocationQuantity sets the quantity of a material in one location, updating the material total
+func setLocationQuantity(tx *sql.Tx, materialID, locationID, quantity int) error {
+	var current int
+	err := tx.QueryRow(`SELECT COALESCE(SUM(quantity), 0) FROM material_stock WHERE material_id = ? AND location_id = ?`,
+		materialID, locationID).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if delta := max(quantity, 0) - current; delta > 0 {
+		return addMaterialStock(tx, materialID, locationID, delta)
+	} else if delta < 0 {
+		_, err = tx.Exec(`UPDATE material_stock SET quantity = quantity + ?, updated_at = datetime('now')
+				  WHERE material_id = ? AND location_id = ?`, delta, materialID, locationID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return syncMaterialQuantity(tx, materialID)
+}
+
+// moveMaterialStock moves a quantity of a material from one location to another
+func moveMaterialStock(tx *sql.Tx, materialID, fromID, toID, quantity int) error {
+	result, err := tx.Exec(`UPDATE material_stock SET quantity = quantity - ?, updated_at = datetime('now')
+			  WHERE material_id = ? AND location_id = ? AND quantity >= ?`, quantity, materialID, fromID, quantity)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errNotEnoughStock
+	}
+
+	return addMaterialStock(tx, materialID, toID, quantity)
+}
+
+// syncMaterialQuantity stores the sum of the locations as the available quantity of a material
+func syncMaterialQuantity(db sqlExecutor, materialID int) error {
+	_, err := db.Exec(`DELETE FROM material_stock WHERE material_id = ? AND quantity = 0`, materialID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE materials SET available_quantity =
+			  (SELECT COALESCE(SUM(quantity), 0) FROM material_stock WHERE material_id = ?), updated_at = datetime('now')
+			  WHERE id = ?`, materialID, materialID)
+	return err
+}
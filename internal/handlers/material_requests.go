@@ -0,0 +1,597 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Errors returned when resolving material requests
+var (
+	errRequestNotPending = errors.New("material request is not pending")
+	errRequestNoStock    = errors.New("not enough free stock to fulfil the request")
+	errRequestNothing    = errors.New("no quantity to fulfil")
+)
+
+// requestStatusLabels are the Spanish names of the request statuses used in notifications
+var requestStatusLabels = map[string]string{
+	"fulfilled": "entregada",
+	"partial":   "entregada en parte",
+	"rejected":  "rechazada",
+}
+
+// requestItemSelectSQL selects the items of the request given as the only argument with the free
+// quantity of their material (0 when the material was deleted)
+const requestItemSelectSQL = `SELECT i.id, i.request_id, i.material_id, i.material_name, i.unit, i.quantity, i.fulfilled_quantity,
+			  COALESCE((SELECT m.available_quantity
+			  - ` + reservedQuantitySQL + ` - ` + loanedQuantitySQL + ` FROM materials m WHERE m.id = i.material_id), 0)
+			  FROM material_request_items i
+			  WHERE i.request_id = ?
+			  ORDER BY i.material_name`
+
+// materialRequestSelectSQL selects the request columns scanned by scanMaterialRequest
+const materialRequestSelectSQL = `SELECT mr.id, mr.center_id, mr.classroom_id, COALESCE(cl.name, ''), mr.requested_by, COALESCE(ru.display_name, ''),
+			  mr.needed_by, mr.status, COALESCE(mr.notes, ''), COALESCE(mr.response_notes, ''), mr.reviewed_by, COALESCE(vu.display_name, ''),
+			  mr.reviewed_at, mr.created_at,
+			  (SELECT COUNT(*) FROM material_request_items i WHERE i.request_id = mr.id)
+			  FROM material_requests mr
+			  LEFT JOIN classrooms cl ON mr.classroom_id = cl.id
+			  LEFT JOIN users ru ON mr.requested_by = ru.id
+			  LEFT JOIN users vu ON mr.reviewed_by = vu.id`
+
+// MaterialesSolicitudes handles the material requests inbox of the selected center.
+// Coordinators see every request; other users only the ones they made.
+func (h *Handlers) MaterialesSolicitudes(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	canApprove := auth.UserHasAccess(c, "materiales.approve")
+
+	// "pendientes" (default for coordinators), "resueltas" or "mias"
+	statusFilter := c.DefaultQuery("estado", "pendientes")
+	if !canApprove {
+		statusFilter = "mias"
+	}
+
+	requests, err := h.getMaterialRequests(centro, statusFilter, user.ID)
+	if err != nil {
+		requests = []models.MaterialRequest{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Solicitudes de Material"
+	data["Centro"] = centro
+	data["Requests"] = requests
+	data["StatusFilter"] = statusFilter
+	data["CanApprove"] = canApprove
+	data["PendingRequests"] = h.countPendingRequests(centro)
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_solicitudes.html", data)
+}
+
+// MaterialesSolicitudCrear handles the request form (GET) and submits a new request (POST)
+func (h *Handlers) MaterialesSolicitudCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	request := models.MaterialRequest{CenterID: centerID, NeededBy: time.Now().AddDate(0, 0, 7)}
+	if aula, err := c.Cookie("aula"); err == nil {
+		var classroomID int
+		if database.DB.QueryRow(`SELECT id FROM classrooms WHERE center_id = ? AND name = ?`, centerID, aula).Scan(&classroomID) == nil {
+			request.ClassroomID = &classroomID
+		}
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleMaterialRequestCreate(c, centro, request, user)
+		return
+	}
+
+	h.renderMaterialRequestForm(c, centro, request, "")
+}
+
+// renderMaterialRequestForm renders the request form with the classrooms and materials of the center
+func (h *Handlers) renderMaterialRequestForm(c *gin.Context, centro string, request models.MaterialRequest, errorMessage string) {
+	classrooms, err := h.getClassroomsByCenter(strconv.Itoa(request.CenterID))
+	if err != nil {
+		classrooms = []models.Classroom{}
+	}
+	materials, err := h.getMaterials(centro)
+	if err != nil {
+		materials = []models.Material{}
+	}
+
+	selectedClassroomID := 0
+	if request.ClassroomID != nil {
+		selectedClassroomID = *request.ClassroomID
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Solicitar Material"
+	data["Centro"] = centro
+	data["Request"] = request
+	data["SelectedClassroomID"] = selectedClassroomID
+	data["Classrooms"] = classrooms
+	data["Materials"] = materials
+	data["Today"] = time.Now().Format("2006-01-02")
+	data["ErrorMessage"] = errorMessage
+
+	h.renderTemplate(c, "materiales_solicitud_form.html", data)
+}
+
+// handleMaterialRequestCreate validates and stores a new request and notifies the coordinators
+func (h *Handlers) handleMaterialRequestCreate(c *gin.Context, centro string, request models.MaterialRequest, user *models.User) {
+	request.Notes = strings.TrimSpace(c.PostForm("notas"))
+	request.ClassroomID = nil
+	if classroomID, _ := parseIntSafe(c.PostForm("aula_id")); classroomID != 0 {
+		request.ClassroomID = &classroomID
+	}
+
+	// Repeated materials are merged into one line
+	materialIDs := c.PostFormArray("item_material_id[]")
+	quantities := c.PostFormArray("item_cantidad[]")
+	unitIDs := c.PostFormArray("item_unidad_id[]")
+	var items []models.MaterialRequestItem
+	positions := map[int]int{}
+	for i, materialID := range materialIDs {
+		if materialID == "" || i >= len(quantities) {
+			continue
+		}
+		material, err := h.getMaterial(materialID, centro)
+		if err != nil {
+			continue
+		}
+		// Each line can be requested in any unit of the material and is stored in base units
+		var unitID string
+		if i < len(unitIDs) {
+			unitID = unitIDs[i]
+		}
+		quantity, err := parseUnitQuantity(quantities[i], unitID, material)
+		if err != nil || quantity <= 0 {
+			request.Items = items
+			h.renderMaterialRequestForm(c, centro, request, "Las cantidades deben ser números enteros positivos")
+			return
+		}
+		if position, ok := positions[material.ID]; ok {
+			if items[position].Quantity > maxBaseQuantity-quantity {
+				request.Items = items
+				h.renderMaterialRequestForm(c, centro, request, "La cantidad de "+material.Name+" es demasiado grande")
+				return
+			}
+			items[position].Quantity += quantity
+			continue
+		}
+		positions[material.ID] = len(items)
+		items = append(items, models.MaterialRequestItem{
+			MaterialID:   &material.ID,
+			MaterialName: material.Name,
+			Unit:         material.Unit,
+			Quantity:     quantity,
+		})
+	}
+	request.Items = items
+
+	neededBy, err := time.Parse("2006-01-02", c.PostForm("fecha_necesaria"))
+	if err != nil {
+		h.renderMaterialRequestForm(c, centro, request, "La fecha en que se necesita el material no es válida")
+		return
+	}
+	request.NeededBy = neededBy
+	if neededBy.Format("2006-01-02") < time.Now().Format("2006-01-02") {
+		h.renderMaterialRequestForm(c, centro, request, "La fecha en que se necesita el material ya ha pasado")
+		return
+	}
+	if len(items) == 0 {
+		h.renderMaterialRequestForm(c, centro, request, "Añade al menos un material a la solicitud")
+		return
+	}
+
+	classroomName := ""
+	if request.ClassroomID != nil {
+		err := database.DB.QueryRow(`SELECT name FROM classrooms WHERE id = ? AND center_id = ?`,
+			*request.ClassroomID, request.CenterID).Scan(&classroomName)
+		if err != nil {
+			h.renderMaterialRequestForm(c, centro, request, "El aula seleccionada no es válida")
+			return
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		h.renderMaterialRequestForm(c, centro, request, "Error al enviar la solicitud: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO material_requests (center_id, classroom_id, requested_by, needed_by, notes, updated_at)
+			  VALUES (?, ?, ?, ?, ?, datetime('now'))`,
+		request.CenterID, request.ClassroomID, user.ID, neededBy.Format("2006-01-02"), request.Notes)
+	if err != nil {
+		h.renderMaterialRequestForm(c, centro, request, "Error al enviar la solicitud: "+err.Error())
+		return
+	}
+	requestID, _ := result.LastInsertId()
+
+	for _, item := range items {
+		_, err = tx.Exec(`INSERT INTO material_request_items (request_id, material_id, material_name, unit, quantity)
+				  VALUES (?, ?, ?, ?, ?)`, requestID, item.MaterialID, item.MaterialName, item.Unit, item.Quantity)
+		if err != nil {
+			h.renderMaterialRequestForm(c, centro, request, "Error al enviar la solicitud: "+err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.renderMaterialRequestForm(c, centro, request, "Error al enviar la solicitud: "+err.Error())
+		return
+	}
+
+	// Coordinators hear about the new request, except the requester when they are one
+	if approvers, err := h.getUsersWithPermission("materiales.approve"); err == nil {
+		var recipients []int
+		for _, approverID := range approvers {
+			if approverID != user.ID {
+				recipients = append(recipients, approverID)
+			}
+		}
+		requester := user.DisplayName
+		if requester == "" {
+			requester = user.Username
+		}
+		message := fmt.Sprintf("%s ha solicitado %d material(es) para %s en %s, para el %s.",
+			requester, len(items), classroomOrCenter(classroomName), centro, neededBy.Format("02/01/2006"))
+		h.notifyUsers(recipients, fmt.Sprintf("Nueva solicitud de material #%d", requestID), message,
+			fmt.Sprintf("/materiales/solicitudes/ver/%d", requestID))
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/materiales/solicitudes/ver/%d?success=Solicitud enviada", requestID))
+}
+
+// MaterialesSolicitudVer shows a request with the form coordinators use to resolve it
+func (h *Handlers) MaterialesSolicitudVer(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	canApprove := auth.UserHasAccess(c, "materiales.approve")
+	request, err := h.getMaterialRequest(c.Param("id"), centro)
+	if err != nil || (!canApprove && (request.RequestedBy == nil || *request.RequestedBy != user.ID)) {
+		c.Redirect(http.StatusFound, "/materiales/solicitudes?error=Solicitud no encontrada")
+		return
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = fmt.Sprintf("Figaró - Solicitud #%d", request.ID)
+	data["Centro"] = centro
+	data["Request"] = request
+	data["CanApprove"] = canApprove
+	data["IsRequester"] = request.RequestedBy != nil && *request.RequestedBy == user.ID
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_solicitud.html", data)
+}
+
+// MaterialesSolicitudResolver fulfils a request in full or in part, taking the stock out, or rejects it
+func (h *Handlers) MaterialesSolicitudResolver(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	request, err := h.getMaterialRequest(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/solicitudes?error=Solicitud no encontrada")
+		return
+	}
+	redirectURL := fmt.Sprintf("/materiales/solicitudes/ver/%d", request.ID)
+
+	if !auth.UserHasAccess(c, "materiales.approve") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para resolver solicitudes")
+		return
+	}
+
+	responseNotes := strings.TrimSpace(c.PostForm("respuesta"))
+	status := "rejected"
+	if c.PostForm("accion") == "entregar" {
+		// Quantities to hand out are posted per item as entregar_<item ID>
+		quantities := map[int]int{}
+		for _, item := range request.Items {
+			quantity, err := parseIntSafe(strings.TrimSpace(c.PostForm(fmt.Sprintf("entregar_%d", item.ID))))
+			if err != nil || quantity < 0 || quantity > item.Quantity {
+				c.Redirect(http.StatusFound, redirectURL+"?error="+fmt.Sprintf("La cantidad a entregar de %s debe estar entre 0 y %d", item.MaterialName, item.Quantity))
+				return
+			}
+			if item.MaterialID != nil && quantity > item.FreeQuantity {
+				c.Redirect(http.StatusFound, redirectURL+"?error="+fmt.Sprintf("Solo hay %d %s libres de %s", max(item.FreeQuantity, 0), item.Unit, item.MaterialName))
+				return
+			}
+			quantities[item.ID] = quantity
+		}
+		status, err = h.fulfilMaterialRequest(request, quantities, responseNotes, user.ID)
+	} else {
+		err = h.rejectMaterialRequest(request, responseNotes, user.ID)
+	}
+
+	switch {
+	case err == errRequestNotPending:
+		c.Redirect(http.StatusFound, redirectURL+"?error=La solicitud ya está resuelta")
+		return
+	case err == errRequestNothing:
+		c.Redirect(http.StatusFound, redirectURL+"?error=Indica alguna cantidad a entregar o rechaza la solicitud")
+		return
+	case err == errRequestNoStock:
+		c.Redirect(http.StatusFound, redirectURL+"?error=No hay stock libre suficiente para entregar la solicitud")
+		return
+	case err != nil:
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al resolver la solicitud")
+		return
+	}
+
+	if request.RequestedBy != nil && *request.RequestedBy != user.ID {
+		message := fmt.Sprintf("Tu solicitud de material #%d para %s ha sido %s.", request.ID,
+			classroomOrCenter(request.ClassroomName), requestStatusLabels[status])
+		if responseNotes != "" {
+			message += " " + responseNotes
+		}
+		h.notifyUsers([]int{*request.RequestedBy}, fmt.Sprintf("Solicitud de material #%d %s", request.ID, requestStatusLabels[status]),
+			message, redirectURL)
+	}
+
+	c.Redirect(http.StatusFound, redirectURL+"?success=Solicitud "+requestStatusLabels[status])
+}
+
+// fulfilMaterialRequest hands out the given quantity of each item, taking it out of stock,
+// and returns the new status: fulfilled when every item was handed out in full, partial otherwise
+func (h *Handlers) fulfilMaterialRequest(request models.MaterialRequest, quantities map[int]int, responseNotes string, userID int) (string, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	status := "fulfilled"
+	handedOut := 0
+	for _, item := range request.Items {
+		quantity := quantities[item.ID]
+		if item.MaterialID == nil {
+			quantity = 0
+		}
+		if quantity < item.Quantity {
+			status = "partial"
+		}
+		if quantity == 0 {
+			continue
+		}
+
+		// Check the free stock again inside the transaction, as loans, kits and transfers
+		// made since the request was loaded may have used it
+		var free int
+		err := tx.QueryRow(`SELECT m.available_quantity - `+reservedQuantitySQL+` - `+loanedQuantitySQL+`
+				  FROM materials m WHERE m.id = ?`, *item.MaterialID).Scan(&free)
+		if err == sql.ErrNoRows || (err == nil && quantity > free) {
+			return "", errRequestNoStock
+		}
+		if err != nil {
+			return "", err
+		}
+
+		removed, err := removeMaterialStock(tx, *item.MaterialID, quantity)
+		if err != nil {
+			return "", err
+		}
+		if err := recordMaterialMovement(tx, *item.MaterialID, -removed, "request", userID); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec(`UPDATE material_request_items SET fulfilled_quantity = ? WHERE id = ?`, removed, item.ID); err != nil {
+			return "", err
+		}
+		handedOut += removed
+	}
+	if handedOut == 0 {
+		return "", errRequestNothing
+	}
+
+	if err := resolveMaterialRequest(tx, request.ID, status, responseNotes, userID); err != nil {
+		return "", err
+	}
+
+	return status, tx.Commit()
+}
+
+// rejectMaterialRequest rejects a pending request without touching the stock
+func (h *Handlers) rejectMaterialRequest(request models.MaterialRequest, responseNotes string, userID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := resolveMaterialRequest(tx, request.ID, "rejected", responseNotes, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// resolveMaterialRequest stores the outcome of a request that must still be pending
+func resolveMaterialRequest(tx *sql.Tx, requestID int, status, responseNotes string, userID int) error {
+	result, err := tx.Exec(`UPDATE material_requests SET status = ?, response_notes = ?, reviewed_by = ?, reviewed_at = datetime('now'),
+			  updated_at = datetime('now') WHERE id = ? AND status = 'pending'`, status, responseNotes, userID, requestID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errRequestNotPending
+	}
+	return nil
+}
+
+// MaterialesSolicitudCancelar lets the requester withdraw a request that is still pending
+func (h *Handlers) MaterialesSolicitudCancelar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	result, err := database.DB.Exec(`UPDATE material_requests SET status = 'cancelled', updated_at = datetime('now')
+			  WHERE id = ? AND requested_by = ? AND status = 'pending' AND center_id = (SELECT id FROM centers WHERE name = ?)`,
+		c.Param("id"), user.ID, centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/solicitudes?error=Error al cancelar la solicitud")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.Redirect(http.StatusFound, "/materiales/solicitudes?error=Solicitud no encontrada o ya resuelta")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/solicitudes?estado=mias&success=Solicitud cancelada")
+}
+
+// classroomOrCenter names the destination of a request in notifications
+func classroomOrCenter(classroomName string) string {
+	if classroomName == "" {
+		return "el centro"
+	}
+	return "el aula " + classroomName
+}
+
+// scanMaterialRequest scans a row selected with materialRequestSelectSQL
+func scanMaterialRequest(rows interface{ Scan(...interface{}) error }) (models.MaterialRequest, error) {
+	var request models.MaterialRequest
+	err := rows.Scan(&request.ID, &request.CenterID, &request.ClassroomID, &request.ClassroomName, &request.RequestedBy,
+		&request.RequesterName, &request.NeededBy, &request.Status, &request.Notes, &request.ResponseNotes,
+		&request.ReviewedBy, &request.ReviewerName, &request.ReviewedAt, &request.CreatedAt, &request.ItemCount)
+	return request, err
+}
+
+// getMaterialRequests retrieves the requests of a center: pending ("pendientes"), resolved ("resueltas")
+// or the ones made by the given user ("mias")
+func (h *Handlers) getMaterialRequests(centro, statusFilter string, userID int) ([]models.MaterialRequest, error) {
+	query := materialRequestSelectSQL + ` WHERE mr.center_id = (SELECT id FROM centers WHERE name = ?)`
+	args := []interface{}{centro}
+	switch statusFilter {
+	case "resueltas":
+		query += ` AND mr.status <> 'pending' ORDER BY mr.updated_at DESC, mr.id DESC LIMIT 100`
+	case "mias":
+		query += ` AND mr.requested_by = ? ORDER BY mr.created_at DESC, mr.id DESC LIMIT 100`
+		args = append(args, userID)
+	default:
+		query += ` AND mr.status = 'pending' ORDER BY mr.needed_by, mr.id`
+	}
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []models.MaterialRequest
+	for rows.Next() {
+		request, err := scanMaterialRequest(rows)
+		if err != nil {
+			continue
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, nil
+}
+
+// getMaterialRequest retrieves a request of a center with its items
+func (h *Handlers) getMaterialRequest(requestID, centro string) (models.MaterialRequest, error) {
+	request, err := scanMaterialRequest(database.DB.QueryRow(materialRequestSelectSQL+`
+			  WHERE mr.id = ? AND mr.center_id = (SELECT id FROM centers WHERE name = ?)`, requestID, centro))
+	if err != nil {
+		return request, err
+	}
+
+	rows, err := database.DB.Query(requestItemSelectSQL, request.ID)
+	if err != nil {
+		return request, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.MaterialRequestItem
+		err := rows.Scan(&item.ID, &item.RequestID, &item.MaterialID, &item.MaterialName, &item.Unit,
+			&item.Quantity, &item.FulfilledQuantity, &item.FreeQuantity)
+		if err != nil {
+			continue
+		}
+		request.Items = append(request.Items, item)
+	}
+
+	return request, nil
+}
+
+// countPendingRequests returns how many requests of a center are waiting for a coordinator
+func (h *Handlers) countPendingRequests(centro string) int {
+	var count int
+	database.DB.QueryRow(`SELECT COUNT(*) FROM material_requests
+			  WHERE status = 'pending' AND center_id = (SELECT id FROM centers WHERE name = ?)`, centro).Scan(&count)
+	return count
+}
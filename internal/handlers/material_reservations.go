@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// errInvalidReservation is returned when a reserved quantity is not a positive number
+var errInvalidReservation = errors.New("invalid reservation quantity")
+
+// parseActivityReservations reads the material rows posted by the activity form.
+// Empty rows are skipped and repeated materials are merged into a single reservation.
+func parseActivityReservations(c *gin.Context) ([]models.ActivityMaterialReservation, error) {
+	materialIDs := c.PostFormArray("reserva_material_id[]")
+	quantities := c.PostFormArray("reserva_cantidad[]")
+
+	var reservations []models.ActivityMaterialReservation
+	positions := map[int]int{}
+	for i, materialIDStr := range materialIDs {
+		if materialIDStr == "" || i >= len(quantities) || quantities[i] == "" {
+			continue
+		}
+
+		materialID, err := strconv.Atoi(materialIDStr)
+		if err != nil {
+			return reservations, errInvalidReservation
+		}
+
+		quantity, err := strconv.Atoi(quantities[i])
+		if err != nil || quantity <= 0 {
+			return reservations, errInvalidReservation
+		}
+
+		if pos, ok := positions[materialID]; ok {
+			reservations[pos].Quantity += quantity
+			continue
+		}
+
+		positions[materialID] = len(reservations)
+		reservations = append(reservations, models.ActivityMaterialReservation{
+			MaterialID: materialID,
+			Quantity:   quantity,
+		})
+	}
+
+	return reservations, nil
+}
+
+// saveActivityReservations replaces the active reservations an activity holds on the center's materials.
+// Reservations that were already consumed or released are kept as history.
+func (h *Handlers) saveActivityReservations(activityID int, centro string, reservations []models.ActivityMaterialReservation) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setActivityReservations(tx, activityID, centro, reservations); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setActivityReservations is saveActivityReservations inside an existing transaction
+func setActivityReservations(tx *sql.Tx, activityID int, centro string, reservations []models.ActivityMaterialReservation) error {
+	_, err := tx.Exec(`DELETE FROM activity_material_reservations
+			  WHERE activity_id = ? AND status = 'reserved'
+			  AND material_id IN (SELECT id FROM materials WHERE center_id = (SELECT id FROM centers WHERE name = ?))`,
+		activityID, centro)
+	if err != nil {
+		return err
+	}
+
+	// Only materials of the selected center can be reserved
+	for _, reservation := range reservations {
+		_, err = tx.Exec(`INSERT INTO activity_material_reservations (activity_id, material_id, quantity, status, updated_at)
+				  SELECT ?, id, ?, 'reserved', datetime('now') FROM materials
+				  WHERE id = ? AND center_id = (SELECT id FROM centers WHERE name = ?)`,
+			activityID, reservation.Quantity, reservation.MaterialID, centro)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getActivityReservations retrieves the reservations an activity holds on the center's materials
+func (h *Handlers) getActivityReservations(activityID int, centro string) ([]models.ActivityMaterialReservation, error) {
+	query := `SELECT r.id, r.activity_id, r.material_id, m.name, m.unit, r.quantity, r.status,
+			  m.available_quantity - COALESCE((SELECT SUM(o.quantity) FROM activity_material_reservations o
+			  WHERE o.material_id = r.material_id AND o.status = 'reserved' AND o.activity_id != r.activity_id), 0)
+			  - ` + loanedQuantitySQL + `,
+			  r.created_at, r.updated_at, r.settled_at
+			  FROM activity_material_reservations r
+			  JOIN materials m ON r.material_id = m.id
+			  WHERE r.activity_id = ? AND m.center_id = (SELECT id FROM centers WHERE name = ?)
+			  ORDER BY m.name`
+
+	rows, err := database.DB.Query(query, activityID, centro)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []models.ActivityMaterialReservation
+	for rows.Next() {
+		var reservation models.ActivityMaterialReservation
+		err := rows.Scan(&reservation.ID, &reservation.ActivityID, &reservation.MaterialID,
+			&reservation.MaterialName, &reservation.Unit, &reservation.Quantity, &reservation.Status,
+			&reservation.FreeQuantity, &reservation.CreatedAt, &reservation.UpdatedAt, &reservation.SettledAt)
+		if err != nil {
+			continue
+		}
+		reservations = append(reservations, reservation)
+	}
+
+	return reservations, nil
+}
+
+// setActivityFormMaterials adds the center materials and the reservation rows used by the activity form
+func (h *Handlers) setActivityFormMaterials(c *gin.Context, data gin.H, centro string) {
+	materials, err := h.getMaterials(centro)
+	if err != nil {
+		materials = []models.Material{}
+	}
+	data["Materials"] = materials
+
+	// Keep the submitted rows when the form is shown again after an error
+	if c.Request.Method == http.MethodPost {
+		reservations, _ := parseActivityReservations(c)
+		data["Reservations"] = reservations
+		return
+	}
+
+	if activity, ok := data["Activity"].(models.Activity); ok {
+		reservations, err := h.getActivityReservations(activity.ID, centro)
+		if err == nil {
+			data["Reservations"] = reservations
+		}
+	}
+}
+
+// settleActivityReservations releases the reservations of cancelled activities and series,
+// which cannot reserve materials, and consumes the stock reserved by activities that have
+// finished in the timezone of their center. Global activities take the default timezone.
+// Postponed activities keep their reservations until they are given their new dates.
+func (h *Handlers) settleActivityReservations() error {
+	_, err := database.DB.Exec(`UPDATE activity_material_reservations
+			  SET status = 'released', settled_at = datetime('now'), updated_at = datetime('now')
+			  WHERE status = 'reserved' AND activity_id IN (SELECT id FROM activities WHERE status = 'cancelled' OR recurrence_rule IS NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT r.id, r.material_id, r.quantity, COALESCE(a.status, ''), a.end_datetime, COALESCE(c.timezone, '')
+			  FROM activity_material_reservations r
+			  JOIN activities a ON r.activity_id = a.id
+			  LEFT JOIN centers c ON a.center_id = c.id
+			  WHERE r.status = 'reserved' AND COALESCE(a.status, '') NOT IN ('cancelled', 'postponed') AND a.recurrence_rule IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	defaultTimezone := h.getDefaultTimezone()
+	locations := make(map[string]*time.Location)
+	now := time.Now()
+
+	var finished []models.ActivityMaterialReservation
+	for rows.Next() {
+		var reservation models.ActivityMaterialReservation
+		var status, timezone string
+		var end time.Time
+		if err := rows.Scan(&reservation.ID, &reservation.MaterialID, &reservation.Quantity, &status, &end, &timezone); err != nil {
+			continue
+		}
+		if timezone == "" {
+			timezone = defaultTimezone
+		}
+		location, ok := locations[timezone]
+		if !ok {
+			location = loadTimezone(timezone)
+			locations[timezone] = location
+		}
+
+		// Activity datetimes are wall clock times of their center
+		if status == "completed" || !end.After(wallClock(now, location)) {
+			finished = append(finished, reservation)
+		}
+	}
+	rows.Close()
+
+	if len(finished) == 0 {
+		return nil
+	}
+
+	for _, reservation := range finished {
+		// Whatever is left is consumed if the stock is lower than the reservation
+		removed, err := removeMaterialStock(tx, reservation.MaterialID, reservation.Quantity)
+		if err != nil {
+			return err
+		}
+		if err := recordMaterialMovement(tx, reservation.MaterialID, -removed, "consumption", 0); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE activity_material_reservations
+				  SET status = 'consumed', settled_at = datetime('now'), updated_at = datetime('now')
+				  WHERE id = ?`, reservation.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logger.Info("Consumed %d material reservations of finished activities", len(finished))
+	return nil
+}
+
+// RunReservationSettler periodically settles the material reservations of finished activities
+func (h *Handlers) RunReservationSettler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := h.settleActivityReservations(); err != nil {
+			logger.Error("Failed to settle material reservations: %v", err)
+		}
+		<-ticker.C
+	}
+}
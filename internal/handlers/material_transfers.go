@@ -0,0 +1,475 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Errors returned while applying a material transfer
+var (
+	errTransferNotPending     = errors.New("transfer is not pending")
+	errTransferNoStock        = errors.New("not enough stock in source center")
+	errTransferSourceNotFound = errors.New("source material no longer exists")
+)
+
+// MaterialesTraspasos handles the transfers page for the selected center
+func (h *Handlers) MaterialesTraspasos(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	// Incoming transfers waiting for this center to accept them
+	incoming, err := h.getMaterialTransfers("t.destination_center_id = ? AND t.status = 'pending'", centerID)
+	if err != nil {
+		incoming = []models.MaterialTransfer{}
+	}
+
+	// Full history of transfers involving this center
+	history, err := h.getMaterialTransfers("(t.source_center_id = ? OR t.destination_center_id = ?) AND NOT (t.destination_center_id = ? AND t.status = 'pending')",
+		centerID, centerID, centerID)
+	if err != nil {
+		history = []models.MaterialTransfer{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Traspasos de Materiales"
+	data["Centro"] = centro
+	data["CenterID"] = centerID
+	data["Incoming"] = incoming
+	data["History"] = history
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_traspasos.html", data)
+}
+
+// MaterialesTraspasoCrear handles proposing a transfer to another center
+func (h *Handlers) MaterialesTraspasoCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=No tienes permiso para traspasar materiales")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleMaterialTransferCreate(c, centro, user)
+		return
+	}
+
+	h.renderMaterialTransferForm(c, centro, "", gin.H{
+		"material_id": c.Query("material_id"),
+	})
+}
+
+// renderMaterialTransferForm renders the transfer form with the materials and target centers
+func (h *Handlers) renderMaterialTransferForm(c *gin.Context, centro, errorMessage string, formData gin.H) {
+	materials, err := h.getMaterials(centro)
+	if err != nil {
+		materials = []models.Material{}
+	}
+
+	// Every center except the current one is a valid destination
+	var destinations []models.Center
+	centers, _ := h.getAllCenters()
+	for _, center := range centers {
+		if center.Name != centro {
+			destinations = append(destinations, center)
+		}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Nuevo Traspaso"
+	data["Centro"] = centro
+	data["Materials"] = materials
+	data["Destinations"] = destinations
+	data["ErrorMessage"] = errorMessage
+	data["FormData"] = formData
+
+	h.renderTemplate(c, "material_traspaso_form.html", data)
+}
+
+// handleMaterialTransferCreate validates and stores a new pending transfer
+func (h *Handlers) handleMaterialTransferCreate(c *gin.Context, centro string, user *models.User) {
+	materialID := c.PostForm("material_id")
+	destinationID := c.PostForm("destination_center_id")
+	quantityStr := c.PostForm("cantidad")
+	notes := strings.TrimSpace(c.PostForm("notas"))
+
+	formData := gin.H{
+		"material_id":           materialID,
+		"destination_center_id": destinationID,
+		"cantidad":              quantityStr,
+		"notas":                 notes,
+	}
+
+	if materialID == "" || destinationID == "" || quantityStr == "" {
+		h.renderMaterialTransferForm(c, centro, "El material, el centro de destino y la cantidad son requeridos", formData)
+		return
+	}
+
+	quantity, err := strconv.Atoi(quantityStr)
+	if err != nil || quantity <= 0 {
+		h.renderMaterialTransferForm(c, centro, "La cantidad debe ser un número mayor que cero", formData)
+		return
+	}
+
+	material, err := h.getMaterial(materialID, centro)
+	if err != nil {
+		h.renderMaterialTransferForm(c, centro, "Material no encontrado", formData)
+		return
+	}
+
+	// Reserved and lent units cannot be sent
+	if quantity > material.AvailableQuantity-material.ReservedQuantity-material.LoanedQuantity {
+		h.renderMaterialTransferForm(c, centro, "No hay suficiente stock disponible para este traspaso", formData)
+		return
+	}
+
+	destination, err := h.getCenterByID(destinationID)
+	if err != nil || destination.ID == material.CenterID {
+		h.renderMaterialTransferForm(c, centro, "Centro de destino inválido", formData)
+		return
+	}
+
+	query := `INSERT INTO material_transfers (source_center_id, destination_center_id, source_material_id, material_name, unit,
+			  quantity, status, notes, requested_by, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, 'pending', ?, ?, datetime('now'))`
+
+	_, err = database.DB.Exec(query, material.CenterID, destination.ID, material.ID, material.Name, material.Unit,
+		quantity, notes, user.ID)
+	if err != nil {
+		h.renderMaterialTransferForm(c, centro, "Error al crear el traspaso: "+err.Error(), formData)
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/traspasos?success=Traspaso propuesto a "+destination.Name)
+}
+
+// MaterialesTraspasoAceptar handles accepting an incoming transfer
+func (h *Handlers) MaterialesTraspasoAceptar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=No tienes permiso para aceptar traspasos")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=Centro no encontrado")
+		return
+	}
+
+	transferID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=ID de traspaso inválido")
+		return
+	}
+
+	err = h.acceptMaterialTransfer(transferID, centerID, user.ID)
+	switch {
+	case err == nil:
+		c.Redirect(http.StatusFound, "/materiales/traspasos?success=Traspaso aceptado y stock actualizado")
+	case errors.Is(err, sql.ErrNoRows):
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=Traspaso no encontrado o sin permisos")
+	case errors.Is(err, errTransferNotPending):
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=El traspaso ya no está pendiente")
+	case errors.Is(err, errTransferNoStock):
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=El centro de origen ya no tiene stock suficiente")
+	case errors.Is(err, errTransferSourceNotFound):
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=El material de origen ya no existe")
+	default:
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=Error al aceptar el traspaso: "+err.Error())
+	}
+}
+
+// acceptMaterialTransfer moves the stock of a pending transfer in a single transaction.
+// The destination material is matched by name and unit, or created if missing.
+func (h *Handlers) acceptMaterialTransfer(transferID, destinationCenterID, userID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var transfer models.MaterialTransfer
+	err = tx.QueryRow(`SELECT id, source_center_id, destination_center_id, source_material_id, material_name, unit, quantity, status
+			  FROM material_transfers WHERE id = ? AND destination_center_id = ?`, transferID, destinationCenterID).Scan(
+		&transfer.ID, &transfer.SourceCenterID, &transfer.DestinationCenterID, &transfer.SourceMaterialID,
+		&transfer.MaterialName, &transfer.Unit, &transfer.Quantity, &transfer.Status)
+	if err != nil {
+		return err
+	}
+
+	if transfer.Status != "pending" {
+		return errTransferNotPending
+	}
+	if transfer.SourceMaterialID == nil {
+		return errTransferSourceNotFound
+	}
+
+	// Take the stock out of the source center, only if there is enough left
+	// Reserved units are kept for their activities and lent units are still out, so they cannot be sent
+	var sourceQuantity int
+	err = tx.QueryRow(`SELECT m.available_quantity - `+reservedQuantitySQL+` - `+loanedQuantitySQL+` FROM materials m WHERE m.id = ? AND m.center_id = ?`,
+		*transfer.SourceMaterialID, transfer.SourceCenterID).Scan(&sourceQuantity)
+	if err == sql.ErrNoRows {
+		return errTransferSourceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if sourceQuantity < transfer.Quantity {
+		return errTransferNoStock
+	}
+	removed, err := removeMaterialStock(tx, *transfer.SourceMaterialID, transfer.Quantity)
+	if err != nil {
+		return err
+	}
+	if removed < transfer.Quantity {
+		return errTransferNoStock
+	}
+	if err := recordMaterialMovement(tx, *transfer.SourceMaterialID, -removed, "transfer_out", userID); err != nil {
+		return err
+	}
+
+	// Find the matching material in the destination center
+	var destinationMaterialID int64
+	err = tx.QueryRow(`SELECT id FROM materials WHERE center_id = ? AND LOWER(name) = LOWER(?) AND LOWER(unit) = LOWER(?)
+			  ORDER BY id LIMIT 1`, destinationCenterID, transfer.MaterialName, transfer.Unit).Scan(&destinationMaterialID)
+	if err == sql.ErrNoRows {
+		// Create it on arrival, copying the descriptive fields from the source material
+		// Center-specific categories are not visible in the destination, so only global ones are kept
+		result, err := tx.Exec(`INSERT INTO materials (center_id, name, photo_path, unit, category, category_id, available_quantity, minimum_quantity, notes,
+				  unit_cost, preferred_supplier_id, updated_at)
+				  SELECT ?, name, photo_path, unit, category,
+				  CASE WHEN (SELECT center_id FROM material_categories WHERE id = category_id) IS NULL THEN category_id END,
+				  0, 0, notes, unit_cost, preferred_supplier_id, datetime('now') FROM materials WHERE id = ?`,
+			destinationCenterID, *transfer.SourceMaterialID)
+		if err != nil {
+			return err
+		}
+		destinationMaterialID, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// Transferred stock arrives at the destination store room
+	if err := addMaterialStock(tx, int(destinationMaterialID), 0, transfer.Quantity); err != nil {
+		return err
+	}
+	if err := recordMaterialMovement(tx, int(destinationMaterialID), transfer.Quantity, "transfer_in", userID); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE material_transfers SET status = 'accepted', destination_material_id = ?, responded_by = ?,
+			  responded_at = datetime('now'), updated_at = datetime('now') WHERE id = ?`,
+		destinationMaterialID, userID, transfer.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MaterialesTraspasoRechazar handles rejecting an incoming transfer
+func (h *Handlers) MaterialesTraspasoRechazar(c *gin.Context) {
+	h.closeMaterialTransfer(c, "rejected", "destination_center_id", "Traspaso rechazado")
+}
+
+// MaterialesTraspasoCancelar handles cancelling an outgoing transfer
+func (h *Handlers) MaterialesTraspasoCancelar(c *gin.Context) {
+	h.closeMaterialTransfer(c, "cancelled", "source_center_id", "Traspaso cancelado")
+}
+
+// closeMaterialTransfer marks a pending transfer as rejected or cancelled without moving stock.
+// centerColumn is the column that must match the selected center for the action to be allowed.
+func (h *Handlers) closeMaterialTransfer(c *gin.Context, status, centerColumn, successMessage string) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=No tienes permiso para gestionar traspasos")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	transferID := c.Param("id")
+	if transferID == "" {
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=ID de traspaso requerido")
+		return
+	}
+
+	query := `UPDATE material_transfers SET status = ?, responded_by = ?, responded_at = datetime('now'), updated_at = datetime('now')
+			  WHERE id = ? AND status = 'pending' AND ` + centerColumn + ` = (SELECT id FROM centers WHERE name = ?)`
+
+	result, err := database.DB.Exec(query, status, user.ID, transferID, centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=Error al actualizar el traspaso")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		c.Redirect(http.StatusFound, "/materiales/traspasos?error=Traspaso no encontrado, ya resuelto o sin permisos")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/traspasos?success="+successMessage)
+}
+
+// AdminTraspasosReport handles the cross-center transfers report
+func (h *Handlers) AdminTraspasosReport(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	centerFilter := c.Query("centro")
+	statusFilter := c.Query("estado")
+
+	where := "1 = 1"
+	var args []interface{}
+	if centerFilter != "" {
+		where += " AND (t.source_center_id = ? OR t.destination_center_id = ?)"
+		args = append(args, centerFilter, centerFilter)
+	}
+	if statusFilter != "" {
+		where += " AND t.status = ?"
+		args = append(args, statusFilter)
+	}
+
+	transfers, err := h.getMaterialTransfers(where, args...)
+	if err != nil {
+		transfers = []models.MaterialTransfer{}
+	}
+
+	// Summary counters by status
+	stats := map[string]int{}
+	totalUnits := 0
+	for _, transfer := range transfers {
+		stats[transfer.Status]++
+		if transfer.Status == "accepted" {
+			totalUnits += transfer.Quantity
+		}
+	}
+
+	centers, err := h.getAllCenters()
+	if err != nil {
+		centers = []models.Center{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Informe de Traspasos"
+	data["Centers"] = centers
+	data["Transfers"] = transfers
+	data["Stats"] = stats
+	data["TotalUnits"] = totalUnits
+	data["CenterFilter"] = centerFilter
+	data["StatusFilter"] = statusFilter
+
+	h.renderTemplate(c, "admin_traspasos_report.html", data)
+}
+
+// getMaterialTransfers retrieves transfers matching the given WHERE clause (using alias t)
+func (h *Handlers) getMaterialTransfers(where string, args ...interface{}) ([]models.MaterialTransfer, error) {
+	query := `SELECT t.id, t.source_center_id, cs.name, t.destination_center_id, cd.name, t.source_material_id,
+			  t.destination_material_id, t.material_name, t.unit, t.quantity, t.status, COALESCE(t.notes, ''),
+			  t.requested_by, COALESCE(ur.display_name, ''), t.responded_by, COALESCE(ua.display_name, ''),
+			  t.created_at, t.updated_at, t.responded_at
+			  FROM material_transfers t
+			  JOIN centers cs ON t.source_center_id = cs.id
+			  JOIN centers cd ON t.destination_center_id = cd.id
+			  LEFT JOIN users ur ON t.requested_by = ur.id
+			  LEFT JOIN users ua ON t.responded_by = ua.id
+			  WHERE ` + where + `
+			  ORDER BY t.created_at DESC, t.id DESC`
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []models.MaterialTransfer
+	for rows.Next() {
+		var transfer models.MaterialTransfer
+		err := rows.Scan(&transfer.ID, &transfer.SourceCenterID, &transfer.SourceCenterName,
+			&transfer.DestinationCenterID, &transfer.DestinationCenterName, &transfer.SourceMaterialID,
+			&transfer.DestinationMaterialID, &transfer.MaterialName, &transfer.Unit, &transfer.Quantity,
+			&transfer.Status, &transfer.Notes, &transfer.RequestedBy, &transfer.RequestedByName,
+			&transfer.RespondedBy, &transfer.RespondedByName, &transfer.CreatedAt, &transfer.UpdatedAt,
+			&transfer.RespondedAt)
+		if err != nil {
+			continue
+		}
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers, nil
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// errUnitNotFound is returned when a quantity is given in a unit the material does not define
+var errUnitNotFound = errors.New("unit not found for material")
+
+// errInvalidQuantity is returned for negative quantities and those too large to store in base units
+var errInvalidQuantity = errors.New("invalid quantity")
+
+// maxBaseQuantity is the largest quantity of a material in base units, so totals of several
+// quantities stay far from overflowing
+const maxBaseQuantity = math.MaxInt32
+
+// MaterialesUnidades shows the units catalogue of a material and the form to define new units
+func (h *Handlers) MaterialesUnidades(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	material, err := h.getMaterial(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado")
+		return
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Unidades de " + material.Name
+	data["Centro"] = centro
+	data["Material"] = material
+	data["Equivalences"] = unitEquivalences(material)
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_unidades.html", data)
+}
+
+// MaterialesUnidadCrear defines a unit of a material as a number of its base unit or of another of its units
+func (h *Handlers) MaterialesUnidadCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	material, err := h.getMaterial(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado")
+		return
+	}
+	redirectURL := fmt.Sprintf("/materiales/unidades/%d", material.ID)
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para definir unidades")
+		return
+	}
+
+	name := strings.TrimSpace(c.PostForm("nombre"))
+	if name == "" {
+		c.Redirect(http.StatusFound, redirectURL+"?error=El nombre de la unidad es obligatorio")
+		return
+	}
+	if strings.EqualFold(name, material.Unit) {
+		c.Redirect(http.StatusFound, redirectURL+"?error="+fmt.Sprintf("%s ya es la unidad base del material", material.Unit))
+		return
+	}
+	for _, unit := range material.Units {
+		if strings.EqualFold(name, unit.Name) {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Ya existe una unidad con ese nombre")
+			return
+		}
+	}
+
+	// "1 caja = 12 paquetes" is stored as 12 times the factor of the pack
+	quantity, err := strconv.Atoi(c.PostForm("cantidad"))
+	if err != nil || quantity <= 0 {
+		c.Redirect(http.StatusFound, redirectURL+"?error=La equivalencia debe ser un número entero positivo")
+		return
+	}
+	factor, err := parseUnitQuantity(strconv.Itoa(quantity), c.PostForm("equivalente_id"), material)
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Unidad de equivalencia no válida")
+		return
+	}
+	if factor <= 1 {
+		c.Redirect(http.StatusFound, redirectURL+"?error="+fmt.Sprintf("La unidad debe contener más de 1 %s", material.Unit))
+		return
+	}
+	for _, unit := range material.Units {
+		if unit.Factor == factor {
+			c.Redirect(http.StatusFound, redirectURL+"?error="+fmt.Sprintf("La unidad %s ya equivale a %d %s", unit.Name, factor, material.Unit))
+			return
+		}
+	}
+
+	_, err = database.DB.Exec(`INSERT INTO material_units (material_id, name, factor) VALUES (?, ?, ?)`, material.ID, name, factor)
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar la unidad")
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirectURL+"?success=Unidad añadida correctamente")
+}
+
+// MaterialesUnidadEliminar removes a unit of a material; quantities are stored in base units so no stock changes
+func (h *Handlers) MaterialesUnidadEliminar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	material, err := h.getMaterial(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado")
+		return
+	}
+	redirectURL := fmt.Sprintf("/materiales/unidades/%d", material.ID)
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para eliminar unidades")
+		return
+	}
+
+	result, err := database.DB.Exec(`DELETE FROM material_units WHERE id = ? AND material_id = ?`, c.Param("unitId"), material.ID)
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al eliminar la unidad")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Unidad no encontrada")
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirectURL+"?success=Unidad eliminada correctamente")
+}
+
+// unitEquivalences describes each unit of a material in terms of the next smaller one,
+// for example "1 caja = 12 paquetes = 144 piezas"
+func unitEquivalences(material models.Material) map[int]string {
+	equivalences := map[int]string{}
+	for i, unit := range material.Units {
+		parts := []string{"1 " + unit.Name}
+		for _, smaller := range material.Units[i+1:] {
+			if unit.Factor%smaller.Factor == 0 {
+				parts = append(parts, fmt.Sprintf("%d %s", unit.Factor/smaller.Factor, smaller.Name))
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", unit.Factor, material.Unit))
+		equivalences[unit.ID] = strings.Join(parts, " = ")
+	}
+	return equivalences
+}
+
+// parseUnitQuantity converts a quantity given in one of the units of a material to base units;
+// an empty or zero unit ID means the base unit
+func parseUnitQuantity(quantity, unitID string, material models.Material) (int, error) {
+	value, err := strconv.Atoi(strings.TrimSpace(quantity))
+	if err != nil {
+		return 0, err
+	}
+
+	_, factor, err := findMaterialUnit(material, unitID)
+	if err != nil {
+		return 0, err
+	}
+
+	return unitQuantity(value, factor)
+}
+
+// unitQuantity converts a quantity of a unit with the given factor to base units
+func unitQuantity(value, factor int) (int, error) {
+	if value < 0 || factor <= 0 || value > maxBaseQuantity/factor {
+		return 0, errInvalidQuantity
+	}
+	return value * factor, nil
+}
+
+// findMaterialUnit returns the name and factor of a unit of a material, or the base unit for an empty or zero ID
+func findMaterialUnit(material models.Material, unitID string) (string, int, error) {
+	id, _ := parseIntSafe(unitID)
+	if id == 0 {
+		return material.Unit, 1, nil
+	}
+	for _, unit := range material.Units {
+		if unit.ID == id {
+			return unit.Name, unit.Factor, nil
+		}
+	}
+	return "", 0, errUnitNotFound
+}
+
+// getMaterialUnits retrieves the units of a material from largest to smallest
+func (h *Handlers) getMaterialUnits(materialID int) ([]models.MaterialUnit, error) {
+	rows, err := database.DB.Query(`SELECT id, material_id, name, factor, created_at
+			  FROM material_units WHERE material_id = ? ORDER BY factor DESC, name`, materialID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var units []models.MaterialUnit
+	for rows.Next() {
+		var unit models.MaterialUnit
+		if err := rows.Scan(&unit.ID, &unit.MaterialID, &unit.Name, &unit.Factor, &unit.CreatedAt); err != nil {
+			continue
+		}
+		units = append(units, unit)
+	}
+
+	return units, nil
+}
+
+// attachMaterialUnits loads the units of a list of materials of a center with a single query
+func (h *Handlers) attachMaterialUnits(materials []models.Material) error {
+	if len(materials) == 0 {
+		return nil
+	}
+
+	units, err := h.getUnitsByMaterial(materials[0].CenterID)
+	if err != nil {
+		return err
+	}
+	for i := range materials {
+		materials[i].Units = units[materials[i].ID]
+	}
+
+	return nil
+}
+
+// getUnitsByMaterial retrieves the units of every material of a center, or of all centers for 0,
+// keyed by material ID and ordered from largest to smallest
+func (h *Handlers) getUnitsByMaterial(centerID int) (map[int][]models.MaterialUnit, error) {
+	query := `SELECT u.id, u.material_id, u.name, u.factor, u.created_at
+			  FROM material_units u
+			  JOIN materials m ON u.material_id = m.id`
+	var args []interface{}
+	if centerID != 0 {
+		query += " WHERE m.center_id = ?"
+		args = append(args, centerID)
+	}
+	query += " ORDER BY u.factor DESC, u.name"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	units := map[int][]models.MaterialUnit{}
+	for rows.Next() {
+		var unit models.MaterialUnit
+		if err := rows.Scan(&unit.ID, &unit.MaterialID, &unit.Name, &unit.Factor, &unit.CreatedAt); err != nil {
+			continue
+		}
+		units[unit.MaterialID] = append(units[unit.MaterialID], unit)
+	}
+
+	return units, nil
+}
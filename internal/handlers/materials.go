@@ -3,7 +3,9 @@ package handlers
 import (
 	"database/sql"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/EuskadiTech/Figaro/internal/auth"
 	"github.com/EuskadiTech/Figaro/internal/database"
@@ -33,8 +35,33 @@ func (h *Handlers) MaterialesIndex(c *gin.Context) {
 		page = 1
 	}
 
+	// Get search, filter and sort parameters
+	filter := parseMaterialListFilter(c)
+
+	// Resolve the location filter; "aula" follows the classroom the user selected
+	var locations []models.StorageLocation
+	var aulaLocationID int
+	if centerID, err := h.getCenterID(centro); err == nil {
+		locations, _ = h.getStorageLocations(centerID)
+		if aula, err := c.Cookie("aula"); err == nil && aula != "" {
+			aulaLocationID, _ = h.getClassroomLocationID(centerID, aula)
+		}
+	}
+	if filter.Location == "aula" {
+		filter.LocationID = aulaLocationID
+	} else if locationID, err := strconv.Atoi(filter.Location); err == nil {
+		for _, location := range locations {
+			if location.ID == locationID {
+				filter.LocationID = locationID
+			}
+		}
+	}
+	if filter.LocationID == 0 {
+		filter.Location = ""
+	}
+
 	// Get materials from database with pagination
-	materials, totalCount, err := h.getMaterialsPaginated(centro, page, 25)
+	materials, totalCount, err := h.getMaterialsPaginated(centro, filter, page, 25)
 	if err != nil {
 		materials = []models.Material{} // Empty slice if error
 		totalCount = 0
@@ -43,27 +70,160 @@ func (h *Handlers) MaterialesIndex(c *gin.Context) {
 	// Create pagination info
 	pagination := models.NewPaginationInfo(page, 25, totalCount)
 
+	// Kits are listed alongside the individual materials
+	kits, err := h.getMaterialKits(centro)
+	if err != nil {
+		kits = []models.MaterialKit{}
+	}
+
 	data := h.getCommonData(c)
 	data["PageTitle"] = "Figaró - Inventario de Materiales"
 	data["Materials"] = materials
 	data["Centro"] = centro
 	data["Pagination"] = pagination
+	data["SearchQuery"] = filter.Search
+	data["CategoryFilter"] = filter.CategoryID
+	data["StockFilter"] = filter.Stock
+	data["LocationFilter"] = filter.Location
+	data["FilteredLocationID"] = filter.LocationID
+	data["Locations"] = locations
+	data["AulaLocationID"] = aulaLocationID
+	data["SortField"] = filter.Sort
+	data["SortOrder"] = filter.Order
+	data["SortLinks"] = materialSortLinks(filter)
+	data["OverdueLoans"] = h.countOverdueLoans(centro)
+	data["ExpiringBatches"] = h.countExpiringBatches(centro, defaultExpiryWarningDays)
+	data["PendingRequests"] = h.countPendingRequests(centro)
+	data["Kits"] = kits
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+	h.setMaterialFormOptions(data, centro)
 
 	h.renderTemplate(c, "materiales.html", data)
 }
 
 // getMaterials retrieves materials for a center (kept for backward compatibility)
 func (h *Handlers) getMaterials(centro string) ([]models.Material, error) {
-	materials, _, err := h.getMaterialsPaginated(centro, 1, 1000) // Large limit for backward compatibility
+	materials, _, err := h.getMaterialsPaginated(centro, materialListFilter{}, 1, 1000) // Large limit for backward compatibility
 	return materials, err
 }
 
-// getMaterialsPaginated retrieves materials for a center with pagination
-func (h *Handlers) getMaterialsPaginated(centro string, page, perPage int) ([]models.Material, int, error) {
+// materialListFilter holds the search, filter and sort options of the materials list
+type materialListFilter struct {
+	Search     string // Text searched in name and notes, or an exact barcode
+	CategoryID int    // Category including its subcategories, 0 for all
+	Stock      string // Stock state: healthy, low or out
+	Location   string // Location as given in the URL: an ID or "aula" for the selected classroom
+	LocationID int    // Resolved location, 0 for all
+	Sort       string // Key of materialSortColumns
+	Order      string // asc or desc
+}
+
+// materialSortColumns maps the sortable columns of the materials list to their SQL expressions
+var materialSortColumns = map[string]string{
+	"nombre":    "m.name",
+	"categoria": "COALESCE(mc.name, m.category)",
+	"cantidad":  "m.available_quantity",
+	"libre":     "m.available_quantity - reserved_quantity - loaned_quantity",
+	"minimo":    "m.minimum_quantity",
+}
+
+// materialStockConditions maps the stock states to their SQL conditions
+var materialStockConditions = map[string]string{
+	"healthy": "m.available_quantity > 0 AND m.available_quantity >= m.minimum_quantity",
+	"low":     "m.available_quantity > 0 AND m.available_quantity < m.minimum_quantity",
+	"out":     "m.available_quantity <= 0",
+}
+
+// parseMaterialListFilter reads the materials list options from the query string, ignoring unknown values
+func parseMaterialListFilter(c *gin.Context) materialListFilter {
+	filter := materialListFilter{
+		Search:   strings.TrimSpace(c.Query("q")),
+		Stock:    c.Query("estado"),
+		Location: c.Query("ubicacion"),
+		Sort:     c.Query("orden"),
+		Order:    c.Query("dir"),
+	}
+	filter.CategoryID, _ = parseIntSafe(c.Query("categoria"))
+
+	if _, ok := materialStockConditions[filter.Stock]; !ok {
+		filter.Stock = ""
+	}
+	if _, ok := materialSortColumns[filter.Sort]; !ok {
+		filter.Sort = "nombre"
+	}
+	if filter.Order != "desc" {
+		filter.Order = "asc"
+	}
+
+	return filter
+}
+
+// materialSortLinks builds the list URL of each sortable column, keeping the current filters.
+// Clicking the column the list is already sorted by reverses the order.
+func materialSortLinks(filter materialListFilter) map[string]string {
+	links := make(map[string]string, len(materialSortColumns))
+	for column := range materialSortColumns {
+		params := url.Values{}
+		if filter.Search != "" {
+			params.Set("q", filter.Search)
+		}
+		if filter.CategoryID != 0 {
+			params.Set("categoria", strconv.Itoa(filter.CategoryID))
+		}
+		if filter.Stock != "" {
+			params.Set("estado", filter.Stock)
+		}
+		if filter.Location != "" {
+			params.Set("ubicacion", filter.Location)
+		}
+		params.Set("orden", column)
+		if column == filter.Sort && filter.Order == "asc" {
+			params.Set("dir", "desc")
+		} else {
+			params.Set("dir", "asc")
+		}
+		links[column] = "/materiales?" + params.Encode()
+	}
+	return links
+}
+
+// likeEscaper escapes the wildcards of a LIKE ... ESCAPE '\' pattern so a search matches them literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// getMaterialsPaginated retrieves materials for a center with pagination, applying the list filter
+func (h *Handlers) getMaterialsPaginated(centro string, filter materialListFilter, page, perPage int) ([]models.Material, int, error) {
+	where := `m.center_id = (SELECT id FROM centers WHERE name = ?)`
+	args := []interface{}{centro}
+	if filter.Search != "" {
+		where += ` AND (m.name LIKE ? ESCAPE '\' OR m.notes LIKE ? ESCAPE '\' OR m.barcode = ?)`
+		searchPattern := "%" + likeEscaper.Replace(filter.Search) + "%"
+		args = append(args, searchPattern, searchPattern, filter.Search)
+	}
+	if filter.CategoryID != 0 {
+		where += ` AND m.category_id IN (` + categoryTreeSQL + `)`
+		args = append(args, filter.CategoryID)
+	}
+	if condition, ok := materialStockConditions[filter.Stock]; ok {
+		where += ` AND ` + condition
+	}
+	if filter.LocationID != 0 {
+		where += ` AND EXISTS (SELECT 1 FROM material_stock s WHERE s.material_id = m.id AND s.location_id = ? AND s.quantity > 0)`
+		args = append(args, filter.LocationID)
+	}
+
+	orderBy := "m.name"
+	if column, ok := materialSortColumns[filter.Sort]; ok {
+		orderBy = column
+	}
+	if filter.Order == "desc" {
+		orderBy += " DESC"
+	}
+
 	// First get total count
-	countQuery := `SELECT COUNT(*) FROM materials WHERE center_id = (SELECT id FROM centers WHERE name = ?)`
+	countQuery := `SELECT COUNT(*) FROM materials m WHERE ` + where
 	var totalCount int
-	err := database.DB.QueryRow(countQuery, centro).Scan(&totalCount)
+	err := database.DB.QueryRow(countQuery, args...).Scan(&totalCount)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -72,11 +232,20 @@ func (h *Handlers) getMaterialsPaginated(centro string, page, perPage int) ([]mo
 	pagination := models.NewPaginationInfo(page, perPage, totalCount)
 	
 	// Get paginated results
-	query := `SELECT id, center_id, name, photo_path, unit, available_quantity, minimum_quantity, notes, category, created_at, updated_at 
-			  FROM materials WHERE center_id = (SELECT id FROM centers WHERE name = ?) 
-			  ORDER BY name LIMIT ? OFFSET ?`
-
-	rows, err := database.DB.Query(query, centro, perPage, pagination.Offset)
+	query := `SELECT m.id, m.center_id, m.name, m.photo_path, m.unit, m.available_quantity, m.minimum_quantity, m.notes, m.category,
+			  COALESCE(m.category_id, 0), COALESCE(mc.name, ''), COALESCE(mc.icon, ''), m.barcode, m.created_at, m.updated_at,
+			  ` + reservedQuantitySQL + ` AS reserved_quantity,
+			  COALESCE((SELECT s.quantity FROM material_stock s WHERE s.material_id = m.id AND s.location_id = ?), 0),
+			  m.is_lendable, ` + loanedQuantitySQL + ` AS loaned_quantity,
+			  m.unit_cost, COALESCE(m.preferred_supplier_id, 0), COALESCE(sp.name, ''), m.tracks_batches
+			  FROM materials m
+			  LEFT JOIN material_categories mc ON m.category_id = mc.id
+			  LEFT JOIN suppliers sp ON m.preferred_supplier_id = sp.id
+			  WHERE ` + where + `
+			  ORDER BY ` + orderBy + `, m.name, m.id LIMIT ? OFFSET ?`
+
+	queryArgs := append([]interface{}{filter.LocationID}, args...)
+	rows, err := database.DB.Query(query, append(queryArgs, perPage, pagination.Offset)...)
 	if err != nil {
 		return nil, totalCount, err
 	}
@@ -89,7 +258,10 @@ func (h *Handlers) getMaterialsPaginated(centro string, page, perPage int) ([]mo
 
 		err := rows.Scan(&material.ID, &material.CenterID, &material.Name, &photoPath,
 			&material.Unit, &material.AvailableQuantity, &material.MinimumQuantity,
-			&material.Notes, &material.Category, &material.CreatedAt, &material.UpdatedAt)
+			&material.Notes, &material.Category, &material.CategoryID, &material.CategoryName,
+			&material.CategoryIcon, &material.Barcode, &material.CreatedAt, &material.UpdatedAt, &material.ReservedQuantity,
+			&material.LocationQuantity, &material.IsLendable, &material.LoanedQuantity,
+			&material.UnitCost, &material.SupplierID, &material.SupplierName, &material.TracksBatches)
 		if err != nil {
 			continue
 		}
@@ -101,6 +273,10 @@ func (h *Handlers) getMaterialsPaginated(centro string, page, perPage int) ([]mo
 		materials = append(materials, material)
 	}
 
+	if err := h.attachMaterialUnits(materials); err != nil {
+		return nil, totalCount, err
+	}
+
 	return materials, totalCount, nil
 }
 
@@ -129,6 +305,7 @@ func (h *Handlers) MaterialesCrear(c *gin.Context) {
 	data["PageTitle"] = "Figaró - Crear Material"
 	data["Centro"] = centro
 	data["Action"] = "crear"
+	h.setMaterialFormOptions(data, centro)
 
 	h.renderTemplate(c, "material_form.html", data)
 }
@@ -141,6 +318,9 @@ func (h *Handlers) handleMaterialCreate(c *gin.Context, centro string) {
 	availableQty := c.PostForm("cantidad_disponible")
 	minimumQty := c.PostForm("cantidad_minima")
 	notes := c.PostForm("notas")
+	barcode := strings.TrimSpace(c.PostForm("codigo_barras"))
+	lendable := c.PostForm("prestable") != ""
+	tracksBatches := c.PostForm("lotes") != ""
 
 	if name == "" || unit == "" || category == "" {
 		data := h.getCommonData(c)
@@ -154,8 +334,15 @@ func (h *Handlers) handleMaterialCreate(c *gin.Context, centro string) {
 			"categoria":           category,
 			"cantidad_disponible": availableQty,
 			"cantidad_minima":     minimumQty,
+			"ubicacion_id":        c.PostForm("ubicacion_id"),
+			"codigo_barras":       barcode,
+			"prestable":           lendable,
+			"lotes":               tracksBatches,
+			"coste_unitario":      c.PostForm("coste_unitario"),
+			"proveedor_id":        c.PostForm("proveedor_id"),
 			"notas":               notes,
 		}
+		h.setMaterialFormOptions(data, centro)
 		h.renderTemplate(c, "material_form.html", data)
 		return
 	}
@@ -167,24 +354,105 @@ func (h *Handlers) handleMaterialCreate(c *gin.Context, centro string) {
 		return
 	}
 
-	// Convert quantities to int
-	var availableQtyInt, minimumQtyInt int
-	if availableQty != "" {
-		if val, err := parseIntSafe(availableQty); err == nil {
-			availableQtyInt = val
+	// The category must be global or belong to this center
+	categoryRecord, err := h.getCategoryForCenter(category, centerID)
+	if err != nil {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Material"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = "La categoría seleccionada no es válida"
+		data["FormData"] = gin.H{
+			"nombre":              name,
+			"unidad":              unit,
+			"cantidad_disponible": availableQty,
+			"cantidad_minima":     minimumQty,
+			"ubicacion_id":        c.PostForm("ubicacion_id"),
+			"codigo_barras":       barcode,
+			"prestable":           lendable,
+			"lotes":               tracksBatches,
+			"coste_unitario":      c.PostForm("coste_unitario"),
+			"proveedor_id":        c.PostForm("proveedor_id"),
+			"notas":               notes,
 		}
+		h.setMaterialFormOptions(data, centro)
+		h.renderTemplate(c, "material_form.html", data)
+		return
 	}
-	if minimumQty != "" {
-		if val, err := parseIntSafe(minimumQty); err == nil {
-			minimumQtyInt = val
+
+	unitCost, supplierID, costError := h.parseMaterialCost(c)
+	if costError != "" {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Material"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = costError
+		data["FormData"] = gin.H{
+			"nombre":              name,
+			"unidad":              unit,
+			"categoria":           category,
+			"cantidad_disponible": availableQty,
+			"cantidad_minima":     minimumQty,
+			"ubicacion_id":        c.PostForm("ubicacion_id"),
+			"codigo_barras":       barcode,
+			"prestable":           lendable,
+			"lotes":               tracksBatches,
+			"coste_unitario":      c.PostForm("coste_unitario"),
+			"proveedor_id":        c.PostForm("proveedor_id"),
+			"notas":               notes,
 		}
+		h.setMaterialFormOptions(data, centro)
+		h.renderTemplate(c, "material_form.html", data)
+		return
 	}
 
-	// Insert into database
-	query := `INSERT INTO materials (center_id, name, unit, category, available_quantity, minimum_quantity, notes, updated_at) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?, datetime('now'))`
+	// Convert quantities to int; a new material only has its base unit
+	availableQtyInt, err := parseMaterialFormQuantity(c, "cantidad_disponible", "unidad_disponible_id", models.Material{Unit: unit})
+	minimumQtyInt, minimumErr := parseMaterialFormQuantity(c, "cantidad_minima", "unidad_minima_id", models.Material{Unit: unit})
+	if err != nil || minimumErr != nil {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Crear Material"
+		data["Centro"] = centro
+		data["Action"] = "crear"
+		data["ErrorMessage"] = "Las cantidades deben ser números enteros positivos"
+		data["FormData"] = gin.H{
+			"nombre":              name,
+			"unidad":              unit,
+			"categoria":           category,
+			"cantidad_disponible": availableQty,
+			"cantidad_minima":     minimumQty,
+			"ubicacion_id":        c.PostForm("ubicacion_id"),
+			"codigo_barras":       barcode,
+			"prestable":           lendable,
+			"lotes":               tracksBatches,
+			"coste_unitario":      c.PostForm("coste_unitario"),
+			"proveedor_id":        c.PostForm("proveedor_id"),
+			"notas":               notes,
+		}
+		h.setMaterialFormOptions(data, centro)
+		h.renderTemplate(c, "material_form.html", data)
+		return
+	}
+	if minimumQty == "" && categoryRecord.DefaultMinimumQuantity != nil {
+		minimumQtyInt = *categoryRecord.DefaultMinimumQuantity
+	}
 
-	_, err = database.DB.Exec(query, centerID, name, unit, category, availableQtyInt, minimumQtyInt, notes)
+	// Insert into database
+	query := `INSERT INTO materials (center_id, name, unit, category, category_id, available_quantity, minimum_quantity, notes, barcode, is_lendable, unit_cost, preferred_supplier_id, tracks_batches, updated_at) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`
+
+	result, err := database.DB.Exec(query, centerID, name, unit, categoryRecord.Slug, categoryRecord.ID, availableQtyInt, minimumQtyInt, notes, barcode, lendable, unitCost, nullableID(supplierID), tracksBatches)
+	if err == nil {
+		// Place the initial stock in the chosen location
+		var newID int64
+		if newID, err = result.LastInsertId(); err == nil {
+			locationID, _ := parseIntSafe(c.PostForm("ubicacion_id"))
+			err = reconcileMaterialStock(int(newID), locationID, availableQtyInt)
+		}
+		if err == nil {
+			err = recordMaterialMovement(database.DB, int(newID), availableQtyInt, "initial", auth.GetCurrentUser(c).ID)
+		}
+	}
 	if err != nil {
 		data := h.getCommonData(c)
 		data["PageTitle"] = "Figaró - Crear Material"
@@ -196,8 +464,15 @@ func (h *Handlers) handleMaterialCreate(c *gin.Context, centro string) {
 			"unidad":              unit,
 			"cantidad_disponible": availableQty,
 			"cantidad_minima":     minimumQty,
+			"ubicacion_id":        c.PostForm("ubicacion_id"),
+			"codigo_barras":       barcode,
+			"prestable":           lendable,
+			"lotes":               tracksBatches,
+			"coste_unitario":      c.PostForm("coste_unitario"),
+			"proveedor_id":        c.PostForm("proveedor_id"),
 			"notas":               notes,
 		}
+		h.setMaterialFormOptions(data, centro)
 		h.renderTemplate(c, "material_form.html", data)
 		return
 	}
@@ -244,6 +519,8 @@ func (h *Handlers) MaterialesEditar(c *gin.Context) {
 	data["Centro"] = centro
 	data["Action"] = "editar"
 	data["Material"] = material
+	data["Forecast"] = h.materialForecast(material)
+	h.setMaterialFormOptions(data, centro)
 
 	h.renderTemplate(c, "material_form.html", data)
 }
@@ -253,9 +530,10 @@ func (h *Handlers) handleMaterialUpdate(c *gin.Context, centro, materialID strin
 	name := c.PostForm("nombre")
 	unit := c.PostForm("unidad")
 	category := c.PostForm("categoria")
-	availableQty := c.PostForm("cantidad_disponible")
-	minimumQty := c.PostForm("cantidad_minima")
 	notes := c.PostForm("notas")
+	barcode := strings.TrimSpace(c.PostForm("codigo_barras"))
+	lendable := c.PostForm("prestable") != ""
+	tracksBatches := c.PostForm("lotes") != ""
 
 	if name == "" || unit == "" || category == "" {
 		material, _ := h.getMaterial(materialID, centro)
@@ -265,6 +543,7 @@ func (h *Handlers) handleMaterialUpdate(c *gin.Context, centro, materialID strin
 		data["Action"] = "editar"
 		data["Material"] = material
 		data["ErrorMessage"] = "El nombre, la unidad y la categoría son requeridos"
+		h.setMaterialFormOptions(data, centro)
 		h.renderTemplate(c, "material_form.html", data)
 		return
 	}
@@ -276,25 +555,83 @@ func (h *Handlers) handleMaterialUpdate(c *gin.Context, centro, materialID strin
 		return
 	}
 
-	// Convert quantities to int
-	var availableQtyInt, minimumQtyInt int
-	if availableQty != "" {
-		if val, err := parseIntSafe(availableQty); err == nil {
-			availableQtyInt = val
-		}
+	// The category must be global or belong to this center
+	categoryRecord, err := h.getCategoryForCenter(category, centerID)
+	if err != nil {
+		material, _ := h.getMaterial(materialID, centro)
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Material"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Material"] = material
+		data["ErrorMessage"] = "La categoría seleccionada no es válida"
+		h.setMaterialFormOptions(data, centro)
+		h.renderTemplate(c, "material_form.html", data)
+		return
 	}
-	if minimumQty != "" {
-		if val, err := parseIntSafe(minimumQty); err == nil {
-			minimumQtyInt = val
-		}
+
+	unitCost, supplierID, costError := h.parseMaterialCost(c)
+	if costError != "" {
+		material, _ := h.getMaterial(materialID, centro)
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Material"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Material"] = material
+		data["ErrorMessage"] = costError
+		h.setMaterialFormOptions(data, centro)
+		h.renderTemplate(c, "material_form.html", data)
+		return
+	}
+
+	// Convert quantities to int, each given in any unit of the material
+	material, err := h.getMaterial(materialID, centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado o sin permisos")
+		return
+	}
+	availableQtyInt, err := parseMaterialFormQuantity(c, "cantidad_disponible", "unidad_disponible_id", material)
+	minimumQtyInt, minimumErr := parseMaterialFormQuantity(c, "cantidad_minima", "unidad_minima_id", material)
+	if err != nil || minimumErr != nil {
+		data := h.getCommonData(c)
+		data["PageTitle"] = "Figaró - Editar Material"
+		data["Centro"] = centro
+		data["Action"] = "editar"
+		data["Material"] = material
+		data["ErrorMessage"] = "Las cantidades deben ser números enteros positivos"
+		h.setMaterialFormOptions(data, centro)
+		h.renderTemplate(c, "material_form.html", data)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Error al actualizar el material")
+		return
+	}
+	defer tx.Rollback()
+
+	// The previous total tells the movements ledger how much was used or restocked
+	var previousQty int
+	err = tx.QueryRow(`SELECT available_quantity FROM materials WHERE id = ? AND center_id = ?`, materialID, centerID).Scan(&previousQty)
+	if err == sql.ErrNoRows {
+		c.Redirect(http.StatusFound, "/materiales?error=Material no encontrado o sin permisos")
+		return
+	}
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Error al actualizar el material")
+		return
 	}
 
 	// Update in database
-	query := `UPDATE materials SET name = ?, unit = ?, category = ?, available_quantity = ?, minimum_quantity = ?, notes = ?, updated_at = datetime('now')
+	query := `UPDATE materials SET name = ?, unit = ?, category = ?, category_id = ?, available_quantity = ?, minimum_quantity = ?, notes = ?, barcode = ?, is_lendable = ?,
+			  unit_cost = ?, preferred_supplier_id = ?, tracks_batches = ?, updated_at = datetime('now')
 			  WHERE id = ? AND center_id = ?`
 
-	result, err := database.DB.Exec(query, name, unit, category, availableQtyInt, minimumQtyInt, notes, materialID, centerID)
+	result, err := tx.Exec(query, name, unit, categoryRecord.Slug, categoryRecord.ID, availableQtyInt, minimumQtyInt, notes, barcode, lendable,
+		unitCost, nullableID(supplierID), tracksBatches, materialID, centerID)
 	if err != nil {
+		tx.Rollback()
 		material, _ := h.getMaterial(materialID, centro)
 		data := h.getCommonData(c)
 		data["PageTitle"] = "Figaró - Editar Material"
@@ -302,6 +639,7 @@ func (h *Handlers) handleMaterialUpdate(c *gin.Context, centro, materialID strin
 		data["Action"] = "editar"
 		data["Material"] = material
 		data["ErrorMessage"] = "Error al actualizar el material: " + err.Error()
+		h.setMaterialFormOptions(data, centro)
 		h.renderTemplate(c, "material_form.html", data)
 		return
 	}
@@ -312,9 +650,41 @@ func (h *Handlers) handleMaterialUpdate(c *gin.Context, centro, materialID strin
 		return
 	}
 
+	// A changed total is added to the store room or taken from the locations
+	materialIDInt, _ := strconv.Atoi(materialID)
+	if err := setMaterialTotal(tx, materialIDInt, 0, availableQtyInt); err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Error al actualizar las ubicaciones del material")
+		return
+	}
+
+	// Lowering the quantity by hand means it was used
+	kind := "restock"
+	if availableQtyInt < previousQty {
+		kind = "consumption"
+	}
+	if err := recordMaterialMovement(tx, materialIDInt, max(availableQtyInt, 0)-previousQty, kind, auth.GetCurrentUser(c).ID); err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Error al registrar el movimiento del material")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Error al actualizar el material")
+		return
+	}
+
 	c.Redirect(http.StatusFound, "/materiales?success=Material actualizado correctamente")
 }
 
+// parseMaterialFormQuantity reads a quantity of the material form in the unit selected next to it,
+// converted to base units; an empty quantity is zero
+func parseMaterialFormQuantity(c *gin.Context, field, unitField string, material models.Material) (int, error) {
+	value := strings.TrimSpace(c.PostForm(field))
+	if value == "" {
+		return 0, nil
+	}
+	return parseUnitQuantity(value, c.PostForm(unitField), material)
+}
+
 // MaterialesEliminar handles material deletion
 func (h *Handlers) MaterialesEliminar(c *gin.Context) {
 	user := auth.GetCurrentUser(c)
@@ -363,22 +733,67 @@ func (h *Handlers) MaterialesEliminar(c *gin.Context) {
 // getMaterial retrieves a single material by ID and center
 func (h *Handlers) getMaterial(materialID, centro string) (models.Material, error) {
 	var material models.Material
-	query := `SELECT id, center_id, name, photo_path, unit, available_quantity, minimum_quantity, notes, category, created_at, updated_at 
-			  FROM materials WHERE id = ? AND center_id = (SELECT id FROM centers WHERE name = ?)`
+	query := `SELECT m.id, m.center_id, m.name, m.photo_path, m.unit, m.available_quantity, m.minimum_quantity, m.notes, m.category,
+			  COALESCE(m.category_id, 0), COALESCE(mc.name, ''), COALESCE(mc.icon, ''), m.barcode, m.created_at, m.updated_at,
+			  ` + reservedQuantitySQL + `,
+			  m.is_lendable, ` + loanedQuantitySQL + `,
+			  m.unit_cost, COALESCE(m.preferred_supplier_id, 0), COALESCE(sp.name, ''), m.tracks_batches
+			  FROM materials m
+			  LEFT JOIN material_categories mc ON m.category_id = mc.id
+			  LEFT JOIN suppliers sp ON m.preferred_supplier_id = sp.id
+			  WHERE m.id = ? AND m.center_id = (SELECT id FROM centers WHERE name = ?)`
 
 	var photoPath sql.NullString
 	err := database.DB.QueryRow(query, materialID, centro).Scan(
 		&material.ID, &material.CenterID, &material.Name, &photoPath,
 		&material.Unit, &material.AvailableQuantity, &material.MinimumQuantity,
-		&material.Notes, &material.Category, &material.CreatedAt, &material.UpdatedAt)
+		&material.Notes, &material.Category, &material.CategoryID, &material.CategoryName,
+		&material.CategoryIcon, &material.Barcode, &material.CreatedAt, &material.UpdatedAt, &material.ReservedQuantity,
+		&material.IsLendable, &material.LoanedQuantity, &material.UnitCost, &material.SupplierID, &material.SupplierName,
+		&material.TracksBatches)
 
 	if photoPath.Valid {
 		material.PhotoPath = &photoPath.String
 	}
+	if err == nil {
+		material.Units, _ = h.getMaterialUnits(material.ID)
+	}
 
 	return material, err
 }
 
+// setMaterialFormOptions adds the categories, storage locations and suppliers to the material form data
+func (h *Handlers) setMaterialFormOptions(data gin.H, centro string) {
+	var categories []models.MaterialCategory
+	var locations []models.StorageLocation
+	if centerID, err := h.getCenterID(centro); err == nil {
+		categories, _ = h.getCategoriesForCenter(centerID)
+		locations, _ = h.getStorageLocations(centerID)
+	}
+	suppliers, _ := h.getSuppliers()
+	data["Categories"] = categories
+	data["Locations"] = locations
+	data["Suppliers"] = suppliers
+}
+
+// parseMaterialCost reads the unit cost and preferred supplier of the material form,
+// returning the message to show when they are not valid
+func (h *Handlers) parseMaterialCost(c *gin.Context) (float64, int, string) {
+	unitCost, err := parsePrice(c.PostForm("coste_unitario"))
+	if err != nil {
+		return 0, 0, "El coste unitario debe ser un importe positivo"
+	}
+
+	supplierID, _ := parseIntSafe(c.PostForm("proveedor_id"))
+	if supplierID != 0 {
+		if _, err := h.getSupplier(strconv.Itoa(supplierID)); err != nil {
+			return 0, 0, "El proveedor seleccionado no es válido"
+		}
+	}
+
+	return unitCost, supplierID, ""
+}
+
 // getCenterID gets the center ID by name
 func (h *Handlers) getCenterID(centerName string) (int, error) {
 	var centerID int
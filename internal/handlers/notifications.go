@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/EuskadiTech/Figaro/pkg/mail"
+	"github.com/gin-gonic/gin"
+)
+
+// Notificaciones shows the latest notifications of the current user and marks them as read
+func (h *Handlers) Notificaciones(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	notifications, err := h.getNotifications(user.ID)
+	if err != nil {
+		notifications = []models.Notification{}
+	}
+
+	// The unread ones keep their highlight on this page and are read from now on
+	database.DB.Exec(`UPDATE notifications SET read_at = datetime('now') WHERE user_id = ? AND read_at IS NULL`, user.ID)
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Notificaciones"
+	data["Notifications"] = notifications
+	data["UnreadNotifications"] = 0
+
+	h.renderTemplate(c, "notificaciones.html", data)
+}
+
+// NotificacionAbrir marks a notification as read and follows its link
+func (h *Handlers) NotificacionAbrir(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	var link string
+	err := database.DB.QueryRow(`SELECT COALESCE(link, '') FROM notifications WHERE id = ? AND user_id = ?`,
+		c.Param("id"), user.ID).Scan(&link)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/notificaciones")
+		return
+	}
+	database.DB.Exec(`UPDATE notifications SET read_at = COALESCE(read_at, datetime('now')) WHERE id = ?`, c.Param("id"))
+
+	// Only links inside the application are followed
+	if !strings.HasPrefix(link, "/") || strings.HasPrefix(link, "//") {
+		link = "/notificaciones"
+	}
+	c.Redirect(http.StatusFound, link)
+}
+
+// getNotifications retrieves the latest notifications of a user, newest first
+func (h *Handlers) getNotifications(userID int) ([]models.Notification, error) {
+	rows, err := database.DB.Query(`SELECT id, user_id, message, COALESCE(link, ''), read_at, created_at
+			  FROM notifications WHERE user_id = ? ORDER BY created_at DESC, id DESC LIMIT 50`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []models.Notification
+	for rows.Next() {
+		var notification models.Notification
+		err := rows.Scan(&notification.ID, &notification.UserID, &notification.Message, &notification.Link,
+			&notification.ReadAt, &notification.CreatedAt)
+		if err != nil {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, nil
+}
+
+// countUnreadNotifications returns how many notifications of a user are still unread
+func (h *Handlers) countUnreadNotifications(userID int) int {
+	var count int
+	database.DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL`, userID).Scan(&count)
+	return count
+}
+
+// notifyUsers stores an in-app notification for each user and, when email is configured,
+// also sends it to the users with an email address. Email failures are only logged.
+func (h *Handlers) notifyUsers(userIDs []int, subject, message, link string) {
+	var recipients []string
+	for _, userID := range userIDs {
+		_, err := database.DB.Exec(`INSERT INTO notifications (user_id, message, link) VALUES (?, ?, ?)`, userID, message, link)
+		if err != nil {
+			logger.Error("Failed to store notification for user %d: %v", userID, err)
+			continue
+		}
+
+		var email string
+		database.DB.QueryRow(`SELECT COALESCE(email, '') FROM users WHERE id = ?`, userID).Scan(&email)
+		if email != "" {
+			recipients = append(recipients, email)
+		}
+	}
+
+	cfg := h.getEmailConfig()
+	if !cfg.Enabled() || len(recipients) == 0 {
+		return
+	}
+	for _, recipient := range recipients {
+		if err := mail.Send(cfg, []string{recipient}, subject, message); err != nil {
+			logger.Error("Failed to email notification to %s: %v", recipient, err)
+		}
+	}
+}
+
+// getUsersWithPermission returns the IDs of the users holding a permission, administrators included
+func (h *Handlers) getUsersWithPermission(permission string) ([]int, error) {
+	rows, err := database.DB.Query(`SELECT DISTINCT user_id FROM user_permissions WHERE permission IN ('ADMIN', ?)`, permission)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, nil
+}
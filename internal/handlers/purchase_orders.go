@@ -0,0 +1,747 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/EuskadiTech/Figaro/pkg/pdf"
+	"github.com/gin-gonic/gin"
+)
+
+// errOrderNotOrdered is returned when receiving an order that was not placed
+var errOrderNotOrdered = errors.New("purchase order is not in ordered status")
+
+// MaterialesCompras handles the suggested shopping list (GET) and creates draft orders from it (POST)
+func (h *Handlers) MaterialesCompras(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handlePurchaseOrderCreate(c, centro, user)
+		return
+	}
+
+	h.renderShoppingList(c, centro, "")
+}
+
+// renderShoppingList renders the shopping list page
+func (h *Handlers) renderShoppingList(c *gin.Context, centro, errorMessage string) {
+	items, err := h.getShoppingList(centro)
+	if err != nil {
+		items = []models.ShoppingListItem{}
+	}
+	suppliers, _ := h.getSuppliers()
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Lista de la Compra"
+	data["Centro"] = centro
+	data["Items"] = items
+	data["Suppliers"] = suppliers
+	data["ErrorMessage"] = errorMessage
+	data["FormData"] = gin.H{
+		"proveedor": c.PostForm("proveedor"),
+		"notas":     c.PostForm("notas"),
+	}
+
+	h.renderTemplate(c, "materiales_compras.html", data)
+}
+
+// getShoppingList returns the materials whose free stock is below the minimum quantity
+func (h *Handlers) getShoppingList(centro string) ([]models.ShoppingListItem, error) {
+	materials, err := h.getMaterials(centro)
+	if err != nil {
+		return nil, err
+	}
+
+	onOrder, err := h.getOnOrderQuantities(centro)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []models.ShoppingListItem
+	for _, material := range materials {
+		free := material.AvailableQuantity - material.ReservedQuantity
+		if free >= material.MinimumQuantity {
+			continue
+		}
+
+		suggested := material.MinimumQuantity - free - onOrder[material.ID]
+		if suggested < 0 {
+			suggested = 0
+		}
+
+		items = append(items, models.ShoppingListItem{
+			Material:          material,
+			FreeQuantity:      free,
+			OnOrderQuantity:   onOrder[material.ID],
+			SuggestedQuantity: suggested,
+		})
+	}
+
+	return items, nil
+}
+
+// getOnOrderQuantities sums the quantities of each material in open purchase orders of a center
+func (h *Handlers) getOnOrderQuantities(centro string) (map[int]int, error) {
+	query := `SELECT i.material_id, SUM(i.quantity * i.unit_factor)
+			  FROM purchase_order_items i
+			  JOIN purchase_orders o ON i.order_id = o.id
+			  WHERE o.center_id = (SELECT id FROM centers WHERE name = ?)
+			  AND o.status IN ('draft', 'ordered') AND i.material_id IS NOT NULL
+			  GROUP BY i.material_id`
+
+	rows, err := database.DB.Query(query, centro)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quantities := map[int]int{}
+	for rows.Next() {
+		var materialID, quantity int
+		if err := rows.Scan(&materialID, &quantity); err != nil {
+			continue
+		}
+		quantities[materialID] = quantity
+	}
+
+	return quantities, nil
+}
+
+// parsePrice parses a price accepting both "1.50" and "1,50"
+func parsePrice(s string) (float64, error) {
+	s = strings.TrimSpace(strings.Replace(s, ",", ".", 1))
+	if s == "" {
+		return 0, nil
+	}
+	price, err := strconv.ParseFloat(s, 64)
+	// ParseFloat accepts "NaN" and "Inf", which would break the order totals and valuations
+	if err != nil || math.IsNaN(price) || math.IsInf(price, 0) || price < 0 {
+		return 0, errors.New("invalid price")
+	}
+	return price, nil
+}
+
+// handlePurchaseOrderCreate creates a draft purchase order from the shopping list form
+func (h *Handlers) handlePurchaseOrderCreate(c *gin.Context, centro string, user *models.User) {
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/compras?error=No tienes permiso para crear pedidos")
+		return
+	}
+
+	supplier := strings.TrimSpace(c.PostForm("proveedor"))
+	notes := strings.TrimSpace(c.PostForm("notas"))
+	materialIDs := c.PostFormArray("item_material_id[]")
+	quantities := c.PostFormArray("item_cantidad[]")
+	prices := c.PostFormArray("item_precio[]")
+	unitIDs := c.PostFormArray("item_unidad_id[]")
+
+	var items []models.PurchaseOrderItem
+	for i, materialID := range materialIDs {
+		if i >= len(quantities) || i >= len(prices) {
+			break
+		}
+
+		quantity, err := parseIntSafe(strings.TrimSpace(quantities[i]))
+		if err != nil || quantity < 0 {
+			h.renderShoppingList(c, centro, "Las cantidades deben ser números enteros positivos")
+			return
+		}
+		if quantity == 0 {
+			continue
+		}
+
+		price, err := parsePrice(prices[i])
+		if err != nil {
+			h.renderShoppingList(c, centro, "Los precios deben ser números positivos")
+			return
+		}
+
+		material, err := h.getMaterial(materialID, centro)
+		if err != nil {
+			continue
+		}
+
+		// Each line can be ordered in any unit of the material, such as reams of paper sold by the sheet
+		var unitID string
+		if i < len(unitIDs) {
+			unitID = unitIDs[i]
+		}
+		unitName, unitFactor, err := findMaterialUnit(material, unitID)
+		if err != nil {
+			h.renderShoppingList(c, centro, "La unidad de "+material.Name+" no es válida")
+			return
+		}
+		if _, err := unitQuantity(quantity, unitFactor); err != nil {
+			h.renderShoppingList(c, centro, "La cantidad de "+material.Name+" es demasiado grande")
+			return
+		}
+
+		items = append(items, models.PurchaseOrderItem{
+			MaterialID:   &material.ID,
+			MaterialName: material.Name,
+			Unit:         unitName,
+			Quantity:     quantity,
+			UnitPrice:    price,
+			UnitFactor:   unitFactor,
+		})
+	}
+
+	if len(items) == 0 {
+		h.renderShoppingList(c, centro, "Indica la cantidad a pedir de al menos un material")
+		return
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		h.renderShoppingList(c, centro, "Error al crear el pedido: "+err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO purchase_orders (center_id, supplier, status, notes, created_by, updated_at)
+			  VALUES (?, ?, 'draft', ?, ?, datetime('now'))`, centerID, supplier, notes, user.ID)
+	if err != nil {
+		h.renderShoppingList(c, centro, "Error al crear el pedido: "+err.Error())
+		return
+	}
+	orderID, _ := result.LastInsertId()
+
+	for _, item := range items {
+		_, err = tx.Exec(`INSERT INTO purchase_order_items (order_id, material_id, material_name, unit, quantity, unit_price, unit_factor)
+				  VALUES (?, ?, ?, ?, ?, ?, ?)`, orderID, item.MaterialID, item.MaterialName, item.Unit, item.Quantity, item.UnitPrice, item.UnitFactor)
+		if err != nil {
+			h.renderShoppingList(c, centro, "Error al crear el pedido: "+err.Error())
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		h.renderShoppingList(c, centro, "Error al crear el pedido: "+err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/materiales/pedidos/ver/%d?success=Pedido creado en borrador", orderID))
+}
+
+// MaterialesPedidos handles the purchase orders list of the selected center
+func (h *Handlers) MaterialesPedidos(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	statusFilter := c.Query("estado")
+
+	orders, err := h.getPurchaseOrders(centro, statusFilter)
+	if err != nil {
+		orders = []models.PurchaseOrder{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Pedidos de Compra"
+	data["Centro"] = centro
+	data["Orders"] = orders
+	data["StatusFilter"] = statusFilter
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_pedidos.html", data)
+}
+
+// MaterialesPedidoVer shows a purchase order (GET) and saves changes to a draft order (POST)
+func (h *Handlers) MaterialesPedidoVer(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	orderID := c.Param("id")
+	order, err := h.getPurchaseOrder(orderID, centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/pedidos?error=Pedido no encontrado")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handlePurchaseOrderUpdate(c, centro, order)
+		return
+	}
+
+	suppliers, _ := h.getSuppliers()
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Pedido de Compra"
+	data["Centro"] = centro
+	data["Order"] = order
+	data["Suppliers"] = suppliers
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_pedido.html", data)
+}
+
+// handlePurchaseOrderUpdate saves supplier, notes and item changes of a draft order
+func (h *Handlers) handlePurchaseOrderUpdate(c *gin.Context, centro string, order models.PurchaseOrder) {
+	redirectURL := fmt.Sprintf("/materiales/pedidos/ver/%d", order.ID)
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para modificar pedidos")
+		return
+	}
+
+	if order.Status != "draft" {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Solo se pueden modificar pedidos en borrador")
+		return
+	}
+
+	supplier := strings.TrimSpace(c.PostForm("proveedor"))
+	notes := strings.TrimSpace(c.PostForm("notas"))
+	itemIDs := c.PostFormArray("item_id[]")
+	quantities := c.PostFormArray("item_cantidad[]")
+	prices := c.PostFormArray("item_precio[]")
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar el pedido")
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE purchase_orders SET supplier = ?, notes = ?, updated_at = datetime('now') WHERE id = ?`,
+		supplier, notes, order.ID)
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar el pedido")
+		return
+	}
+
+	for i, itemID := range itemIDs {
+		if i >= len(quantities) || i >= len(prices) {
+			break
+		}
+
+		quantity, err := parseIntSafe(strings.TrimSpace(quantities[i]))
+		if err != nil || quantity < 0 {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Las cantidades deben ser números enteros positivos")
+			return
+		}
+
+		// A quantity of zero removes the line from the order
+		if quantity == 0 {
+			_, err = tx.Exec(`DELETE FROM purchase_order_items WHERE id = ? AND order_id = ?`, itemID, order.ID)
+		} else {
+			price, perr := parsePrice(prices[i])
+			if perr != nil {
+				c.Redirect(http.StatusFound, redirectURL+"?error=Los precios deben ser números positivos")
+				return
+			}
+			_, err = tx.Exec(`UPDATE purchase_order_items SET quantity = ?, unit_price = ? WHERE id = ? AND order_id = ?`,
+				quantity, price, itemID, order.ID)
+		}
+		if err != nil {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar el pedido")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar el pedido")
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirectURL+"?success=Pedido guardado correctamente")
+}
+
+// MaterialesPedidoEstado changes the status of a purchase order
+func (h *Handlers) MaterialesPedidoEstado(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	orderID := c.Param("id")
+	redirectURL := "/materiales/pedidos/ver/" + orderID
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para modificar pedidos")
+		return
+	}
+
+	order, err := h.getPurchaseOrder(orderID, centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/pedidos?error=Pedido no encontrado")
+		return
+	}
+
+	switch newStatus := c.PostForm("estado"); {
+	case newStatus == "ordered" && order.Status == "draft":
+		if len(order.Items) == 0 {
+			c.Redirect(http.StatusFound, redirectURL+"?error=El pedido no tiene materiales")
+			return
+		}
+		_, err = database.DB.Exec(`UPDATE purchase_orders SET status = 'ordered', ordered_at = datetime('now'), updated_at = datetime('now')
+				  WHERE id = ? AND status = 'draft'`, order.ID)
+		if err != nil {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Error al actualizar el pedido")
+			return
+		}
+		c.Redirect(http.StatusFound, redirectURL+"?success=Pedido marcado como realizado")
+	case newStatus == "draft" && order.Status == "ordered":
+		_, err = database.DB.Exec(`UPDATE purchase_orders SET status = 'draft', ordered_at = NULL, updated_at = datetime('now')
+				  WHERE id = ? AND status = 'ordered'`, order.ID)
+		if err != nil {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Error al actualizar el pedido")
+			return
+		}
+		c.Redirect(http.StatusFound, redirectURL+"?success=Pedido devuelto a borrador")
+	case newStatus == "received" && order.Status == "ordered":
+		if err := h.receivePurchaseOrder(order, user.ID); err != nil {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Error al recibir el pedido: "+err.Error())
+			return
+		}
+		c.Redirect(http.StatusFound, redirectURL+"?success=Pedido recibido y stock actualizado")
+	default:
+		c.Redirect(http.StatusFound, redirectURL+"?error=Cambio de estado no permitido")
+	}
+}
+
+// receivePurchaseOrder adds the ordered quantities to the stock and marks the order as received
+func (h *Handlers) receivePurchaseOrder(order models.PurchaseOrder, userID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE purchase_orders SET status = 'received', received_at = datetime('now'), updated_at = datetime('now')
+			  WHERE id = ? AND status = 'ordered'`, order.ID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return errOrderNotOrdered
+	}
+
+	// Received stock goes to the center's store room
+	locationID, err := defaultLocationID(tx, order.CenterID)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range order.Items {
+		if item.MaterialID == nil {
+			continue
+		}
+		// Materials that no longer belong to the center are skipped
+		err = addMaterialStock(tx, *item.MaterialID, locationID, item.BaseQuantity())
+		if err == errLocationNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// The price paid becomes the unit cost, and a known supplier the preferred one if there was none.
+		// Prices are per ordered unit, so they are divided by the factor to get the cost of a base unit
+		unitCost := item.UnitPrice / float64(max(item.UnitFactor, 1))
+		_, err = tx.Exec(`UPDATE materials SET unit_cost = CASE WHEN ? > 0 THEN ? ELSE unit_cost END,
+				  preferred_supplier_id = COALESCE(preferred_supplier_id, (SELECT id FROM suppliers WHERE name = ?)),
+				  updated_at = datetime('now') WHERE id = ?`,
+			unitCost, unitCost, order.Supplier, *item.MaterialID)
+		if err != nil {
+			return err
+		}
+		if err := recordMaterialMovement(tx, *item.MaterialID, item.BaseQuantity(), "purchase", userID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// MaterialesPedidoEliminar deletes a draft purchase order
+func (h *Handlers) MaterialesPedidoEliminar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/pedidos?error=No tienes permiso para eliminar pedidos")
+		return
+	}
+
+	query := `DELETE FROM purchase_orders WHERE id = ? AND status = 'draft' AND center_id = (SELECT id FROM centers WHERE name = ?)`
+	result, err := database.DB.Exec(query, c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/pedidos?error=Error al eliminar el pedido")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		c.Redirect(http.StatusFound, "/materiales/pedidos?error=Pedido no encontrado o no está en borrador")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/pedidos?success=Pedido eliminado correctamente")
+}
+
+// MaterialesPedidoExportar exports a purchase order as CSV or PDF
+func (h *Handlers) MaterialesPedidoExportar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	order, err := h.getPurchaseOrder(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/pedidos?error=Pedido no encontrado")
+		return
+	}
+
+	filename := fmt.Sprintf("pedido_%d", order.ID)
+
+	if c.DefaultQuery("formato", "csv") == "pdf" {
+		c.Header("Content-Disposition", "attachment; filename="+filename+".pdf")
+		c.Data(http.StatusOK, "application/pdf", purchaseOrderPDF(order))
+		return
+	}
+
+	data, err := purchaseOrderCSV(order)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/pedidos?error=Error al exportar el pedido")
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename="+filename+".csv")
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", data)
+}
+
+// purchaseOrderStatusLabel returns the Spanish label of an order status
+func purchaseOrderStatusLabel(status string) string {
+	switch status {
+	case "draft":
+		return "Borrador"
+	case "ordered":
+		return "Realizado"
+	case "received":
+		return "Recibido"
+	}
+	return status
+}
+
+// purchaseOrderCSV renders an order as a semicolon separated CSV that opens directly in spreadsheet apps
+func purchaseOrderCSV(order models.PurchaseOrder) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("\ufeff") // UTF-8 BOM so accents show correctly
+
+	w := csv.NewWriter(&buf)
+	w.Comma = ';'
+
+	records := [][]string{
+		{"Pedido", strconv.Itoa(order.ID)},
+		{"Centro", order.CenterName},
+		{"Proveedor", order.Supplier},
+		{"Estado", purchaseOrderStatusLabel(order.Status)},
+		{"Fecha", order.CreatedAt.Format("02/01/2006")},
+		{},
+		{"Material", "Unidad", "Cantidad", "Precio unitario", "Subtotal"},
+	}
+	for _, item := range order.Items {
+		records = append(records, []string{
+			item.MaterialName,
+			item.Unit,
+			strconv.Itoa(item.Quantity),
+			formatPrice(item.UnitPrice),
+			formatPrice(item.Subtotal()),
+		})
+	}
+	records = append(records, []string{"", "", "", "Total", formatPrice(order.TotalAmount)})
+
+	if err := w.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// purchaseOrderPDF renders an order as a printable PDF document
+func purchaseOrderPDF(order models.PurchaseOrder) []byte {
+	doc := pdf.New()
+	doc.Title(fmt.Sprintf("Pedido de compra #%d", order.ID))
+	doc.Line("Centro: " + order.CenterName)
+	doc.Line("Proveedor: " + order.Supplier)
+	doc.Line("Estado: " + purchaseOrderStatusLabel(order.Status))
+	doc.Line("Fecha: " + order.CreatedAt.Format("02/01/2006"))
+	if order.Notes != "" {
+		doc.Line("Notas: " + order.Notes)
+	}
+	doc.Space(12)
+
+	widths := []float64{195, 80, 60, 80, 80}
+	doc.Row([]string{"Material", "Unidad", "Cantidad", "Precio unit.", "Subtotal"}, widths, true)
+	for _, item := range order.Items {
+		doc.Row([]string{
+			item.MaterialName,
+			item.Unit,
+			strconv.Itoa(item.Quantity),
+			formatPrice(item.UnitPrice) + " €",
+			formatPrice(item.Subtotal()) + " €",
+		}, widths, false)
+	}
+	doc.Space(6)
+	doc.Row([]string{"", "", "", "Total", formatPrice(order.TotalAmount) + " €"}, widths, true)
+
+	return doc.Bytes()
+}
+
+// formatPrice formats an amount with two decimals and a decimal comma
+func formatPrice(amount float64) string {
+	return strings.Replace(strconv.FormatFloat(amount, 'f', 2, 64), ".", ",", 1)
+}
+
+// getPurchaseOrders retrieves the purchase orders of a center, optionally filtered by status
+func (h *Handlers) getPurchaseOrders(centro, status string) ([]models.PurchaseOrder, error) {
+	query := `SELECT o.id, o.center_id, c.name, o.supplier, o.status, COALESCE(o.notes, ''), o.created_by,
+			  COALESCE(u.display_name, ''), o.created_at, o.updated_at, o.ordered_at, o.received_at,
+			  (SELECT COUNT(*) FROM purchase_order_items i WHERE i.order_id = o.id),
+			  COALESCE((SELECT SUM(i.quantity * i.unit_price) FROM purchase_order_items i WHERE i.order_id = o.id), 0)
+			  FROM purchase_orders o
+			  JOIN centers c ON o.center_id = c.id
+			  LEFT JOIN users u ON o.created_by = u.id
+			  WHERE c.name = ?`
+	args := []interface{}{centro}
+
+	if status != "" {
+		query += " AND o.status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY o.created_at DESC, o.id DESC"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []models.PurchaseOrder
+	for rows.Next() {
+		var order models.PurchaseOrder
+		err := rows.Scan(&order.ID, &order.CenterID, &order.CenterName, &order.Supplier, &order.Status,
+			&order.Notes, &order.CreatedBy, &order.CreatedByName, &order.CreatedAt, &order.UpdatedAt,
+			&order.OrderedAt, &order.ReceivedAt, &order.ItemCount, &order.TotalAmount)
+		if err != nil {
+			continue
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, nil
+}
+
+// getPurchaseOrder retrieves a purchase order of a center with its items
+func (h *Handlers) getPurchaseOrder(orderID, centro string) (models.PurchaseOrder, error) {
+	var order models.PurchaseOrder
+	query := `SELECT o.id, o.center_id, c.name, o.supplier, o.status, COALESCE(o.notes, ''), o.created_by,
+			  COALESCE(u.display_name, ''), o.created_at, o.updated_at, o.ordered_at, o.received_at
+			  FROM purchase_orders o
+			  JOIN centers c ON o.center_id = c.id
+			  LEFT JOIN users u ON o.created_by = u.id
+			  WHERE o.id = ? AND c.name = ?`
+
+	err := database.DB.QueryRow(query, orderID, centro).Scan(&order.ID, &order.CenterID, &order.CenterName,
+		&order.Supplier, &order.Status, &order.Notes, &order.CreatedBy, &order.CreatedByName,
+		&order.CreatedAt, &order.UpdatedAt, &order.OrderedAt, &order.ReceivedAt)
+	if err != nil {
+		return order, err
+	}
+
+	rows, err := database.DB.Query(`SELECT id, order_id, material_id, material_name, unit, quantity, unit_price, unit_factor
+			  FROM purchase_order_items WHERE order_id = ? ORDER BY material_name`, order.ID)
+	if err != nil {
+		return order, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.PurchaseOrderItem
+		var materialID sql.NullInt64
+		err := rows.Scan(&item.ID, &item.OrderID, &materialID, &item.MaterialName, &item.Unit,
+			&item.Quantity, &item.UnitPrice, &item.UnitFactor)
+		if err != nil {
+			continue
+		}
+		if materialID.Valid {
+			id := int(materialID.Int64)
+			item.MaterialID = &id
+		}
+		order.Items = append(order.Items, item)
+		order.TotalAmount += item.Subtotal()
+	}
+	order.ItemCount = len(order.Items)
+
+	return order, nil
+}
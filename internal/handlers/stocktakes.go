@@ -0,0 +1,616 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// stocktakeExpectedSQL is the live expected quantity of a stocktake item (alias i, stocktake s, material m):
+// the stock in the counted location, or the center total when the stocktake covers every location
+const stocktakeExpectedSQL = `CASE WHEN s.location_id IS NOT NULL
+			  THEN COALESCE((SELECT ms.quantity FROM material_stock ms WHERE ms.material_id = i.material_id AND ms.location_id = s.location_id), 0)
+			  ELSE COALESCE(m.available_quantity, 0) END`
+
+// MaterialesInventarios handles the stocktakes list of the selected center
+func (h *Handlers) MaterialesInventarios(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	stocktakes, err := h.getStocktakes(centro)
+	if err != nil {
+		stocktakes = []models.Stocktake{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Inventarios"
+	data["Centro"] = centro
+	data["Stocktakes"] = stocktakes
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+	h.setMaterialFormOptions(data, centro)
+
+	h.renderTemplate(c, "materiales_inventarios.html", data)
+}
+
+// MaterialesInventarioCrear opens a stocktake with the materials in its scope
+func (h *Handlers) MaterialesInventarioCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=No tienes permiso para abrir inventarios")
+		return
+	}
+
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales?error=Centro no encontrado")
+		return
+	}
+
+	categoryID, _ := parseIntSafe(c.PostForm("categoria"))
+	if categoryID != 0 {
+		if _, err := h.getCategoryForCenter(strconv.Itoa(categoryID), centerID); err != nil {
+			c.Redirect(http.StatusFound, "/materiales/inventarios?error=Categoría no válida")
+			return
+		}
+	}
+
+	locationID, _ := parseIntSafe(c.PostForm("ubicacion"))
+	if locationID != 0 {
+		var count int
+		database.DB.QueryRow(`SELECT COUNT(*) FROM storage_locations WHERE id = ? AND center_id = ?`, locationID, centerID).Scan(&count)
+		if count == 0 {
+			c.Redirect(http.StatusFound, "/materiales/inventarios?error=Ubicación no válida")
+			return
+		}
+	}
+
+	stocktakeID, err := h.createStocktake(centerID, categoryID, locationID, strings.TrimSpace(c.PostForm("notas")), user.ID)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=Error al abrir el inventario")
+		return
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/materiales/inventarios/ver/%d", stocktakeID))
+}
+
+// createStocktake stores a new open stocktake with one item per material in its scope
+func (h *Handlers) createStocktake(centerID, categoryID, locationID int, notes string, userID int) (int64, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO stocktakes (center_id, category_id, location_id, notes, created_by, updated_at)
+			  VALUES (?, ?, ?, ?, ?, datetime('now'))`,
+		centerID, nullableID(categoryID), nullableID(locationID), notes, userID)
+	if err != nil {
+		return 0, err
+	}
+	stocktakeID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO stocktake_items (stocktake_id, material_id, material_name, unit)
+			  SELECT ?, m.id, m.name, m.unit FROM materials m WHERE m.center_id = ?`
+	args := []interface{}{stocktakeID, centerID}
+	if categoryID != 0 {
+		query += ` AND m.category_id IN (` + categoryTreeSQL + `)`
+		args = append(args, categoryID)
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return 0, err
+	}
+
+	return stocktakeID, tx.Commit()
+}
+
+// MaterialesInventarioVer shows a stocktake (GET) and saves the counted quantities of an open one (POST)
+func (h *Handlers) MaterialesInventarioVer(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	stocktake, err := h.getStocktake(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=Inventario no encontrado")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleStocktakeCount(c, stocktake)
+		return
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = fmt.Sprintf("Figaró - Inventario #%d", stocktake.ID)
+	data["Centro"] = centro
+	data["Stocktake"] = stocktake
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_inventario.html", data)
+}
+
+// handleStocktakeCount saves the counted quantities; an empty field leaves the item uncounted
+func (h *Handlers) handleStocktakeCount(c *gin.Context, stocktake models.Stocktake) {
+	redirectURL := fmt.Sprintf("/materiales/inventarios/ver/%d", stocktake.ID)
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para contar inventarios")
+		return
+	}
+
+	if stocktake.Status != "open" {
+		c.Redirect(http.StatusFound, redirectURL+"?error=El inventario ya está cerrado")
+		return
+	}
+
+	itemIDs := c.PostFormArray("item_id[]")
+	counts := c.PostFormArray("contado[]")
+	unitIDs := c.PostFormArray("contado_unidad_id[]")
+
+	// Each count can be given in any unit of its material
+	materials := map[string]models.Material{}
+	for _, item := range stocktake.Items {
+		materials[strconv.Itoa(item.ID)] = models.Material{Unit: item.Unit, Units: item.Units}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar el recuento")
+		return
+	}
+	defer tx.Rollback()
+
+	for i, itemID := range itemIDs {
+		if i >= len(counts) {
+			break
+		}
+
+		var counted interface{}
+		if value := strings.TrimSpace(counts[i]); value != "" {
+			var unitID string
+			if i < len(unitIDs) {
+				unitID = unitIDs[i]
+			}
+			quantity, err := parseUnitQuantity(value, unitID, materials[itemID])
+			if err != nil {
+				c.Redirect(http.StatusFound, redirectURL+"?error=Las cantidades contadas deben ser números positivos")
+				return
+			}
+			counted = quantity
+		}
+
+		// Only touch rows whose count changed, so counted_at reflects the last real count
+		_, err = tx.Exec(`UPDATE stocktake_items SET counted_quantity = ?, counted_at = datetime('now')
+				  WHERE id = ? AND stocktake_id = ? AND counted_quantity IS NOT ?`, counted, itemID, stocktake.ID, counted)
+		if err != nil {
+			c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar el recuento")
+			return
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE stocktakes SET updated_at = datetime('now') WHERE id = ?`, stocktake.ID)
+	if err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar el recuento")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, redirectURL+"?error=Error al guardar el recuento")
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirectURL+"?success=Recuento guardado")
+}
+
+// MaterialesInventarioCerrar shows the discrepancy report (GET) and closes the stocktake applying the adjustments (POST)
+func (h *Handlers) MaterialesInventarioCerrar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	stocktake, err := h.getStocktake(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=Inventario no encontrado")
+		return
+	}
+
+	redirectURL := fmt.Sprintf("/materiales/inventarios/ver/%d", stocktake.ID)
+	if stocktake.Status != "open" {
+		c.Redirect(http.StatusFound, redirectURL+"?error=El inventario ya está cerrado")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, redirectURL+"?error=No tienes permiso para cerrar inventarios")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleStocktakeClose(c, stocktake, user)
+		return
+	}
+
+	var discrepancies []models.StocktakeItem
+	uncounted := 0
+	for _, item := range stocktake.Items {
+		if item.CountedQuantity == nil {
+			uncounted++
+		} else if item.Difference() != 0 {
+			discrepancies = append(discrepancies, item)
+		}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = fmt.Sprintf("Figaró - Cerrar Inventario #%d", stocktake.ID)
+	data["Centro"] = centro
+	data["Stocktake"] = stocktake
+	data["Discrepancies"] = discrepancies
+	data["Uncounted"] = uncounted
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "materiales_inventario_cerrar.html", data)
+}
+
+// handleStocktakeClose stores the final expected quantities, applies the selected adjustments and closes the stocktake.
+// Every adjustment needs a reason, taken from its own field or the general one.
+func (h *Handlers) handleStocktakeClose(c *gin.Context, stocktake models.Stocktake, user *models.User) {
+	closeURL := fmt.Sprintf("/materiales/inventarios/cerrar/%d", stocktake.ID)
+	generalReason := strings.TrimSpace(c.PostForm("motivo"))
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		c.Redirect(http.StatusFound, closeURL+"?error=Error al cerrar el inventario")
+		return
+	}
+	defer tx.Rollback()
+
+	for _, item := range stocktake.Items {
+		adjust := false
+		reason := ""
+		if item.CountedQuantity != nil && item.Difference() != 0 && item.MaterialID != nil &&
+			c.PostForm(fmt.Sprintf("ajustar_%d", item.ID)) != "" {
+			adjust = true
+			reason = strings.TrimSpace(c.PostForm(fmt.Sprintf("motivo_%d", item.ID)))
+			if reason == "" {
+				reason = generalReason
+			}
+			if reason == "" {
+				c.Redirect(http.StatusFound, closeURL+"?error=Indica el motivo de cada ajuste: "+item.MaterialName)
+				return
+			}
+
+			if stocktake.LocationID != 0 {
+				err = setLocationQuantity(tx, *item.MaterialID, stocktake.LocationID, *item.CountedQuantity)
+			} else {
+				err = setMaterialTotal(tx, *item.MaterialID, 0, *item.CountedQuantity)
+			}
+			if err == nil {
+				err = recordMaterialMovement(tx, *item.MaterialID, item.Difference(), "stocktake", user.ID)
+			}
+			if err != nil {
+				c.Redirect(http.StatusFound, closeURL+"?error=Error al ajustar "+item.MaterialName)
+				return
+			}
+		}
+
+		_, err = tx.Exec(`UPDATE stocktake_items SET expected_quantity = ?, adjusted = ?, reason = ? WHERE id = ?`,
+			item.ExpectedQuantity, adjust, reason, item.ID)
+		if err != nil {
+			c.Redirect(http.StatusFound, closeURL+"?error=Error al cerrar el inventario")
+			return
+		}
+	}
+
+	result, err := tx.Exec(`UPDATE stocktakes SET status = 'closed', closed_by = ?, closed_at = datetime('now'), updated_at = datetime('now')
+			  WHERE id = ? AND status = 'open'`, user.ID, stocktake.ID)
+	if err != nil {
+		c.Redirect(http.StatusFound, closeURL+"?error=Error al cerrar el inventario")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.Redirect(http.StatusFound, closeURL+"?error=El inventario ya está cerrado")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.Redirect(http.StatusFound, closeURL+"?error=Error al cerrar el inventario")
+		return
+	}
+
+	c.Redirect(http.StatusFound, fmt.Sprintf("/materiales/inventarios/ver/%d?success=Inventario cerrado y ajustes aplicados", stocktake.ID))
+}
+
+// MaterialesInventarioCancelar cancels an open stocktake without touching the stock
+func (h *Handlers) MaterialesInventarioCancelar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	if !auth.UserHasAccess(c, "materiales.update") {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=No tienes permiso para cancelar inventarios")
+		return
+	}
+
+	result, err := database.DB.Exec(`UPDATE stocktakes SET status = 'cancelled', closed_by = ?, closed_at = datetime('now'), updated_at = datetime('now')
+			  WHERE id = ? AND status = 'open' AND center_id = (SELECT id FROM centers WHERE name = ?)`,
+		user.ID, c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=Error al cancelar el inventario")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=Inventario no encontrado o ya cerrado")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/materiales/inventarios?success=Inventario cancelado")
+}
+
+// MaterialesInventarioExportar exports a stocktake with its discrepancies as CSV
+func (h *Handlers) MaterialesInventarioExportar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Get selected center
+	centro, err := c.Cookie("centro")
+	if err != nil || centro == "" {
+		c.Redirect(http.StatusFound, "/elegir_centro")
+		return
+	}
+
+	stocktake, err := h.getStocktake(c.Param("id"), centro)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=Inventario no encontrado")
+		return
+	}
+
+	data, err := stocktakeCSV(stocktake)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/materiales/inventarios?error=Error al exportar el inventario")
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=inventario_%d.csv", stocktake.ID))
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", data)
+}
+
+// stocktakeStatusLabel returns the Spanish label of a stocktake status
+func stocktakeStatusLabel(status string) string {
+	switch status {
+	case "open":
+		return "Abierto"
+	case "closed":
+		return "Cerrado"
+	case "cancelled":
+		return "Cancelado"
+	}
+	return status
+}
+
+// stocktakeCSV renders a stocktake as a semicolon separated CSV, like purchase orders
+func stocktakeCSV(stocktake models.Stocktake) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("\ufeff") // UTF-8 BOM so accents show correctly
+
+	w := csv.NewWriter(&buf)
+	w.Comma = ';'
+
+	scope := "Todo el centro"
+	if stocktake.CategoryName != "" {
+		scope = "Categoría: " + stocktake.CategoryName
+	}
+	if stocktake.LocationName != "" {
+		scope += " / Ubicación: " + stocktake.LocationName
+	}
+	closedAt := ""
+	if stocktake.ClosedAt != nil {
+		closedAt = stocktake.ClosedAt.Format("02/01/2006 15:04")
+	}
+
+	records := [][]string{
+		{"Inventario", strconv.Itoa(stocktake.ID)},
+		{"Centro", stocktake.CenterName},
+		{"Alcance", scope},
+		{"Estado", stocktakeStatusLabel(stocktake.Status)},
+		{"Abierto", stocktake.CreatedAt.Format("02/01/2006 15:04"), stocktake.CreatedByName},
+		{"Cerrado", closedAt, stocktake.ClosedByName},
+		{},
+		{"Material", "Unidad", "Esperado", "Contado", "Diferencia", "Ajustado", "Motivo"},
+	}
+	for _, item := range stocktake.Items {
+		counted, difference := "", ""
+		if item.CountedQuantity != nil {
+			counted = strconv.Itoa(*item.CountedQuantity)
+			difference = strconv.Itoa(item.Difference())
+		}
+		adjusted := "No"
+		if item.Adjusted {
+			adjusted = "Sí"
+		}
+		records = append(records, []string{
+			item.MaterialName,
+			item.Unit,
+			strconv.Itoa(item.ExpectedQuantity),
+			counted,
+			difference,
+			adjusted,
+			item.Reason,
+		})
+	}
+
+	if err := w.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// getStocktakes retrieves the stocktakes of a center, newest first
+func (h *Handlers) getStocktakes(centro string) ([]models.Stocktake, error) {
+	query := `SELECT s.id, s.center_id, c.name, COALESCE(s.category_id, 0), COALESCE(mc.name, ''),
+			  COALESCE(s.location_id, 0), COALESCE(l.name, ''), s.status, s.notes, s.created_by, COALESCE(uc.display_name, ''),
+			  s.closed_by, COALESCE(ux.display_name, ''), s.created_at, s.updated_at, s.closed_at,
+			  (SELECT COUNT(*) FROM stocktake_items i WHERE i.stocktake_id = s.id),
+			  (SELECT COUNT(*) FROM stocktake_items i WHERE i.stocktake_id = s.id AND i.counted_quantity IS NOT NULL),
+			  (SELECT COUNT(*) FROM stocktake_items i WHERE i.stocktake_id = s.id AND i.counted_quantity != i.expected_quantity)
+			  FROM stocktakes s
+			  JOIN centers c ON s.center_id = c.id
+			  LEFT JOIN material_categories mc ON s.category_id = mc.id
+			  LEFT JOIN storage_locations l ON s.location_id = l.id
+			  LEFT JOIN users uc ON s.created_by = uc.id
+			  LEFT JOIN users ux ON s.closed_by = ux.id
+			  WHERE c.name = ?
+			  ORDER BY s.status = 'open' DESC, s.created_at DESC, s.id DESC`
+
+	rows, err := database.DB.Query(query, centro)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stocktakes []models.Stocktake
+	for rows.Next() {
+		var stocktake models.Stocktake
+		err := rows.Scan(&stocktake.ID, &stocktake.CenterID, &stocktake.CenterName, &stocktake.CategoryID,
+			&stocktake.CategoryName, &stocktake.LocationID, &stocktake.LocationName, &stocktake.Status,
+			&stocktake.Notes, &stocktake.CreatedBy, &stocktake.CreatedByName, &stocktake.ClosedBy,
+			&stocktake.ClosedByName, &stocktake.CreatedAt, &stocktake.UpdatedAt, &stocktake.ClosedAt,
+			&stocktake.ItemCount, &stocktake.CountedCount, &stocktake.DiscrepancyCount)
+		if err != nil {
+			continue
+		}
+		stocktakes = append(stocktakes, stocktake)
+	}
+
+	return stocktakes, nil
+}
+
+// getStocktake retrieves a stocktake of a center with its items.
+// While open, the expected quantities are the current stock.
+func (h *Handlers) getStocktake(stocktakeID, centro string) (models.Stocktake, error) {
+	var stocktake models.Stocktake
+	query := `SELECT s.id, s.center_id, c.name, COALESCE(s.category_id, 0), COALESCE(mc.name, ''),
+			  COALESCE(s.location_id, 0), COALESCE(l.name, ''), s.status, s.notes, s.created_by, COALESCE(uc.display_name, ''),
+			  s.closed_by, COALESCE(ux.display_name, ''), s.created_at, s.updated_at, s.closed_at
+			  FROM stocktakes s
+			  JOIN centers c ON s.center_id = c.id
+			  LEFT JOIN material_categories mc ON s.category_id = mc.id
+			  LEFT JOIN storage_locations l ON s.location_id = l.id
+			  LEFT JOIN users uc ON s.created_by = uc.id
+			  LEFT JOIN users ux ON s.closed_by = ux.id
+			  WHERE s.id = ? AND c.name = ?`
+
+	err := database.DB.QueryRow(query, stocktakeID, centro).Scan(&stocktake.ID, &stocktake.CenterID,
+		&stocktake.CenterName, &stocktake.CategoryID, &stocktake.CategoryName, &stocktake.LocationID,
+		&stocktake.LocationName, &stocktake.Status, &stocktake.Notes, &stocktake.CreatedBy,
+		&stocktake.CreatedByName, &stocktake.ClosedBy, &stocktake.ClosedByName, &stocktake.CreatedAt,
+		&stocktake.UpdatedAt, &stocktake.ClosedAt)
+	if err != nil {
+		return stocktake, err
+	}
+
+	rows, err := database.DB.Query(`SELECT i.id, i.stocktake_id, i.material_id, i.material_name, i.unit, COALESCE(m.barcode, ''),
+			  CASE WHEN s.status = 'open' THEN `+stocktakeExpectedSQL+` ELSE i.expected_quantity END,
+			  i.counted_quantity, i.adjusted, i.reason, i.counted_at
+			  FROM stocktake_items i
+			  JOIN stocktakes s ON i.stocktake_id = s.id
+			  LEFT JOIN materials m ON i.material_id = m.id
+			  WHERE i.stocktake_id = ?
+			  ORDER BY i.material_name`, stocktake.ID)
+	if err != nil {
+		return stocktake, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.StocktakeItem
+		err := rows.Scan(&item.ID, &item.StocktakeID, &item.MaterialID, &item.MaterialName, &item.Unit,
+			&item.Barcode, &item.ExpectedQuantity, &item.CountedQuantity, &item.Adjusted, &item.Reason, &item.CountedAt)
+		if err != nil {
+			continue
+		}
+		stocktake.Items = append(stocktake.Items, item)
+		stocktake.ItemCount++
+		if item.CountedQuantity != nil {
+			stocktake.CountedCount++
+			if item.Difference() != 0 {
+				stocktake.DiscrepancyCount++
+			}
+		}
+	}
+
+	units, err := h.getUnitsByMaterial(stocktake.CenterID)
+	if err != nil {
+		return stocktake, err
+	}
+	for i, item := range stocktake.Items {
+		if item.MaterialID != nil {
+			stocktake.Items[i].Units = units[*item.MaterialID]
+		}
+	}
+
+	return stocktake, nil
+}
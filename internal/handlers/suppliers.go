@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/EuskadiTech/Figaro/internal/auth"
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/internal/models"
+	"github.com/gin-gonic/gin"
+)
+
+// AdminProveedores handles the suppliers list
+func (h *Handlers) AdminProveedores(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	suppliers, err := h.getSuppliers()
+	if err != nil {
+		suppliers = []models.Supplier{}
+	}
+
+	data := h.getCommonData(c)
+	data["PageTitle"] = "Figaró - Proveedores"
+	data["Suppliers"] = suppliers
+	data["SuccessMessage"] = c.Query("success")
+	data["ErrorMessage"] = c.Query("error")
+
+	h.renderTemplate(c, "admin_proveedores.html", data)
+}
+
+// AdminProveedorCrear handles supplier creation
+func (h *Handlers) AdminProveedorCrear(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleSupplierSave(c, models.Supplier{})
+		return
+	}
+
+	h.renderSupplierForm(c, models.Supplier{}, "")
+}
+
+// AdminProveedorEditar handles supplier editing
+func (h *Handlers) AdminProveedorEditar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	supplier, err := h.getSupplier(c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/proveedores?error=Proveedor no encontrado")
+		return
+	}
+
+	if c.Request.Method == http.MethodPost {
+		h.handleSupplierSave(c, supplier)
+		return
+	}
+
+	h.renderSupplierForm(c, supplier, "")
+}
+
+// renderSupplierForm renders the supplier form
+func (h *Handlers) renderSupplierForm(c *gin.Context, supplier models.Supplier, errorMessage string) {
+	data := h.getCommonData(c)
+	data["Action"] = "crear"
+	data["PageTitle"] = "Figaró - Crear Proveedor"
+	if supplier.ID != 0 {
+		data["Action"] = "editar"
+		data["PageTitle"] = "Figaró - Editar Proveedor"
+	}
+	data["Supplier"] = supplier
+	data["ErrorMessage"] = errorMessage
+
+	h.renderTemplate(c, "admin_proveedor_form.html", data)
+}
+
+// handleSupplierSave validates and stores a new or edited supplier
+func (h *Handlers) handleSupplierSave(c *gin.Context, supplier models.Supplier) {
+	supplier.Name = strings.TrimSpace(c.PostForm("nombre"))
+	supplier.ContactName = strings.TrimSpace(c.PostForm("contacto"))
+	supplier.Email = strings.TrimSpace(c.PostForm("email"))
+	supplier.Phone = strings.TrimSpace(c.PostForm("telefono"))
+	supplier.Website = strings.TrimSpace(c.PostForm("web"))
+	supplier.Notes = strings.TrimSpace(c.PostForm("notas"))
+
+	if supplier.Name == "" {
+		h.renderSupplierForm(c, supplier, "El nombre del proveedor es obligatorio")
+		return
+	}
+	if supplier.Email != "" {
+		if _, err := mail.ParseAddress(supplier.Email); err != nil {
+			h.renderSupplierForm(c, supplier, "El email del proveedor no es válido")
+			return
+		}
+	}
+	if supplier.Website != "" && !strings.HasPrefix(supplier.Website, "http://") && !strings.HasPrefix(supplier.Website, "https://") {
+		supplier.Website = "https://" + supplier.Website
+	}
+
+	var existing int
+	database.DB.QueryRow(`SELECT COUNT(*) FROM suppliers WHERE name = ? AND id <> ?`, supplier.Name, supplier.ID).Scan(&existing)
+	if existing > 0 {
+		h.renderSupplierForm(c, supplier, "Ya existe un proveedor con ese nombre")
+		return
+	}
+
+	var err error
+	if supplier.ID == 0 {
+		_, err = database.DB.Exec(`INSERT INTO suppliers (name, contact_name, email, phone, website, notes, updated_at)
+				  VALUES (?, ?, ?, ?, ?, ?, datetime('now'))`,
+			supplier.Name, supplier.ContactName, supplier.Email, supplier.Phone, supplier.Website, supplier.Notes)
+	} else {
+		_, err = database.DB.Exec(`UPDATE suppliers SET name = ?, contact_name = ?, email = ?, phone = ?, website = ?, notes = ?,
+				  updated_at = datetime('now') WHERE id = ?`,
+			supplier.Name, supplier.ContactName, supplier.Email, supplier.Phone, supplier.Website, supplier.Notes, supplier.ID)
+	}
+	if err != nil {
+		h.renderSupplierForm(c, supplier, "Error al guardar el proveedor: "+err.Error())
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/admin/proveedores?success=Proveedor guardado correctamente")
+}
+
+// AdminProveedorEliminar deletes a supplier; its materials are left without a preferred supplier
+func (h *Handlers) AdminProveedorEliminar(c *gin.Context) {
+	user := auth.GetCurrentUser(c)
+	if user == nil {
+		c.Redirect(http.StatusFound, "/login")
+		return
+	}
+
+	// Check admin permissions
+	if !auth.UserHasAccess(c, "ADMIN") {
+		c.String(http.StatusForbidden, "Acceso denegado")
+		return
+	}
+
+	result, err := database.DB.Exec(`DELETE FROM suppliers WHERE id = ?`, c.Param("id"))
+	if err != nil {
+		c.Redirect(http.StatusFound, "/admin/proveedores?error=Error al eliminar el proveedor")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.Redirect(http.StatusFound, "/admin/proveedores?error=Proveedor no encontrado")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/admin/proveedores?success=Proveedor eliminado correctamente")
+}
+
+// getSuppliers retrieves every supplier ordered by name
+func (h *Handlers) getSuppliers() ([]models.Supplier, error) {
+	rows, err := database.DB.Query(`SELECT s.id, s.name, COALESCE(s.contact_name, ''), COALESCE(s.email, ''), COALESCE(s.phone, ''),
+			  COALESCE(s.website, ''), COALESCE(s.notes, ''),
+			  (SELECT COUNT(*) FROM materials m WHERE m.preferred_supplier_id = s.id),
+			  s.created_at, s.updated_at
+			  FROM suppliers s
+			  ORDER BY s.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suppliers []models.Supplier
+	for rows.Next() {
+		var supplier models.Supplier
+		err := rows.Scan(&supplier.ID, &supplier.Name, &supplier.ContactName, &supplier.Email, &supplier.Phone,
+			&supplier.Website, &supplier.Notes, &supplier.MaterialCount, &supplier.CreatedAt, &supplier.UpdatedAt)
+		if err != nil {
+			continue
+		}
+		suppliers = append(suppliers, supplier)
+	}
+
+	return suppliers, nil
+}
+
+// getSupplier retrieves a single supplier by ID
+func (h *Handlers) getSupplier(supplierID string) (models.Supplier, error) {
+	var supplier models.Supplier
+	err := database.DB.QueryRow(`SELECT id, name, COALESCE(contact_name, ''), COALESCE(email, ''), COALESCE(phone, ''),
+			  COALESCE(website, ''), COALESCE(notes, ''), created_at, updated_at
+			  FROM suppliers WHERE id = ?`, supplierID).Scan(&supplier.ID, &supplier.Name, &supplier.ContactName,
+		&supplier.Email, &supplier.Phone, &supplier.Website, &supplier.Notes, &supplier.CreatedAt, &supplier.UpdatedAt)
+	return supplier, err
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/EuskadiTech/Figaro/internal/database"
+	"github.com/EuskadiTech/Figaro/pkg/ical"
+	"github.com/EuskadiTech/Figaro/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// workingWeek lists the weekdays in the order they are shown, from Monday to Sunday
+var workingWeek = []time.Weekday{
+	time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday,
+}
+
+var errInvalidWorkingHours = errors.New("invalid working hours")
+
+// workingDay is the opening time of a center on a weekday, in minutes from midnight
+type workingDay struct {
+	Start int
+	End   int
+}
+
+// workingHours are the opening times of a center by weekday. Weekdays missing from a
+// non-empty map are closed; an empty map means that the center has no hours configured.
+type workingHours map[time.Weekday]workingDay
+
+// workingHoursDay is a row of the weekly hours editor of the center form
+type workingHoursDay struct {
+	DayOfWeek int
+	Name      string
+	Open      bool
+	Start     string
+	End       string
+	Invalid   bool
+}
+
+// getWorkingHours returns the working hours of a center
+func getWorkingHours(centerID int) (workingHours, error) {
+	rows, err := database.DB.Query(`SELECT day_of_week, start_time, end_time FROM center_working_hours WHERE center_id = ?`, centerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := workingHours{}
+	for rows.Next() {
+		var day int
+		var start, end sql.NullString
+		if err := rows.Scan(&day, &start, &end); err != nil {
+			return nil, err
+		}
+		startMinutes, okStart := parseClock(start.String)
+		endMinutes, okEnd := parseClock(end.String)
+		if okStart && okEnd && startMinutes < endMinutes {
+			hours[time.Weekday(day)] = workingDay{Start: startMinutes, End: endMinutes}
+		}
+	}
+	return hours, rows.Err()
+}
+
+// getWorkingHoursDays returns the working hours of a center for the center form
+func getWorkingHoursDays(centerID int) ([]workingHoursDay, error) {
+	hours, err := getWorkingHours(centerID)
+	if err != nil {
+		return nil, err
+	}
+
+	days := make([]workingHoursDay, 0, len(workingWeek))
+	for _, weekday := range workingWeek {
+		day := workingHoursDay{DayOfWeek: int(weekday), Name: weekdayNames[weekday], Start: "08:00", End: "18:00"}
+		if hours, ok := hours[weekday]; ok {
+			day.Open = true
+			day.Start, day.End = formatClock(hours.Start), formatClock(hours.End)
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// parseWorkingHoursDays reads the weekly hours editor of the center form. The days are
+// returned even if some are invalid, marked as such, so that the form can be shown again.
+func parseWorkingHoursDays(c *gin.Context) ([]workingHoursDay, error) {
+	var invalid error
+	days := make([]workingHoursDay, 0, len(workingWeek))
+	for _, weekday := range workingWeek {
+		day := workingHoursDay{
+			DayOfWeek: int(weekday),
+			Name:      weekdayNames[weekday],
+			Open:      c.PostForm(fmt.Sprintf("abierto_%d", weekday)) == "1",
+			Start:     c.PostForm(fmt.Sprintf("apertura_%d", weekday)),
+			End:       c.PostForm(fmt.Sprintf("cierre_%d", weekday)),
+		}
+		if day.Open {
+			start, okStart := parseClock(day.Start)
+			end, okEnd := parseClock(day.End)
+			if !okStart || !okEnd || start >= end {
+				day.Invalid = true
+				invalid = errInvalidWorkingHours
+			}
+		}
+		days = append(days, day)
+	}
+	return days, invalid
+}
+
+// saveWorkingHours replaces the working hours of a center. Closed days are stored without
+// hours; if every day is closed the hours are removed and activities are not checked.
+func saveWorkingHours(centerID int, days []workingHoursDay) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM center_working_hours WHERE center_id = ?`, centerID); err != nil {
+		return err
+	}
+
+	open := false
+	for _, day := range days {
+		open = open || day.Open
+	}
+	if open {
+		for _, day := range days {
+			var start, end *string
+			if day.Open {
+				start, end = &day.Start, &day.End
+			}
+			if _, err := tx.Exec(`INSERT INTO center_working_hours (center_id, day_of_week, start_time, end_time) VALUES (?, ?, ?, ?)`,
+				centerID, day.DayOfWeek, start, end); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// describeWorkingHours summarises the working hours, joining consecutive days with the same hours
+func describeWorkingHours(hours workingHours) string {
+	var parts []string
+	for i := 0; i < len(workingWeek); i++ {
+		day, open := hours[workingWeek[i]]
+		if !open {
+			continue
+		}
+		last := i
+		for last+1 < len(workingWeek) && hours[workingWeek[last+1]] == day {
+			last++
+		}
+
+		days := weekdayNames[workingWeek[i]]
+		if last == i+1 {
+			days += " y " + weekdayNames[workingWeek[last]]
+		} else if last > i {
+			days += " a " + weekdayNames[workingWeek[last]]
+		}
+		parts = append(parts, fmt.Sprintf("%s de %s a %s", days, formatClock(day.Start), formatClock(day.End)))
+		i = last
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	text := strings.Join(parts, "; ")
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// checkWorkingHours returns why an activity of a center, repeating by rule if any, takes
+// place outside of the working hours of the center, or "" if it does not. The times are
+// wall clock times in the timezone of the center, as activities are stored.
+func (h *Handlers) checkWorkingHours(centro string, start, end time.Time, rule *string) string {
+	var centerID int
+	var timezone string
+	err := database.DB.QueryRow(`SELECT id, COALESCE(timezone, '') FROM centers WHERE name = ?`, centro).Scan(&centerID, &timezone)
+	if err != nil {
+		logger.Error("Failed to get center %q to check working hours: %v", centro, err)
+		return ""
+	}
+	hours, err := getWorkingHours(centerID)
+	if err != nil {
+		logger.Error("Failed to get working hours of center %d: %v", centerID, err)
+		return ""
+	}
+	location := loadTimezone(timezone)
+
+	occurrences := []time.Time{start}
+	if rule != nil {
+		if r, err := ical.ParseRule(*rule); err == nil {
+			occurrences = r.Between(start, start, start.AddDate(recurrenceHorizonYears, 0, 0))
+		}
+	}
+	duration := end.Sub(start)
+	for _, occurrence := range occurrences {
+		if problem := hours.check(location, occurrence, occurrence.Add(duration)); problem != "" {
+			return problem
+		}
+	}
+	return ""
+}
+
+// check returns why an occurrence from start to end falls outside of the working hours,
+// going through each of the days it takes
+func (hours workingHours) check(location *time.Location, start, end time.Time) string {
+	for _, t := range []time.Time{start, end} {
+		if !wallClock(inLocation(t, location), location).Equal(t) {
+			return fmt.Sprintf("La hora %s del %s no existe en la zona horaria del centro (%s) por el cambio de hora",
+				t.Format("15:04"), formatWorkingDate(t), location)
+		}
+	}
+	if len(hours) == 0 {
+		return ""
+	}
+
+	first := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
+	for day := first; day.Equal(first) || day.Before(end); day = day.AddDate(0, 0, 1) {
+		from, to := 0, 24*60
+		if day.Equal(first) {
+			from = start.Hour()*60 + start.Minute()
+		}
+		if next := day.AddDate(0, 0, 1); !end.After(next) {
+			to = int(end.Sub(day).Minutes())
+		}
+
+		open, ok := hours[day.Weekday()]
+		if !ok {
+			return fmt.Sprintf("El centro está cerrado el %s", formatWorkingDate(day))
+		}
+		if from < open.Start || to > open.End {
+			return fmt.Sprintf("La actividad del %s queda fuera del horario del centro (de %s a %s)",
+				formatWorkingDate(day), formatClock(open.Start), formatClock(open.End))
+		}
+	}
+	return ""
+}
+
+// setActivityFormWorkingHours adds the working hours of the center to the activity form
+func (h *Handlers) setActivityFormWorkingHours(data gin.H, centro string) {
+	centerID, err := h.getCenterID(centro)
+	if err != nil {
+		return
+	}
+	hours, err := getWorkingHours(centerID)
+	if err != nil {
+		logger.Error("Failed to get working hours of center %d: %v", centerID, err)
+		return
+	}
+	data["WorkingHours"] = describeWorkingHours(hours)
+}
+
+// parseClock reads an HH:MM time, with optional seconds, as minutes from midnight
+func parseClock(value string) (int, bool) {
+	if len(value) > 5 {
+		value = value[:5]
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+// formatClock formats minutes from midnight as HH:MM
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// formatWorkingDate formats a date with its weekday, such as "lunes 19/10/2026"
+func formatWorkingDate(t time.Time) string {
+	return weekdayNames[t.Weekday()] + " " + t.Format("02/01/2006")
+}
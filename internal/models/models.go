@@ -4,6 +4,7 @@ package models
 import (
 	"database/sql/driver"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -60,10 +61,54 @@ type Material struct {
 	MinimumQuantity   int       `json:"cantidad_minima" db:"minimum_quantity"` // Keep Spanish JSON field for compatibility
 	Notes             string    `json:"notas" db:"notes"` // Keep Spanish JSON field for compatibility
 	Category          string    `json:"categoria" db:"category"` // Keep Spanish JSON field for compatibility
+	CategoryID        int       `json:"categoria_id" db:"category_id"` // 0 if the material has no managed category
+	CategoryName      string    `json:"categoria_nombre"`                 // Loaded via JOIN
+	CategoryIcon      string    `json:"categoria_icono"`                  // Loaded via JOIN
+	ReservedQuantity  int       `json:"cantidad_reservada"` // Sum of active activity reservations
+	LocationQuantity  int       `json:"cantidad_ubicacion"` // Quantity in the location the list is filtered by
+	Barcode           string    `json:"codigo_barras" db:"barcode"` // Empty if the material has no barcode
+	IsLendable        bool      `json:"prestable" db:"is_lendable"` // Reusable material that is lent instead of consumed
+	LoanedQuantity    int       `json:"cantidad_prestada"`          // Sum of outstanding loans
+	UnitCost          float64   `json:"coste_unitario" db:"unit_cost"`          // Last known cost of one unit
+	SupplierID        int       `json:"proveedor_id" db:"preferred_supplier_id"` // Preferred supplier, 0 if none
+	SupplierName      string    `json:"proveedor_nombre"`                        // Loaded via JOIN
+	TracksBatches     bool      `json:"lotes" db:"tracks_batches"` // Perishable material tracked by batch and expiry date
+	Units             []MaterialUnit `json:"unidades"`                // Larger units, ordered from largest to smallest
 	CreatedAt         time.Time `json:"createdAt" db:"created_at"` // Keep existing field name
 	UpdatedAt         time.Time `json:"updated_at" db:"updated_at"`
 }
 
+// FormatQuantity writes a quantity in base units using the larger units of the material,
+// for example 150 as "1 caja, 6 piezas"
+func (m Material) FormatQuantity(quantity int) string {
+	if len(m.Units) == 0 || quantity <= 0 {
+		return fmt.Sprintf("%d %s", quantity, m.Unit)
+	}
+
+	var parts []string
+	remaining := quantity
+	for _, unit := range m.Units {
+		if count := remaining / unit.Factor; count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count, unit.Name))
+			remaining -= count * unit.Factor
+		}
+	}
+	if remaining > 0 {
+		parts = append(parts, fmt.Sprintf("%d %s", remaining, m.Unit))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// MaterialUnit represents a unit of a material holding several base units
+type MaterialUnit struct {
+	ID         int       `json:"id" db:"id"`
+	MaterialID int       `json:"material_id" db:"material_id"`
+	Name       string    `json:"name" db:"name"`
+	Factor     int       `json:"factor" db:"factor"` // Number of base units in one of this unit
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
 // Activity represents an activity or event
 type Activity struct {
 	ID             int                   `json:"id" db:"id"`
@@ -78,10 +123,35 @@ type Activity struct {
 	WebURL         *string               `json:"web_url" db:"web_url"`
 	CreatedAt      time.Time             `json:"created_at" db:"created_at"`
 	UpdatedAt      time.Time             `json:"updated_at" db:"updated_at"`
+	// Recurrence: a series has a rule, an edited occurrence points to its series
+	RecurrenceRule     *string    `json:"recurrence_rule,omitempty" db:"recurrence_rule"`
+	RecurrenceParentID *int       `json:"recurrence_parent_id,omitempty" db:"recurrence_parent_id"`
+	RecurrenceDate     *time.Time `json:"recurrence_date,omitempty" db:"recurrence_date"` // Original start of the replaced occurrence
+	OccurrenceDate     *time.Time `json:"occurrence_date,omitempty"`                      // Original start of an expanded occurrence
+	RecurrenceText     string     `json:"recurrence_text,omitempty"`                      // Rule described for display
+	// Allowed by an administrator outside of the working hours of the center
+	OutsideWorkingHours bool `json:"outside_working_hours" db:"outside_working_hours"`
 	// Additional fields for sharing and links (loaded separately)
 	Shares         []ActivityShare       `json:"shares,omitempty"`
 	CustomLinks    []ActivityCustomLink  `json:"custom_links,omitempty"`
 	SharedFromCenter *string             `json:"shared_from_center,omitempty"` // For display purposes
+	Reservations     []ActivityMaterialReservation `json:"reservations,omitempty"`
+	Classrooms       []ActivityParticipant         `json:"classrooms,omitempty"`
+	Staff            []ActivityParticipant         `json:"staff,omitempty"`
+	Attachments      []ActivityAttachment          `json:"attachments,omitempty"`
+}
+
+// IsRecurring reports whether the activity is a series or an edited occurrence of one
+func (a Activity) IsRecurring() bool {
+	return a.RecurrenceRule != nil || a.RecurrenceParentID != nil
+}
+
+// OccurrenceKey identifies the occurrence of a series in URLs, empty for single activities
+func (a Activity) OccurrenceKey() string {
+	if a.OccurrenceDate == nil {
+		return ""
+	}
+	return a.OccurrenceDate.Format("2006-01-02T15:04")
 }
 
 // ActivityShare represents an activity shared with a specific center
@@ -91,6 +161,27 @@ type ActivityShare struct {
 	CenterID         int    `json:"center_id" db:"center_id"`
 	SharedByCenterID int    `json:"shared_by_center_id" db:"shared_by_center_id"`
 	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	CenterName       string    `json:"center_name,omitempty"` // Loaded for display
+}
+
+// ActivityStatusChange is an entry of the status history of an activity
+type ActivityStatusChange struct {
+	ID            int       `json:"id" db:"id"`
+	ActivityID    int       `json:"activity_id" db:"activity_id"`
+	OldStatus     string    `json:"old_status" db:"old_status"`
+	NewStatus     string    `json:"new_status" db:"new_status"`
+	ChangedBy     *int      `json:"changed_by,omitempty" db:"changed_by"` // NULL for the automatic changes
+	ChangedByName string    `json:"changed_by_name,omitempty"`
+	ChangedAt     time.Time `json:"changed_at" db:"changed_at"`
+}
+
+// ActivityParticipant is a classroom or a staff member taking part in an activity
+type ActivityParticipant struct {
+	ClassroomID *int   `json:"classroom_id,omitempty" db:"classroom_id"`
+	UserID      *int   `json:"user_id,omitempty" db:"user_id"`
+	Name        string `json:"name"`
+	CenterName  string `json:"center_name,omitempty"` // Center of a classroom
+	Attended    *bool  `json:"attended,omitempty" db:"attended"` // NULL until the attendance is taken
 }
 
 // ActivityCustomLink represents a custom link associated with an activity
@@ -102,6 +193,190 @@ type ActivityCustomLink struct {
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 }
 
+// ActivityAttachment represents a file attached to an activity
+type ActivityAttachment struct {
+	ID             int       `json:"id" db:"id"`
+	ActivityID     int       `json:"activity_id" db:"activity_id"`
+	FileName       string    `json:"file_name" db:"file_name"`     // Name of the uploaded file
+	StoredName     string    `json:"-" db:"stored_name"`           // Name of the file in the upload directory
+	ContentType    string    `json:"content_type" db:"content_type"`
+	Size           int64     `json:"size" db:"size"`
+	UploadedBy     *int      `json:"uploaded_by,omitempty" db:"uploaded_by"`
+	UploadedByName string    `json:"uploaded_by_name,omitempty"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+}
+
+// SizeText returns the size of the attachment for display
+func (a ActivityAttachment) SizeText() string {
+	switch {
+	case a.Size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(a.Size)/(1024*1024))
+	case a.Size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(a.Size)/1024)
+	}
+	return fmt.Sprintf("%d B", a.Size)
+}
+
+// ActivityMaterialReservation represents a quantity of material reserved for an activity
+type ActivityMaterialReservation struct {
+	ID           int        `json:"id" db:"id"`
+	ActivityID   int        `json:"activity_id" db:"activity_id"`
+	MaterialID   int        `json:"material_id" db:"material_id"`
+	MaterialName string     `json:"material_name"` // Loaded via JOIN
+	Unit         string     `json:"unit"`          // Loaded via JOIN
+	Quantity     int        `json:"quantity" db:"quantity"`
+	Status       string     `json:"status" db:"status"` // "reserved", "consumed" or "released"
+	FreeQuantity int        `json:"free_quantity"`      // Stock left after other activities' reservations
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	SettledAt    *time.Time `json:"settled_at" db:"settled_at"`
+}
+
+// ExceedsStock reports whether an active reservation needs more than the free stock
+func (r ActivityMaterialReservation) ExceedsStock() bool {
+	return r.Status == "reserved" && r.Quantity > r.FreeQuantity
+}
+
+// MaterialLoan represents units of a reusable material lent to a user or a classroom
+type MaterialLoan struct {
+	ID                  int        `json:"id" db:"id"`
+	MaterialID          int        `json:"material_id" db:"material_id"`
+	MaterialName        string     `json:"material_name"` // Loaded via JOIN
+	Unit                string     `json:"unit"`          // Loaded via JOIN
+	CenterID            int        `json:"center_id" db:"center_id"`
+	Quantity            int        `json:"quantity" db:"quantity"`
+	BorrowerUserID      *int       `json:"borrower_user_id" db:"borrower_user_id"`
+	BorrowerClassroomID *int       `json:"borrower_classroom_id" db:"borrower_classroom_id"`
+	BorrowerName        string     `json:"borrower_name"`  // User display name or classroom name
+	BorrowerEmail       string     `json:"borrower_email"` // Empty for classrooms
+	DueDate             time.Time  `json:"due_date" db:"due_date"`
+	Status              string     `json:"status" db:"status"` // "out" or "returned"
+	Notes               string     `json:"notes" db:"notes"`
+	SendReminders       bool       `json:"send_reminders" db:"send_reminders"`
+	LentBy              *int       `json:"lent_by" db:"lent_by"`
+	LentByName          string     `json:"lent_by_name"`  // Loaded via JOIN
+	LentByEmail         string     `json:"lent_by_email"` // Loaded via JOIN
+	ReturnedByName      string     `json:"returned_by_name"`
+	LentAt              time.Time  `json:"lent_at" db:"lent_at"`
+	ReturnedAt          *time.Time `json:"returned_at" db:"returned_at"`
+}
+
+// IsOverdue reports whether an outstanding loan is past its due date
+func (l MaterialLoan) IsOverdue() bool {
+	return l.Status == "out" && l.DueDate.Format("2006-01-02") < time.Now().Format("2006-01-02")
+}
+
+// MaterialRequest represents a request of materials made by a teacher for a classroom
+type MaterialRequest struct {
+	ID            int                   `json:"id" db:"id"`
+	CenterID      int                   `json:"center_id" db:"center_id"`
+	ClassroomID   *int                  `json:"classroom_id" db:"classroom_id"`
+	ClassroomName string                `json:"classroom_name"` // Loaded via JOIN
+	RequestedBy   *int                  `json:"requested_by" db:"requested_by"`
+	RequesterName string                `json:"requester_name"` // Loaded via JOIN
+	NeededBy      time.Time             `json:"needed_by" db:"needed_by"`
+	Status        string                `json:"status" db:"status"` // pending, fulfilled, partial, rejected or cancelled
+	Notes         string                `json:"notes" db:"notes"`
+	ResponseNotes string                `json:"response_notes" db:"response_notes"` // Written by the coordinator
+	ReviewedBy    *int                  `json:"reviewed_by" db:"reviewed_by"`
+	ReviewerName  string                `json:"reviewer_name"` // Loaded via JOIN
+	ReviewedAt    *time.Time            `json:"reviewed_at" db:"reviewed_at"`
+	CreatedAt     time.Time             `json:"created_at" db:"created_at"`
+	ItemCount     int                   `json:"item_count"`
+	Items         []MaterialRequestItem `json:"items"`
+}
+
+// IsOverdue reports whether a pending request is past its needed-by date
+func (r MaterialRequest) IsOverdue() bool {
+	return r.Status == "pending" && r.NeededBy.Format("2006-01-02") < time.Now().Format("2006-01-02")
+}
+
+// MaterialRequestItem represents a material and quantity asked for in a request
+type MaterialRequestItem struct {
+	ID                int    `json:"id" db:"id"`
+	RequestID         int    `json:"request_id" db:"request_id"`
+	MaterialID        *int   `json:"material_id" db:"material_id"` // NULL if the material was deleted
+	MaterialName      string `json:"material_name" db:"material_name"`
+	Unit              string `json:"unit" db:"unit"`
+	Quantity          int    `json:"quantity" db:"quantity"`
+	FulfilledQuantity int    `json:"fulfilled_quantity" db:"fulfilled_quantity"`
+	FreeQuantity      int    `json:"free_quantity"` // Available minus reserved and loaned
+}
+
+// SelectedMaterialID returns the ID of the material, 0 if it was deleted
+func (i MaterialRequestItem) SelectedMaterialID() int {
+	if i.MaterialID == nil {
+		return 0
+	}
+	return *i.MaterialID
+}
+
+// Notification represents a message shown to a user inside the application
+type Notification struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"user_id" db:"user_id"`
+	Message   string     `json:"message" db:"message"`
+	Link      string     `json:"link" db:"link"`
+	ReadAt    *time.Time `json:"read_at" db:"read_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+// MaterialBatch represents a lot of a material received together, with its expiry date
+type MaterialBatch struct {
+	ID              int        `json:"id" db:"id"`
+	MaterialID      int        `json:"material_id" db:"material_id"`
+	MaterialName    string     `json:"material_name"` // Loaded via JOIN
+	Unit            string     `json:"unit"`          // Loaded via JOIN
+	CenterID        int        `json:"center_id" db:"center_id"`
+	BatchCode       string     `json:"batch_code" db:"batch_code"`
+	Quantity        int        `json:"quantity" db:"quantity"`
+	InitialQuantity int        `json:"initial_quantity" db:"initial_quantity"`
+	ExpiryDate      *time.Time `json:"expiry_date" db:"expiry_date"` // NULL if the batch does not expire
+	Status          string     `json:"status" db:"status"`           // "active" or "expired"
+	CreatedByName   string     `json:"created_by_name"`              // Loaded via JOIN
+	ReceivedAt      time.Time  `json:"received_at" db:"received_at"`
+	ExpiredAt       *time.Time `json:"expired_at" db:"expired_at"`
+}
+
+// DaysUntilExpiry returns the days left until the batch expires, negative once expired
+func (b MaterialBatch) DaysUntilExpiry() int {
+	if b.ExpiryDate == nil {
+		return 0
+	}
+	today, _ := time.Parse("2006-01-02", time.Now().Format("2006-01-02"))
+	expiry, _ := time.Parse("2006-01-02", b.ExpiryDate.Format("2006-01-02"))
+	return int(expiry.Sub(today).Hours() / 24)
+}
+
+// MaterialKit represents a standard set of materials of a center
+type MaterialKit struct {
+	ID                int               `json:"id" db:"id"`
+	CenterID          int               `json:"center_id" db:"center_id"`
+	Name              string            `json:"name" db:"name"`
+	Description       string            `json:"description" db:"description"`
+	AssembledQuantity int               `json:"assembled_quantity" db:"assembled_quantity"` // Ready-made kits
+	BuildableQuantity int               `json:"buildable_quantity"`                         // Kits that can be made from the free stock
+	Items             []MaterialKitItem `json:"items,omitempty"`
+	CreatedAt         time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// AvailableQuantity returns the kits that can be handed out: the ready-made ones plus those that can be made
+func (k MaterialKit) AvailableQuantity() int {
+	return k.AssembledQuantity + k.BuildableQuantity
+}
+
+// MaterialKitItem represents a component material of a kit
+type MaterialKitItem struct {
+	ID           int    `json:"id" db:"id"`
+	KitID        int    `json:"kit_id" db:"kit_id"`
+	MaterialID   int    `json:"material_id" db:"material_id"`
+	MaterialName string `json:"material_name"` // Loaded via JOIN
+	Unit         string `json:"unit"`          // Loaded via JOIN
+	Quantity     int    `json:"quantity" db:"quantity"`
+	FreeQuantity int    `json:"free_quantity"` // Available minus reserved and loaned
+}
+
 // UserPermission represents a user's permission
 type UserPermission struct {
 	ID         int    `json:"id" db:"id"`
@@ -171,8 +446,233 @@ type MaterialWithCenter struct {
 	MinimumQuantity   int       `json:"minimum_quantity"`
 	Notes             string    `json:"notes"`
 	Category          string    `json:"category"`
+	CategoryName      string    `json:"category_name"`
+	CategoryIcon      string    `json:"category_icon"`
 	CreatedAt         time.Time `json:"created_at"`
 	UpdatedAt         time.Time `json:"updated_at"`
+	// Consumption forecast, filled from the movements ledger
+	Used             int     `json:"used"`               // Units consumed in the analysed period
+	DailyRate        float64 `json:"daily_rate"`         // Average units consumed per day
+	DaysUntilMinimum int     `json:"days_until_minimum"` // Only meaningful when Used > 0
+	SuggestedMinimum int     `json:"suggested_minimum"`
+	Units            []MaterialUnit `json:"units"` // Larger units, ordered from largest to smallest
+}
+
+// FormatQuantity writes a quantity in base units using the larger units of the material
+func (m MaterialWithCenter) FormatQuantity(quantity int) string {
+	return Material{Unit: m.Unit, Units: m.Units}.FormatQuantity(quantity)
+}
+
+// MaterialMovement is an entry of the ledger of changes of the available quantity of a material
+type MaterialMovement struct {
+	ID             int       `json:"id" db:"id"`
+	MaterialID     int       `json:"material_id" db:"material_id"`
+	CenterID       int       `json:"center_id" db:"center_id"`
+	Kind           string    `json:"kind" db:"kind"` // initial, consumption, restock, purchase, transfer_in, transfer_out, stocktake, expired, kit_assembly, kit_disassembly, request
+	QuantityChange int       `json:"quantity_change" db:"quantity_change"`
+	QuantityAfter  int       `json:"quantity_after" db:"quantity_after"`
+	UserID         *int      `json:"user_id" db:"user_id"`
+	UserName       string    `json:"user_name"` // Loaded via JOIN
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+}
+
+// ConsumptionPeriod is the material consumed in a month or school term, for the trend charts
+type ConsumptionPeriod struct {
+	Label   string `json:"label"`
+	Used    int    `json:"used"`
+	Percent int    `json:"percent"` // Bar height relative to the busiest period
+}
+
+// SpendPeriod is the amount spent on restocking materials in a school term
+type SpendPeriod struct {
+	Label   string  `json:"label"`
+	Amount  float64 `json:"amount"`
+	Percent int     `json:"percent"` // Bar height relative to the most expensive period
+}
+
+// InventoryValuation is the value of the stock of a center in a category
+type InventoryValuation struct {
+	CenterID      int     `json:"center_id"`
+	CenterName    string  `json:"center_name"`
+	CategoryName  string  `json:"category_name"`
+	MaterialCount int     `json:"material_count"`
+	Units         int     `json:"units"`
+	Value         float64 `json:"value"`
+	Uncosted      int     `json:"uncosted"` // Materials in stock without a unit cost
+}
+
+// Supplier represents a company materials are bought from
+type Supplier struct {
+	ID            int       `json:"id" db:"id"`
+	Name          string    `json:"name" db:"name"`
+	ContactName   string    `json:"contact_name" db:"contact_name"`
+	Email         string    `json:"email" db:"email"`
+	Phone         string    `json:"phone" db:"phone"`
+	Website       string    `json:"website" db:"website"`
+	Notes         string    `json:"notes" db:"notes"`
+	MaterialCount int       `json:"material_count"` // Materials that prefer this supplier
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// StorageLocation represents a place where a center keeps materials: a named storage room or a classroom
+type StorageLocation struct {
+	ID            int       `json:"id" db:"id"`
+	CenterID      int       `json:"center_id" db:"center_id"`
+	ClassroomID   int       `json:"classroom_id" db:"classroom_id"` // 0 for storage rooms
+	Name          string    `json:"name" db:"name"`
+	IsDefault     bool      `json:"is_default" db:"is_default"` // The store room that receives new stock
+	MaterialCount int       `json:"material_count"`
+	TotalQuantity int       `json:"total_quantity"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// MaterialStock represents the quantity of a material kept in a location
+type MaterialStock struct {
+	MaterialID   int       `json:"material_id" db:"material_id"`
+	LocationID   int       `json:"location_id" db:"location_id"`
+	LocationName string    `json:"location_name"`
+	IsClassroom  bool      `json:"is_classroom"`
+	Quantity     int       `json:"quantity" db:"quantity"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// MaterialCategory represents a managed material category, global or specific to a center
+type MaterialCategory struct {
+	ID                     int       `json:"id" db:"id"`
+	CenterID               int       `json:"center_id" db:"center_id"` // 0 for global categories
+	CenterName             string    `json:"center_name"`              // Loaded via JOIN
+	ParentID               int       `json:"parent_id" db:"parent_id"` // 0 for top-level categories
+	Name                   string    `json:"name" db:"name"`
+	Slug                   string    `json:"slug" db:"slug"`
+	Icon                   string    `json:"icon" db:"icon"` // File name in static/pictos
+	DefaultMinimumQuantity *int      `json:"default_minimum_quantity" db:"default_minimum_quantity"`
+	MaterialCount          int       `json:"material_count"`
+	Depth                  int       `json:"depth"` // Nesting level when listed as a tree
+	CreatedAt              time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt              time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// MaterialTransfer represents a stock transfer of a material between two centers
+type MaterialTransfer struct {
+	ID                    int        `json:"id" db:"id"`
+	SourceCenterID        int        `json:"source_center_id" db:"source_center_id"`
+	SourceCenterName      string     `json:"source_center_name"`      // Loaded via JOIN
+	DestinationCenterID   int        `json:"destination_center_id" db:"destination_center_id"`
+	DestinationCenterName string     `json:"destination_center_name"` // Loaded via JOIN
+	SourceMaterialID      *int       `json:"source_material_id" db:"source_material_id"`           // NULL if the material was deleted
+	DestinationMaterialID *int       `json:"destination_material_id" db:"destination_material_id"` // Set when accepted
+	MaterialName          string     `json:"material_name" db:"material_name"`
+	Unit                  string     `json:"unit" db:"unit"`
+	Quantity              int        `json:"quantity" db:"quantity"`
+	Status                string     `json:"status" db:"status"` // "pending", "accepted", "rejected" or "cancelled"
+	Notes                 string     `json:"notes" db:"notes"`
+	RequestedBy           *int       `json:"requested_by" db:"requested_by"`
+	RequestedByName       string     `json:"requested_by_name"` // Loaded via JOIN
+	RespondedBy           *int       `json:"responded_by" db:"responded_by"`
+	RespondedByName       string     `json:"responded_by_name"` // Loaded via JOIN
+	CreatedAt             time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at" db:"updated_at"`
+	RespondedAt           *time.Time `json:"responded_at" db:"responded_at"`
+}
+
+// Stocktake represents a physical count of the materials of a center
+type Stocktake struct {
+	ID               int             `json:"id" db:"id"`
+	CenterID         int             `json:"center_id" db:"center_id"`
+	CenterName       string          `json:"center_name"` // Loaded via JOIN
+	CategoryID       int             `json:"category_id" db:"category_id"` // 0 if not limited to a category
+	CategoryName     string          `json:"category_name"`                // Loaded via JOIN
+	LocationID       int             `json:"location_id" db:"location_id"` // 0 if not limited to a location
+	LocationName     string          `json:"location_name"`                // Loaded via JOIN
+	Status           string          `json:"status" db:"status"`           // "open", "closed" or "cancelled"
+	Notes            string          `json:"notes" db:"notes"`
+	CreatedBy        *int            `json:"created_by" db:"created_by"`
+	CreatedByName    string          `json:"created_by_name"` // Loaded via JOIN
+	ClosedBy         *int            `json:"closed_by" db:"closed_by"`
+	ClosedByName     string          `json:"closed_by_name"` // Loaded via JOIN
+	CreatedAt        time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at" db:"updated_at"`
+	ClosedAt         *time.Time      `json:"closed_at" db:"closed_at"`
+	Items            []StocktakeItem `json:"items,omitempty"`
+	ItemCount        int             `json:"item_count"`
+	CountedCount     int             `json:"counted_count"`
+	DiscrepancyCount int             `json:"discrepancy_count"`
+}
+
+// StocktakeItem is the count of one material in a stocktake
+type StocktakeItem struct {
+	ID               int        `json:"id" db:"id"`
+	StocktakeID      int        `json:"stocktake_id" db:"stocktake_id"`
+	MaterialID       *int       `json:"material_id" db:"material_id"` // NULL if the material was deleted
+	MaterialName     string     `json:"material_name" db:"material_name"`
+	Unit             string     `json:"unit" db:"unit"`
+	Barcode          string     `json:"barcode"`                                  // Loaded via JOIN
+	ExpectedQuantity int        `json:"expected_quantity" db:"expected_quantity"` // Current stock while open, stored on close
+	CountedQuantity  *int       `json:"counted_quantity" db:"counted_quantity"`   // NULL until counted
+	Adjusted         bool       `json:"adjusted" db:"adjusted"`
+	Reason           string     `json:"reason" db:"reason"`
+	CountedAt        *time.Time `json:"counted_at" db:"counted_at"`
+	// Units of the material to count in, loaded separately
+	Units []MaterialUnit `json:"units,omitempty"`
+}
+
+// Difference returns counted minus expected quantity, 0 if not counted
+func (i StocktakeItem) Difference() int {
+	if i.CountedQuantity == nil {
+		return 0
+	}
+	return *i.CountedQuantity - i.ExpectedQuantity
+}
+
+// ShoppingListItem is a material below its minimum with the suggested quantity to buy
+type ShoppingListItem struct {
+	Material          Material `json:"material"`
+	FreeQuantity      int      `json:"free_quantity"`      // Available minus reserved
+	OnOrderQuantity   int      `json:"on_order_quantity"`  // Already in draft or ordered purchase orders
+	SuggestedQuantity int      `json:"suggested_quantity"` // Needed to get back to the minimum
+}
+
+// PurchaseOrder represents an order of materials to a supplier
+type PurchaseOrder struct {
+	ID            int                 `json:"id" db:"id"`
+	CenterID      int                 `json:"center_id" db:"center_id"`
+	CenterName    string              `json:"center_name"` // Loaded via JOIN
+	Supplier      string              `json:"supplier" db:"supplier"`
+	Status        string              `json:"status" db:"status"` // "draft", "ordered" or "received"
+	Notes         string              `json:"notes" db:"notes"`
+	CreatedBy     *int                `json:"created_by" db:"created_by"`
+	CreatedByName string              `json:"created_by_name"` // Loaded via JOIN
+	CreatedAt     time.Time           `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time           `json:"updated_at" db:"updated_at"`
+	OrderedAt     *time.Time          `json:"ordered_at" db:"ordered_at"`
+	ReceivedAt    *time.Time          `json:"received_at" db:"received_at"`
+	Items         []PurchaseOrderItem `json:"items,omitempty"`
+	ItemCount     int                 `json:"item_count"`
+	TotalAmount   float64             `json:"total_amount"`
+}
+
+// PurchaseOrderItem represents a line of a purchase order
+type PurchaseOrderItem struct {
+	ID           int     `json:"id" db:"id"`
+	OrderID      int     `json:"order_id" db:"order_id"`
+	MaterialID   *int    `json:"material_id" db:"material_id"` // NULL if the material was deleted
+	MaterialName string  `json:"material_name" db:"material_name"`
+	Unit         string  `json:"unit" db:"unit"`
+	Quantity     int     `json:"quantity" db:"quantity"`
+	UnitPrice    float64 `json:"unit_price" db:"unit_price"`
+	UnitFactor   int     `json:"unit_factor" db:"unit_factor"` // Base units in one ordered unit
+}
+
+// BaseQuantity returns the ordered quantity in base units of the material
+func (i PurchaseOrderItem) BaseQuantity() int {
+	return i.Quantity * max(i.UnitFactor, 1)
+}
+
+// Subtotal returns the price of the line
+func (i PurchaseOrderItem) Subtotal() float64 {
+	return float64(i.Quantity) * i.UnitPrice
 }
 
 // MaterialStats represents statistics about materials
@@ -200,12 +700,24 @@ type ActivityWithCenter struct {
 	UpdatedAt     time.Time `json:"updated_at"`
 }
 
+// ClassroomParticipation summarises the activities of a classroom and its attendance
+type ClassroomParticipation struct {
+	ClassroomID   int    `json:"classroom_id"`
+	ClassroomName string `json:"classroom_name"`
+	CenterName    string `json:"center_name"`
+	Activities    int    `json:"activities"` // Activities the classroom takes part in
+	Attended      int    `json:"attended"`   // Occurrences it attended
+	Absent        int    `json:"absent"`     // Occurrences it missed
+}
+
 // ActivityStats represents statistics about activities
 type ActivityStats struct {
 	TotalActivities     int `json:"total_activities"`
 	PendingActivities   int `json:"pending_activities"`
 	InProgressActivities int `json:"in_progress_activities"`
 	CompletedActivities int `json:"completed_activities"`
+	CancelledActivities int `json:"cancelled_activities"`
+	PostponedActivities int `json:"postponed_activities"`
 }
 
 // PaginationInfo represents pagination information for lists
@@ -308,4 +820,13 @@ type WebDAVToken struct {
 	LastUsed   time.Time `json:"last_used" db:"last_used"`
 	ExpiresAt  time.Time `json:"expires_at" db:"expires_at"`
 	IsActive   bool      `json:"is_active" db:"is_active"`
+}
+
+// CalendarFeedToken is the secret that authenticates the activity calendar feeds of a user
+type CalendarFeedToken struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"user_id" db:"user_id"`
+	Token     string     `json:"token" db:"token"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	LastUsed  *time.Time `json:"last_used" db:"last_used"`
 }
\ No newline at end of file
@@ -0,0 +1,197 @@
+// Package ical writes iCalendar (RFC 5545) data for the activity calendars of Figaro.
+// Event times are written in UTC, except for recurring events: they are written in their
+// timezone, described by a VTIMEZONE component, so repetitions keep their local time.
+package ical
+
+import (
+	"bytes"
+	"strings"
+	"time"
+)
+
+// Event statuses understood by calendar clients
+const (
+	StatusConfirmed = "CONFIRMED"
+	StatusTentative = "TENTATIVE"
+	StatusCancelled = "CANCELLED"
+)
+
+// maxLineOctets is the line length limit of RFC 5545, longer lines are folded
+const maxLineOctets = 75
+
+// Event is a single VEVENT
+type Event struct {
+	UID          string
+	Summary      string
+	Description  string
+	Location     string
+	URL          string
+	Conference   string // Video call link
+	Categories   []string
+	Status       string
+	Start        time.Time
+	End          time.Time
+	Created      time.Time
+	LastModified time.Time
+
+	// Recurrence
+	RRule        string         // RRULE value, see Rule
+	ExDates      []time.Time    // Starts of the occurrences removed from the series
+	RecurrenceID time.Time      // Original start of the occurrence an override replaces
+	TimeZone     *time.Location // Timezone of the times of recurring events and overrides
+}
+
+// Calendar is a VCALENDAR with its display name and events
+type Calendar struct {
+	Name            string
+	Description     string
+	Timezone        string // IANA name shown to clients as the calendar timezone
+	Method          string // PUBLISH for feeds, empty for CalDAV resources
+	RefreshInterval string // Suggested polling interval for feeds, such as PT1H
+	Events          []Event
+}
+
+// Bytes renders the calendar as iCalendar text with CRLF line endings
+func (cal Calendar) Bytes() []byte {
+	var buf bytes.Buffer
+	w := &writer{buf: &buf}
+
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:-//EuskadiTech//Figaro//ES")
+	w.line("CALSCALE:GREGORIAN")
+	if cal.Method != "" {
+		w.line("METHOD:" + cal.Method)
+	}
+	if cal.Name != "" {
+		w.property("X-WR-CALNAME", cal.Name)
+		w.property("NAME", cal.Name)
+	}
+	if cal.Description != "" {
+		w.property("X-WR-CALDESC", cal.Description)
+	}
+	if cal.Timezone != "" {
+		w.line("X-WR-TIMEZONE:" + cal.Timezone)
+	}
+	if cal.RefreshInterval != "" {
+		w.line("REFRESH-INTERVAL;VALUE=DURATION:" + cal.RefreshInterval)
+		w.line("X-PUBLISHED-TTL:" + cal.RefreshInterval)
+	}
+
+	for _, zone := range cal.timezones() {
+		zone.write(w)
+	}
+	for _, event := range cal.Events {
+		event.write(w)
+	}
+
+	w.line("END:VCALENDAR")
+	return buf.Bytes()
+}
+
+// write renders a VEVENT, skipping the optional properties that are empty
+func (e Event) write(w *writer) {
+	stamp := e.LastModified
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+
+	w.line("BEGIN:VEVENT")
+	w.line("UID:" + escapeText(e.UID))
+	w.line("DTSTAMP:" + FormatTime(stamp))
+	w.line("DTSTART" + e.formatTime(e.Start))
+	w.line("DTEND" + e.formatTime(e.End))
+	if !e.RecurrenceID.IsZero() {
+		w.line("RECURRENCE-ID" + e.formatTime(e.RecurrenceID))
+	}
+	if e.RRule != "" {
+		w.line("RRULE:" + e.RRule)
+	}
+	for _, exdate := range e.ExDates {
+		w.line("EXDATE" + e.formatTime(exdate))
+	}
+	w.property("SUMMARY", e.Summary)
+	if e.Description != "" {
+		w.property("DESCRIPTION", e.Description)
+	}
+	if e.Location != "" {
+		w.property("LOCATION", e.Location)
+	}
+	if e.URL != "" {
+		w.line("URL;VALUE=URI:" + e.URL)
+	}
+	if e.Conference != "" {
+		w.line("CONFERENCE;VALUE=URI;FEATURE=VIDEO:" + e.Conference)
+	}
+	if len(e.Categories) > 0 {
+		escaped := make([]string, len(e.Categories))
+		for i, category := range e.Categories {
+			escaped[i] = escapeText(category)
+		}
+		w.line("CATEGORIES:" + strings.Join(escaped, ","))
+	}
+	if e.Status != "" {
+		w.line("STATUS:" + e.Status)
+	}
+	if !e.Created.IsZero() {
+		w.line("CREATED:" + FormatTime(e.Created))
+	}
+	if !e.LastModified.IsZero() {
+		w.line("LAST-MODIFIED:" + FormatTime(e.LastModified))
+	}
+	w.line("END:VEVENT")
+}
+
+// formatTime formats the parameters and value of a date-time property of the event,
+// in its timezone when it has one and in UTC otherwise
+func (e Event) formatTime(t time.Time) string {
+	if e.TimeZone == nil {
+		return ":" + FormatTime(t)
+	}
+	return ";TZID=" + e.TimeZone.String() + ":" + t.In(e.TimeZone).Format("20060102T150405")
+}
+
+// FormatTime formats a time as an iCalendar UTC date-time, for example 20240131T090000Z
+func FormatTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// escapeText escapes a TEXT value: backslashes, separators and line breaks
+func escapeText(value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "\n")
+	replacer := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", `\n`)
+	return replacer.Replace(value)
+}
+
+// writer writes content lines folded to the RFC 5545 line length
+type writer struct {
+	buf *bytes.Buffer
+}
+
+// property writes a TEXT property, escaping its value
+func (w *writer) property(name, value string) {
+	w.line(name + ":" + escapeText(value))
+}
+
+// line writes a content line, folding it every 75 octets without splitting UTF-8 sequences
+func (w *writer) line(content string) {
+	limit := maxLineOctets
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !isRuneStart(content[cut]) {
+			cut--
+		}
+		w.buf.WriteString(content[:cut])
+		w.buf.WriteString("\r\n ")
+		content = content[cut:]
+		// Continuation lines start with a space, which counts towards the limit
+		limit = maxLineOctets - 1
+	}
+	w.buf.WriteString(content)
+	w.buf.WriteString("\r\n")
+}
+
+// isRuneStart reports whether a byte starts a UTF-8 sequence
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
@@ -0,0 +1,316 @@
+package ical
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoEvent is returned when the iCalendar data has no VEVENT component
+var ErrNoEvent = errors.New("no VEVENT in calendar data")
+
+// ErrInvalidTime is returned when DTSTART, DTEND or DURATION cannot be read
+var ErrInvalidTime = errors.New("invalid event date or time")
+
+// durationPattern matches the RFC 5545 durations such as P1D, PT1H30M or -P1W
+var durationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// property is a content line: NAME;PARAM=value:VALUE
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// ParseEvent reads the first VEVENT of iCalendar data. Floating times and times in
+// a TZID that is not a known IANA name are read in the given location.
+func ParseEvent(data []byte, location *time.Location) (Event, error) {
+	events, err := ParseEvents(data, location)
+	if err != nil {
+		return Event{}, err
+	}
+	return events[0], nil
+}
+
+// ParseEvents reads every VEVENT of iCalendar data, such as a recurring event followed
+// by the overrides of some of its occurrences
+func ParseEvents(data []byte, location *time.Location) ([]Event, error) {
+	var components [][]property
+	var current []property
+	inEvent := false
+	depth := 0 // Nesting inside the VEVENT, to skip its VALARM components
+
+	for _, line := range unfold(string(data)) {
+		prop, ok := parseProperty(line)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case prop.name == "BEGIN" && strings.EqualFold(prop.value, "VEVENT") && !inEvent:
+			inEvent = true
+			current = nil
+		case !inEvent:
+		case prop.name == "BEGIN":
+			depth++
+		case prop.name == "END" && depth > 0:
+			depth--
+		case prop.name == "END" && strings.EqualFold(prop.value, "VEVENT"):
+			inEvent = false
+			components = append(components, current)
+		case depth == 0:
+			current = append(current, prop)
+		}
+	}
+
+	if len(components) == 0 {
+		return nil, ErrNoEvent
+	}
+	events := make([]Event, 0, len(components))
+	for _, props := range components {
+		event, err := parseEvent(props, location)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// parseEvent builds an event from the properties of a VEVENT
+func parseEvent(props []property, location *time.Location) (Event, error) {
+	var event Event
+	var start, end, duration *property
+	for i := range props {
+		prop := props[i]
+		switch prop.name {
+		case "UID":
+			event.UID = prop.value
+		case "SUMMARY":
+			event.Summary = unescapeText(prop.value)
+		case "DESCRIPTION":
+			event.Description = unescapeText(prop.value)
+		case "LOCATION":
+			event.Location = unescapeText(prop.value)
+		case "URL":
+			event.URL = prop.value
+		case "CONFERENCE":
+			event.Conference = prop.value
+		case "STATUS":
+			event.Status = strings.ToUpper(prop.value)
+		case "CATEGORIES":
+			for _, category := range splitText(prop.value) {
+				event.Categories = append(event.Categories, unescapeText(category))
+			}
+		case "RRULE":
+			event.RRule = prop.value
+		case "EXDATE":
+			// A single EXDATE may hold several comma separated values
+			for _, value := range strings.Split(prop.value, ",") {
+				exdate := prop
+				exdate.value = value
+				t, _, err := parseTime(exdate, location)
+				if err != nil {
+					return Event{}, err
+				}
+				event.ExDates = append(event.ExDates, t)
+			}
+		case "RECURRENCE-ID":
+			t, _, err := parseTime(prop, location)
+			if err != nil {
+				return Event{}, err
+			}
+			event.RecurrenceID = t
+		case "DTSTART":
+			start = &props[i]
+		case "DTEND":
+			end = &props[i]
+		case "DURATION":
+			duration = &props[i]
+		}
+	}
+
+	if start == nil {
+		return Event{}, ErrInvalidTime
+	}
+
+	var err error
+	var allDay bool
+	event.Start, allDay, err = parseTime(*start, location)
+	if err != nil {
+		return Event{}, err
+	}
+	if tzid := start.params["TZID"]; tzid != "" {
+		event.TimeZone = loadTZID(tzid)
+	}
+
+	switch {
+	case end != nil:
+		event.End, _, err = parseTime(*end, location)
+		if err != nil {
+			return Event{}, err
+		}
+	case duration != nil:
+		d, err := parseDuration(duration.value)
+		if err != nil {
+			return Event{}, err
+		}
+		event.End = event.Start.Add(d)
+	case allDay:
+		event.End = event.Start.AddDate(0, 0, 1)
+	default:
+		event.End = event.Start
+	}
+
+	return event, nil
+}
+
+// unfold joins the continuation lines of iCalendar text
+func unfold(data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	var lines []string
+	for _, line := range strings.Split(data, "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseProperty splits a content line into its name, parameters and value
+func parseProperty(line string) (property, bool) {
+	// The value starts at the first colon outside a quoted parameter value
+	inQuotes := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			inQuotes = !inQuotes
+		} else if r == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return property{}, false
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	prop := property{
+		name:   strings.ToUpper(parts[0]),
+		params: map[string]string{},
+		value:  line[colon+1:],
+	}
+	for _, param := range parts[1:] {
+		if key, value, ok := strings.Cut(param, "="); ok {
+			prop.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return prop, true
+}
+
+// parseTime reads a DATE or DATE-TIME value, reporting whether it was a DATE
+func parseTime(prop property, location *time.Location) (time.Time, bool, error) {
+	value := strings.TrimSpace(prop.value)
+
+	if prop.params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, location)
+		if err != nil {
+			return time.Time{}, false, ErrInvalidTime
+		}
+		return t, true, nil
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return time.Time{}, false, ErrInvalidTime
+		}
+		return t, false, nil
+	}
+
+	if tzid := prop.params["TZID"]; tzid != "" {
+		if tz := loadTZID(tzid); tz != nil {
+			location = tz
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, location)
+	if err != nil {
+		return time.Time{}, false, ErrInvalidTime
+	}
+	return t, false, nil
+}
+
+// loadTZID resolves a TZID to a location. Some clients prefix the IANA name with a path,
+// such as /mozilla.org/20050126_1/Europe/Madrid, so the last two segments are also tried.
+func loadTZID(tzid string) *time.Location {
+	if location, err := time.LoadLocation(tzid); err == nil {
+		return location
+	}
+	segments := strings.Split(strings.Trim(tzid, "/"), "/")
+	if len(segments) >= 2 {
+		if location, err := time.LoadLocation(strings.Join(segments[len(segments)-2:], "/")); err == nil {
+			return location
+		}
+	}
+	return nil
+}
+
+// parseDuration reads an RFC 5545 duration
+func parseDuration(value string) (time.Duration, error) {
+	match := durationPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, ErrInvalidTime
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var d time.Duration
+	for i, unit := range units {
+		if match[i+2] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(match[i+2])
+		if err != nil {
+			return 0, ErrInvalidTime
+		}
+		d += time.Duration(n) * unit
+	}
+	if match[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// splitText splits a list of TEXT values on the commas that are not escaped
+func splitText(value string) []string {
+	var parts []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			current.WriteRune('\\')
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(parts, current.String())
+}
+
+// unescapeText reverts escapeText
+func unescapeText(value string) string {
+	replacer := strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+	return replacer.Replace(value)
+}
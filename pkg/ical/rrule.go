@@ -0,0 +1,378 @@
+package ical
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence frequencies supported by Rule
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+)
+
+// ErrInvalidRule is returned for recurrence rules outside the supported subset of RFC 5545
+var ErrInvalidRule = errors.New("invalid or unsupported recurrence rule")
+
+// maxIterations bounds the expansion of a rule whose occurrences never fall in the requested range
+const maxIterations = 100000
+
+// weekdayCodes maps the RFC 5545 weekday codes to Go weekdays
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// Rule is a recurrence rule: daily, weekly on some weekdays, or monthly on the day of
+// the month of the first occurrence or on its n-th weekday, until a date or a number of times.
+//
+// Rules are expanded on wall clock times: the location of the start time is kept, so an
+// activity at 10:00 stays at 10:00 across daylight saving changes.
+type Rule struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday // Weekdays of a weekly rule, or the weekday of a monthly one
+	Ordinal  int            // Week of the month of a monthly rule on a weekday: 1 to 4, or -1 for the last
+	Until    time.Time      // Last possible start, inclusive; zero for no limit
+	UntilUTC bool           // Until is an absolute UTC time rather than a wall clock time
+	Count    int            // Number of occurrences, the first one included; 0 for no limit
+}
+
+// ParseRule reads an RRULE value such as FREQ=WEEKLY;BYDAY=MO,WE;UNTIL=20270630T215959Z
+func ParseRule(value string) (Rule, error) {
+	rule := Rule{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(value), "RRULE:"), ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(val)
+		case "INTERVAL":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return Rule{}, ErrInvalidRule
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return Rule{}, ErrInvalidRule
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, utc, err := parseUntil(val)
+			if err != nil {
+				return Rule{}, err
+			}
+			rule.Until, rule.UntilUTC = until, utc
+		case "BYDAY":
+			for _, day := range strings.Split(strings.ToUpper(val), ",") {
+				if len(day) < 2 {
+					return Rule{}, ErrInvalidRule
+				}
+				weekday, ok := weekdayCodes[day[len(day)-2:]]
+				if !ok {
+					return Rule{}, ErrInvalidRule
+				}
+				if prefix := day[:len(day)-2]; prefix != "" {
+					n, err := strconv.Atoi(prefix)
+					if err != nil || n == 0 || n < -1 || n > 4 {
+						return Rule{}, ErrInvalidRule
+					}
+					rule.Ordinal = n
+				}
+				rule.ByDay = append(rule.ByDay, weekday)
+			}
+		case "WKST":
+			// Weeks always start on Monday
+		default:
+			return Rule{}, ErrInvalidRule
+		}
+	}
+
+	switch rule.Freq {
+	case FreqDaily:
+		if len(rule.ByDay) > 0 {
+			return Rule{}, ErrInvalidRule
+		}
+	case FreqWeekly:
+		if rule.Ordinal != 0 {
+			return Rule{}, ErrInvalidRule
+		}
+	case FreqMonthly:
+		if len(rule.ByDay) > 1 || (len(rule.ByDay) == 1 && rule.Ordinal == 0) {
+			return Rule{}, ErrInvalidRule
+		}
+	default:
+		return Rule{}, ErrInvalidRule
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return Rule{}, ErrInvalidRule
+	}
+
+	sortWeekdays(rule.ByDay)
+	return rule, nil
+}
+
+// parseUntil reads an UNTIL value; a date means until the end of that day
+func parseUntil(value string) (time.Time, bool, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse("20060102T150405", value); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.Parse("20060102", value); err == nil {
+		return t.Add(24*time.Hour - time.Second), false, nil
+	}
+	return time.Time{}, false, ErrInvalidRule
+}
+
+// String formats the rule as an RRULE value
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, len(r.ByDay))
+		for i, weekday := range r.ByDay {
+			days[i] = weekdayCode(weekday)
+			if r.Ordinal != 0 {
+				days[i] = strconv.Itoa(r.Ordinal) + days[i]
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if r.Count > 0 {
+		parts = append(parts, fmt.Sprintf("COUNT=%d", r.Count))
+	}
+	if !r.Until.IsZero() {
+		if r.UntilUTC {
+			parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+		} else {
+			parts = append(parts, "UNTIL="+r.Until.Format("20060102T150405"))
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// Between returns the starts of the occurrences of a series starting at start that fall in
+// [from, to). The first occurrence is always start, even if the rule would not produce it.
+func (r Rule) Between(start, from, to time.Time) []time.Time {
+	var occurrences []time.Time
+	r.each(start, from, func(t time.Time) bool {
+		if !t.Before(to) {
+			return false
+		}
+		if !t.Before(from) {
+			occurrences = append(occurrences, t)
+		}
+		return true
+	})
+	return occurrences
+}
+
+// FirstBetween returns the starts of at most the first n occurrences of a series starting at
+// start that fall in [from, to)
+func (r Rule) FirstBetween(start, from, to time.Time, n int) []time.Time {
+	var occurrences []time.Time
+	if n <= 0 {
+		return occurrences
+	}
+	r.each(start, from, func(t time.Time) bool {
+		if !t.Before(to) {
+			return false
+		}
+		if !t.Before(from) {
+			occurrences = append(occurrences, t)
+		}
+		return len(occurrences) < n
+	})
+	return occurrences
+}
+
+// CountBetween returns how many occurrences of a series starting at start fall in [from, to)
+func (r Rule) CountBetween(start, from, to time.Time) int {
+	count := 0
+	r.each(start, from, func(t time.Time) bool {
+		if !t.Before(to) {
+			return false
+		}
+		if !t.Before(from) {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// Next returns the start of the first occurrence of the series at or after t
+func (r Rule) Next(start, t time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+	r.each(start, t, func(occurrence time.Time) bool {
+		if occurrence.Before(t) {
+			return true
+		}
+		next, found = occurrence, true
+		return false
+	})
+	return next, found
+}
+
+// Includes reports whether t is the start of an occurrence of the series
+func (r Rule) Includes(start, t time.Time) bool {
+	occurrences := r.Between(start, t, t.Add(time.Second))
+	return len(occurrences) == 1 && occurrences[0].Equal(t)
+}
+
+// CountBefore returns how many occurrences of the series start before t
+func (r Rule) CountBefore(start, t time.Time) int {
+	count := 0
+	r.each(start, time.Time{}, func(occurrence time.Time) bool {
+		if !occurrence.Before(t) {
+			return false
+		}
+		count++
+		return true
+	})
+	return count
+}
+
+// each calls fn with the occurrences in order until it returns false or the series ends.
+// Without a count limit the expansion jumps close to from instead of starting at start.
+func (r Rule) each(start, from time.Time, fn func(time.Time) bool) {
+	interval := r.Interval
+	if interval < 1 {
+		interval = 1
+	}
+	until := r.Until
+	if r.UntilUTC {
+		until = until.In(start.Location())
+	}
+
+	emitted := 0
+	emit := func(t time.Time) bool {
+		if !until.IsZero() && t.After(until) {
+			return false
+		}
+		if r.Count > 0 && emitted >= r.Count {
+			return false
+		}
+		emitted++
+		return fn(t)
+	}
+
+	if !emit(start) {
+		return
+	}
+
+	// Number of periods that can be skipped because they end before from
+	skip := 0
+	if r.Count == 0 && from.After(start) {
+		switch r.Freq {
+		case FreqDaily:
+			skip = int(from.Sub(start).Hours()/24)/interval - 1
+		case FreqWeekly:
+			skip = int(from.Sub(start).Hours()/(24*7))/interval - 1
+		case FreqMonthly:
+			months := (from.Year()-start.Year())*12 + int(from.Month()-start.Month())
+			skip = months/interval - 1
+		}
+		if skip < 0 {
+			skip = 0
+		}
+	}
+
+	hour, minute, second := start.Clock()
+	weekStart := start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7)) // Monday of the first week
+	days := r.ByDay
+	if r.Freq == FreqWeekly && len(days) == 0 {
+		days = []time.Weekday{start.Weekday()}
+	}
+
+	for period := skip; period < skip+maxIterations; period++ {
+		var candidates []time.Time
+		switch r.Freq {
+		case FreqDaily:
+			candidates = []time.Time{start.AddDate(0, 0, period*interval)}
+		case FreqWeekly:
+			week := weekStart.AddDate(0, 0, 7*period*interval)
+			for _, weekday := range days {
+				day := week.AddDate(0, 0, (int(weekday)+6)%7)
+				candidates = append(candidates, time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, start.Location()))
+			}
+		case FreqMonthly:
+			first := time.Date(start.Year(), start.Month()+time.Month(period*interval), 1, hour, minute, second, 0, start.Location())
+			if day, ok := r.monthDay(first, start); ok {
+				candidates = []time.Time{time.Date(first.Year(), first.Month(), day, hour, minute, second, 0, start.Location())}
+			}
+		default:
+			return
+		}
+
+		for _, candidate := range candidates {
+			if !candidate.After(start) {
+				continue
+			}
+			if !until.IsZero() && candidate.After(until) {
+				return
+			}
+			if !emit(candidate) {
+				return
+			}
+		}
+	}
+}
+
+// monthDay returns the day of the month of a monthly occurrence, and false when the month has none
+func (r Rule) monthDay(first, start time.Time) (int, bool) {
+	daysInMonth := time.Date(first.Year(), first.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if len(r.ByDay) == 0 {
+		return start.Day(), start.Day() <= daysInMonth
+	}
+
+	weekday := r.ByDay[0]
+	if r.Ordinal == -1 {
+		last := time.Date(first.Year(), first.Month(), daysInMonth, 0, 0, 0, 0, time.UTC)
+		return daysInMonth - (int(last.Weekday())-int(weekday)+7)%7, true
+	}
+	day := 1 + (int(weekday)-int(first.Weekday())+7)%7 + 7*(r.Ordinal-1)
+	return day, day <= daysInMonth
+}
+
+// weekdayCode returns the RFC 5545 code of a weekday
+func weekdayCode(weekday time.Weekday) string {
+	for code, day := range weekdayCodes {
+		if day == weekday {
+			return code
+		}
+	}
+	return ""
+}
+
+// ParseWeekday reads an RFC 5545 weekday code such as MO
+func ParseWeekday(code string) (time.Weekday, bool) {
+	weekday, ok := weekdayCodes[strings.ToUpper(code)]
+	return weekday, ok
+}
+
+// WeekdayCode returns the RFC 5545 code of a weekday, such as MO for Monday
+func WeekdayCode(weekday time.Weekday) string {
+	return weekdayCode(weekday)
+}
+
+// sortWeekdays orders weekdays from Monday to Sunday
+func sortWeekdays(days []time.Weekday) {
+	sort.Slice(days, func(i, j int) bool {
+		return (int(days[i])+6)%7 < (int(days[j])+6)%7
+	})
+}
@@ -0,0 +1,252 @@
+package ical
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day, hour, minute int) time.Time {
+	return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		value string
+		want  Rule
+	}{
+		{"FREQ=DAILY", Rule{Freq: FreqDaily, Interval: 1}},
+		{"RRULE:FREQ=DAILY;INTERVAL=2;COUNT=5", Rule{Freq: FreqDaily, Interval: 2, Count: 5}},
+		{"FREQ=WEEKLY;BYDAY=WE,MO", Rule{Freq: FreqWeekly, Interval: 1, ByDay: []time.Weekday{time.Monday, time.Wednesday}}},
+		{"FREQ=WEEKLY;BYDAY=SU,MO;WKST=MO", Rule{Freq: FreqWeekly, Interval: 1, ByDay: []time.Weekday{time.Monday, time.Sunday}}},
+		{"FREQ=MONTHLY;BYDAY=-1FR", Rule{Freq: FreqMonthly, Interval: 1, ByDay: []time.Weekday{time.Friday}, Ordinal: -1}},
+		{"FREQ=MONTHLY;BYDAY=2TU", Rule{Freq: FreqMonthly, Interval: 1, ByDay: []time.Weekday{time.Tuesday}, Ordinal: 2}},
+		{"FREQ=WEEKLY;UNTIL=20270630T215959Z", Rule{Freq: FreqWeekly, Interval: 1, Until: date(2027, 6, 30, 21, 59).Add(59 * time.Second), UntilUTC: true}},
+		{"FREQ=WEEKLY;UNTIL=20270630T100000", Rule{Freq: FreqWeekly, Interval: 1, Until: date(2027, 6, 30, 10, 0)}},
+		{"FREQ=WEEKLY;UNTIL=20270630", Rule{Freq: FreqWeekly, Interval: 1, Until: date(2027, 6, 30, 23, 59).Add(59 * time.Second)}},
+	}
+	for _, tt := range tests {
+		got, err := ParseRule(tt.value)
+		if err != nil {
+			t.Errorf("ParseRule(%q) returned error %v", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRule(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"FREQ=YEARLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;COUNT=-1",
+		"FREQ=DAILY;BYDAY=MO",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=MONTHLY;BYDAY=MO",
+		"FREQ=MONTHLY;BYDAY=1MO,2TU",
+		"FREQ=MONTHLY;BYDAY=5MO",
+		"FREQ=WEEKLY;COUNT=3;UNTIL=20270630",
+		"FREQ=WEEKLY;UNTIL=tomorrow",
+		"FREQ=WEEKLY;BYMONTH=1",
+	} {
+		if _, err := ParseRule(value); err != ErrInvalidRule {
+			t.Errorf("ParseRule(%q) error = %v, want %v", value, err, ErrInvalidRule)
+		}
+	}
+}
+
+func TestRuleString(t *testing.T) {
+	for _, value := range []string{
+		"FREQ=DAILY",
+		"FREQ=DAILY;INTERVAL=3;COUNT=10",
+		"FREQ=WEEKLY;BYDAY=MO,WE,FR",
+		"FREQ=MONTHLY;BYDAY=-1FR",
+		"FREQ=MONTHLY;INTERVAL=2;BYDAY=3TH",
+		"FREQ=WEEKLY;UNTIL=20270630T215959Z",
+		"FREQ=WEEKLY;UNTIL=20270630T100000",
+	} {
+		rule, err := ParseRule(value)
+		if err != nil {
+			t.Fatalf("ParseRule(%q) returned error %v", value, err)
+		}
+		if got := rule.String(); got != value {
+			t.Errorf("ParseRule(%q).String() = %q", value, got)
+		}
+	}
+
+	// Weekdays are written from Monday to Sunday
+	rule, _ := ParseRule("FREQ=WEEKLY;BYDAY=SU,TU")
+	if got, want := rule.String(), "FREQ=WEEKLY;BYDAY=TU,SU"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		start    time.Time
+		from, to time.Time
+		want     []time.Time
+	}{
+		{
+			name:  "daily every other day",
+			rule:  "FREQ=DAILY;INTERVAL=2",
+			start: date(2026, 1, 1, 9, 0),
+			from:  date(2026, 1, 1, 0, 0),
+			to:    date(2026, 1, 8, 0, 0),
+			want:  []time.Time{date(2026, 1, 1, 9, 0), date(2026, 1, 3, 9, 0), date(2026, 1, 5, 9, 0), date(2026, 1, 7, 9, 0)},
+		},
+		{
+			name:  "weekly on several days",
+			rule:  "FREQ=WEEKLY;BYDAY=MO,WE",
+			start: date(2026, 1, 5, 10, 0), // Monday
+			from:  date(2026, 1, 6, 0, 0),
+			to:    date(2026, 1, 19, 0, 0),
+			want:  []time.Time{date(2026, 1, 7, 10, 0), date(2026, 1, 12, 10, 0), date(2026, 1, 14, 10, 0)},
+		},
+		{
+			name:  "from is inclusive and to exclusive",
+			rule:  "FREQ=DAILY",
+			start: date(2026, 1, 1, 9, 0),
+			from:  date(2026, 1, 2, 9, 0),
+			to:    date(2026, 1, 4, 9, 0),
+			want:  []time.Time{date(2026, 1, 2, 9, 0), date(2026, 1, 3, 9, 0)},
+		},
+		{
+			name:  "count includes the first occurrence",
+			rule:  "FREQ=WEEKLY;COUNT=3",
+			start: date(2026, 1, 1, 9, 0),
+			from:  date(2026, 1, 1, 0, 0),
+			to:    date(2027, 1, 1, 0, 0),
+			want:  []time.Time{date(2026, 1, 1, 9, 0), date(2026, 1, 8, 9, 0), date(2026, 1, 15, 9, 0)},
+		},
+		{
+			name:  "count is kept when the range starts later",
+			rule:  "FREQ=DAILY;COUNT=5",
+			start: date(2026, 1, 1, 9, 0),
+			from:  date(2026, 1, 4, 0, 0),
+			to:    date(2027, 1, 1, 0, 0),
+			want:  []time.Time{date(2026, 1, 4, 9, 0), date(2026, 1, 5, 9, 0)},
+		},
+		{
+			name:  "until is inclusive",
+			rule:  "FREQ=DAILY;UNTIL=20260103T090000",
+			start: date(2026, 1, 1, 9, 0),
+			from:  date(2026, 1, 1, 0, 0),
+			to:    date(2027, 1, 1, 0, 0),
+			want:  []time.Time{date(2026, 1, 1, 9, 0), date(2026, 1, 2, 9, 0), date(2026, 1, 3, 9, 0)},
+		},
+		{
+			name:  "monthly skips months without the day",
+			rule:  "FREQ=MONTHLY;COUNT=3",
+			start: date(2026, 1, 31, 9, 0),
+			from:  date(2026, 1, 1, 0, 0),
+			to:    date(2027, 1, 1, 0, 0),
+			want:  []time.Time{date(2026, 1, 31, 9, 0), date(2026, 3, 31, 9, 0), date(2026, 5, 31, 9, 0)},
+		},
+		{
+			name:  "monthly on the last weekday",
+			rule:  "FREQ=MONTHLY;BYDAY=-1FR",
+			start: date(2026, 1, 30, 9, 0),
+			from:  date(2026, 1, 1, 0, 0),
+			to:    date(2026, 4, 1, 0, 0),
+			want:  []time.Time{date(2026, 1, 30, 9, 0), date(2026, 2, 27, 9, 0), date(2026, 3, 27, 9, 0)},
+		},
+		{
+			name:  "monthly on the second weekday",
+			rule:  "FREQ=MONTHLY;BYDAY=2TU",
+			start: date(2026, 1, 13, 9, 0),
+			from:  date(2026, 1, 1, 0, 0),
+			to:    date(2026, 4, 1, 0, 0),
+			want:  []time.Time{date(2026, 1, 13, 9, 0), date(2026, 2, 10, 9, 0), date(2026, 3, 10, 9, 0)},
+		},
+		{
+			name:  "far ranges of endless rules",
+			rule:  "FREQ=WEEKLY",
+			start: date(2026, 1, 5, 10, 0),
+			from:  date(2036, 1, 1, 0, 0),
+			to:    date(2036, 1, 15, 0, 0),
+			want:  []time.Time{date(2036, 1, 7, 10, 0), date(2036, 1, 14, 10, 0)},
+		},
+	}
+	for _, tt := range tests {
+		rule, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: ParseRule(%q) returned error %v", tt.name, tt.rule, err)
+		}
+		if got := rule.Between(tt.start, tt.from, tt.to); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Between() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBetweenKeepsWallClock(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip("timezone data not available")
+	}
+	rule, _ := ParseRule("FREQ=WEEKLY")
+	start := time.Date(2026, 3, 23, 10, 0, 0, 0, madrid) // The week before daylight saving starts
+	got := rule.Between(start, start, start.AddDate(0, 0, 8))
+	if len(got) != 2 {
+		t.Fatalf("Between() returned %d occurrences, want 2", len(got))
+	}
+	if hour := got[1].Hour(); hour != 10 {
+		t.Errorf("occurrence after the change starts at %d:00, want 10:00", hour)
+	}
+}
+
+func TestCountBefore(t *testing.T) {
+	start := date(2026, 1, 5, 10, 0)
+	tests := []struct {
+		rule   string
+		before time.Time
+		want   int
+	}{
+		{"FREQ=DAILY", start, 0},
+		{"FREQ=DAILY", start.Add(time.Second), 1},
+		{"FREQ=DAILY", date(2026, 1, 10, 10, 0), 5},
+		{"FREQ=WEEKLY;BYDAY=MO,FR", date(2026, 1, 20, 0, 0), 5},
+		{"FREQ=DAILY;COUNT=3", date(2027, 1, 1, 0, 0), 3},
+		{"FREQ=DAILY;UNTIL=20260107T235959", date(2027, 1, 1, 0, 0), 3},
+	}
+	for _, tt := range tests {
+		rule, err := ParseRule(tt.rule)
+		if err != nil {
+			t.Fatalf("ParseRule(%q) returned error %v", tt.rule, err)
+		}
+		if got := rule.CountBefore(start, tt.before); got != tt.want {
+			t.Errorf("%s: CountBefore(%v) = %d, want %d", tt.rule, tt.before, got, tt.want)
+		}
+	}
+}
+
+func TestFirstBetweenAndCountBetween(t *testing.T) {
+	rule, _ := ParseRule("FREQ=DAILY")
+	start := date(2026, 1, 1, 9, 0)
+	from, to := date(2026, 3, 1, 0, 0), date(2027, 1, 1, 0, 0)
+
+	got := rule.FirstBetween(start, from, to, 3)
+	want := []time.Time{date(2026, 3, 1, 9, 0), date(2026, 3, 2, 9, 0), date(2026, 3, 3, 9, 0)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FirstBetween() = %v, want %v", got, want)
+	}
+	if got := rule.FirstBetween(start, from, to, 0); len(got) != 0 {
+		t.Errorf("FirstBetween() with no limit returned %v", got)
+	}
+	if got := rule.FirstBetween(start, from, date(2026, 3, 2, 0, 0), 10); len(got) != 1 {
+		t.Errorf("FirstBetween() returned %d occurrences, want 1", len(got))
+	}
+
+	if got, want := rule.CountBetween(start, from, to), len(rule.Between(start, from, to)); got != want {
+		t.Errorf("CountBetween() = %d, want %d", got, want)
+	}
+	if got := rule.CountBetween(start, to, from); got != 0 {
+		t.Errorf("CountBetween() of an empty range = %d, want 0", got)
+	}
+}
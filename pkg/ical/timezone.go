@@ -0,0 +1,122 @@
+package ical
+
+import (
+	"fmt"
+	"time"
+)
+
+// timezoneYearsAhead is how many years after the current one the VTIMEZONE rules cover.
+// Clients keep the last offset for later dates.
+const timezoneYearsAhead = 10
+
+// vtimezone is the VTIMEZONE of a location over a range of years
+type vtimezone struct {
+	location *time.Location
+	fromYear int
+	toYear   int
+}
+
+// transition is a change of UTC offset
+type transition struct {
+	at         time.Time
+	fromOffset int
+	toOffset   int
+	name       string
+	dst        bool
+}
+
+// timezones returns the VTIMEZONE components needed by the events with a TimeZone,
+// covering from their first start to some years ahead
+func (cal Calendar) timezones() []vtimezone {
+	var zones []vtimezone
+	index := map[string]int{}
+	for _, event := range cal.Events {
+		if event.TimeZone == nil || event.TimeZone == time.UTC {
+			continue
+		}
+		year := event.Start.In(event.TimeZone).Year()
+		if i, ok := index[event.TimeZone.String()]; ok {
+			zones[i].fromYear = min(zones[i].fromYear, year)
+			zones[i].toYear = max(zones[i].toYear, year+1)
+			continue
+		}
+		index[event.TimeZone.String()] = len(zones)
+		zones = append(zones, vtimezone{
+			location: event.TimeZone,
+			fromYear: year,
+			toYear:   max(time.Now().Year()+timezoneYearsAhead, year+1),
+		})
+	}
+	return zones
+}
+
+// write renders the VTIMEZONE with one observance per offset change
+func (z vtimezone) write(w *writer) {
+	start := time.Date(z.fromYear, time.January, 1, 0, 0, 0, 0, z.location)
+	name, offset := start.Zone()
+
+	w.line("BEGIN:VTIMEZONE")
+	w.line("TZID:" + z.location.String())
+	observance(w, transition{at: start, fromOffset: offset, toOffset: offset, name: name, dst: start.IsDST()})
+	for _, t := range z.transitions(start) {
+		observance(w, t)
+	}
+	w.line("END:VTIMEZONE")
+}
+
+// transitions finds the offset changes from start to the end of the range, day by day
+func (z vtimezone) transitions(start time.Time) []transition {
+	end := time.Date(z.toYear+1, time.January, 1, 0, 0, 0, 0, z.location)
+	_, offset := start.Zone()
+
+	var transitions []transition
+	for day := start; day.Before(end); day = day.Add(24 * time.Hour) {
+		next := day.Add(24 * time.Hour)
+		_, nextOffset := next.Zone()
+		if nextOffset == offset {
+			continue
+		}
+
+		// Narrow the change down to the minute
+		low, high := day, next
+		for high.Sub(low) > time.Minute {
+			middle := low.Add(high.Sub(low) / 2)
+			if _, o := middle.Zone(); o == offset {
+				low = middle
+			} else {
+				high = middle
+			}
+		}
+		at := high.Truncate(time.Minute)
+		name, _ := at.Zone()
+		transitions = append(transitions, transition{at: at, fromOffset: offset, toOffset: nextOffset, name: name, dst: at.IsDST()})
+		offset = nextOffset
+	}
+	return transitions
+}
+
+// observance writes a STANDARD or DAYLIGHT component starting at the local time before the change
+func observance(w *writer, t transition) {
+	kind := "STANDARD"
+	if t.dst {
+		kind = "DAYLIGHT"
+	}
+	local := t.at.In(time.FixedZone("", t.fromOffset))
+
+	w.line("BEGIN:" + kind)
+	w.line("DTSTART:" + local.Format("20060102T150405"))
+	w.line("TZOFFSETFROM:" + formatOffset(t.fromOffset))
+	w.line("TZOFFSETTO:" + formatOffset(t.toOffset))
+	w.line("TZNAME:" + t.name)
+	w.line("END:" + kind)
+}
+
+// formatOffset formats a UTC offset in seconds as +HHMM
+func formatOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds/60%60)
+}
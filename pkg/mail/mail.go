@@ -0,0 +1,151 @@
+// Package mail sends plain text emails through the SMTP server configured in
+// the email system settings of Figaro.
+package mail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// ErrNotConfigured is returned when no SMTP server or sender address is set
+var ErrNotConfigured = errors.New("email is not configured")
+
+// ErrStartTLSUnsupported is returned when STARTTLS is required but the server does not offer it
+var ErrStartTLSUnsupported = errors.New("the SMTP server does not support STARTTLS")
+
+// Timeout bounds connecting to the SMTP server and the whole exchange with it, so an
+// unreachable or stalled server does not block the sender
+const Timeout = 30 * time.Second
+
+// Config holds the SMTP settings, using the keys of the "email" settings category
+type Config struct {
+	Host       string
+	Port       string
+	Username   string
+	Password   string
+	FromEmail  string
+	FromName   string
+	Encryption string // tls (STARTTLS), ssl (implicit TLS) or none
+}
+
+// ConfigFromSettings builds a Config from the "email" system settings
+func ConfigFromSettings(settings map[string]string) Config {
+	return Config{
+		Host:       settings["smtp_host"],
+		Port:       settings["smtp_port"],
+		Username:   settings["smtp_username"],
+		Password:   settings["smtp_password"],
+		FromEmail:  settings["smtp_from_email"],
+		FromName:   settings["smtp_from_name"],
+		Encryption: settings["smtp_encryption"],
+	}
+}
+
+// Enabled reports whether there is enough configuration to send emails
+func (c Config) Enabled() bool {
+	return c.Host != "" && c.FromEmail != ""
+}
+
+// Send delivers a plain text email to the given recipients
+func Send(cfg Config, to []string, subject, body string) error {
+	if !cfg.Enabled() {
+		return ErrNotConfigured
+	}
+	if len(to) == 0 {
+		return errors.New("no recipients")
+	}
+
+	port := cfg.Port
+	if port == "" {
+		port = "587"
+	}
+	addr := net.JoinHostPort(cfg.Host, port)
+	tlsConfig := &tls.Config{ServerName: cfg.Host}
+
+	dialer := &net.Dialer{Timeout: Timeout}
+	var conn net.Conn
+	var err error
+	if cfg.Encryption == "ssl" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(Timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	// Never fall back to plain text when encryption was asked for
+	if cfg.Encryption == "tls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return ErrStartTLSUnsupported
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(cfg.FromEmail); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buildMessage(cfg, to, subject, body)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// buildMessage renders the headers and body of a UTF-8 plain text email
+func buildMessage(cfg Config, to []string, subject, body string) []byte {
+	from := mail.Address{Name: cfg.FromName, Address: cfg.FromEmail}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return msg.Bytes()
+}
@@ -0,0 +1,170 @@
+// Package pdf provides a minimal PDF writer for simple text reports in Figaro.
+// It only uses the standard Helvetica fonts, so no font files are embedded.
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A4 page size and margins in points
+const (
+	pageWidth    = 595.0
+	pageHeight   = 842.0
+	marginLeft   = 50.0
+	marginTop    = 60.0
+	marginBottom = 60.0
+)
+
+// Document is a simple top-to-bottom text document with automatic page breaks
+type Document struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+// New creates an empty A4 document
+func New() *Document {
+	d := &Document{}
+	d.newPage()
+	return d
+}
+
+// newPage starts a new page and moves the cursor to the top margin
+func (d *Document) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pageHeight - marginTop
+}
+
+// ensureSpace breaks the page if the next line does not fit
+func (d *Document) ensureSpace(height float64) {
+	if d.y-height < marginBottom {
+		d.newPage()
+	}
+}
+
+// text writes a single string at the given position
+func (d *Document) text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	page := d.pages[len(d.pages)-1]
+	fmt.Fprintf(page, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, encode(s))
+}
+
+// Title writes a large bold line
+func (d *Document) Title(s string) {
+	d.ensureSpace(24)
+	d.y -= 18
+	d.text(marginLeft, d.y, 16, true, s)
+	d.y -= 10
+}
+
+// Line writes a line of regular text
+func (d *Document) Line(s string) {
+	d.ensureSpace(14)
+	d.y -= 14
+	d.text(marginLeft, d.y, 10, false, s)
+}
+
+// Space adds vertical space
+func (d *Document) Space(height float64) {
+	d.y -= height
+}
+
+// Row writes a table row. Each column is truncated to fit its width in points.
+func (d *Document) Row(columns []string, widths []float64, bold bool) {
+	const size = 9.0
+	d.ensureSpace(16)
+	d.y -= 14
+
+	x := marginLeft
+	for i, column := range columns {
+		if i >= len(widths) {
+			break
+		}
+		d.text(x, d.y, size, bold, fit(column, widths[i], size))
+		x += widths[i]
+	}
+
+	if bold {
+		page := d.pages[len(d.pages)-1]
+		fmt.Fprintf(page, "%.2f %.2f m %.2f %.2f l S\n", marginLeft, d.y-4, pageWidth-marginLeft, d.y-4)
+		d.y -= 4
+	}
+}
+
+// Bytes renders the document as a PDF file
+func (d *Document) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+
+	writeObject := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	// Objects 1-4 are the catalog, page tree and fonts; pages and contents follow in pairs
+	pageCount := len(d.pages)
+	kids := make([]string, pageCount)
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+i*2)
+	}
+
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pageCount))
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range d.pages {
+		writeObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, 6+i*2))
+		writeObject(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return out.Bytes()
+}
+
+// fit truncates a string so it fits in the given width using an average glyph width
+func fit(s string, width, size float64) string {
+	maxChars := int((width - 6) / (size * 0.5))
+	runes := []rune(s)
+	if maxChars < 1 || len(runes) <= maxChars {
+		return s
+	}
+	if maxChars <= 3 {
+		return string(runes[:maxChars])
+	}
+	return string(runes[:maxChars-3]) + "..."
+}
+
+// encode converts text to WinAnsi bytes and escapes it for a PDF string literal
+func encode(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '€':
+			b.WriteString("\\200")
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r < 256:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}